@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+func newAddCmd() *cobra.Command {
+	var features []string
+
+	cmd := &cobra.Command{
+		Use:   "add <package[@requirement]>...",
+		Short: "Add dependencies to vira.toml",
+		Long: `Add dependencies to vira.toml.
+
+Without a requirement, the newest version in the registry is added, as in
+vira add math. With one, as in vira add math@^0.2, the requirement is kept
+as written once a matching version has been found.`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			proj, err := loadProject(".")
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			idx, err := fetchRegistryIndex()
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			err = proj.editManifest(func(src string) (string, error) {
+				for _, spec := range args {
+					name, dep, err := resolveDependencySpec(idx, spec, features)
+					if err != nil {
+						return "", err
+					}
+					if old, ok := proj.manifest.Dependencies[name]; ok && (old.Git != "" || old.Path != "" || old.Registry != "") {
+						return "", fmt.Errorf("%s is not a dependency from the default registry; edit it in %s or remove it first", name, manifestName)
+					}
+					src = setDependency(src, name, dep)
+				}
+				return src, nil
+			})
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+		},
+	}
+	cmd.Flags().StringSliceVarP(&features, "features", "F", nil, "features to enable on the added packages")
+	return cmd
+}
+
+func newRemoveCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:     "remove <package>...",
+		Aliases: []string{"rm"},
+		Short:   "Remove dependencies from vira.toml",
+		Args:    cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			proj, err := loadProject(".")
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			err = proj.editManifest(func(src string) (string, error) {
+				for _, name := range args {
+					var removed bool
+					if src, removed = removeDependency(src, name); !removed {
+						return "", fmt.Errorf("%s is not a dependency of %s", name, proj.manifest.Package.Name)
+					}
+					pterm.Info.Printfln("Removing %s from dependencies", name)
+				}
+				return src, nil
+			})
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+		},
+	}
+}
+
+// resolveDependencySpec turns "name" or "name@requirement" into a
+// dependency, checking that the registry has a matching version.
+func resolveDependencySpec(idx *registryIndex, spec string, features []string) (string, Dependency, error) {
+	name, raw, _ := strings.Cut(spec, "@")
+	pkg := idx.lookup(name)
+	if pkg == nil {
+		return "", Dependency{}, fmt.Errorf("package %s is not in the registry", name)
+	}
+	req, err := parseVersionReq(raw)
+	if err != nil {
+		return "", Dependency{}, err
+	}
+	rec, ok := pkg.latestMatching(req)
+	if !ok {
+		return "", Dependency{}, fmt.Errorf("no version of %s matches %s", name, raw)
+	}
+	for _, f := range features {
+		if _, ok := rec.Features[f]; !ok {
+			return "", Dependency{}, fmt.Errorf("%s v%s has no feature %q", name, rec.Version, f)
+		}
+	}
+	dep := Dependency{Version: raw, Features: features}
+	if raw == "" {
+		dep.Version = rec.Version
+	}
+	pterm.Info.Printfln("Adding %s v%s to dependencies", name, rec.Version)
+	return name, dep, nil
+}
+
+// editManifest rewrites vira.toml with edit and brings vira.lock up to date
+// with the new manifest. The edited manifest is resolved before it is
+// written, so that an edit which does not parse or whose dependencies do not
+// resolve leaves both files as they were.
+func (p *project) editManifest(edit func(src string) (string, error)) error {
+	path := filepath.Join(p.root, manifestName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	src, err := edit(string(data))
+	if err != nil {
+		return err
+	}
+	var m Manifest
+	if _, err := toml.Decode(src, &m); err != nil {
+		return fmt.Errorf("editing %s produced invalid TOML: %v", manifestName, err)
+	}
+	old := p.manifest
+	p.manifest = &m
+	if _, _, err := p.resolve(resolveOptions{}); err != nil {
+		p.manifest = old
+		return err
+	}
+	return os.WriteFile(path, []byte(src), 0644)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"vira/pkg/interrupt"
+	"vira/pkg/logging"
+)
+
+// astSchemaVersion is the version of the JSON vira ast prints. Fields may be
+// added to nodes without changing it; it is bumped when a field or node kind
+// is removed, renamed or changes meaning.
+const astSchemaVersion = 1
+
+// astNode is a node of the parse tree as vira ast prints it.
+type astNode struct {
+	// Kind is Program, Function, ReturnStmt, BinaryOp, NumberLiteral or
+	// Identifier.
+	Kind string `json:"kind"`
+	// Value is the name of a function or identifier, the operator of a
+	// binary operation or the digits of a number.
+	Value    string     `json:"value,omitempty"`
+	File     string     `json:"file"`
+	Line     int        `json:"line"`
+	Column   int        `json:"column"`
+	Children []*astNode `json:"children,omitempty"`
+}
+
+func newASTCmd() *cobra.Command {
+	var query string
+
+	cmd := &cobra.Command{
+		Use:   "ast file.vira",
+		Short: "Print the parse tree of a file as JSON",
+		Long: `Print the parse tree of a file, after preprocessing, as JSON.
+
+The output is an object with the schema version, the file and the root
+node. Every node has a kind, a value for the kinds that carry one, the file,
+line and column it starts at in the sources, and its children:
+
+    {"version": 1, "file": "src/main.vira", "root": {"kind": "Program", ...}}
+
+The version only changes when fields or kinds are removed or change meaning,
+so tools can rely on it.
+
+--query selects nodes by a path of kinds separated by slashes, starting
+below the root; "*" matches any kind, and a value in brackets only nodes
+with that value. The selected nodes are printed as a JSON array:
+
+    vira ast src/main.vira --query 'Function[main]/ReturnStmt'
+    vira ast src/main.vira --query '*/*/Identifier'`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			root, err := parseAST(args[0])
+			if err != nil {
+				printError(err)
+				exit(1)
+			}
+			var out any = struct {
+				Version int      `json:"version"`
+				File    string   `json:"file"`
+				Root    *astNode `json:"root"`
+			}{astSchemaVersion, displayPath(args[0]), root}
+			if cmd.Flags().Changed("query") {
+				nodes, err := queryAST(root, query)
+				if err != nil {
+					printError(err)
+					exit(1)
+				}
+				out = nodes
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(out); err != nil {
+				printError(err)
+				exit(1)
+			}
+		},
+	}
+	cmd.Flags().StringVar(&query, "query", "", "print only the nodes at this path, such as Function[main]/ReturnStmt")
+	return cmd
+}
+
+// parseAST preprocesses source and has plsa parse it, with the positions of
+// the nodes mapped back to the files the preprocessor read.
+func parseAST(source string) (*astNode, error) {
+	source, err := filepath.Abs(source)
+	if err != nil {
+		return nil, err
+	}
+	dir, remove, err := interrupt.TempDir("vira-ast-")
+	if err != nil {
+		return nil, err
+	}
+	defer remove()
+	pre := filepath.Join(dir, strings.TrimSuffix(filepath.Base(source), filepath.Ext(source))+".pre")
+
+	if err := ensureTools("preprocessor", "plsa"); err != nil {
+		return nil, err
+	}
+	origins, err := preprocess(source, pre)
+	if err != nil {
+		return nil, compileError(source, err)
+	}
+	out, err := runStageOutput("plsa", dir, toolPath("plsa"), pre, "--ast-json")
+	if err != nil {
+		var stageErr *stageError
+		if errors.As(err, &stageErr) {
+			stageErr.pre, stageErr.origins = pre, origins
+		}
+		return nil, compileError(source, err)
+	}
+	var root astNode
+	if err := json.Unmarshal([]byte(out), &root); err != nil {
+		return nil, fmt.Errorf("plsa printed an invalid parse tree: %v", err)
+	}
+	sources := map[string][]string{}
+	var locate func(n *astNode)
+	locate = func(n *astNode) {
+		n.File = displayPath(source)
+		if n.Line >= 1 && n.Line <= len(origins) {
+			o := origins[n.Line-1]
+			n.File, n.Line = displayPath(o.File), o.Line
+			if n.Kind == "Function" || n.Kind == "Identifier" {
+				if sources[o.File] == nil {
+					data, _ := os.ReadFile(o.File)
+					sources[o.File] = strings.Split(string(data), "\n")
+				}
+				if lines := sources[o.File]; o.Line <= len(lines) {
+					n.Column = nameColumn(lines[o.Line-1], n.Column, n.Value)
+				}
+			}
+		}
+		for _, c := range n.Children {
+			locate(c)
+		}
+	}
+	locate(&root)
+	// The program starts where the source does, whatever it includes first.
+	root.File, root.Line, root.Column = displayPath(source), 1, 1
+	return &root, nil
+}
+
+// nameColumn returns the column of the occurrence of name in line nearest
+// to column. A macro expanded earlier on the line moves the names after it
+// in the preprocessed code, where plsa sees them. A name that is not in
+// line, having come from a macro body, keeps column.
+func nameColumn(line string, column int, name string) int {
+	best, distance := column, -1
+	for i := 0; name != ""; {
+		j := strings.Index(line[i:], name)
+		if j < 0 {
+			break
+		}
+		start, end := i+j, i+j+len(name)
+		i = end
+		if start > 0 && isIdentChar(line[start-1]) || end < len(line) && isIdentChar(line[end]) {
+			continue
+		}
+		if d := abs(start + 1 - column); distance < 0 || d < distance {
+			best, distance = start+1, d
+		}
+	}
+	return best
+}
+
+// nameAt reports whether name is at the 1-based column of line.
+func nameAt(line string, column int, name string) bool {
+	end := column - 1 + len(name)
+	return column >= 1 && end <= len(line) && line[column-1:end] == name &&
+		(end == len(line) || !isIdentChar(line[end]))
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// parseASTText is parseAST for text, the unsaved contents of source. Like
+// checkText it parses a hidden copy next to source, so that the includes
+// resolve as they would for source itself, and locates the nodes of the
+// copy in source.
+func parseASTText(source, text string) (*astNode, error) {
+	source, err := filepath.Abs(source)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(source), "."+filepath.Base(source)+".*"+filepath.Ext(source))
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(text)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	root, err := parseAST(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	copied := displayPath(f.Name())
+	root.walk(func(n *astNode) {
+		if n.File == copied {
+			n.File = displayPath(source)
+		}
+	})
+	return root, nil
+}
+
+// parseDocument returns the parse tree of text, the contents of path as an
+// editor has them, or nil when the toolchain cannot parse or text does not
+// parse, as it often does not while it is typed. The language server then
+// falls back to scanning text.
+func parseDocument(path, text string) *astNode {
+	if len(checkTools("preprocessor", "plsa")) > 0 {
+		return nil
+	}
+	root, err := parseASTText(path, text)
+	if err != nil {
+		logging.Debug("scanning instead of parsing", "file", path, "err", err)
+		return nil
+	}
+	return root
+}
+
+// walk calls fn for n and every node below it, in the order of the source.
+func (n *astNode) walk(fn func(*astNode)) {
+	fn(n)
+	for _, c := range n.Children {
+		c.walk(fn)
+	}
+}
+
+// queryAST returns the nodes below root at path, as described in the help
+// of vira ast.
+func queryAST(root *astNode, path string) ([]*astNode, error) {
+	nodes := []*astNode{root}
+	for _, step := range strings.Split(strings.Trim(path, "/"), "/") {
+		kind, value, filtered := strings.Cut(step, "[")
+		if filtered {
+			if !strings.HasSuffix(value, "]") {
+				return nil, fmt.Errorf("invalid query step %q: missing ]", step)
+			}
+			value = strings.TrimSuffix(value, "]")
+		}
+		if kind == "" {
+			return nil, fmt.Errorf("invalid query %q: empty step", path)
+		}
+		var next []*astNode
+		for _, n := range nodes {
+			for _, c := range n.Children {
+				if (kind == "*" || c.Kind == kind) && (!filtered || c.Value == value) {
+					next = append(next, c)
+				}
+			}
+		}
+		nodes = next
+	}
+	if nodes == nil {
+		nodes = []*astNode{}
+	}
+	return nodes, nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+// defaultAdvisoryDB is the advisory database published from this repository.
+const defaultAdvisoryDB = "https://raw.githubusercontent.com/vira-language/vira/main/repository/advisories.json"
+
+// advisoryDB mirrors repository/advisories.json.
+type advisoryDB struct {
+	Advisories []advisory `json:"advisories"`
+}
+
+// advisory is a published vulnerability in a range of package versions.
+type advisory struct {
+	ID       string `json:"id"`
+	Package  string `json:"package"`
+	Title    string `json:"title"`
+	Severity string `json:"severity"`
+	Date     string `json:"date,omitempty"`
+	URL      string `json:"url,omitempty"`
+	// Affected is a version requirement matching the vulnerable versions.
+	Affected string `json:"affected"`
+	// Patched lists requirements matching versions with the fix.
+	Patched []string `json:"patched,omitempty"`
+}
+
+var severityRank = map[string]int{"low": 1, "medium": 2, "high": 3, "critical": 4}
+
+// advisoryDBURL returns the database location, which VIRA_ADVISORY_DB
+// overrides. It may be a URL or a local path.
+func advisoryDBURL() string {
+	if url := os.Getenv("VIRA_ADVISORY_DB"); url != "" {
+		return url
+	}
+	return defaultAdvisoryDB
+}
+
+func fetchAdvisoryDB() (*advisoryDB, error) {
+	location := advisoryDBURL()
+	data, err := readCachedLocation(location)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch advisory database %s: %v", location, err)
+	}
+	var db advisoryDB
+	if err := json.Unmarshal(data, &db); err != nil {
+		return nil, fmt.Errorf("invalid advisory database %s: %v", location, err)
+	}
+	return &db, nil
+}
+
+// finding is an advisory that applies to a resolved package.
+type finding struct {
+	Advisory advisory `json:"advisory"`
+	Version  string   `json:"version"`
+	// FixedIn is the oldest registry version that is patched, if any.
+	FixedIn string `json:"fixedIn,omitempty"`
+	Ignored bool   `json:"ignored"`
+}
+
+// auditResolution matches every resolved package except the root against
+// db. Advisories in ignore are reported but marked as ignored.
+func auditResolution(res *resolution, db *advisoryDB, idx *registryIndex, ignore []string) ([]finding, error) {
+	var findings []finding
+	for _, key := range sortedKeys(res.packages) {
+		if key == res.root {
+			continue
+		}
+		pkg := res.packages[key]
+		v, err := parseVersion(pkg.Version)
+		if err != nil {
+			return nil, err
+		}
+		for _, adv := range db.Advisories {
+			if adv.Package != pkg.Name {
+				continue
+			}
+			affected, err := parseVersionReq(adv.Affected)
+			if err != nil {
+				return nil, fmt.Errorf("advisory %s: %v", adv.ID, err)
+			}
+			if !affected.matches(v) {
+				continue
+			}
+			f := finding{Advisory: adv, Version: pkg.Version, Ignored: containsString(ignore, adv.ID)}
+			f.FixedIn, err = patchedVersion(adv, idx)
+			if err != nil {
+				return nil, err
+			}
+			findings = append(findings, f)
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		return severityRank[findings[i].Advisory.Severity] > severityRank[findings[j].Advisory.Severity]
+	})
+	return findings, nil
+}
+
+// patchedVersion returns the oldest registry version of the advised package
+// that matches one of the patched requirements.
+func patchedVersion(adv advisory, idx *registryIndex) (string, error) {
+	pkg := idx.lookup(adv.Package)
+	if pkg == nil {
+		return "", nil
+	}
+	versions := pkg.sortedVersions()
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Yanked {
+			continue
+		}
+		v, _ := parseVersion(versions[i].Version)
+		for _, p := range adv.Patched {
+			req, err := parseVersionReq(p)
+			if err != nil {
+				return "", fmt.Errorf("advisory %s: %v", adv.ID, err)
+			}
+			if req.matches(v) {
+				return versions[i].Version, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+func newAuditCmd() *cobra.Command {
+	var ignore []string
+
+	cmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Check dependencies for published security advisories",
+		Long: `Check the resolved dependencies of the current project against the
+advisory database and report vulnerable versions.
+
+The command fails when an advisory applies that has not been ignored, either
+with --ignore or in the [audit] section of vira.toml:
+
+    [audit]
+    ignore = ["VIRA-2024-0001"]
+
+VIRA_ADVISORY_DB overrides the location of the database.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			proj, err := loadProject(".")
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			idx, err := fetchRegistryIndex()
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			res, _, err := proj.resolve(resolveOptions{})
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			db, err := fetchAdvisoryDB()
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			findings, err := auditResolution(res, db, idx, append(proj.manifest.Audit.Ignore, ignore...))
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+
+			open := 0
+			for _, f := range findings {
+				if !f.Ignored {
+					open++
+				}
+			}
+			if jsonOutput {
+				if findings == nil {
+					findings = []finding{}
+				}
+				if err := printJSON(findings); err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+			} else {
+				printFindings(findings, len(res.packages)-1)
+			}
+			if open > 0 {
+				exit(1)
+			}
+		},
+	}
+	cmd.Flags().StringSliceVar(&ignore, "ignore", nil, "advisory IDs to ignore")
+	return cmd
+}
+
+func printFindings(findings []finding, scanned int) {
+	if len(findings) == 0 {
+		pterm.Success.Printfln("No advisories found for %d dependencies", scanned)
+		return
+	}
+	data := pterm.TableData{{"ID", "Package", "Version", "Severity", "Fixed in", "Title"}}
+	open := 0
+	for _, f := range findings {
+		fixed := f.FixedIn
+		if fixed == "" {
+			fixed = "no fix available"
+		}
+		id := f.Advisory.ID
+		if f.Ignored {
+			id += " (ignored)"
+		} else {
+			open++
+		}
+		data = append(data, []string{id, f.Advisory.Package, f.Version, strings.ToLower(f.Advisory.Severity), fixed, f.Advisory.Title})
+	}
+	pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+	for _, f := range findings {
+		if f.Advisory.URL != "" && !f.Ignored {
+			pterm.Println(f.Advisory.ID + ": " + f.Advisory.URL)
+		}
+	}
+	if open > 0 {
+		pterm.Error.Printfln("%d advisories found in %d dependencies", open, scanned)
+	} else {
+		pterm.Warning.Printfln("%d advisories found, all ignored", len(findings))
+	}
+}
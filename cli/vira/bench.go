@@ -0,0 +1,449 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"vira/pkg/interrupt"
+)
+
+func newBenchCmd() *cobra.Command {
+	var opts benchOptions
+
+	cmd := &cobra.Command{
+		Use:   "bench [filter...]",
+		Short: "Build and time the benchmarks of the project",
+		Long: `Build every benchmark of the project with the release profile and time
+it. A benchmark is a program in benches/, or a directory below it, that is
+not included by another file there, and is timed by running it --samples
+times, after one run to warm up, with the start of the program included.
+Only the benchmarks whose names contain one of the filters run, if any are
+given. Benchmarks include the sources of the project as tests do.
+
+The results are recorded for the commit checked out, in
+target/bench/revisions, unless the working tree has changes, and with
+--save-baseline under a name as well. --baseline compares the results with
+those saved under a name or recorded for a commit, such as main or HEAD~1,
+giving the change of the mean time and whether it is significant: the p
+value of Welch's t-test is below 0.05. With --fail-threshold the command
+fails when a benchmark is significantly slower than the baseline by more
+than the given percentage, as a performance gate in CI.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			opts.filters = args
+			opts.gate = cmd.Flags().Changed("fail-threshold")
+			if opts.gate && opts.baseline == "" {
+				pterm.Error.Println("--fail-threshold needs a --baseline to compare with")
+				exit(1)
+			}
+			if opts.samples < 2 {
+				pterm.Error.Println("--samples must be at least 2")
+				exit(1)
+			}
+			if jsonOutput {
+				// stdout carries the results.
+				pterm.SetDefaultOutput(os.Stderr)
+			}
+			proj, err := loadProject(".")
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			run, err := proj.runBenchmarks(opts)
+			if err != nil {
+				printError(err)
+				exit(1)
+			}
+			if jsonOutput {
+				if err := printJSON(run); err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+			} else {
+				printBenchRun(run)
+			}
+			failed := false
+			for _, b := range run.Benchmarks {
+				switch {
+				case b.Error != "":
+					failed = true
+				case opts.gate && b.Baseline != nil && b.Baseline.Significant && b.Baseline.Change > opts.failThreshold:
+					pterm.Error.Printfln("%s is %.1f%% slower than the baseline, more than the threshold of %g%%", b.Name, b.Baseline.Change, opts.failThreshold)
+					failed = true
+				}
+			}
+			if failed {
+				exit(1)
+			}
+		},
+	}
+	cmd.Flags().IntVarP(&opts.samples, "samples", "n", 10, "number of timed runs of each benchmark")
+	cmd.Flags().StringVar(&opts.baseline, "baseline", "", "compare with the results saved under this name or recorded for this commit")
+	cmd.Flags().StringVar(&opts.saveBaseline, "save-baseline", "", "save the results under this name")
+	cmd.Flags().Float64Var(&opts.failThreshold, "fail-threshold", 0, "fail when a benchmark is significantly slower than the baseline by more than this percentage")
+	return cmd
+}
+
+type benchOptions struct {
+	filters       []string
+	samples       int
+	baseline      string
+	saveBaseline  string
+	failThreshold float64
+	// gate is whether --fail-threshold was given.
+	gate bool
+}
+
+// benchRun is the outcome of vira bench, as it is recorded and as --json
+// prints it.
+type benchRun struct {
+	// Revision is the commit the benchmarks ran at, if the project is in
+	// git, and Dirty whether the working tree had changes.
+	Revision   string        `json:"revision,omitempty"`
+	Dirty      bool          `json:"dirty,omitempty"`
+	Time       string        `json:"time"`
+	Baseline   string        `json:"baseline,omitempty"`
+	Benchmarks []benchResult `json:"benchmarks"`
+}
+
+type benchResult struct {
+	Name string `json:"name"`
+	File string `json:"file"`
+	// Samples are the times of the runs, in nanoseconds.
+	Samples []float64 `json:"samples_ns"`
+	Mean    float64   `json:"mean_ns"`
+	StdDev  float64   `json:"stddev_ns"`
+	// Error is why the benchmark could not be built or run.
+	Error    string           `json:"error,omitempty"`
+	Baseline *benchComparison `json:"baseline,omitempty"`
+}
+
+// benchComparison compares a benchmark with its baseline.
+type benchComparison struct {
+	Mean float64 `json:"mean_ns"`
+	// Change is how much slower the benchmark is, in percent of the
+	// baseline; it is negative when it got faster.
+	Change      float64 `json:"change_percent"`
+	PValue      float64 `json:"p_value"`
+	Significant bool    `json:"significant"`
+}
+
+func (p *project) benchesDir() string {
+	return filepath.Join(p.root, "benches")
+}
+
+// benchResultsDir holds the recorded results: revisions/<commit>.json and
+// baselines/<name>.json.
+func (p *project) benchResultsDir() string {
+	return p.targetDir("bench")
+}
+
+// runBenchmarks builds and times the benchmarks opts select, one after
+// another, and records the results.
+func (p *project) runBenchmarks(opts benchOptions) (*benchRun, error) {
+	run := &benchRun{Time: time.Now().UTC().Format(time.RFC3339), Benchmarks: []benchResult{}}
+	var baseline *benchRun
+	if opts.baseline != "" {
+		var err error
+		if baseline, err = p.loadBaseline(opts.baseline); err != nil {
+			return nil, err
+		}
+		run.Baseline = opts.baseline
+	}
+	files, err := programFiles(p.benchesDir())
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		pterm.Info.Println("The project has no benchmarks; add programs to benches/ to time them")
+		return run, nil
+	}
+	includeDirs, sources, err := p.programInputs()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(p.targetDir(buildOptions{release: true}.outputDir()), "benches")
+
+	for _, file := range files {
+		b := benchResult{Name: programName(p.benchesDir(), file), File: p.rel(file), Samples: []float64{}}
+		if !matchesFilters(b.Name, opts.filters) {
+			continue
+		}
+		exe, err := p.buildProgram(file, b.Name, dir, includeDirs, sources)
+		if err == nil {
+			pterm.Info.Printfln("Timing %s", b.Name)
+			b.Samples, err = p.timeProgram(exe, opts.samples)
+		} else {
+			err = compileError(file, err)
+			printError(err)
+		}
+		if err != nil {
+			b.Error = err.Error()
+		} else {
+			b.Mean, b.StdDev = meanStdDev(b.Samples)
+			if baseline != nil {
+				b.Baseline = compareBenchmark(b, baseline)
+			}
+		}
+		run.Benchmarks = append(run.Benchmarks, b)
+	}
+
+	if err := p.recordBenchRun(run, opts.saveBaseline); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// timeProgram runs exe once to warm up and then samples times, returning
+// how long each of those took in nanoseconds.
+func (p *project) timeProgram(exe string, samples int) ([]float64, error) {
+	var times []float64
+	for i := 0; i <= samples; i++ {
+		cmd := exec.Command(exe)
+		cmd.Dir = p.root
+		start := time.Now()
+		out, err := interrupt.CombinedOutput(cmd)
+		elapsed := time.Since(start)
+		code, err := commandExitCode(err)
+		if err != nil {
+			return nil, err
+		}
+		if code != 0 {
+			return nil, &stageError{stage: "benchmark", output: string(out), err: fmt.Errorf("exit status %d", code)}
+		}
+		if i > 0 {
+			times = append(times, float64(elapsed.Nanoseconds()))
+		}
+	}
+	logf("bench %s: %d samples", exe, len(times))
+	return times, nil
+}
+
+// recordBenchRun writes run for its commit, unless the working tree has
+// changes, and under the name save if it is set.
+func (p *project) recordBenchRun(run *benchRun, save string) error {
+	if commit, err := runGit(p.root, "rev-parse", "--verify", "HEAD"); err == nil {
+		run.Revision = commit
+		status, _ := runGit(p.root, "status", "--porcelain", "--untracked-files=no")
+		run.Dirty = status != ""
+	}
+	var files []string
+	switch {
+	case run.Revision == "":
+	case run.Dirty:
+		pterm.Info.Printfln("The working tree has changes, so the results are not recorded for %s", shortCommit(run.Revision))
+	default:
+		files = append(files, filepath.Join(p.benchResultsDir(), "revisions", run.Revision+".json"))
+	}
+	if save != "" {
+		if !packageNamePattern.MatchString(save) {
+			return fmt.Errorf("%q is not a valid baseline name: use a-z, 0-9, - and _", save)
+		}
+		files = append(files, filepath.Join(p.benchResultsDir(), "baselines", save+".json"))
+	}
+	data, err := json.MarshalIndent(run, "", "  ")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(file, append(data, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+	if save != "" {
+		pterm.Info.Printfln("Saved the results as the baseline %s", save)
+	}
+	return nil
+}
+
+// loadBaseline reads the results saved under name, or else those recorded
+// for the commit git resolves name to.
+func (p *project) loadBaseline(name string) (*benchRun, error) {
+	file := filepath.Join(p.benchResultsDir(), "baselines", name+".json")
+	if !packageNamePattern.MatchString(name) {
+		file = ""
+	}
+	if _, err := os.Stat(file); file == "" || err != nil {
+		commit, gitErr := runGit(p.root, "rev-parse", "--verify", name+"^{commit}")
+		if gitErr != nil {
+			return nil, fmt.Errorf("there is no baseline %s: save one with vira bench --save-baseline %s", name, name)
+		}
+		file = filepath.Join(p.benchResultsDir(), "revisions", commit+".json")
+		if _, err := os.Stat(file); errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("no results are recorded for %s (%s): check it out and run vira bench there first", name, shortCommit(commit))
+		}
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var run benchRun
+	if err := json.Unmarshal(data, &run); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return &run, nil
+}
+
+func shortCommit(commit string) string {
+	return commit[:min(len(commit), 12)]
+}
+
+// compareBenchmark compares b with the benchmark of the same name in
+// baseline, or returns nil if baseline has no results for it.
+func compareBenchmark(b benchResult, baseline *benchRun) *benchComparison {
+	for _, base := range baseline.Benchmarks {
+		if base.Name != b.Name || base.Error != "" || len(base.Samples) == 0 {
+			continue
+		}
+		c := &benchComparison{Mean: base.Mean, PValue: welchPValue(b.Samples, base.Samples)}
+		if base.Mean > 0 {
+			c.Change = (b.Mean - base.Mean) / base.Mean * 100
+		}
+		c.Significant = c.PValue < 0.05
+		return c
+	}
+	return nil
+}
+
+func meanStdDev(xs []float64) (mean, stddev float64) {
+	for _, x := range xs {
+		mean += x
+	}
+	mean /= float64(len(xs))
+	if len(xs) < 2 {
+		return mean, 0
+	}
+	for _, x := range xs {
+		stddev += (x - mean) * (x - mean)
+	}
+	return mean, math.Sqrt(stddev / float64(len(xs)-1))
+}
+
+// welchPValue returns the two-sided p value of Welch's t-test of whether a
+// and b have the same mean, which does not assume they vary alike.
+func welchPValue(a, b []float64) float64 {
+	if len(a) < 2 || len(b) < 2 {
+		return 1
+	}
+	ma, sa := meanStdDev(a)
+	mb, sb := meanStdDev(b)
+	va, vb := sa*sa/float64(len(a)), sb*sb/float64(len(b))
+	if va+vb == 0 {
+		if ma == mb {
+			return 1
+		}
+		return 0
+	}
+	t := (ma - mb) / math.Sqrt(va+vb)
+	df := (va + vb) * (va + vb) / (va*va/float64(len(a)-1) + vb*vb/float64(len(b)-1))
+	// The two tails of Student's t distribution with df degrees of freedom.
+	return incompleteBeta(df/2, 0.5, df/(df+t*t))
+}
+
+// incompleteBeta returns the regularized incomplete beta function I_x(a,b),
+// evaluated by its continued fraction.
+func incompleteBeta(a, b, x float64) float64 {
+	switch {
+	case x <= 0:
+		return 0
+	case x >= 1:
+		return 1
+	}
+	la, _ := math.Lgamma(a)
+	lb, _ := math.Lgamma(b)
+	lab, _ := math.Lgamma(a + b)
+	front := math.Exp(lab - la - lb + a*math.Log(x) + b*math.Log(1-x))
+	// The fraction converges quickly below the mean of the distribution;
+	// above it, I_x(a,b) = 1 - I_(1-x)(b,a).
+	if x > (a+1)/(a+b+2) {
+		return 1 - front*betaFraction(b, a, 1-x)/b
+	}
+	return front * betaFraction(a, b, x) / a
+}
+
+// betaFraction evaluates the continued fraction of the incomplete beta
+// function with Lentz's method.
+func betaFraction(a, b, x float64) float64 {
+	const tiny = 1e-300
+	c, d := 1.0, 1-(a+b)*x/(a+1)
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	h := d
+	for m := 1; m <= 200; m++ {
+		fm := float64(m)
+		for _, num := range []float64{
+			fm * (b - fm) * x / ((a + 2*fm - 1) * (a + 2*fm)),
+			-(a + fm) * (a + b + fm) * x / ((a + 2*fm) * (a + 2*fm + 1)),
+		} {
+			d = 1 + num*d
+			if math.Abs(d) < tiny {
+				d = tiny
+			}
+			c = 1 + num/c
+			if math.Abs(c) < tiny {
+				c = tiny
+			}
+			d = 1 / d
+			h *= d * c
+		}
+		if math.Abs(d*c-1) < 1e-12 {
+			break
+		}
+	}
+	return h
+}
+
+// benchTime renders nanoseconds to the microsecond.
+func benchTime(ns float64) string {
+	return time.Duration(ns).Round(time.Microsecond).String()
+}
+
+func printBenchRun(run *benchRun) {
+	if len(run.Benchmarks) == 0 {
+		return
+	}
+	header := []string{"Benchmark", "Mean", "Std. dev."}
+	if run.Baseline != "" {
+		header = append(header, "Baseline", "Change", "p")
+	}
+	data := pterm.TableData{header}
+	for _, b := range run.Benchmarks {
+		if b.Error != "" {
+			row := []string{b.Name, "failed"}
+			for len(row) < len(header) {
+				row = append(row, "")
+			}
+			data = append(data, row)
+			continue
+		}
+		row := []string{b.Name, benchTime(b.Mean), benchTime(b.StdDev)}
+		switch c := b.Baseline; {
+		case run.Baseline == "":
+		case c == nil:
+			row = append(row, "none")
+		default:
+			change := fmt.Sprintf("%+.1f%%", c.Change)
+			if !c.Significant {
+				change += " (no change)"
+			}
+			row = append(row, benchTime(c.Mean), change, strconv.FormatFloat(c.PValue, 'f', 3, 64))
+		}
+		data = append(data, row)
+	}
+	pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"vira/pkg/i18n"
+)
+
+func newBindgenCmd() *cobra.Command {
+	var emitHeader bool
+	var output string
+
+	cmd := &cobra.Command{
+		Use:   "bindgen --emit-header",
+		Short: "Generate bindings for using the project from other languages",
+		Long: `Generate bindings for the functions of the project, so that C and C++
+code can call them without declaring them by hand.
+
+--emit-header writes a C header, target/include/<name>.h or the file given
+with --output, declaring every function defined in src/ except main. The
+compiler exports each function under its own name with the C calling
+convention, and as every Vira function takes no arguments and returns an
+int, each is declared as int32_t name(void).
+
+vira builds executables only, not libraries: C code links with the object
+files of the build, in target/debug/obj or target/release/obj, which can be
+archived into a static library with ar, leaving out the one defining main.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if !emitHeader {
+				pterm.Error.Println("name the bindings to generate: --emit-header")
+				exit(1)
+			}
+			proj, err := loadProject(".")
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			if output == "" {
+				output = filepath.Join(proj.targetDir("include"), proj.manifest.Package.Name+".h")
+			}
+			if err := proj.writeHeader(output); err != nil {
+				printError(err)
+				exit(1)
+			}
+			pterm.Success.Println(i18n.T("Wrote the header %s", proj.rel(output)))
+		},
+	}
+	cmd.Flags().BoolVar(&emitHeader, "emit-header", false, "write a C header declaring the functions of the project")
+	cmd.Flags().StringVarP(&output, "output", "o", "", "write the header to this file")
+	return cmd
+}
+
+// exportedFunction is a function the objects of the project export.
+type exportedFunction struct {
+	name string
+	// file and line are where it is defined, relative to the project.
+	file string
+	line int
+}
+
+// exportedFunctions parses the compilation units of the project and returns
+// the functions defined in src/, other than main, in the order of the
+// units.
+func (p *project) exportedFunctions() ([]exportedFunction, error) {
+	units, err := p.compilationUnits()
+	if err != nil {
+		return nil, err
+	}
+	if len(units) == 0 {
+		return nil, errors.New("the project has no sources in src/")
+	}
+	var functions []exportedFunction
+	seen := map[string]bool{}
+	for _, unit := range units {
+		root, err := parseAST(unit)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range root.Children {
+			if n.Kind != "Function" || n.Value == "main" || seen[n.Value] {
+				continue
+			}
+			file, err := filepath.Abs(n.File)
+			if err != nil {
+				return nil, err
+			}
+			// Functions of dependencies are theirs to declare.
+			if rel, err := filepath.Rel(p.srcDir(), file); err != nil || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			seen[n.Value] = true
+			functions = append(functions, exportedFunction{name: n.Value, file: p.rel(file), line: n.Line})
+		}
+	}
+	return functions, nil
+}
+
+// cKeywords are the C and C++ keywords a Vira function may be named, which
+// C code could not call.
+var cKeywords = map[string]bool{
+	"auto": true, "bool": true, "break": true, "case": true, "catch": true, "char": true,
+	"class": true, "const": true, "continue": true, "default": true, "delete": true, "do": true,
+	"double": true, "else": true, "enum": true, "extern": true, "false": true, "float": true,
+	"for": true, "goto": true, "if": true, "inline": true, "long": true, "namespace": true,
+	"new": true, "private": true, "public": true, "register": true, "restrict": true,
+	"short": true, "signed": true, "sizeof": true, "static": true, "struct": true,
+	"switch": true, "template": true, "this": true, "throw": true, "true": true, "try": true,
+	"typedef": true, "union": true, "unsigned": true, "virtual": true, "void": true,
+	"volatile": true, "while": true,
+}
+
+// writeHeader writes the C header of the functions of the project to file.
+func (p *project) writeHeader(file string) error {
+	functions, err := p.exportedFunctions()
+	if err != nil {
+		return err
+	}
+	for _, f := range functions {
+		if cKeywords[f.name] {
+			return fmt.Errorf("%s:%d: the function %s cannot be declared in C, where %s is a keyword", f.file, f.line, f.name, f.name)
+		}
+	}
+	if len(functions) == 0 {
+		pterm.Warning.Println("The project defines no functions besides main; the header declares none")
+	}
+
+	guard := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, p.manifest.Package.Name) + "_H"
+	var b strings.Builder
+	fmt.Fprintf(&b, "/* Generated by vira bindgen from %s v%s. Do not edit. */\n\n", p.manifest.Package.Name, p.manifest.Package.Version)
+	fmt.Fprintf(&b, "#ifndef %s\n#define %s\n\n#include <stdint.h>\n\n", guard, guard)
+	b.WriteString("#ifdef __cplusplus\nextern \"C\" {\n#endif\n\n")
+	for _, f := range functions {
+		fmt.Fprintf(&b, "/* %s:%d */\nint32_t %s(void);\n\n", f.file, f.line, f.name)
+	}
+	b.WriteString("#ifdef __cplusplus\n}\n#endif\n\n")
+	fmt.Fprintf(&b, "#endif /* %s */\n", guard)
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(file, []byte(b.String()), 0644)
+}
@@ -0,0 +1,811 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"vira/pkg/diagnostics"
+	"vira/pkg/i18n"
+)
+
+func newBuildCmd() *cobra.Command {
+	var opts buildOptions
+	var container string
+	var noSign bool
+
+	cmd := &cobra.Command{
+		Use:   "build",
+		Short: "Build the current project",
+		Long: `Build the current project into target/debug, or target/release with
+--release.
+
+With --container, the build runs in a container with docker or podman
+instead, in the official builder image for the toolchain the project
+uses, or in the image given as --container=IMAGE. The project and the
+download cache are mounted into the container, so the results end up in
+target/ as usual, built the same way on every host. VIRA_CONTAINER_ENGINE
+picks docker or podman when both are installed.
+
+With --target, such as x86_64-linux-gnu, aarch64-macos or
+x86_64-windows-gnu, the executable is built for another platform into
+target/<target>/debug or target/<target>/release. The objects are linked
+with zig cc, which brings the C library and startup files of every target
+along, so Linux, macOS and Windows executables can be built on any host
+with just zig on PATH.
+
+Bare-metal targets, such as aarch64-none-elf or riscv64-none-elf, are
+linked without a C library, as --no-std does for any target, and laid out
+by the linker script given with --linker-script. --emit bin,hex then also
+writes the executable as raw binary and Intel HEX images to flash onto the
+device.
+
+A profile with a [profile.<name>.signing] section in vira.toml has its
+executables signed once linked: Windows executables with Authenticode, by
+signtool or, on other hosts, osslsigncode; macOS executables with
+codesign; others with a detached GPG signature written next to them as
+.asc. The password of the certificate file or GPG key is read from
+VIRA_SIGNING_PASSWORD; identities in the keychain or certificate store of
+the system need none. --no-sign skips signing, as for local builds.
+
+With --reproducible, the executable depends only on the sources: the
+tools get SOURCE_DATE_EPOCH, the time of the last commit unless set, in
+place of the current time, and link.exe writes no timestamp. vira
+verify-build checks that a project builds reproducibly.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			proj, err := loadProject(".")
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			if container != "" {
+				code, err := buildInContainer(proj, cmd, container)
+				if err != nil {
+					pterm.Error.Println(err)
+				}
+				exit(code)
+			}
+			opts.sign = !noSign
+			if opts.sbom != "" && opts.sbom != "cyclonedx" && opts.sbom != "spdx" {
+				pterm.Error.Printfln("unknown SBOM format %q (use cyclonedx or spdx)", opts.sbom)
+				exit(1)
+			}
+			for _, format := range opts.emit {
+				if imageFormats[format] == "" {
+					pterm.Error.Printfln("unknown image format %q (use bin or hex)", format)
+					exit(1)
+				}
+			}
+			if opts.sbom != "" && opts.target != "" {
+				// The libraries are read from the executable as the host
+				// links them.
+				pterm.Error.Println("--sbom cannot be used with --target")
+				exit(1)
+			}
+			if opts.logFile != "" {
+				if opts.logFile == defaultBuildLog {
+					opts.logFile = filepath.Join(proj.root, defaultBuildLog)
+				}
+				closeLog, err := openBuildLog(opts.logFile)
+				if err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+				defer closeLog()
+			}
+			closeTrace := func() {}
+			if opts.traceFile != "" {
+				closeFile, err := openTrace(opts.traceFile)
+				if err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+				// The trace is written before any exit, with the span of
+				// the build ended.
+				endBuild := traceSpan("build", "build "+proj.manifest.Package.Name, map[string]any{"profile": opts.profile()})
+				closeTrace = func() {
+					endBuild()
+					if err := closeFile(); err != nil {
+						pterm.Error.Println(err)
+						exit(1)
+					}
+					pterm.Info.Println(i18n.T("Wrote the trace to %s", opts.traceFile))
+				}
+			}
+			pterm.DefaultSection.Println(i18n.T("Building %s v%s", proj.manifest.Package.Name, proj.manifest.Package.Version))
+			logf("building %s v%s with the %s profile in %s", proj.manifest.Package.Name, proj.manifest.Package.Version, opts.profile(), proj.root)
+			result := buildResult{
+				Package:     proj.manifest.Package.Name,
+				Version:     proj.manifest.Package.Version,
+				Profile:     opts.profile(),
+				Diagnostics: []diagnostic{},
+			}
+			if jsonOutput {
+				opts.warned = func(warnings []diagnostic) {
+					result.Diagnostics = warnings
+					printDiagnostics(warnings)
+				}
+			}
+			start := time.Now()
+			exe, err := proj.build(opts)
+			result.Duration = time.Since(start).Milliseconds()
+			if err != nil {
+				logf("build failed after %s: %v", time.Since(start).Round(time.Millisecond), err)
+				printError(err)
+				closeTrace()
+				if buildLog != nil {
+					pterm.Info.Println(i18n.T("The build log is in %s", opts.logFile))
+				}
+				if jsonOutput {
+					var diagErr *diagnosticsError
+					if errors.As(err, &diagErr) {
+						result.Diagnostics = diagErr.diags
+					} else {
+						result.Error = err.Error()
+					}
+					printJSON(result)
+				}
+				exit(1)
+			}
+			logf("built %s in %s", exe, time.Since(start).Round(time.Millisecond))
+			closeTrace()
+			pterm.Success.Println(i18n.T("Built %s", exe))
+			result.Success, result.Executable = true, exe
+			if opts.sign && proj.signing(opts.profile()) != nil {
+				pterm.Success.Println(i18n.T("Signed %s", exe))
+				target, _ := parseCrossTarget(opts.target)
+				result.Signature = signaturePath(target, exe)
+			}
+			for _, format := range opts.emit {
+				image := imagePath(exe, format)
+				pterm.Success.Println(i18n.T("Wrote the image %s", image))
+				result.Images = append(result.Images, image)
+			}
+			if opts.sbom != "" {
+				b, err := proj.collectSBOM(exe)
+				if err == nil {
+					var file string
+					if file, err = b.write(opts.sbom); err == nil {
+						pterm.Success.Println(i18n.T("Wrote the bill of materials to %s", proj.rel(file)))
+						result.SBOM = file
+					}
+				}
+				if err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+			}
+			if jsonOutput {
+				if err := printJSON(result); err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+			}
+		},
+	}
+	cmd.Flags().BoolVar(&opts.release, "release", false, "build with the release profile")
+	cmd.Flags().BoolVarP(&opts.debugInfo, "debug-info", "g", false, "keep debug information in the executable")
+	cmd.Flags().BoolVar(&opts.locked, "locked", false, "fail if vira.lock is missing or out of date")
+	cmd.Flags().StringVar(&opts.sbom, "sbom", "", "also write a software bill of materials: cyclonedx or spdx")
+	cmd.Flags().Lookup("sbom").NoOptDefVal = "cyclonedx"
+	cmd.Flags().StringSliceVar(&opts.werror, "werror", nil, "treat warnings with these codes as errors (every warning if no code is given)")
+	cmd.Flags().Lookup("werror").NoOptDefVal = "all"
+	cmd.Flags().BoolVar(&opts.reproducible, "reproducible", false, "build an executable that depends only on the sources, not on when it was built")
+	cmd.Flags().IntVarP(&opts.jobs, "jobs", "j", 0, "run this many compilation jobs at once (one per CPU by default, or as many as the make jobserver allows)")
+	cmd.Flags().StringVar(&opts.logFile, "log-file", "", "write a detailed log of the build to this file (target/build.log if no file is given)")
+	cmd.Flags().Lookup("log-file").NoOptDefVal = defaultBuildLog
+	cmd.Flags().StringVar(&opts.traceFile, "trace", "", "write a trace of the build to this file, for Perfetto or chrome://tracing")
+	cmd.Flags().StringVar(&opts.target, "target", "", "build for another platform, such as x86_64-linux-gnu, aarch64-macos or x86_64-windows-gnu, linking with zig cc")
+	cmd.Flags().StringVar(&opts.linkerScript, "linker-script", "", "lay out the executable with this linker script")
+	cmd.Flags().BoolVar(&opts.noStd, "no-std", false, "link without the C library and its startup files, as for bare-metal targets")
+	cmd.Flags().StringSliceVar(&opts.emit, "emit", nil, "also write the executable as flash images: bin for raw binary, hex for Intel HEX")
+	cmd.Flags().BoolVar(&noSign, "no-sign", false, "do not sign the executable, even if the profile has signing configured")
+	cmd.Flags().StringVar(&container, "container", "", "build in a container, in the official builder image or the given one")
+	cmd.Flags().Lookup("container").NoOptDefVal = officialImage
+	return cmd
+}
+
+// buildResult is what vira build prints with --json.
+type buildResult struct {
+	Package    string `json:"package"`
+	Version    string `json:"version"`
+	Profile    string `json:"profile"`
+	Success    bool   `json:"success"`
+	Executable string `json:"executable,omitempty"`
+	SBOM       string `json:"sbom,omitempty"`
+	// Signature is the detached signature of the executable, where its
+	// platform has one.
+	Signature string `json:"signature,omitempty"`
+	// Images are the flash images written with --emit.
+	Images []string `json:"images,omitempty"`
+	// Duration is how long the build took, in milliseconds.
+	Duration int64 `json:"duration_ms"`
+	// Diagnostics are the warnings of a successful build, or the errors
+	// and warnings of a failed one.
+	Diagnostics []diagnostic `json:"diagnostics"`
+	// Error is why the build failed, when it was not because of
+	// diagnostics.
+	Error string `json:"error,omitempty"`
+}
+
+// defaultBuildLog is where vira build --log-file writes the log, relative to
+// the project root.
+var defaultBuildLog = filepath.Join("target", "build.log")
+
+type buildOptions struct {
+	release   bool
+	debugInfo bool
+	locked    bool
+	// sbom is the format of the bill of materials to write, if any.
+	sbom string
+	// werror lists the codes of warnings to treat as errors, in addition to
+	// those of the manifest's [diagnostics] section.
+	werror []string
+	// logFile is where --log-file writes the build log.
+	logFile string
+	// traceFile is where --trace writes the trace of the build.
+	traceFile string
+	// target is the platform to build for, as --target names it, or empty
+	// for the host.
+	target string
+	// linkerScript lays out the executable, and noStd links it without the
+	// C library and its startup files, as on bare-metal targets.
+	linkerScript string
+	noStd        bool
+	// emit lists the formats of flash images to write from the
+	// executable: bin or hex.
+	emit []string
+	// sign signs the executable if the profile has a signing
+	// configuration.
+	sign bool
+	// reproducible builds the executable so that it only depends on the
+	// sources, not on when it was built.
+	reproducible bool
+	// dir, if set, is the directory below target/ to build in instead of
+	// the one of the profile.
+	dir string
+	// jobs is how many compilation jobs run at once; 0 means one per CPU, or
+	// as many as the make jobserver allows.
+	jobs int
+	// compiling and warned, when set, are told about the progress of the
+	// build and the warnings of a successful one, which are printed
+	// otherwise. compiling is called with the unit about to be compiled
+	// and the index of the unit among all of them.
+	compiling func(unit string, i, units int)
+	warned    func(warnings []diagnostic)
+}
+
+func (o buildOptions) profile() string {
+	if o.release {
+		return "release"
+	}
+	return "debug"
+}
+
+// outputDir is the directory below target/ the build writes to: the
+// profile, in a directory of its own for another target.
+func (o buildOptions) outputDir() string {
+	if o.dir != "" {
+		return o.dir
+	}
+	if o.target != "" {
+		return filepath.Join(o.target, o.profile())
+	}
+	return o.profile()
+}
+
+// project is a directory with a vira.toml. Sources live in src/ and build
+// output goes to target/<profile>/, or target/<target>/<profile>/ when
+// building for another target.
+type project struct {
+	root     string
+	manifest *Manifest
+}
+
+func loadProject(dir string) (*project, error) {
+	root, err := findProjectRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	m, err := loadManifest(filepath.Join(root, manifestName))
+	if err != nil {
+		return nil, err
+	}
+	return &project{root: root, manifest: m}, nil
+}
+
+func (p *project) srcDir() string {
+	return filepath.Join(p.root, "src")
+}
+
+// targetDir is the directory of build output below target/, as returned by
+// buildOptions.outputDir.
+func (p *project) targetDir(out string) string {
+	return filepath.Join(p.root, "target", out)
+}
+
+func (p *project) executable(out string, target *crossTarget) string {
+	return filepath.Join(p.targetDir(out), target.executableName(p.manifest.Package.Name))
+}
+
+// sourceFiles lists every .vira file under src/, sorted.
+func (p *project) sourceFiles() ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(p.srcDir(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && filepath.Ext(path) == ".vira" {
+			files = append(files, path)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// compilationUnits returns the source files that are not included by another
+// source file; each of them is compiled into its own object.
+func (p *project) compilationUnits() ([]string, error) {
+	files, err := p.sourceFiles()
+	if err != nil {
+		return nil, err
+	}
+	included := map[string]bool{}
+	for _, file := range files {
+		for _, inc := range localIncludes(file) {
+			included[inc] = true
+		}
+	}
+	var units []string
+	for _, file := range files {
+		if !included[file] {
+			units = append(units, file)
+		}
+	}
+	return units, nil
+}
+
+func (p *project) objectPath(out, source string) string {
+	rel, err := filepath.Rel(p.srcDir(), source)
+	if err != nil {
+		rel = filepath.Base(source)
+	}
+	return filepath.Join(p.targetDir(out), "obj", strings.TrimSuffix(rel, ".vira")+".o")
+}
+
+// build compiles every out-of-date compilation unit and links the project's
+// executable, returning its path.
+func (p *project) build(opts buildOptions) (string, error) {
+	target, err := parseCrossTarget(opts.target)
+	if err != nil {
+		return "", err
+	}
+	if target != nil {
+		if _, err := zigPath(); err != nil {
+			return "", err
+		}
+	}
+	if opts.reproducible {
+		if err := p.setReproducibleEnv(); err != nil {
+			return "", err
+		}
+	}
+	out := opts.outputDir()
+	units, err := p.compilationUnits()
+	if err != nil {
+		return "", err
+	}
+	endResolve := traceSpan("resolve", "resolve dependencies", nil)
+	includeDirs, err := p.dependencyDirs(resolveOptions{locked: opts.locked})
+	if err != nil {
+		endResolve()
+		return "", err
+	}
+	localSources, err := p.pathDependencySources()
+	endResolve()
+	if err != nil {
+		return "", err
+	}
+	// Registry and git dependencies are pinned by vira.lock, which is only
+	// rewritten when the resolution changes.
+	if _, err := os.Stat(p.lockPath()); err == nil {
+		localSources = append(localSources, p.lockPath())
+	}
+	werror := append(append([]string{}, p.manifest.Diagnostics.Werror...), opts.werror...)
+	// Units are compiled in parallel, but their results are gathered in
+	// order so that the output does not depend on scheduling.
+	results := make([]unitResult, len(units))
+	var stale []int
+	endCheck := traceSpan("cache", "check objects", map[string]any{"units": len(units)})
+	for i, unit := range units {
+		obj := p.objectPath(out, unit)
+		if upToDate(target.objectFile(obj), append(includeClosure(unit), localSources...)) {
+			results[i].written = target.objectFile(obj)
+			continue
+		}
+		stale = append(stale, i)
+	}
+	endCheck()
+	if len(stale) > 0 {
+		// Any repair of the toolchain happens before the workers start.
+		if err := ensureTools("preprocessor", "plsa", "compiler"); err != nil {
+			return "", err
+		}
+		stopPool := func() {}
+		if len(stale) > 1 {
+			// Tools that can keep running between files save their
+			// startup on every file but the first.
+			stopPool = startToolPool()
+		}
+		p.compileUnits(out, target, units, stale, results, includeDirs, opts)
+		stopPool()
+	}
+
+	var objs []string
+	// A unit that fails to compile does not stop the others, so that
+	// problems they share can be reported once. Warnings are reported after
+	// all units are compiled, and only fail the build when promoted.
+	var failed []*diagnosticsError
+	var warnings []diagnostic
+	for i, unit := range units {
+		r := results[i]
+		if r.err != nil {
+			var diagErr *diagnosticsError
+			if err := compileError(unit, r.err); !errors.As(err, &diagErr) {
+				return "", err
+			}
+			promoteWarnings(diagErr.diags, werror)
+			failed = append(failed, diagErr)
+			continue
+		}
+		promoteWarnings(r.warnings, werror)
+		if hasErrors(r.warnings) {
+			failed = append(failed, &diagnosticsError{files: []string{unit}, diags: r.warnings})
+			continue
+		}
+		warnings = append(warnings, r.warnings...)
+		objs = append(objs, r.written)
+	}
+	if len(failed) > 0 {
+		if len(warnings) > 0 {
+			failed = append(failed, &diagnosticsError{diags: warnings})
+		}
+		merged := mergeDiagnosticsErrors(failed)
+		logDiagnostics(merged.diags)
+		return "", merged
+	}
+	if warnings = diagnostics.Dedup(warnings); len(warnings) > 0 {
+		logDiagnostics(warnings)
+		if opts.warned != nil {
+			opts.warned(warnings)
+		} else {
+			printDiagnostics(warnings)
+			if errorFormat == errorFormatHuman {
+				pterm.Warning.Println(i18n.T("%s emitted", diagnostics.Summary(warnings)))
+			}
+		}
+	}
+
+	exe := p.executable(out, target)
+	flags, err := opts.linkFlags(target)
+	if err != nil {
+		return "", err
+	}
+	if target != nil {
+		err = linkCross(target, objs, exe, flags...)
+	} else {
+		err = linkExecutable(objs, exe, flags...)
+	}
+	if err != nil {
+		return "", err
+	}
+	if cfg := p.signing(opts.profile()); cfg != nil && opts.sign {
+		if err := p.signExecutable(cfg, target, exe); err != nil {
+			return "", err
+		}
+	}
+	for _, format := range opts.emit {
+		if err := writeImage(target, exe, format); err != nil {
+			return "", err
+		}
+	}
+	return exe, nil
+}
+
+// linkFlags returns the flags for the linker of target that opts ask for.
+func (o buildOptions) linkFlags(target *crossTarget) ([]string, error) {
+	// Only link.exe does not take the flags of a C compiler.
+	msvc := target == nil && runtime.GOOS == "windows"
+	var flags []string
+	if o.debugInfo {
+		if target == nil {
+			flags = debugLinkFlags()
+		} else {
+			flags = []string{"-g"}
+		}
+	}
+	if o.reproducible && msvc {
+		// link.exe writes a timestamp unless told otherwise.
+		flags = append(flags, "/Brepro")
+	}
+	if o.noStd || target.bareMetal() {
+		if msvc {
+			flags = append(flags, "/NODEFAULTLIB")
+		} else {
+			flags = append(flags, "-nostdlib")
+		}
+	}
+	if o.linkerScript != "" {
+		if msvc {
+			return nil, errors.New("link.exe takes no linker script; --linker-script needs gcc, clang or a --target linked with zig cc")
+		}
+		script, err := filepath.Abs(o.linkerScript)
+		if err != nil {
+			return nil, err
+		}
+		flags = append(flags, "-T", script)
+	}
+	return flags, nil
+}
+
+// unitResult is the outcome of compiling a unit: the object written, or
+// the error, and the warnings.
+type unitResult struct {
+	written  string
+	warnings []diagnostic
+	err      error
+}
+
+// compileUnits compiles units[i] into results[i] for every i in stale, for
+// target.
+// The stages of the files are scheduled one by one, up to opts.jobs at
+// once, so that the compiler can work on one file while another is still
+// being preprocessed; later stages go first, which finishes objects, and
+// reports their errors, as early as possible. Under a make jobserver, every
+// stage running but one also needs one of its tokens.
+func (p *project) compileUnits(out string, target *crossTarget, units []string, stale []int, results []unitResult, includeDirs []string, opts buildOptions) {
+	// js is nil once the jobserver fails, while server still takes back the
+	// tokens read from it.
+	js := jobServerFromEnv()
+	server := js
+	jobs := opts.jobs
+	switch {
+	case jobs > 0:
+	case js != nil:
+		// The jobserver bounds the jobs of everything make runs.
+		jobs = len(stale)
+	default:
+		jobs = runtime.NumCPU()
+	}
+	defer traceParallel()()
+
+	type task struct {
+		unit, stage int
+	}
+	type finished struct {
+		task
+		release func()
+		err     error
+	}
+	builds := make([]*objectBuild, len(units))
+	var ready []task
+	for _, i := range stale {
+		ready = append(ready, task{unit: i})
+	}
+	done := make(chan finished, jobs)
+	running := 0
+	// implicit is the job vira may run without a token. Tokens are read in
+	// the background, so that jobs can give theirs back meanwhile, and held
+	// until a job takes them.
+	implicit := true
+	type acquisition struct {
+		token byte
+		err   error
+	}
+	acquired := make(chan acquisition, 1)
+	acquiring := false
+	var held []byte
+	for len(ready) > 0 || running > 0 {
+		for len(ready) > 0 && running < jobs {
+			var release func()
+			switch {
+			case implicit:
+				implicit = false
+				release = func() { implicit = true }
+			case len(held) > 0:
+				token := held[len(held)-1]
+				held = held[:len(held)-1]
+				release = func() { server.release(token) }
+			case js == nil:
+				// Without a jobserver, -j alone bounds the jobs.
+				release = func() {}
+			case !acquiring:
+				acquiring = true
+				go func() {
+					token, err := js.acquire()
+					acquired <- acquisition{token, err}
+				}()
+			}
+			if release == nil {
+				break
+			}
+			next := 0
+			for k, t := range ready {
+				if t.stage > ready[next].stage || t.stage == ready[next].stage && t.unit < ready[next].unit {
+					next = k
+				}
+			}
+			t := ready[next]
+			ready = append(ready[:next], ready[next+1:]...)
+			if t.stage == 0 {
+				unit := units[t.unit]
+				if opts.compiling != nil {
+					opts.compiling(unit, t.unit, len(units))
+				} else {
+					pterm.Info.Println(i18n.T("Compiling %s", p.rel(unit)))
+				}
+			}
+			running++
+			go func(t task, release func()) {
+				var err error
+				if t.stage == 0 {
+					builds[t.unit], err = newObjectBuild(units[t.unit], p.objectPath(out, units[t.unit]), includeDirs...)
+					if err == nil {
+						builds[t.unit].target = target
+					}
+				}
+				if err == nil {
+					err = builds[t.unit].stage(t.stage)
+				}
+				done <- finished{t, release, err}
+			}(t, release)
+		}
+
+		select {
+		case a := <-acquired:
+			acquiring = false
+			if a.err != nil {
+				// The jobs running on tokens already acquired finish, but
+				// no more are started.
+				logf("the make jobserver failed; compiling one file at a time: %v", a.err)
+				js, jobs = nil, 1
+				continue
+			}
+			held = append(held, a.token)
+		case f := <-done:
+			running--
+			f.release()
+			r := &results[f.unit]
+			switch {
+			case f.err != nil:
+				r.err = f.err
+			case f.stage+1 < objectStages:
+				ready = append(ready, task{unit: f.unit, stage: f.stage + 1})
+			default:
+				r.written, r.warnings = builds[f.unit].written(), builds[f.unit].warnings
+			}
+		}
+	}
+	// Every token goes back to make, including one still being read.
+	if acquiring {
+		server.interrupt()
+		if a := <-acquired; a.err == nil {
+			held = append(held, a.token)
+		}
+	}
+	for _, token := range held {
+		server.release(token)
+	}
+}
+
+// hasErrors reports whether any of diags is an error.
+func hasErrors(diags []diagnostic) bool {
+	for _, d := range diags {
+		if d.Severity == diagnostics.Error {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *project) rel(path string) string {
+	if rel, err := filepath.Rel(p.root, path); err == nil {
+		return rel
+	}
+	return path
+}
+
+func debugLinkFlags() []string {
+	if runtime.GOOS == "windows" {
+		return []string{"/DEBUG"}
+	}
+	return []string{"-g"}
+}
+
+// upToDate reports whether target exists and is newer than all of sources.
+func upToDate(target string, sources []string) bool {
+	info, err := os.Stat(target)
+	if err != nil {
+		return false
+	}
+	for _, src := range sources {
+		srcInfo, err := os.Stat(src)
+		if err != nil || srcInfo.ModTime().After(info.ModTime()) {
+			return false
+		}
+	}
+	return true
+}
+
+// localIncludes returns the absolute paths of the files that file pulls in
+// with #include "...". System includes (<...>) are not followed.
+func localIncludes(file string) []string {
+	var includes []string
+	for _, inc := range sourceIncludes(file) {
+		if !inc.system {
+			includes = append(includes, filepath.Join(filepath.Dir(file), inc.name))
+		}
+	}
+	return includes
+}
+
+// parseInclude recognizes a preprocessor include line the way the
+// preprocessor does.
+func parseInclude(line string) (name string, system bool, ok bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "#") {
+		return "", false, false
+	}
+	rest := strings.TrimSpace(line[1:])
+	if !strings.HasPrefix(rest, "include") {
+		return "", false, false
+	}
+	rest = strings.TrimSpace(rest[len("include"):])
+	if len(rest) < 2 {
+		return "", false, false
+	}
+	closing := byte('"')
+	if rest[0] == '<' {
+		closing = '>'
+	} else if rest[0] != '"' {
+		return "", false, false
+	}
+	end := strings.IndexByte(rest[1:], closing)
+	if end < 0 {
+		return "", false, false
+	}
+	return rest[1 : end+1], closing == '>', true
+}
+
+// includeClosure returns file together with everything it includes,
+// transitively.
+func includeClosure(file string) []string {
+	seen := map[string]bool{}
+	var walk func(string)
+	walk = func(f string) {
+		if seen[f] {
+			return
+		}
+		seen[f] = true
+		for _, inc := range localIncludes(f) {
+			walk(inc)
+		}
+	}
+	walk(file)
+	files := make([]string, 0, len(seen))
+	for f := range seen {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return files
+}
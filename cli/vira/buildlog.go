@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"vira/pkg/logging"
+)
+
+// buildLog records, when vira build runs with --log-file, every tool run
+// with its duration and full output and every diagnostic, independent of
+// what the terminal shows, for looking into failed builds afterwards.
+var buildLog *log.Logger
+
+// openBuildLog starts logging to path, replacing an earlier log, and
+// returns the function that closes it.
+func openBuildLog(path string) (func() error, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	buildLog = log.New(f, "", log.Ldate|log.Ltime|log.Lmicroseconds)
+	return func() error {
+		buildLog = nil
+		return f.Close()
+	}, nil
+}
+
+// logf writes a line to the build log, if there is one, and logs it at the
+// debug level. Continuation lines of a multi-line message are indented.
+func logf(format string, args ...any) {
+	if buildLog == nil && !logging.Enabled(slog.LevelDebug) {
+		return
+	}
+	msg := strings.TrimRight(fmt.Sprintf(format, args...), "\n")
+	logging.Debug(msg)
+	if buildLog != nil {
+		buildLog.Print(strings.ReplaceAll(msg, "\n", "\n    "))
+	}
+}
+
+// logDiagnostics writes diags to the build log, one per line.
+func logDiagnostics(diags []diagnostic) {
+	for _, d := range diags {
+		logf("%s", d)
+		for _, note := range d.Notes {
+			logf("  note: %s", note)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"vira/pkg/diagnostics"
+	"vira/pkg/logging"
+)
+
+func newBuildServerCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "build-server",
+		Short: "Run a build server for IDEs over stdio",
+		Long: `Run a build server over stdio, speaking the JSON-RPC of the Build Server
+Protocol so that IDEs can drive builds without parsing the output of vira
+build.
+
+The server offers the debug and release builds of the project in the
+working directory as build targets. It answers build/initialize,
+workspace/buildTargets, buildTarget/sources and buildTarget/compile, and
+while compiling sends build/taskStart, build/taskProgress, build/taskFinish
+and build/publishDiagnostics notifications.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			// stdout carries the protocol, so whatever the build prints
+			// goes to stderr.
+			pterm.SetDefaultOutput(os.Stderr)
+			server := &buildServer{conn: newRPCConn(os.Stdin, os.Stdout), published: map[string]bool{}}
+			if err := server.serve(); err != nil {
+				logging.Error("build server failed", "err", err)
+				exit(1)
+			}
+			if !server.shutdown {
+				exit(1)
+			}
+		},
+	}
+}
+
+type buildServer struct {
+	conn     *rpcConn
+	proj     *project
+	shutdown bool
+	// published holds the files diagnostics were last published for, which
+	// are cleared by the next compilation.
+	published map[string]bool
+	// tasks numbers the tasks reported to the client.
+	tasks int
+}
+
+// BSP types, limited to the fields the server uses.
+
+type bspTargetID struct {
+	URI string `json:"uri"`
+}
+
+type bspTaskID struct {
+	ID string `json:"id"`
+}
+
+const (
+	bspStatusOK    = 1
+	bspStatusError = 2
+)
+
+func (s *buildServer) serve() error {
+	for {
+		msg, err := s.conn.read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		var req rpcRequest
+		if err := json.Unmarshal(msg, &req); err != nil {
+			s.conn.write(rpcErrorResponse{JSONRPC: "2.0", Error: rpcError{Code: rpcParseError, Message: err.Error()}})
+			continue
+		}
+		if req.Method == "build/exit" {
+			return nil
+		}
+		result, err := s.handle(req)
+		if req.ID == nil {
+			if err != nil {
+				logging.Error("notification failed", "method", req.Method, "err", err)
+			}
+			continue
+		}
+		if err != nil {
+			var rpcErr *rpcError
+			if !errors.As(err, &rpcErr) {
+				rpcErr = &rpcError{Code: rpcInternalError, Message: err.Error()}
+			}
+			s.conn.write(rpcErrorResponse{JSONRPC: "2.0", ID: req.ID, Error: *rpcErr})
+			continue
+		}
+		s.conn.write(rpcResponse{JSONRPC: "2.0", ID: req.ID, Result: result})
+	}
+}
+
+func (s *buildServer) handle(req rpcRequest) (any, error) {
+	switch req.Method {
+	case "build/initialize":
+		proj, err := loadProject(".")
+		if err != nil {
+			return nil, err
+		}
+		s.proj = proj
+		return map[string]any{
+			"displayName": "vira",
+			"version":     toolchainVersion(),
+			"bspVersion":  "2.1.0",
+			"capabilities": map[string]any{
+				"compileProvider": map[string]any{"languageIds": []string{"vira"}},
+			},
+		}, nil
+	case "build/initialized":
+		return nil, nil
+	case "build/shutdown":
+		s.shutdown = true
+		return nil, nil
+	}
+	if s.proj == nil {
+		return nil, &rpcError{Code: rpcInvalidRequest, Message: "the server is not initialized"}
+	}
+	switch req.Method {
+	case "workspace/buildTargets":
+		var targets []map[string]any
+		for _, profile := range []string{"debug", "release"} {
+			targets = append(targets, map[string]any{
+				"id":            s.targetID(profile),
+				"displayName":   fmt.Sprintf("%s (%s)", s.proj.manifest.Package.Name, profile),
+				"baseDirectory": pathToURI(s.proj.root),
+				"tags":          []string{"application"},
+				"languageIds":   []string{"vira"},
+				"dependencies":  []bspTargetID{},
+				"capabilities":  map[string]any{"canCompile": true, "canTest": false, "canRun": false, "canDebug": false},
+			})
+		}
+		return map[string]any{"targets": targets}, nil
+	case "buildTarget/sources":
+		var params struct {
+			Targets []bspTargetID `json:"targets"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		files, err := s.proj.sourceFiles()
+		if err != nil {
+			return nil, err
+		}
+		items := []map[string]any{}
+		for _, target := range params.Targets {
+			sources := []map[string]any{}
+			for _, file := range files {
+				sources = append(sources, map[string]any{"uri": pathToURI(file), "kind": 1, "generated": false})
+			}
+			items = append(items, map[string]any{"target": target, "sources": sources})
+		}
+		return map[string]any{"items": items}, nil
+	case "buildTarget/compile":
+		var params struct {
+			Targets  []bspTargetID `json:"targets"`
+			OriginID string        `json:"originId,omitempty"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		status := bspStatusOK
+		for _, target := range params.Targets {
+			profile, err := s.targetProfile(target)
+			if err != nil {
+				return nil, err
+			}
+			if !s.compile(target, profile, params.OriginID) {
+				status = bspStatusError
+			}
+		}
+		return map[string]any{"originId": params.OriginID, "statusCode": status}, nil
+	}
+	if req.ID == nil {
+		return nil, nil
+	}
+	return nil, &rpcError{Code: rpcMethodNotFound, Message: "method not supported: " + req.Method}
+}
+
+// targetID names the build of the project with profile.
+func (s *buildServer) targetID(profile string) bspTargetID {
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(s.proj.root), RawQuery: "profile=" + profile}
+	return bspTargetID{URI: u.String()}
+}
+
+func (s *buildServer) targetProfile(target bspTargetID) (string, error) {
+	for _, profile := range []string{"debug", "release"} {
+		if s.targetID(profile) == target {
+			return profile, nil
+		}
+	}
+	return "", &rpcError{Code: rpcInvalidParams, Message: "unknown build target " + target.URI}
+}
+
+// compile builds target with profile, reporting its progress and
+// diagnostics to the client, and returns whether it succeeded.
+func (s *buildServer) compile(target bspTargetID, profile, originID string) bool {
+	s.tasks++
+	task := bspTaskID{ID: fmt.Sprint(s.tasks)}
+	s.notify("build/taskStart", map[string]any{
+		"taskId":  task,
+		"message": fmt.Sprintf("Building %s (%s)", s.proj.manifest.Package.Name, profile),
+	})
+	var diags []diagnostic
+	opts := buildOptions{
+		release: profile == "release",
+		compiling: func(unit string, i, units int) {
+			s.notify("build/taskProgress", map[string]any{
+				"taskId":   task,
+				"message":  "Compiling " + s.proj.rel(unit),
+				"progress": i,
+				"total":    units,
+				"unit":     "files",
+			})
+		},
+		warned: func(warnings []diagnostic) { diags = warnings },
+	}
+	_, err := s.proj.build(opts)
+	var diagErr *diagnosticsError
+	if errors.As(err, &diagErr) {
+		diags = diagErr.diags
+	}
+	s.publish(target, originID, diags)
+
+	status, message := bspStatusOK, "Built "+s.proj.manifest.Package.Name
+	if err != nil {
+		status = bspStatusError
+		message = err.Error()
+		if diagErr != nil {
+			message = diagnostics.Summary(diagErr.diags)
+		}
+	}
+	s.notify("build/taskFinish", map[string]any{"taskId": task, "status": status, "message": message})
+	return err == nil
+}
+
+// publish sends the diagnostics of a compilation by file, and clears those
+// of files that have none anymore.
+func (s *buildServer) publish(target bspTargetID, originID string, diags []diagnostic) {
+	byFile := map[string][]lspDiagnostic{}
+	for _, d := range diags {
+		path, err := filepath.Abs(d.File)
+		if err != nil {
+			continue
+		}
+		var text string
+		if data, err := os.ReadFile(path); err == nil {
+			text = string(data)
+		}
+		byFile[path] = append(byFile[path], toLSPDiagnostic(d, text))
+	}
+	for path := range s.published {
+		if byFile[path] == nil {
+			byFile[path] = []lspDiagnostic{}
+		}
+	}
+	s.published = map[string]bool{}
+	for _, path := range sortedKeys(byFile) {
+		if len(byFile[path]) > 0 {
+			s.published[path] = true
+		}
+		s.notify("build/publishDiagnostics", map[string]any{
+			"textDocument": map[string]any{"uri": pathToURI(path)},
+			"buildTarget":  target,
+			"originId":     originID,
+			"diagnostics":  byFile[path],
+			"reset":        true,
+		})
+	}
+}
+
+func (s *buildServer) notify(method string, params any) {
+	s.conn.write(rpcNotification{JSONRPC: "2.0", Method: method, Params: params})
+}
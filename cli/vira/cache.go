@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"vira/pkg/interrupt"
+	"vira/pkg/logging"
+)
+
+// The source cache, below cacheDir, is shared by all projects and keyed by
+// content:
+//
+//	store/<sha256>/<file>   downloaded package sources
+//	extracted/<sha256>/     unpacked tarball packages
+//	sources/<url hash>      the sha256 last downloaded from a URL
+//
+// Entries are verified against their hash whenever they are used, and are
+// populated under a file lock so that concurrent builds do not race.
+
+func newCacheCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:         "cache",
+		Annotations: map[string]string{skipToolchain: "true"},
+		Short:       "Manage the cache of downloaded sources",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "clean",
+		Short: "Delete the cache of downloaded sources and indexes",
+		Long: `Delete the cache of downloaded package sources and indexes. They are
+downloaded again when a build needs them, unless offline mode is on.
+
+The command asks before deleting anything; without a terminal, it only
+deletes the cache with --yes.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := cleanCache(); err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+		},
+	})
+	return cmd
+}
+
+func cleanCache() error {
+	dir, err := cacheDir()
+	if err != nil {
+		return err
+	}
+	size, err := dirSize(dir)
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		pterm.Info.Println("The cache is empty")
+		return nil
+	}
+	if !confirm(fmt.Sprintf("Delete the cache in %s (%s)?", displayPath(dir), formatSize(size)), false) {
+		return errors.New("the cache was left in place (use --yes to delete it without asking)")
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	pterm.Success.Printfln("Deleted %s from the cache", formatSize(size))
+	return nil
+}
+
+// staleLockAge is how old a lock file must be before it is assumed to have
+// been left behind by a process that died. The holder of a lock touches it
+// every lockRefresh, however long it holds it.
+const (
+	staleLockAge = 10 * time.Minute
+	lockRefresh  = time.Minute
+)
+
+// lockPath takes an exclusive lock for populating target, waiting while
+// another process holds it. The returned function releases the lock.
+func lockPath(target string) (func(), error) {
+	lock := target + ".lock"
+	if err := os.MkdirAll(filepath.Dir(lock), 0755); err != nil {
+		return nil, err
+	}
+	waiting := false
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			done := interrupt.Cleanup(func() { os.Remove(lock) })
+			stop, stopped := make(chan struct{}), make(chan struct{})
+			go func() {
+				defer close(stopped)
+				ticker := time.NewTicker(lockRefresh)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-stop:
+						return
+					case now := <-ticker.C:
+						os.Chtimes(lock, now, now)
+					}
+				}
+			}()
+			return func() {
+				close(stop)
+				<-stopped
+				os.Remove(lock)
+				done()
+			}, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if info, err := os.Stat(lock); err == nil && time.Since(info.ModTime()) > staleLockAge {
+			os.Remove(lock)
+			continue
+		}
+		if !waiting {
+			pterm.Info.Printfln("Waiting for the lock on %s", lock)
+			waiting = true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// cacheSubdir returns a path below the cache. Parts that would lead out of
+// it are an error, since callers may remove what they find there.
+func cacheSubdir(parts ...string) (string, error) {
+	cache, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(append([]string{cache}, parts...)...)
+	if rel, err := filepath.Rel(cache, dir); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid cache path %q", filepath.Join(parts...))
+	}
+	return dir, nil
+}
+
+// isSHA256 reports whether s is a SHA-256 as the cache writes it: 64
+// lowercase hex digits.
+func isSHA256(s string) bool {
+	return len(s) == 64 && isLowerHex(s)
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if (s[i] < '0' || s[i] > '9') && (s[i] < 'a' || s[i] > 'f') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// storedFile returns the cached file with the given hash. A file whose
+// contents no longer match is removed and reported as missing.
+func storedFile(hash string) (string, bool) {
+	if !isSHA256(hash) {
+		return "", false
+	}
+	dir, err := cacheSubdir("store", hash)
+	if err != nil {
+		return "", false
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", false
+	}
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		file := filepath.Join(dir, e.Name())
+		if sum, err := fileHash(file); err == nil && sum == hash {
+			return file, true
+		}
+		logging.Warn("removing corrupted cache entry", "file", file)
+		os.RemoveAll(dir)
+		return "", false
+	}
+	return "", false
+}
+
+// storeFile adds data to the cache under its hash and returns its path.
+func storeFile(name string, data []byte) (string, string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	dir, err := cacheSubdir("store", hash)
+	if err != nil {
+		return "", "", err
+	}
+	unlock, err := lockPath(dir)
+	if err != nil {
+		return "", "", err
+	}
+	defer unlock()
+	if file, ok := storedFile(hash); ok {
+		return file, hash, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", "", err
+	}
+	// Write under a temporary name and rename, so readers never see a
+	// partial file.
+	file := filepath.Join(dir, name)
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return "", "", err
+	}
+	defer interrupt.Cleanup(func() { os.Remove(tmp.Name()) })()
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", "", err
+	}
+	return file, hash, nil
+}
+
+func sourceIndexPath(source string) (string, error) {
+	sum := sha256.Sum256([]byte(source))
+	return cacheSubdir("sources", hex.EncodeToString(sum[:16]))
+}
+
+// cachedPackage returns the path of the package's source in the cache,
+// downloading it first if needed. Packages with a checksum are looked up by
+// it and must match it; others are looked up by the hash last downloaded
+// from their source.
+func cachedPackage(pkg lockedPackage) (string, error) {
+	index, err := sourceIndexPath(pkg.Source)
+	if err != nil {
+		return "", err
+	}
+	if pkg.Checksum != "" && !isSHA256(pkg.Checksum) {
+		return "", fmt.Errorf("invalid checksum %q for %s v%s", pkg.Checksum, pkg.Name, pkg.Version)
+	}
+	hash := pkg.Checksum
+	if hash == "" {
+		if data, err := os.ReadFile(index); err == nil {
+			hash = strings.TrimSpace(string(data))
+		}
+	}
+	endLookup := traceSpan("cache", "lookup "+pkg.Name, map[string]any{"version": pkg.Version})
+	if hash != "" {
+		if file, ok := storedFile(hash); ok {
+			endLookup()
+			return file, nil
+		}
+	}
+	endLookup()
+	if offlineMode() {
+		return "", offlineError(fmt.Sprintf("%s v%s is not in the download cache; downloading it", pkg.Name, pkg.Version))
+	}
+
+	pterm.Info.Printfln("Downloading %s v%s", pkg.Name, pkg.Version)
+	data, err := readLocation(pkg.Source)
+	if err != nil {
+		return "", fmt.Errorf("failed to download %s v%s from %s: %v", pkg.Name, pkg.Version, pkg.Source, err)
+	}
+	// Check the download before it goes into the cache, where it would be
+	// found by its own hash.
+	if sum := sha256.Sum256(data); pkg.Checksum != "" && hex.EncodeToString(sum[:]) != pkg.Checksum {
+		return "", fmt.Errorf("checksum mismatch for %s v%s: %s has %s, but %s expects %s", pkg.Name, pkg.Version, pkg.Source, hex.EncodeToString(sum[:]), lockfileName, pkg.Checksum)
+	}
+	file, sum, err := storeFile(path.Base(filepath.ToSlash(pkg.Source)), data)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(index), 0755); err == nil {
+		os.WriteFile(index, []byte(sum+"\n"), 0644)
+	}
+	return file, nil
+}
+
+func isTarball(name string) bool {
+	return strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz")
+}
+
+// packageSourceDir returns the include directory of a registry package:
+// the directory of a single-file package, or the sources of a tarball
+// package, which is extracted into the cache once and verified against its
+// hash before every extraction.
+func packageSourceDir(pkg lockedPackage) (string, error) {
+	file, err := cachedPackage(pkg)
+	if err != nil {
+		return "", err
+	}
+	if !isTarball(file) {
+		return filepath.Dir(file), nil
+	}
+	hash := filepath.Base(filepath.Dir(file))
+	if !isSHA256(hash) {
+		return "", fmt.Errorf("cached archive of %s v%s is not in the store: %s", pkg.Name, pkg.Version, file)
+	}
+	dir, err := cacheSubdir("extracted", hash)
+	if err != nil {
+		return "", err
+	}
+	if root, ok := extractedRoot(dir); ok {
+		return packageIncludeDir(root), nil
+	}
+
+	unlock, err := lockPath(dir)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	if root, ok := extractedRoot(dir); ok {
+		return packageIncludeDir(root), nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != hash {
+		os.RemoveAll(filepath.Dir(file))
+		return "", fmt.Errorf("cached archive of %s v%s is corrupted and was removed; run the command again to download it", pkg.Name, pkg.Version)
+	}
+	tmp := dir + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return "", err
+	}
+	if _, err := extractTarball(data, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return "", fmt.Errorf("%s v%s: %v", pkg.Name, pkg.Version, err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return "", err
+	}
+	root, _ := extractedRoot(dir)
+	return packageIncludeDir(root), nil
+}
+
+// extractedRoot finds the project in an extracted package: dir itself or
+// the single directory the tarball was packed under.
+func extractedRoot(dir string) (string, bool) {
+	if _, err := os.Stat(filepath.Join(dir, manifestName)); err == nil {
+		return dir, true
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "*", manifestName))
+	if len(matches) == 1 {
+		return filepath.Dir(matches[0]), true
+	}
+	return "", false
+}
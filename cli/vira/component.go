@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+// componentManifest is components.json, which a release that is split into
+// components publishes next to a <component>-<os>.zip archive for each of
+// them. The toolchain directory keeps a copy that records what is
+// installed.
+type componentManifest struct {
+	Components []toolchainComponent `json:"components"`
+}
+
+type toolchainComponent struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Files are the binaries the component provides, without .exe.
+	Files []string `json:"files"`
+	// Default components are installed unless others are asked for.
+	Default   bool `json:"default,omitempty"`
+	Installed bool `json:"installed,omitempty"`
+}
+
+func fetchComponentManifest(version string) (*componentManifest, error) {
+	data, err := readLocation(toolchainReleaseURL(version, "components.json"))
+	if err != nil {
+		return nil, err
+	}
+	var m componentManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid components.json of toolchain %s: %v", version, err)
+	}
+	return &m, nil
+}
+
+func (m *componentManifest) lookup(name string) *toolchainComponent {
+	for i := range m.Components {
+		if m.Components[i].Name == name {
+			return &m.Components[i]
+		}
+	}
+	return nil
+}
+
+func (m *componentManifest) names() string {
+	var names []string
+	for _, c := range m.Components {
+		names = append(names, c.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// install installs the named components, or the default ones if names is
+// nil, of toolchain version into dir, and records them there.
+func (m *componentManifest) install(version, dir string, names []string) error {
+	if names == nil {
+		for _, c := range m.Components {
+			if c.Default {
+				names = append(names, c.Name)
+			}
+		}
+	}
+	var archives []string
+	for _, name := range names {
+		if m.lookup(name) == nil {
+			return fmt.Errorf("toolchain %s has no component %s (available: %s)", version, name, m.names())
+		}
+		archives = append(archives, name+"-"+runtime.GOOS+".zip")
+	}
+	pterm.Info.Printfln("Downloading components %s of toolchain %s", strings.Join(names, ", "), version)
+	data, err := downloadReleases(version, archives)
+	if err != nil {
+		return fmt.Errorf("failed to download the components of toolchain %s: %v", version, err)
+	}
+	for i, name := range names {
+		sums, err := unzipToolchain(data[i], filepath.Join(dir, "bin"))
+		if err == nil {
+			err = recordFiles(dir, sums)
+		}
+		if err != nil {
+			return fmt.Errorf("component %s: %v", name, err)
+		}
+		m.lookup(name).Installed = true
+	}
+	return m.save(dir)
+}
+
+func (m *componentManifest) save(dir string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "components.json"), append(data, '\n'), 0644)
+}
+
+// installedComponents loads the component record of an installed toolchain.
+func installedComponents(version string) (*componentManifest, string, error) {
+	dir, err := toolchainDir(version)
+	if err != nil {
+		return nil, "", err
+	}
+	if !toolchainInstalled(version) {
+		return nil, "", fmt.Errorf("toolchain %s is not installed", version)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "components.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "", fmt.Errorf("toolchain %s was installed as a whole and has no separate components", version)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	var m componentManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, "", fmt.Errorf("invalid %s: %v", filepath.Join(dir, "components.json"), err)
+	}
+	return &m, dir, nil
+}
+
+// missingComponent names the component of the active toolchain that
+// provides tool, if that component is not installed.
+func missingComponent(tool string) (string, bool) {
+	version := activeToolchain()
+	if version == "" {
+		return "", false
+	}
+	m, _, err := installedComponents(version)
+	if err != nil {
+		return "", false
+	}
+	for _, c := range m.Components {
+		if !c.Installed && containsString(c.Files, tool) {
+			return c.Name, true
+		}
+	}
+	return "", false
+}
+
+func newComponentCmd() *cobra.Command {
+	var toolchain string
+
+	cmd := &cobra.Command{
+		Use:   "component",
+		Short: "Add or remove components of a toolchain",
+		Long: `Add or remove components of the active toolchain, or of the one given with
+--toolchain, such as only the preprocessor and plsa needed for vira check on
+a CI runner. Only toolchains whose release is split into components, as
+described by its components.json, support this.`,
+	}
+	cmd.PersistentFlags().StringVar(&toolchain, "toolchain", "", "toolchain version to change instead of the active one")
+	target := func() (*componentManifest, string, string) {
+		version := toolchain
+		if version == "" {
+			version = activeToolchain()
+		}
+		if version == "" {
+			pterm.Error.Println("the system toolchain has no components; install one with vira toolchain install")
+			exit(1)
+		}
+		m, dir, err := installedComponents(version)
+		if err != nil {
+			pterm.Error.Println(err)
+			exit(1)
+		}
+		return m, dir, version
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:     "list",
+		Aliases: []string{"ls"},
+		Short:   "List the components of a toolchain",
+		Args:    cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			m, _, _ := target()
+			if jsonOutput {
+				if err := printJSON(m.Components); err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+				return
+			}
+			data := pterm.TableData{{"Component", "Installed", "Description"}}
+			for _, c := range m.Components {
+				installed := "no"
+				if c.Installed {
+					installed = "yes"
+				}
+				data = append(data, []string{c.Name, installed, c.Description})
+			}
+			pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "add <component>...",
+		Short: "Install components",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			m, dir, version := target()
+			if offlineMode() {
+				pterm.Error.Println(offlineError("adding components"))
+				exit(1)
+			}
+			unlock, err := lockPath(dir)
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			defer unlock()
+			if err := m.install(version, dir, args); err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			pterm.Success.Printfln("Added %s to toolchain %s", strings.Join(args, ", "), version)
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:     "remove <component>...",
+		Aliases: []string{"rm"},
+		Short:   "Remove installed components",
+		Args:    cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			m, dir, version := target()
+			unlock, err := lockPath(dir)
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			defer unlock()
+			var removed []string
+			for _, name := range args {
+				c := m.lookup(name)
+				if c == nil || !c.Installed {
+					pterm.Error.Printfln("component %s is not installed in toolchain %s", name, version)
+					exit(1)
+				}
+				for _, f := range c.Files {
+					err := os.Remove(filepath.Join(dir, "bin", executableName(f)))
+					if err != nil && !errors.Is(err, os.ErrNotExist) {
+						pterm.Error.Println(err)
+						exit(1)
+					}
+					removed = append(removed, executableName(f))
+				}
+				c.Installed = false
+			}
+			if err := forgetFiles(dir, removed); err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			if err := m.save(dir); err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			pterm.Success.Printfln("Removed %s from toolchain %s", strings.Join(args, ", "), version)
+		},
+	})
+	return cmd
+}
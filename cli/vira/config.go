@@ -0,0 +1,342 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+// globalConfig is config.toml in the config directory (~/.config/vira on
+// Linux, ~/.vira elsewhere), the user's settings for all projects.
+type globalConfig struct {
+	// Registries are alternative package registries by name, which
+	// dependencies select with registry = "<name>".
+	Registries map[string]registryConfig `toml:"registries"`
+	// Offline disables network access, like --offline.
+	Offline bool `toml:"offline"`
+	// AssumeYes answers questions with yes, like --yes.
+	AssumeYes bool            `toml:"assume-yes,omitempty"`
+	Editor    editorConfig    `toml:"editor"`
+	Telemetry telemetryConfig `toml:"telemetry"`
+}
+
+// editorConfig is the [editor] section.
+type editorConfig struct {
+	// URLTemplate is the URL that locations in diagnostics link to, with
+	// {file}, {line} and {column} replaced, such as
+	// "vscode://file/{file}:{line}:{column}". By default they link to the
+	// file:// URL of the file.
+	URLTemplate string `toml:"url-template,omitempty"`
+}
+
+// telemetryConfig is the [telemetry] section, which vira telemetry on and
+// off change.
+type telemetryConfig struct {
+	// Enabled records usage telemetry locally.
+	Enabled bool `toml:"enabled,omitempty"`
+	// UploadURL is where vira telemetry upload sends the recorded events.
+	UploadURL string `toml:"upload-url,omitempty"`
+}
+
+// configSetting is a value of config.toml that vira config reads and
+// writes.
+type configSetting struct {
+	table, key string
+	boolean    bool
+	get        func(*globalConfig) string
+}
+
+// configSettings are the settings vira config knows, by dotted name.
+var configSettings = map[string]configSetting{
+	"offline": {
+		key:     "offline",
+		boolean: true,
+		get:     func(c *globalConfig) string { return strconv.FormatBool(c.Offline) },
+	},
+	"assume-yes": {
+		key:     "assume-yes",
+		boolean: true,
+		get:     func(c *globalConfig) string { return strconv.FormatBool(c.AssumeYes) },
+	},
+	"editor.url-template": {
+		table: "editor",
+		key:   "url-template",
+		get:   func(c *globalConfig) string { return c.Editor.URLTemplate },
+	},
+	"telemetry.enabled": {
+		table:   "telemetry",
+		key:     "enabled",
+		boolean: true,
+		get:     func(c *globalConfig) string { return strconv.FormatBool(c.Telemetry.Enabled) },
+	},
+	"telemetry.upload-url": {
+		table: "telemetry",
+		key:   "upload-url",
+		get:   func(c *globalConfig) string { return c.Telemetry.UploadURL },
+	},
+}
+
+func newConfigCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:         "config",
+		Annotations: map[string]string{skipToolchain: "true"},
+		Short:       "Read and change the global configuration",
+		Long: `Read and change settings of config.toml in the configuration directory.
+
+Settings:
+    offline               work without network access, like --offline
+    assume-yes            answer questions with yes without asking, like
+                          --yes, for automation
+    editor.url-template   the URL that locations in diagnostics link to,
+                          with {file}, {line} and {column} replaced, such as
+                          vscode://file/{file}:{line}:{column}
+    telemetry.enabled     record usage telemetry locally, as vira telemetry
+                          on and off do
+    telemetry.upload-url  where vira telemetry upload sends the events
+
+Registries are configured by editing the [registries] tables of the file.`,
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "get <setting>",
+		Short: "Print the value of a setting",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			setting, err := lookupConfigSetting(args[0])
+			if err == nil {
+				var cfg *globalConfig
+				if cfg, err = loadGlobalConfig(); err == nil {
+					fmt.Println(setting.get(cfg))
+				}
+			}
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "set <setting> <value>",
+		Short: "Change a setting",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setConfig(args[0], args[1], false); err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "unset <setting>",
+		Short: "Reset a setting to its default",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setConfig(args[0], "", true); err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+		},
+	})
+	return cmd
+}
+
+func lookupConfigSetting(name string) (configSetting, error) {
+	setting, ok := configSettings[name]
+	if !ok {
+		return setting, fmt.Errorf("unknown setting %q (known settings: %s)", name, strings.Join(sortedKeys(configSettings), ", "))
+	}
+	return setting, nil
+}
+
+// setConfig changes a setting in config.toml, or removes it if unset is
+// true. The file is edited as text so that the rest of it is kept as is.
+func setConfig(name, value string, unset bool) error {
+	setting, err := lookupConfigSetting(name)
+	if err != nil {
+		return err
+	}
+	file, err := configPath()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	src := string(data)
+	switch {
+	case unset:
+		src, _ = removeTOMLValue(src, setting.table, setting.key)
+	case setting.boolean:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s must be true or false, not %q", name, value)
+		}
+		src = setTOMLValue(src, setting.table, setting.key, strconv.FormatBool(b))
+	default:
+		src = setTOMLValue(src, setting.table, setting.key, strconv.Quote(value))
+	}
+	var cfg globalConfig
+	if _, err := toml.Decode(src, &cfg); err != nil {
+		return fmt.Errorf("%s: the changed configuration would not be valid: %v", file, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(file, []byte(src), 0644)
+}
+
+type registryConfig struct {
+	// Index is the location of the registry's index, like VIRA_REGISTRY.
+	Index string `toml:"index"`
+	// Publish is the API vira publish uploads to.
+	Publish string `toml:"publish,omitempty"`
+	// Token is sent with requests to the registry. Tokens saved with
+	// vira login take precedence.
+	Token string `toml:"token,omitempty"`
+}
+
+func configPath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "config.toml"), nil
+}
+
+// loadGlobalConfig reads the global configuration, which may be absent.
+func loadGlobalConfig() (*globalConfig, error) {
+	file, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+	var cfg globalConfig
+	if _, err := toml.DecodeFile(file, &cfg); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return &cfg, nil
+}
+
+// registry returns the configuration of the named registry.
+func (c *globalConfig) registry(name string) (registryConfig, error) {
+	reg, ok := c.Registries[name]
+	if !ok {
+		if len(c.Registries) == 0 {
+			file, _ := configPath()
+			return reg, fmt.Errorf("registry %q is not configured: add [registries.%s] to %s", name, name, file)
+		}
+		return reg, fmt.Errorf("registry %q is not configured (known registries: %s)", name, strings.Join(sortedKeys(c.Registries), ", "))
+	}
+	if reg.Index == "" {
+		return reg, fmt.Errorf("registry %q has no index in the configuration", name)
+	}
+	return reg, nil
+}
+
+// configuredToken returns the token configured for the registry that serves
+// location, matched by host, or "".
+func configuredToken(location string) string {
+	cfg, err := loadGlobalConfig()
+	if err != nil {
+		return ""
+	}
+	key := registryKey(location)
+	for _, name := range sortedKeys(cfg.Registries) {
+		reg := cfg.Registries[name]
+		if reg.Token == "" {
+			continue
+		}
+		for _, url := range []string{reg.Index, reg.Publish} {
+			if url != "" && registryKey(url) == key {
+				return reg.Token
+			}
+		}
+	}
+	return ""
+}
+
+// resolveRegistryName maps the name of a configured registry to one of its
+// URLs, picked by which; other values are returned unchanged.
+func resolveRegistryName(registry string, which func(registryConfig) string) string {
+	cfg, err := loadGlobalConfig()
+	if err != nil {
+		return registry
+	}
+	if reg, ok := cfg.Registries[registry]; ok && which(reg) != "" {
+		return which(reg)
+	}
+	return registry
+}
+
+// withAlternativeRegistries adds the packages of the registries that
+// dependencies of the project and of its path dependencies name. Each such
+// dependency resolves from its registry only; the other packages of an
+// alternative registry are available to it and its dependencies unless the
+// default index has a package of the same name.
+func (p *project) withAlternativeRegistries(idx *registryIndex) (*registryIndex, error) {
+	manifests := []*Manifest{p.manifest}
+	local, err := p.pathDependencies()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range sortedKeys(local) {
+		manifests = append(manifests, local[name].manifest)
+	}
+	selected := map[string]string{}
+	for _, m := range manifests {
+		for _, name := range m.sortedDependencies() {
+			dep := m.Dependencies[name]
+			if dep.Registry == "" {
+				continue
+			}
+			if prev, ok := selected[name]; ok && prev != dep.Registry {
+				return nil, fmt.Errorf("dependency %s is taken from both registry %s and registry %s", name, prev, dep.Registry)
+			}
+			selected[name] = dep.Registry
+		}
+	}
+	if len(selected) == 0 {
+		return idx, nil
+	}
+
+	cfg, err := loadGlobalConfig()
+	if err != nil {
+		return nil, err
+	}
+	indexes := map[string]*registryIndex{}
+	overlay := map[string]registryPackage{}
+	for _, name := range sortedKeys(selected) {
+		regName := selected[name]
+		alt, ok := indexes[regName]
+		if !ok {
+			reg, err := cfg.registry(regName)
+			if err != nil {
+				return nil, err
+			}
+			if alt, err = fetchIndex(reg.Index); err != nil {
+				return nil, err
+			}
+			for i := range alt.Libraries {
+				alt.Libraries[i].Registry = regName
+			}
+			indexes[regName] = alt
+			for _, pkg := range alt.Libraries {
+				if _, taken := overlay[pkg.Name]; !taken && selected[pkg.Name] == "" && idx.lookup(pkg.Name) == nil {
+					overlay[pkg.Name] = pkg
+				}
+			}
+		}
+		pkg := alt.lookup(name)
+		if pkg == nil {
+			return nil, fmt.Errorf("package %s is not in registry %s", name, regName)
+		}
+		overlay[name] = *pkg
+	}
+	return overlayIndex(idx, overlay), nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"vira/pkg/interrupt"
+	"vira/pkg/logging"
+	"vira/pkg/terminal"
+	"vira/pkg/toolchain"
+)
+
+// builderImage is the official image with a toolchain that builds run in
+// with --container. Its tags are toolchain versions.
+const builderImage = "ghcr.io/vira-language/builder"
+
+// officialImage is the value of --container without an image, which picks
+// the official image for the toolchain of the project.
+const officialImage = "official"
+
+// Inside the container, the project is mounted at containerProject and
+// the cache of the host at containerCache, which vira there uses as
+// XDG_CACHE_HOME.
+const (
+	containerProject = "/work"
+	containerCache   = "/cache"
+)
+
+// containerEngine returns the docker or podman executable that runs
+// containers: VIRA_CONTAINER_ENGINE if set, else whichever is installed,
+// docker first.
+func containerEngine() (string, error) {
+	if engine := os.Getenv("VIRA_CONTAINER_ENGINE"); engine != "" {
+		return exec.LookPath(engine)
+	}
+	for _, engine := range []string{"docker", "podman"} {
+		if path, err := exec.LookPath(engine); err == nil {
+			return path, nil
+		}
+	}
+	return "", errors.New("building in a container needs docker or podman, and neither is on PATH")
+}
+
+// containerImage returns the image to build in: image itself, unless it
+// asks for the official one, which is pinned to the toolchain the build
+// would use on the host.
+func containerImage(image string) (string, error) {
+	if image != officialImage {
+		return image, nil
+	}
+	version := activeToolchain()
+	if version == "" {
+		version = toolchainVersion()
+	}
+	if version == "" {
+		return "", fmt.Errorf("the toolchain version is unknown, so no builder image can be picked; pin a toolchain in %s or give an image with --container=IMAGE", toolchain.FileName)
+	}
+	return builderImage + ":" + version, nil
+}
+
+// buildInContainer runs vira build with the flags of cmd, except
+// --container, inside image and returns its exit code. The project is
+// mounted read-write, so target/ ends up on the host, and so is the
+// download cache, so that dependencies are downloaded once for the host and
+// all containers. With --offline the container has no network either.
+func buildInContainer(p *project, cmd *cobra.Command, image string) (int, error) {
+	engine, err := containerEngine()
+	if err != nil {
+		return 1, err
+	}
+	if image, err = containerImage(image); err != nil {
+		return 1, err
+	}
+	cache, err := cacheDir()
+	if err != nil {
+		return 1, err
+	}
+	if err := os.MkdirAll(cache, 0755); err != nil {
+		return 1, err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return 1, err
+	}
+	rel, err := filepath.Rel(p.root, wd)
+	if err != nil {
+		return 1, err
+	}
+
+	args := []string{"run", "--rm", "-i",
+		"-v", p.root + ":" + containerProject,
+		"-v", cache + ":" + path.Join(containerCache, "vira"),
+		"-w", path.Join(containerProject, filepath.ToSlash(rel)),
+		"-e", "XDG_CACHE_HOME=" + containerCache,
+	}
+	if terminal.Interactive() && terminal.IsTerminal(os.Stdout) {
+		args = append(args, "-t")
+	}
+	if runtime.GOOS != "windows" {
+		// The files written to target/ belong to the user rather than to
+		// root: podman maps the user into the container, docker runs as
+		// the user, with a home directory that can be written to.
+		if filepath.Base(engine) == "podman" {
+			args = append(args, "--userns=keep-id")
+		} else {
+			args = append(args, "--user", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()), "-e", "HOME=/tmp")
+		}
+	}
+	if offlineMode() {
+		args = append(args, "--network=none")
+	}
+	for _, env := range os.Environ() {
+		name, _, _ := strings.Cut(env, "=")
+		if containerEnv(name) {
+			args = append(args, "-e", name)
+		}
+	}
+	args = append(args, image, "vira", "build")
+	args = append(args, containerFlags(cmd)...)
+	if offlineMode() && !offlineFlag {
+		// Offline mode may come from config.toml, which stays on the host.
+		args = append(args, "--offline")
+	}
+
+	logging.Debug("building in a container", "engine", engine, "args", args)
+	run := exec.Command(engine, args...)
+	run.Stdin, run.Stdout, run.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return commandExitCode(interrupt.Foreground(run))
+}
+
+// containerEnv reports whether the variable name is passed on to the
+// container: CI and the settings of vira, except those naming places on
+// the host.
+func containerEnv(name string) bool {
+	switch name {
+	case "CI":
+		return true
+	case "VIRA_HOME", "VIRA_BIN_PATH", "VIRA_TOOLCHAIN", "VIRA_CONTAINER_ENGINE":
+		return false
+	}
+	return strings.HasPrefix(name, "VIRA_")
+}
+
+// containerFlags returns the flags given to cmd, and to vira itself, as
+// arguments for the vira build in the container, leaving out --container.
+func containerFlags(cmd *cobra.Command) []string {
+	var flags []string
+	add := func(f *pflag.Flag) {
+		if f.Name == "container" {
+			return
+		}
+		value := f.Value.String()
+		if s, ok := f.Value.(pflag.SliceValue); ok {
+			value = strings.Join(s.GetSlice(), ",")
+		}
+		flags = append(flags, "--"+f.Name+"="+value)
+	}
+	// The flags of cmd include those of vira, once they are parsed.
+	cmd.Flags().Visit(add)
+	return flags
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"vira/pkg/terminal"
+)
+
+// keychainService names the entries vira keeps in the OS keychain.
+const keychainService = "vira-registry"
+
+// registryKey identifies a registry for credential storage: its host, or the
+// location itself for registries that are not URLs.
+func registryKey(registry string) string {
+	if u, err := url.Parse(registry); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return registry
+}
+
+// keychain stores tokens with the platform's secret store, using the macOS
+// security tool or libsecret's secret-tool. It is nil when neither is
+// available, in which case tokens go to the credentials file.
+type keychain struct {
+	store  func(key, token string) error
+	lookup func(key string) (string, error)
+	remove func(key string) error
+}
+
+func systemKeychain() *keychain {
+	switch runtime.GOOS {
+	case "darwin":
+		if _, err := exec.LookPath("security"); err != nil {
+			return nil
+		}
+		return &keychain{
+			store: func(key, token string) error {
+				return exec.Command("security", "add-generic-password", "-U", "-s", keychainService, "-a", key, "-w", token).Run()
+			},
+			lookup: func(key string) (string, error) {
+				out, err := exec.Command("security", "find-generic-password", "-s", keychainService, "-a", key, "-w").Output()
+				return strings.TrimSpace(string(out)), err
+			},
+			remove: func(key string) error {
+				return exec.Command("security", "delete-generic-password", "-s", keychainService, "-a", key).Run()
+			},
+		}
+	case "linux":
+		if _, err := exec.LookPath("secret-tool"); err != nil {
+			return nil
+		}
+		return &keychain{
+			store: func(key, token string) error {
+				cmd := exec.Command("secret-tool", "store", "--label=Vira registry "+key, "service", keychainService, "registry", key)
+				cmd.Stdin = strings.NewReader(token)
+				return cmd.Run()
+			},
+			lookup: func(key string) (string, error) {
+				out, err := exec.Command("secret-tool", "lookup", "service", keychainService, "registry", key).Output()
+				return strings.TrimSpace(string(out)), err
+			},
+			remove: func(key string) error {
+				return exec.Command("secret-tool", "clear", "service", keychainService, "registry", key).Run()
+			},
+		}
+	}
+	return nil
+}
+
+// credentialsPath is the fallback token store, readable only by the user.
+func credentialsPath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "credentials.json"), nil
+}
+
+func loadCredentialsFile() (map[string]string, error) {
+	file, err := credentialsPath()
+	if err != nil {
+		return nil, err
+	}
+	creds := map[string]string{}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return creds, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", file, err)
+	}
+	return creds, nil
+}
+
+func saveCredentialsFile(creds map[string]string) error {
+	file, err := credentialsPath()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(file, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of an existing file.
+	return os.Chmod(file, 0600)
+}
+
+// saveToken stores the token for registry and returns where it was put.
+func saveToken(registry, token string) (string, error) {
+	key := registryKey(registry)
+	if kc := systemKeychain(); kc != nil {
+		if err := kc.store(key, token); err == nil {
+			return "the system keychain", nil
+		}
+	}
+	creds, err := loadCredentialsFile()
+	if err != nil {
+		return "", err
+	}
+	creds[key] = token
+	if err := saveCredentialsFile(creds); err != nil {
+		return "", err
+	}
+	file, _ := credentialsPath()
+	return file, nil
+}
+
+// storedToken returns the token saved for registry, or "" if there is none.
+func storedToken(registry string) string {
+	key := registryKey(registry)
+	if kc := systemKeychain(); kc != nil {
+		if token, err := kc.lookup(key); err == nil && token != "" {
+			return token
+		}
+	}
+	if creds, err := loadCredentialsFile(); err == nil {
+		return creds[key]
+	}
+	return ""
+}
+
+// deleteToken removes stored tokens for registry from every store and
+// reports whether there was one.
+func deleteToken(registry string) (bool, error) {
+	key := registryKey(registry)
+	found := false
+	if kc := systemKeychain(); kc != nil {
+		if token, err := kc.lookup(key); err == nil && token != "" {
+			found = kc.remove(key) == nil
+		}
+	}
+	creds, err := loadCredentialsFile()
+	if err != nil {
+		return found, err
+	}
+	if _, ok := creds[key]; ok {
+		delete(creds, key)
+		found = true
+		if err := saveCredentialsFile(creds); err != nil {
+			return found, err
+		}
+	}
+	return found, nil
+}
+
+// loginRegistry is the registry login and logout act on: the one given with
+// --registry, which may name a configured registry, or else the publish
+// registry if set, else the index.
+func loginRegistry(registry string) string {
+	if registry == "" {
+		registry = os.Getenv("VIRA_PUBLISH_REGISTRY")
+	}
+	if registry == "" {
+		return registryURL()
+	}
+	return resolveRegistryName(registry, func(r registryConfig) string {
+		if r.Publish != "" {
+			return r.Publish
+		}
+		return r.Index
+	})
+}
+
+func newLoginCmd() *cobra.Command {
+	var registry string
+
+	cmd := &cobra.Command{
+		Use:   "login [token]",
+		Short: "Save an API token for a registry",
+		Long: `Save an API token for a registry. Without an argument, the token is read
+from standard input.
+
+The token is kept in the system keychain when one is available (the macOS
+keychain, or the Secret Service through secret-tool on Linux) and otherwise
+in credentials.json next to config.toml, readable only by you. It is sent
+with requests to that registry, including vira publish.`,
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			registry = loginRegistry(registry)
+			var token string
+			if len(args) == 1 {
+				token = args[0]
+			} else {
+				if terminal.Interactive() {
+					pterm.Print("Token for " + registryKey(registry) + ": ")
+				}
+				line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+				if err != nil && line == "" {
+					pterm.Error.Println("no token given")
+					exit(1)
+				}
+				token = line
+			}
+			token = strings.TrimSpace(token)
+			if token == "" {
+				pterm.Error.Println("no token given")
+				exit(1)
+			}
+			where, err := saveToken(registry, token)
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			pterm.Success.Printfln("Saved token for %s in %s", registryKey(registry), where)
+		},
+	}
+	cmd.Flags().StringVar(&registry, "registry", "", "registry URL or configured registry name the token is for")
+	return cmd
+}
+
+func newLogoutCmd() *cobra.Command {
+	var registry string
+
+	cmd := &cobra.Command{
+		Use:   "logout",
+		Short: "Remove the saved API token for a registry",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			registry = loginRegistry(registry)
+			found, err := deleteToken(registry)
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			if !found {
+				pterm.Warning.Printfln("No token saved for %s", registryKey(registry))
+				return
+			}
+			pterm.Success.Printfln("Removed token for %s", registryKey(registry))
+		},
+	}
+	cmd.Flags().StringVar(&registry, "registry", "", "registry URL or configured registry name to log out of")
+	return cmd
+}
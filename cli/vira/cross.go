@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"vira/pkg/interrupt"
+)
+
+// crossTarget is a platform vira build --target builds executables for,
+// named as zig names it: arch-os or arch-os-abi, such as x86_64-linux-gnu
+// or aarch64-macos. The compiler writes objects for it and zig cc links
+// them, with the C library and startup files zig ships for every target,
+// so no cross toolchain is needed. Bare-metal targets have the operating
+// system none, such as aarch64-none-elf, and are linked without any. A
+// nil *crossTarget is the host, built for with the platform linker.
+type crossTarget struct {
+	name          string
+	arch, os, abi string
+}
+
+// crossArchs and crossOSes are the architectures and operating systems the
+// compiler can write objects for, and their names in the triples the
+// compiler takes.
+var (
+	crossArchs = map[string]string{"x86_64": "x86_64", "aarch64": "aarch64", "riscv64": "riscv64gc"}
+	crossOSes  = map[string]string{"linux": "unknown-linux", "macos": "apple-darwin", "windows": "pc-windows", "none": "unknown-none"}
+)
+
+// parseCrossTarget parses the value of --target. An empty name is the
+// host.
+func parseCrossTarget(name string) (*crossTarget, error) {
+	if name == "" {
+		return nil, nil
+	}
+	parts := strings.Split(name, "-")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("invalid target %q: expected arch-os or arch-os-abi, such as x86_64-linux-gnu", name)
+	}
+	t := &crossTarget{name: name, arch: parts[0], os: parts[1]}
+	if len(parts) == 3 {
+		t.abi = parts[2]
+	}
+	if strings.HasPrefix(t.arch, "wasm") {
+		// Cranelift compiles WebAssembly, but does not generate it.
+		return nil, fmt.Errorf("invalid target %q: WebAssembly is not supported, as the compiler cannot generate it", name)
+	}
+	if strings.HasPrefix(t.arch, "thumb") || strings.HasPrefix(t.arch, "arm") && t.arch != "arm64" {
+		return nil, fmt.Errorf("invalid target %q: 32-bit ARM is not supported, as the compiler cannot generate code for it; aarch64-none-elf and riscv64-none-elf are the bare-metal targets", name)
+	}
+	if crossArchs[t.arch] == "" {
+		return nil, fmt.Errorf("invalid target %q: the architecture must be one of %s", name, strings.Join(sortedKeys(crossArchs), ", "))
+	}
+	if crossOSes[t.os] == "" {
+		return nil, fmt.Errorf("invalid target %q: the operating system must be one of %s", name, strings.Join(sortedKeys(crossOSes), ", "))
+	}
+	return t, nil
+}
+
+// compilerTriple is the target as the compiler takes it with --target.
+func (t *crossTarget) compilerTriple() string {
+	triple := crossArchs[t.arch] + "-" + crossOSes[t.os]
+	switch {
+	case t.os == "windows":
+		// zig links Windows executables against MinGW unless told msvc.
+		if t.abi == "msvc" {
+			return triple + "-msvc"
+		}
+		return triple + "-gnu"
+	case t.os == "linux":
+		abi := t.abi
+		if abi == "" {
+			abi = "gnu"
+		}
+		return triple + "-" + abi
+	case t.os == "none":
+		return triple + "-elf"
+	}
+	return triple
+}
+
+// zigTarget is the target as zig cc takes it.
+func (t *crossTarget) zigTarget() string {
+	if t.bareMetal() {
+		return t.arch + "-freestanding-none"
+	}
+	return t.name
+}
+
+// bareMetal reports whether t runs without an operating system, so that
+// there is no C library to link against.
+func (t *crossTarget) bareMetal() bool {
+	return t != nil && t.os == "none"
+}
+
+// goos is the operating system of the target as runtime.GOOS names it.
+func (t *crossTarget) goos() string {
+	switch {
+	case t == nil:
+		return runtime.GOOS
+	case t.os == "macos":
+		return "darwin"
+	}
+	return t.os
+}
+
+// objectFile returns the path the compiler writes for output when building
+// for t, which for Windows targets has ".o" rewritten to ".obj".
+func (t *crossTarget) objectFile(output string) string {
+	if t.goos() == "windows" {
+		return strings.ReplaceAll(output, ".o", ".obj")
+	}
+	return output
+}
+
+// executableName adds .exe to name for Windows targets.
+func (t *crossTarget) executableName(name string) string {
+	if t.goos() == "windows" {
+		return name + ".exe"
+	}
+	return name
+}
+
+// zigPath returns the zig executable that links for cross targets.
+func zigPath() (string, error) {
+	path, err := exec.LookPath("zig")
+	if err != nil {
+		return "", errors.New("building for another target needs zig on PATH, which links for every target; install it from https://ziglang.org/download")
+	}
+	return path, nil
+}
+
+// linkCross links objs into the executable exe for t with zig cc, passing
+// flags through to it.
+func linkCross(t *crossTarget, objs []string, exe string, flags ...string) error {
+	zig, err := zigPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(exe), 0755); err != nil {
+		return err
+	}
+	args := []string{"cc", "-target", t.zigTarget()}
+	args = append(args, objs...)
+	args = append(args, flags...)
+	args = append(args, "-o", exe)
+	defer interrupt.Cleanup(func() { os.Remove(exe) })()
+	return runStage("linker", filepath.Dir(exe), zig, args...)
+}
+
+// imageFormats are the formats vira build --emit writes flash images in,
+// by the names objcopy has for them.
+var imageFormats = map[string]string{"bin": "binary", "hex": "ihex"}
+
+// imagePath is where the image of exe in format is written.
+func imagePath(exe, format string) string {
+	return strings.TrimSuffix(exe, ".exe") + "." + format
+}
+
+// writeImage copies the contents of the executable exe into a flash image
+// in format, bin or hex, next to it. Images for other targets are written
+// by zig objcopy, those for the host by the objcopy of binutils.
+func writeImage(t *crossTarget, exe, format string) error {
+	tool, args := "objcopy", []string{}
+	if t != nil {
+		zig, err := zigPath()
+		if err != nil {
+			return err
+		}
+		tool, args = zig, []string{"objcopy"}
+	} else if _, err := exec.LookPath(tool); err != nil {
+		return errors.New("writing images needs objcopy on PATH, which comes with binutils")
+	}
+	image := imagePath(exe, format)
+	args = append(args, "-O", imageFormats[format], exe, image)
+	defer interrupt.Cleanup(func() { os.Remove(image) })()
+	return runStage("objcopy", filepath.Dir(exe), tool, args...)
+}
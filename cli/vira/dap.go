@@ -0,0 +1,589 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+
+	"vira/pkg/interrupt"
+	"vira/pkg/logging"
+)
+
+func newDAPCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "dap",
+		Short: "Run a Debug Adapter Protocol server over stdio",
+		Long: `Run a Debug Adapter Protocol server over stdio.
+
+The adapter builds the program with debug information and drives gdb or
+lldb-mi through their machine interface. On Windows use the gdb shipped with
+MinGW; CDB is not supported. The compiler does not emit line tables yet, so
+breakpoints on a line of a .vira file are placed on the function containing
+that line.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := newDAPServer(os.Stdin, os.Stdout).serve(); err != nil {
+				logging.Error("debug adapter failed", "err", err)
+				exit(1)
+			}
+		},
+	}
+}
+
+type dapMessage struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command,omitempty"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+type dapResponse struct {
+	Seq        int    `json:"seq"`
+	Type       string `json:"type"`
+	RequestSeq int    `json:"request_seq"`
+	Success    bool   `json:"success"`
+	Command    string `json:"command"`
+	Message    string `json:"message,omitempty"`
+	Body       any    `json:"body,omitempty"`
+}
+
+type dapEvent struct {
+	Seq   int    `json:"seq"`
+	Type  string `json:"type"`
+	Event string `json:"event"`
+	Body  any    `json:"body,omitempty"`
+}
+
+type dapSource struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+type dapBreakpoint struct {
+	Verified bool       `json:"verified"`
+	Message  string     `json:"message,omitempty"`
+	Line     int        `json:"line,omitempty"`
+	Source   *dapSource `json:"source,omitempty"`
+}
+
+// functionLocation is where a function is defined in Vira source.
+type functionLocation struct {
+	file      string
+	startLine int
+	endLine   int
+}
+
+type dapServer struct {
+	conn *rpcConn
+
+	mu  sync.Mutex
+	seq int
+
+	mi        *miClient
+	functions map[string]functionLocation
+	// Breakpoint numbers in the debugger, per source path, so a new
+	// setBreakpoints request for a file can replace the old ones.
+	sourceBreakpoints   map[string][]string
+	functionBreakpoints []string
+
+	terminateOnce sync.Once
+	// removeBuild deletes the temporary directory a single program was
+	// built into for the session, if any.
+	removeBuild func()
+}
+
+func newDAPServer(r io.Reader, w io.Writer) *dapServer {
+	return &dapServer{
+		conn:              newRPCConn(r, w),
+		functions:         map[string]functionLocation{},
+		sourceBreakpoints: map[string][]string{},
+	}
+}
+
+func (s *dapServer) nextSeq() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	return s.seq
+}
+
+func (s *dapServer) event(name string, body any) {
+	s.conn.write(dapEvent{Seq: s.nextSeq(), Type: "event", Event: name, Body: body})
+}
+
+func (s *dapServer) serve() error {
+	defer s.end()
+	for {
+		msg, err := s.conn.read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		var req dapMessage
+		if err := json.Unmarshal(msg, &req); err != nil {
+			return err
+		}
+		if req.Type != "request" {
+			continue
+		}
+		body, err := s.handle(req)
+		resp := dapResponse{
+			Seq:        s.nextSeq(),
+			Type:       "response",
+			RequestSeq: req.Seq,
+			Success:    err == nil,
+			Command:    req.Command,
+			Body:       body,
+		}
+		if err != nil {
+			resp.Message = err.Error()
+		}
+		s.conn.write(resp)
+
+		switch req.Command {
+		case "launch":
+			if err == nil {
+				// Clients send their breakpoints once they see this event.
+				s.event("initialized", nil)
+			}
+		case "disconnect", "terminate":
+			return nil
+		}
+	}
+}
+
+type dapLaunchArgs struct {
+	// Program is a .vira file to debug; when empty the project containing
+	// Cwd is built.
+	Program     string   `json:"program"`
+	Cwd         string   `json:"cwd"`
+	Args        []string `json:"args"`
+	StopOnEntry bool     `json:"stopOnEntry"`
+	Debugger    string   `json:"debugger"`
+}
+
+func (s *dapServer) handle(req dapMessage) (any, error) {
+	switch req.Command {
+	case "initialize":
+		return map[string]any{
+			"supportsConfigurationDoneRequest": true,
+			"supportsFunctionBreakpoints":      true,
+			"supportsTerminateRequest":         true,
+		}, nil
+	case "launch":
+		var args dapLaunchArgs
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		return nil, s.launch(args)
+	case "setBreakpoints":
+		var args struct {
+			Source      dapSource `json:"source"`
+			Breakpoints []struct {
+				Line int `json:"line"`
+			} `json:"breakpoints"`
+		}
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		var lines []int
+		for _, bp := range args.Breakpoints {
+			lines = append(lines, bp.Line)
+		}
+		bps, err := s.setBreakpoints(args.Source.Path, lines)
+		return map[string]any{"breakpoints": bps}, err
+	case "setFunctionBreakpoints":
+		var args struct {
+			Breakpoints []struct {
+				Name string `json:"name"`
+			} `json:"breakpoints"`
+		}
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, bp := range args.Breakpoints {
+			names = append(names, bp.Name)
+		}
+		bps, err := s.setFunctionBreakpoints(names)
+		return map[string]any{"breakpoints": bps}, err
+	case "configurationDone":
+		return nil, s.exec("-exec-run")
+	case "threads":
+		return s.threads()
+	case "stackTrace":
+		var args struct {
+			ThreadID int `json:"threadId"`
+		}
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		return s.stackTrace(args.ThreadID)
+	case "scopes":
+		// The compiler does not describe locals to the debugger yet.
+		return map[string]any{"scopes": []any{}}, nil
+	case "variables":
+		return map[string]any{"variables": []any{}}, nil
+	case "continue":
+		return map[string]any{"allThreadsContinued": true}, s.exec("-exec-continue")
+	case "next":
+		return nil, s.exec("-exec-next")
+	case "stepIn":
+		return nil, s.exec("-exec-step")
+	case "stepOut":
+		return nil, s.exec("-exec-finish")
+	case "pause":
+		return nil, s.exec("-exec-interrupt")
+	case "evaluate":
+		var args struct {
+			Expression string `json:"expression"`
+		}
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		if s.mi == nil {
+			return nil, fmt.Errorf("no program is being debugged")
+		}
+		rec, err := s.mi.run("-data-evaluate-expression " + miQuote(args.Expression))
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"result": rec.str("value"), "variablesReference": 0}, nil
+	case "disconnect", "terminate":
+		s.end()
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported request %q", req.Command)
+}
+
+func (s *dapServer) exec(command string) error {
+	if s.mi == nil {
+		return fmt.Errorf("no program is being debugged")
+	}
+	_, err := s.mi.run(command)
+	return err
+}
+
+// end stops the debugger and removes the session's build, once it is over.
+func (s *dapServer) end() {
+	if s.mi != nil {
+		s.mi.close()
+		s.mi = nil
+	}
+	if s.removeBuild != nil {
+		s.removeBuild()
+		s.removeBuild = nil
+	}
+}
+
+func defaultDebugger() string {
+	if runtime.GOOS == "darwin" {
+		return "lldb"
+	}
+	return "gdb"
+}
+
+// launch builds the program with debug information, indexes the functions
+// of its sources and loads it into the debugger.
+func (s *dapServer) launch(args dapLaunchArgs) error {
+	if args.Cwd == "" {
+		args.Cwd = "."
+	}
+	if args.Debugger == "" {
+		args.Debugger = defaultDebugger()
+	}
+
+	var exe string
+	var sources []string
+	if args.Program != "" {
+		program := args.Program
+		if !filepath.IsAbs(program) {
+			program = filepath.Join(args.Cwd, program)
+		}
+		dir, err := os.MkdirTemp("", "vira-dap-")
+		if err != nil {
+			return err
+		}
+		done := interrupt.Cleanup(func() { os.RemoveAll(dir) })
+		s.removeBuild = func() {
+			os.RemoveAll(dir)
+			done()
+		}
+		name := strings.TrimSuffix(filepath.Base(program), filepath.Ext(program))
+		obj, err := compileObject(program, filepath.Join(dir, name+".o"))
+		if err != nil {
+			return err
+		}
+		exe = filepath.Join(dir, executableName(name))
+		if err := linkExecutable([]string{obj}, exe, debugLinkFlags()...); err != nil {
+			return err
+		}
+		sources = includeClosure(program)
+	} else {
+		proj, err := loadProject(args.Cwd)
+		if err != nil {
+			return err
+		}
+		if exe, err = proj.build(buildOptions{debugInfo: true}); err != nil {
+			return err
+		}
+		if sources, err = proj.sourceFiles(); err != nil {
+			return err
+		}
+	}
+	s.indexFunctions(sources)
+
+	mi, err := startMI(args.Debugger)
+	if err != nil {
+		return err
+	}
+	s.mi = mi
+	go s.forwardEvents()
+
+	if _, err := mi.run("-file-exec-and-symbols " + miQuote(exe)); err != nil {
+		return err
+	}
+	if len(args.Args) > 0 {
+		quoted := make([]string, len(args.Args))
+		for i, a := range args.Args {
+			quoted[i] = miQuote(a)
+		}
+		if _, err := mi.run("-exec-arguments " + strings.Join(quoted, " ")); err != nil {
+			return err
+		}
+	}
+	if args.StopOnEntry {
+		if _, err := mi.run("-break-insert -t main"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *dapServer) indexFunctions(files []string) {
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		for _, sym := range scanSymbols(string(src)) {
+			if sym.kind == symFunction {
+				s.functions[sym.name] = functionLocation{file: file, startLine: sym.startLine, endLine: sym.endLine}
+			}
+		}
+	}
+}
+
+// functionAt returns the function whose definition spans line of file.
+func (s *dapServer) functionAt(file string, line int) (string, functionLocation, bool) {
+	for name, loc := range s.functions {
+		if sameFile(loc.file, file) && line >= loc.startLine && line <= loc.endLine {
+			return name, loc, true
+		}
+	}
+	return "", functionLocation{}, false
+}
+
+func sameFile(a, b string) bool {
+	a, _ = filepath.Abs(a)
+	b, _ = filepath.Abs(b)
+	if runtime.GOOS == "windows" {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
+
+func (s *dapServer) deleteBreakpoints(numbers []string) {
+	if s.mi != nil && len(numbers) > 0 {
+		s.mi.run("-break-delete " + strings.Join(numbers, " "))
+	}
+}
+
+func (s *dapServer) insertBreakpoint(function string) (string, error) {
+	if s.mi == nil {
+		return "", fmt.Errorf("no program is being debugged")
+	}
+	rec, err := s.mi.run("-break-insert " + function)
+	if err != nil {
+		return "", err
+	}
+	bkpt, _ := rec.values["bkpt"].(map[string]any)
+	number, _ := bkpt["number"].(string)
+	return number, nil
+}
+
+// setBreakpoints translates line breakpoints in a .vira file into function
+// breakpoints on the functions containing those lines.
+func (s *dapServer) setBreakpoints(path string, lines []int) ([]dapBreakpoint, error) {
+	s.deleteBreakpoints(s.sourceBreakpoints[path])
+	delete(s.sourceBreakpoints, path)
+
+	source := &dapSource{Name: filepath.Base(path), Path: path}
+	bps := []dapBreakpoint{}
+	placed := map[string]bool{}
+	for _, line := range lines {
+		name, loc, ok := s.functionAt(path, line)
+		if !ok {
+			bps = append(bps, dapBreakpoint{Line: line, Source: source, Message: "no function contains this line"})
+			continue
+		}
+		bp := dapBreakpoint{Verified: true, Line: loc.startLine, Source: source}
+		if !placed[name] {
+			number, err := s.insertBreakpoint(name)
+			if err != nil {
+				bps = append(bps, dapBreakpoint{Line: line, Source: source, Message: err.Error()})
+				continue
+			}
+			placed[name] = true
+			s.sourceBreakpoints[path] = append(s.sourceBreakpoints[path], number)
+		}
+		bps = append(bps, bp)
+	}
+	return bps, nil
+}
+
+func (s *dapServer) setFunctionBreakpoints(names []string) ([]dapBreakpoint, error) {
+	s.deleteBreakpoints(s.functionBreakpoints)
+	s.functionBreakpoints = nil
+
+	bps := []dapBreakpoint{}
+	for _, name := range names {
+		number, err := s.insertBreakpoint(name)
+		if err != nil {
+			bps = append(bps, dapBreakpoint{Message: err.Error()})
+			continue
+		}
+		s.functionBreakpoints = append(s.functionBreakpoints, number)
+		bp := dapBreakpoint{Verified: true}
+		if loc, ok := s.functions[name]; ok {
+			bp.Line = loc.startLine
+			bp.Source = &dapSource{Name: filepath.Base(loc.file), Path: loc.file}
+		}
+		bps = append(bps, bp)
+	}
+	return bps, nil
+}
+
+func (s *dapServer) threads() (any, error) {
+	threads := []map[string]any{}
+	if s.mi != nil {
+		rec, err := s.mi.run("-thread-info")
+		if err == nil {
+			list, _ := rec.values["threads"].([]any)
+			for _, t := range list {
+				thread, _ := t.(map[string]any)
+				id, _ := strconv.Atoi(fmt.Sprint(thread["id"]))
+				name, _ := thread["target-id"].(string)
+				threads = append(threads, map[string]any{"id": id, "name": name})
+			}
+		}
+	}
+	if len(threads) == 0 {
+		threads = append(threads, map[string]any{"id": 1, "name": "main"})
+	}
+	return map[string]any{"threads": threads}, nil
+}
+
+func (s *dapServer) stackTrace(threadID int) (any, error) {
+	if s.mi == nil {
+		return nil, fmt.Errorf("no program is being debugged")
+	}
+	cmd := "-stack-list-frames"
+	if threadID > 0 {
+		cmd = fmt.Sprintf("-stack-list-frames --thread %d", threadID)
+	}
+	rec, err := s.mi.run(cmd)
+	if err != nil {
+		return nil, err
+	}
+	frames := []map[string]any{}
+	list, _ := rec.values["stack"].([]any)
+	for _, f := range list {
+		frame, _ := f.(map[string]any)
+		level, _ := strconv.Atoi(fmt.Sprint(frame["level"]))
+		name, _ := frame["func"].(string)
+		if name == "" {
+			name, _ = frame["addr"].(string)
+		}
+		item := map[string]any{"id": level, "name": name, "line": 0, "column": 0}
+		if loc, ok := s.functions[name]; ok {
+			item["source"] = dapSource{Name: filepath.Base(loc.file), Path: loc.file}
+			item["line"] = loc.startLine
+			item["column"] = 1
+		} else {
+			item["presentationHint"] = "subtle"
+		}
+		frames = append(frames, item)
+	}
+	return map[string]any{"stackFrames": frames, "totalFrames": len(frames)}, nil
+}
+
+// forwardEvents turns asynchronous debugger output into DAP events.
+func (s *dapServer) forwardEvents() {
+	for rec := range s.mi.events {
+		switch rec.kind {
+		case 0:
+			// Not MI output, so it comes from the debuggee.
+			s.event("output", map[string]any{"category": "stdout", "output": rec.text + "\n"})
+		case '~':
+			s.event("output", map[string]any{"category": "console", "output": rec.text})
+		case '@':
+			s.event("output", map[string]any{"category": "stdout", "output": rec.text})
+		case '*':
+			if rec.class == "stopped" {
+				s.stopped(rec)
+			}
+		}
+	}
+	s.terminated()
+}
+
+func (s *dapServer) terminated() {
+	s.terminateOnce.Do(func() { s.event("terminated", nil) })
+}
+
+func (s *dapServer) stopped(rec miRecord) {
+	reason := rec.str("reason")
+	if strings.HasPrefix(reason, "exited") {
+		code := int64(0)
+		if c := rec.str("exit-code"); c != "" {
+			// gdb reports the exit code in octal.
+			code, _ = strconv.ParseInt(c, 8, 32)
+		}
+		s.event("exited", map[string]any{"exitCode": code})
+		s.terminated()
+		return
+	}
+	threadID, _ := strconv.Atoi(rec.str("thread-id"))
+	if threadID == 0 {
+		threadID = 1
+	}
+	dapReason := "pause"
+	switch reason {
+	case "breakpoint-hit":
+		dapReason = "breakpoint"
+	case "end-stepping-range", "function-finished":
+		dapReason = "step"
+	case "signal-received":
+		if rec.str("signal-name") != "SIGINT" {
+			dapReason = "exception"
+		}
+	}
+	s.event("stopped", map[string]any{
+		"reason":            dapReason,
+		"threadId":          threadID,
+		"allThreadsStopped": true,
+		"description":       rec.str("signal-meaning"),
+	})
+}
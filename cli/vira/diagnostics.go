@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pterm/pterm"
+
+	"vira/pkg/diagnostics"
+	"vira/pkg/i18n"
+	"vira/pkg/terminal"
+)
+
+// The diagnostics of the pipeline tools, lints and vira fix are modelled and
+// rendered by the diagnostics package, which virac uses too.
+type (
+	diagnostic = diagnostics.Diagnostic
+	suggestion = diagnostics.Suggestion
+	textEdit   = diagnostics.Edit
+)
+
+// Error formats, as selected with the global --error-format flag.
+const (
+	errorFormatHuman  = "human"
+	errorFormatShort  = "short"
+	errorFormatGitHub = "github"
+)
+
+// errorFormat is set by the global --error-format flag: human shows each
+// diagnostic with the source it points at, short on a single line as
+// file:line:column: severity[code]: message, for grep and editors such as
+// Vim's quickfix, which diagnostics.Short keeps stable, and github as a
+// GitHub Actions workflow command, which shows it as an annotation of the
+// pull request.
+var errorFormat = errorFormatHuman
+
+// maxErrors is set by the global --max-errors flag: how many errors are
+// shown before the rest are suppressed, or zero for all of them.
+var maxErrors = 20
+
+// limitDiagnostics applies --max-errors to diags, returning the ones to show
+// and a note on the ones left out, if any.
+func limitDiagnostics(diags []diagnostic) ([]diagnostic, string) {
+	shown, suppressed := diagnostics.Limit(diags, maxErrors)
+	if len(suppressed) == 0 {
+		return shown, ""
+	}
+	return shown, i18n.T("%d more not shown (%s); use --max-errors=0 to see all", len(suppressed), diagnostics.Summary(suppressed))
+}
+
+// parseDiagnostics extracts diagnostics from a tool's combined output and
+// assigns the codes vira explain knows about to those the tool gave none.
+func parseDiagnostics(file, output string) []diagnostic {
+	diags := diagnostics.Parse(file, output)
+	for i := range diags {
+		if diags[i].Code == "" {
+			diags[i].Code = codeForMessage(diags[i].Message)
+		}
+	}
+	return diags
+}
+
+// diagnosticsError reports each diagnostic of the source files that failed
+// to compile, followed by how many errors and warnings there were.
+type diagnosticsError struct {
+	files []string
+	diags []diagnostic
+}
+
+func (e *diagnosticsError) Error() string {
+	shown, more := limitDiagnostics(e.diags)
+	if errorFormat != errorFormatHuman {
+		return strings.TrimRight(formatLines(shown), "\n")
+	}
+	r := &diagnostics.Renderer{Path: displayPath, Link: hyperlinks(), Width: terminal.Width(diagnosticsOutput())}
+	names := make([]string, len(e.files))
+	for i, file := range e.files {
+		names[i] = displayPath(file)
+	}
+	lines := []string{i18n.T("could not compile %s", strings.Join(names, ", "))}
+	var code string
+	for _, d := range shown {
+		lines = append(lines, strings.TrimRight(r.Format(d), "\n"))
+		if code == "" {
+			code = d.Code
+		}
+	}
+	if more != "" {
+		lines = append(lines, more)
+	}
+	if summary := diagnostics.Summary(e.diags); summary != "" {
+		lines = append(lines, summary)
+	}
+	if code != "" {
+		lines = append(lines, i18n.T("For more information about this error, try `vira explain %s`.", code))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// compileError turns the failure of compileObject into a diagnosticsError
+// when the tool output can be parsed, and returns err unchanged otherwise.
+// A crash of a tool is reported as an internal compiler error, with a bug
+// report bundle to attach to an issue.
+func compileError(source string, err error) error {
+	if stageErr, ok := internalError(err); ok {
+		return internalCompilerError(stageErr, source)
+	}
+	diags, derr := stageDiagnostics(source, err)
+	if derr != nil || len(diags) == 0 {
+		return err
+	}
+	return &diagnosticsError{files: []string{source}, diags: diags}
+}
+
+// mergeDiagnosticsErrors combines the failures of several compilation
+// units into one, so that a problem every unit runs into, such as an error
+// in a file they all include, is reported once and first.
+func mergeDiagnosticsErrors(errs []*diagnosticsError) *diagnosticsError {
+	merged := &diagnosticsError{}
+	for _, e := range errs {
+		merged.files = append(merged.files, e.files...)
+		merged.diags = append(merged.diags, e.diags...)
+	}
+	merged.diags = diagnostics.Dedup(merged.diags)
+	return merged
+}
+
+// formatLines returns diags one per line in the short or github error
+// format.
+func formatLines(diags []diagnostic) string {
+	var b strings.Builder
+	for _, d := range diags {
+		d.File = displayPath(d.File)
+		if errorFormat == errorFormatGitHub {
+			b.WriteString(githubCommand(d) + "\n")
+		} else {
+			b.WriteString(d.String() + "\n")
+		}
+	}
+	return b.String()
+}
+
+// githubCommand formats d as the workflow command that annotates its
+// location, as in ::error file=src/main.vira,line=4,col=5,title=E0301::...
+func githubCommand(d diagnostic) string {
+	command := "error"
+	switch d.Severity {
+	case diagnostics.Warning:
+		command = "warning"
+	case diagnostics.Note, diagnostics.Help:
+		command = "notice"
+	}
+	data := strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+	property := strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C")
+	props := []string{"file=" + property.Replace(filepath.ToSlash(d.File)), "line=" + strconv.Itoa(d.Line), "col=" + strconv.Itoa(d.Column)}
+	if d.EndLine > 0 {
+		props = append(props, "endLine="+strconv.Itoa(d.EndLine))
+	}
+	if d.EndColumn > 0 {
+		props = append(props, "endColumn="+strconv.Itoa(d.EndColumn))
+	}
+	if d.Code != "" {
+		props = append(props, "title="+property.Replace(d.Code))
+	}
+	message := d.Message
+	for _, note := range d.Notes {
+		message += "\nnote: " + note
+	}
+	for _, s := range d.Suggestions {
+		message += "\nhelp: " + s.Message
+	}
+	return "::" + command + " " + strings.Join(props, ",") + "::" + data.Replace(message)
+}
+
+// diagnosticsOutput is where diagnostics are written: stdout for workflow
+// commands, which the GitHub Actions runner reads there, and stderr
+// otherwise.
+func diagnosticsOutput() *os.File {
+	if errorFormat == errorFormatGitHub {
+		return os.Stdout
+	}
+	return os.Stderr
+}
+
+// printDiagnostics writes diags in the selected error format, up to the
+// --max-errors limit.
+func printDiagnostics(diags []diagnostic) {
+	diags, more := limitDiagnostics(diags)
+	if errorFormat != errorFormatHuman {
+		fmt.Fprint(diagnosticsOutput(), formatLines(diags))
+		return
+	}
+	r := &diagnostics.Renderer{Color: pterm.PrintColor, Path: displayPath, Link: hyperlinks(), Width: terminal.Width(diagnosticsOutput())}
+	r.RenderAll(os.Stderr, diags)
+	if more != "" {
+		pterm.Info.Println(more)
+	}
+}
+
+// printError reports err. In the short and github error formats,
+// diagnostics are written without decoration, so that every line can be
+// parsed. Its class is noted for telemetry.
+func printError(err error) {
+	noteTelemetryError(err)
+	var diagErr *diagnosticsError
+	if errorFormat != errorFormatHuman && errors.As(err, &diagErr) {
+		fmt.Fprintln(diagnosticsOutput(), err)
+		return
+	}
+	pterm.Error.Println(err)
+}
+
+// hyperlinks returns how locations in diagnostics link to the editor, or
+// nil when the terminal is not known to support OSC 8 hyperlinks.
+// VIRA_HYPERLINKS=1 or 0 turns them on or off regardless of the terminal.
+func hyperlinks() func(file string, line, column int) string {
+	switch os.Getenv("VIRA_HYPERLINKS") {
+	case "0":
+		return nil
+	case "":
+		info, err := os.Stderr.Stat()
+		if err != nil || info.Mode()&os.ModeCharDevice == 0 || os.Getenv("TERM") == "dumb" || !pterm.PrintColor {
+			return nil
+		}
+	}
+	template := "file://{file}"
+	if cfg, err := loadGlobalConfig(); err == nil && cfg.Editor.URLTemplate != "" {
+		template = cfg.Editor.URLTemplate
+	}
+	return func(file string, line, column int) string {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return ""
+		}
+		path := filepath.ToSlash(abs)
+		if strings.HasPrefix(template, "file://") {
+			if !strings.HasPrefix(path, "/") {
+				path = "/" + path
+			}
+			path = (&url.URL{Path: path}).EscapedPath()
+		}
+		return strings.NewReplacer("{file}", path, "{line}", strconv.Itoa(line), "{column}", strconv.Itoa(column)).Replace(template)
+	}
+}
+
+// promoteWarnings turns the warnings whose code is in werror into errors.
+// The code "all" promotes every warning.
+func promoteWarnings(diags []diagnostic, werror []string) {
+	promote := map[string]bool{}
+	for _, code := range werror {
+		promote[strings.ToUpper(strings.TrimSpace(code))] = true
+	}
+	for i, d := range diags {
+		if d.Severity == diagnostics.Warning && (promote["ALL"] || d.Code != "" && promote[strings.ToUpper(d.Code)]) {
+			diags[i].Severity = diagnostics.Error
+		}
+	}
+}
+
+// displayPath shortens path to be relative to the working directory when it
+// lies below it.
+func displayPath(path string) string {
+	wd, err := os.Getwd()
+	if err != nil || !filepath.IsAbs(path) {
+		return path
+	}
+	rel, err := filepath.Rel(wd, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return path
+	}
+	return rel
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"vira/pkg/diagnostics"
+)
+
+// TestMain runs vira itself when a test starts the test binary with
+// VIRA_TEST_MAIN set, so that tests can check the output of commands end
+// to end.
+func TestMain(m *testing.M) {
+	if os.Getenv("VIRA_TEST_MAIN") != "" {
+		os.Args = append([]string{"vira"}, os.Args[1:]...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runVira runs vira with args in dir, with a home of its own, and returns
+// what it writes to stdout and stderr.
+func runVira(t *testing.T, dir string, args ...string) (stdout, stderr string, err error) {
+	t.Helper()
+	home := t.TempDir()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"VIRA_TEST_MAIN=1",
+		"HOME="+home,
+		"USERPROFILE="+home,
+		"XDG_CONFIG_HOME="+filepath.Join(home, ".config"),
+		"XDG_DATA_HOME="+filepath.Join(home, ".local", "share"),
+		"XDG_CACHE_HOME="+filepath.Join(home, ".cache"),
+		"NO_COLOR=1",
+	)
+	var out, errOut bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	err = cmd.Run()
+	return out.String(), errOut.String(), err
+}
+
+// TestShortErrorFormat pins the lines --error-format=short writes for a
+// command with diagnostics to the documented contract.
+func TestShortErrorFormat(t *testing.T) {
+	// The lints run over the parse tree.
+	if broken := checkTools("preprocessor", "plsa"); len(broken) > 0 {
+		t.Skip(toolsProblem(broken))
+	}
+	dir := t.TempDir()
+	src := "#define Answer 42\n\nint main() {\n    return Answer;\n    return 0;\n}\n"
+	if err := os.WriteFile(filepath.Join(dir, "main.vira"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, stderr, err := runVira(t, dir, "lint", "--error-format=short", "main.vira")
+	if err == nil {
+		t.Fatal("vira lint succeeded with unreachable code, which is denied")
+	}
+
+	re := regexp.MustCompile(diagnostics.ShortPattern)
+	want := map[string]string{
+		"naming-convention": "main.vira:1:9: warning[naming-convention]: ",
+		"unreachable-code":  "main.vira:5:5: error[unreachable-code]: ",
+	}
+	for _, line := range strings.Split(strings.TrimSpace(stderr), "\n") {
+		if !strings.HasPrefix(line, "main.vira:") {
+			continue
+		}
+		m := re.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("ShortPattern does not match %q", line)
+			continue
+		}
+		prefix, ok := want[m[5]]
+		if !ok {
+			t.Errorf("unexpected diagnostic %q", line)
+			continue
+		}
+		if !strings.HasPrefix(line, prefix) {
+			t.Errorf("got %q, want it to start with %q", line, prefix)
+		}
+		delete(want, m[5])
+	}
+	for code := range want {
+		t.Errorf("no %s diagnostic in the output:\n%s", code, stderr)
+	}
+}
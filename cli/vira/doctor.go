@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+type doctorStatus int
+
+const (
+	doctorPass doctorStatus = iota
+	doctorWarn
+	doctorFail
+)
+
+var doctorStatusNames = [3]string{"pass", "warn", "fail"}
+
+func (s doctorStatus) MarshalText() ([]byte, error) {
+	return []byte(doctorStatusNames[s]), nil
+}
+
+// doctor collects the results of vira doctor's checks and prints each as
+// it is made.
+type doctor struct {
+	counts [3]int
+	checks []doctorCheck
+}
+
+// doctorCheck is the result of one check, as vira doctor prints it with
+// --json.
+type doctorCheck struct {
+	Name   string       `json:"name"`
+	Status doctorStatus `json:"status"`
+	Detail string       `json:"detail"`
+	Hint   string       `json:"hint,omitempty"`
+}
+
+var doctorPrinters = [3]*pterm.PrefixPrinter{
+	pterm.Success.WithPrefix(pterm.Prefix{Text: "PASS", Style: pterm.Success.Prefix.Style}),
+	pterm.Warning.WithPrefix(pterm.Prefix{Text: "WARN", Style: pterm.Warning.Prefix.Style}),
+	pterm.Error.WithPrefix(pterm.Prefix{Text: "FAIL", Style: pterm.Error.Prefix.Style}),
+}
+
+func (d *doctor) report(status doctorStatus, name, detail, hint string) {
+	d.counts[status]++
+	d.checks = append(d.checks, doctorCheck{Name: name, Status: status, Detail: detail, Hint: hint})
+	msg := name + ": " + detail
+	if hint != "" {
+		msg += "\n→ " + hint
+	}
+	doctorPrinters[status].Println(msg)
+}
+
+func (d *doctor) pass(name, detail string)       { d.report(doctorPass, name, detail, "") }
+func (d *doctor) warn(name, detail, hint string) { d.report(doctorWarn, name, detail, hint) }
+func (d *doctor) fail(name, detail, hint string) { d.report(doctorFail, name, detail, hint) }
+
+func newDoctorCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:         "doctor",
+		Annotations: map[string]string{skipToolchain: "true"},
+		Short:       "Check that Vira is installed and configured correctly",
+		Long: `Check the environment Vira runs in: that the toolchain's binaries exist and
+run, a C linker is available, PATH is set up, the directories Vira writes to
+are writable, the registries and the toolchain mirror can be reached, and
+the configuration is valid.
+
+Every check prints PASS, WARN or FAIL, with a hint on how to fix problems.
+The command exits with status 1 if any check fails.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			d := &doctor{}
+			pterm.DefaultSection.Println("Toolchain")
+			d.checkToolchain()
+			pterm.DefaultSection.Println("Environment")
+			d.checkPath()
+			d.checkDirs()
+			pterm.DefaultSection.Println("Configuration")
+			d.checkConfig()
+			pterm.DefaultSection.Println("Network")
+			d.checkNetwork()
+
+			pterm.Println()
+			pterm.Printfln("%d passed, %d warnings, %d failed", d.counts[doctorPass], d.counts[doctorWarn], d.counts[doctorFail])
+			if jsonOutput {
+				if err := printJSON(d.checks); err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+			}
+			if d.counts[doctorFail] > 0 {
+				exit(1)
+			}
+		},
+	}
+}
+
+func (d *doctor) checkToolchain() {
+	if err := selectProjectToolchain(); err != nil {
+		d.fail("project toolchain", err.Error(), "fix the pin, or install the toolchain with vira toolchain install")
+	}
+	version := activeToolchain()
+	bin, binErr := toolchainBinDir()
+	switch {
+	case version == "" && binErr != nil:
+		d.fail("toolchain", binErr.Error(), "install a toolchain with vira toolchain install, or set VIRA_BIN_PATH")
+		return
+	case version == "" && !dirExists(bin):
+		d.fail("toolchain", "no toolchain is installed in "+bin, "run vira setup to install one")
+		return
+	case version == "":
+		d.pass("toolchain", "system toolchain "+toolchainVersion()+" in "+bin)
+	case !toolchainInstalled(version):
+		d.fail("toolchain", "toolchain "+version+" is selected but not installed", "run vira toolchain install "+version)
+		return
+	default:
+		d.pass("toolchain", "toolchain "+version+" in "+bin)
+	}
+
+	tools := []string{"preprocessor", "plsa", "compiler"}
+	broken := map[string]brokenTool{}
+	for _, t := range checkTools(tools...) {
+		broken[t.name] = t
+	}
+	for _, name := range tools {
+		if t, ok := broken[name]; ok {
+			if t.component != "" {
+				d.fail(name, "the "+t.component+" component is not installed", "run vira component add "+t.component)
+			} else {
+				d.fail(name, t.path+" "+t.reason, "run vira update --repair")
+			}
+			continue
+		}
+		if err := startTool(toolPath(name)); err != nil {
+			d.fail(name, toolPath(name)+" does not run: "+err.Error(), "run vira update --repair, or check that the toolchain matches this system")
+			continue
+		}
+		d.pass(name, toolPath(name))
+	}
+
+	if path, err := exec.LookPath(linker()); err != nil {
+		d.fail("linker", linker()+" was not found on PATH", linkerHint())
+	} else if v := linkerVersion(); v != "" {
+		d.pass("linker", path+" "+v)
+	} else {
+		d.pass("linker", path)
+	}
+}
+
+// startTool runs tool without arguments to check that the system can
+// execute it. Its exit status does not matter.
+func startTool(tool string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, tool)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	cmd.Wait()
+	return nil
+}
+
+func linkerHint() string {
+	switch runtime.GOOS {
+	case "windows":
+		return "install the Visual Studio Build Tools and run vira from a developer command prompt"
+	case "darwin":
+		return "install the command line tools with xcode-select --install"
+	default:
+		return "install gcc with your package manager, such as apt install gcc"
+	}
+}
+
+func (d *doctor) checkPath() {
+	bin, err := userBinDir()
+	if err != nil {
+		d.fail("PATH", err.Error(), "")
+		return
+	}
+	if onPath(bin) {
+		d.pass("PATH", bin+" is on PATH")
+	} else {
+		d.warn("PATH", bin+" is not on PATH, so installed programs and toolchain shims are not found", "add it to PATH, or run vira setup")
+	}
+
+	vira, err := exec.LookPath(executableName("vira"))
+	shim := filepath.Join(bin, "vira")
+	if runtime.GOOS == "windows" {
+		shim += ".cmd"
+	}
+	switch {
+	case err != nil:
+		d.warn("vira", "vira is not on PATH", "run vira setup")
+	case defaultToolchain() != "" && filepath.Clean(vira) != filepath.Clean(shim) && fileExists(shim):
+		d.warn("vira", vira+" comes before the toolchain shim "+shim+" on PATH", "put "+bin+" earlier in PATH")
+	default:
+		d.pass("vira", vira)
+	}
+}
+
+func fileExists(file string) bool {
+	_, err := os.Stat(file)
+	return err == nil
+}
+
+func (d *doctor) checkDirs() {
+	dirs := []struct {
+		name string
+		dir  func() (string, error)
+	}{
+		{"config directory", configDir},
+		{"cache directory", cacheDir},
+		{"data directory", dataDir},
+		{"bin directory", userBinDir},
+	}
+	for _, entry := range dirs {
+		dir, err := entry.dir()
+		if err != nil {
+			d.fail(entry.name, err.Error(), "")
+			continue
+		}
+		// A directory that does not exist yet is created in the closest
+		// existing parent.
+		existing := dir
+		for !dirExists(existing) && filepath.Dir(existing) != existing {
+			existing = filepath.Dir(existing)
+		}
+		if err := checkWritable(existing); err != nil {
+			d.fail(entry.name, dir+" is not writable: "+err.Error(), "fix the ownership or permissions of "+existing)
+		} else if existing != dir {
+			d.pass(entry.name, dir+" (not created yet)")
+		} else {
+			d.pass(entry.name, dir)
+		}
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	if file, err := credentialsPath(); err == nil {
+		if info, err := os.Stat(file); err == nil && info.Mode().Perm()&0077 != 0 {
+			d.warn("credentials", fmt.Sprintf("%s is readable by others (mode %v)", file, info.Mode().Perm()), "run chmod 600 "+file)
+		}
+	}
+}
+
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".vira-doctor-")
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func (d *doctor) checkConfig() {
+	file, err := configPath()
+	if err != nil {
+		d.fail("config", err.Error(), "")
+		return
+	}
+	var cfg globalConfig
+	md, err := toml.DecodeFile(file, &cfg)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		d.pass("config", file+" does not exist; the defaults are used")
+	case err != nil:
+		d.fail("config", file+": "+err.Error(), "fix the syntax error in "+file)
+	case len(md.Undecoded()) > 0:
+		var keys []string
+		for _, key := range md.Undecoded() {
+			keys = append(keys, key.String())
+		}
+		d.warn("config", file+" has unknown keys: "+strings.Join(keys, ", "), "remove or correct them")
+	default:
+		d.pass("config", file)
+	}
+	for _, name := range sortedKeys(cfg.Registries) {
+		if cfg.Registries[name].Index == "" {
+			d.fail("config", "registry "+name+" has no index", "set index in [registries."+name+"] of "+file)
+		}
+	}
+
+	if _, err := loadCredentialsFile(); err != nil {
+		d.fail("credentials", err.Error(), "log in again with vira login, or remove the file")
+	}
+
+	root, err := findProjectRoot(".")
+	if err != nil {
+		return
+	}
+	manifest := filepath.Join(root, manifestName)
+	if _, err := loadManifest(manifest); err != nil {
+		d.fail("project", err.Error(), "fix "+manifest)
+	} else {
+		d.pass("project", manifest)
+	}
+}
+
+func (d *doctor) checkNetwork() {
+	if offlineMode() {
+		d.warn("network", "skipped, offline mode is on", "")
+		return
+	}
+	locations := []struct{ name, location string }{
+		{"registry", registryURL()},
+		{"toolchain mirror", toolchainListURL(channelStable)},
+	}
+	if cfg, err := loadGlobalConfig(); err == nil {
+		for _, name := range sortedKeys(cfg.Registries) {
+			if index := cfg.Registries[name].Index; index != "" {
+				locations = append(locations, struct{ name, location string }{"registry " + name, index})
+			}
+		}
+	}
+	for _, l := range locations {
+		if err := reachable(l.location); err != nil {
+			d.fail(l.name, l.location+": "+err.Error(), "check the network connection, proxy settings (HTTPS_PROXY) and the location, or use --offline")
+		} else {
+			d.pass(l.name, l.location)
+		}
+	}
+}
+
+// reachable checks that location can be fetched, without downloading it.
+func reachable(location string) error {
+	if !isRemote(location) {
+		_, err := os.Stat(strings.TrimPrefix(location, "file://"))
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	req, err := http.NewRequest(http.MethodHead, location, nil)
+	if err != nil {
+		return err
+	}
+	token := storedToken(location)
+	if token == "" {
+		token = configuredToken(location)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%s (log in with vira login)", resp.Status)
+	case resp.StatusCode >= 400 && resp.StatusCode != http.StatusMethodNotAllowed:
+		return errors.New(resp.Status)
+	}
+	return nil
+}
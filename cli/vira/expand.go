@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"vira/pkg/interrupt"
+)
+
+func newExpandCmd() *cobra.Command {
+	var plain bool
+
+	cmd := &cobra.Command{
+		Use:   "expand [file.vira]",
+		Short: "Show the fully preprocessed source of a file",
+		Long: `Run only the preprocessor on a file and print the expanded source.
+
+Every line is annotated with the file and line it came from, which helps when
+debugging macros and includes. Use --plain to print the bare output.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := expand(os.Stdout, args[0], plain); err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+		},
+	}
+	cmd.Flags().BoolVar(&plain, "plain", false, "print the expanded source without annotations")
+	return cmd
+}
+
+func expand(w io.Writer, file string, plain bool) error {
+	dir, remove, err := interrupt.TempDir("vira-expand-")
+	if err != nil {
+		return err
+	}
+	defer remove()
+
+	pre := filepath.Join(dir, "expanded.pre")
+	origins, err := preprocess(file, pre)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(pre)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if plain {
+		_, err := io.WriteString(w, string(data))
+		return err
+	}
+
+	width := 1
+	for _, o := range origins {
+		width = max(width, len(fmt.Sprint(o.Line)))
+	}
+	cwd, _ := os.Getwd()
+	current := ""
+	for i, line := range lines {
+		if i >= len(origins) {
+			fmt.Fprintln(w, line)
+			continue
+		}
+		o := origins[i]
+		if o.File != current {
+			current = o.File
+			name := current
+			if rel, err := filepath.Rel(cwd, current); err == nil && !strings.HasPrefix(rel, "..") {
+				name = rel
+			}
+			fmt.Fprintln(w, pterm.FgCyan.Sprint("── "+name+" ──"))
+		}
+		gutter := fmt.Sprintf("%*d │ ", width, o.Line)
+		fmt.Fprintln(w, pterm.FgGray.Sprint(gutter)+line)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+// errorCode describes one diagnostic the toolchain can report. Codes are
+// stable: once published a code keeps its meaning, and retired codes are
+// never reused. E01xx come from the preprocessor, E02xx from the parser and
+// E03xx from semantic checking.
+type errorCode struct {
+	code    string
+	title   string
+	pattern *regexp.Regexp
+	explain string
+	wrong   string
+	fixed   string
+	seeAlso []string
+}
+
+var errorCodes = []errorCode{
+	{
+		code:    "E0101",
+		title:   "included file not found",
+		pattern: regexp.MustCompile(`^Cannot open include: `),
+		explain: `An #include directive names a file the preprocessor could not open.
+
+Quoted includes ("file.vira") are opened relative to the directory of the
+file being compiled. Angle-bracket includes (<file.vira>) are searched for in
+the system include paths.`,
+		wrong: `#include "utils.vira"   // but the file is src/util.vira`,
+		fixed: `#include "util.vira"`,
+	},
+	{
+		code:    "E0102",
+		title:   "malformed include directive",
+		pattern: regexp.MustCompile(`^Invalid include`),
+		explain: `An #include directive is missing the closing quote or angle bracket around
+the file name.`,
+		wrong:   `#include "util.vira`,
+		fixed:   `#include "util.vira"`,
+		seeAlso: []string{"E0101"},
+	},
+	{
+		code:    "E0103",
+		title:   "includes nested too deeply",
+		pattern: regexp.MustCompile(`^Include depth exceeded`),
+		explain: `Files can include each other at most 16 levels deep. This usually means two
+files include each other, directly or through other files.`,
+		wrong: `// a.vira
+#include "b.vira"
+// b.vira
+#include "a.vira"`,
+		fixed: `// Move the shared declarations into a third file that both include.`,
+	},
+	{
+		code:    "E0104",
+		title:   "too many macros",
+		pattern: regexp.MustCompile(`^Too many defines`),
+		explain: `A compilation unit may define at most 1024 macros with #define. Remove unused
+macros or #undef macros that are no longer needed.`,
+	},
+	{
+		code:    "E0201",
+		title:   "unexpected character",
+		pattern: regexp.MustCompile(`^Unexpected character: `),
+		explain: `The source contains a character that is not part of the Vira language, such
+as '@', '$' or a stray backslash. Only letters, digits, '_', string quotes
+and the punctuation + - * / = ( ) ; { } [ ] < > , & | ! are allowed.`,
+		wrong: `int main() {
+    return 1 $ 2;
+}`,
+		fixed: `int main() {
+    return 1 + 2;
+}`,
+	},
+	{
+		code:    "E0202",
+		title:   "syntax error",
+		pattern: regexp.MustCompile(`^Syntax error`),
+		explain: `The parser found a token it did not expect at this point, for example a
+missing semicolon, parenthesis or brace.`,
+		wrong: `int main() {
+    return 1
+}`,
+		fixed: `int main() {
+    return 1;
+}`,
+		seeAlso: []string{"E0203"},
+	},
+	{
+		code:    "E0203",
+		title:   "expected an expression",
+		pattern: regexp.MustCompile(`^Unexpected token in primary`),
+		explain: `An expression was expected, but the next token cannot start one. Expressions
+are numbers and identifiers combined with + - * /.`,
+		wrong: `int main() {
+    return * 2;
+}`,
+		fixed: `int main() {
+    return 2;
+}`,
+		seeAlso: []string{"E0202"},
+	},
+	{
+		code:    "E0204",
+		title:   "unsupported statement",
+		pattern: regexp.MustCompile(`^Unsupported statement`),
+		explain: `Function bodies currently only support return statements. Other statements,
+including declarations and if/while/for, are reserved for future versions.`,
+		wrong: `int main() {
+    int x;
+    return 0;
+}`,
+		fixed: `int main() {
+    return 0;
+}`,
+	},
+	{
+		code:    "E0301",
+		title:   "undefined identifier",
+		pattern: regexp.MustCompile(`^Undefined identifier: `),
+		explain: `An expression uses a name that has not been declared. Check the spelling, or
+use #define to give the name a value.`,
+		wrong: `int main() {
+    return answer;
+}`,
+		fixed: `#define answer 42
+int main() {
+    return answer;
+}`,
+	},
+	{
+		code:    "E0302",
+		title:   "return without a value",
+		pattern: regexp.MustCompile(`^Return statement missing expression`),
+		explain: `Every function returns an int, so every return statement needs a value.`,
+		wrong: `int main() {
+    return;
+}`,
+		fixed: `int main() {
+    return 0;
+}`,
+	},
+}
+
+// codeForMessage returns the code of the first catalog entry matching msg.
+func codeForMessage(msg string) string {
+	for _, c := range errorCodes {
+		if c.pattern.MatchString(msg) {
+			return c.code
+		}
+	}
+	return ""
+}
+
+func lookupErrorCode(code string) (errorCode, bool) {
+	// Accept "E0202", "e0202" and "202" alike.
+	num := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(code)), "E")
+	if len(num) < 4 {
+		num = strings.Repeat("0", 4-len(num)) + num
+	}
+	code = "E" + num
+	for _, c := range errorCodes {
+		if c.code == code {
+			return c, true
+		}
+	}
+	return errorCode{}, false
+}
+
+func newExplainCmd() *cobra.Command {
+	var list bool
+
+	cmd := &cobra.Command{
+		Use:   "explain [code]",
+		Short: "Explain a diagnostic code in detail",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if list || len(args) == 0 {
+				listErrorCodes(os.Stdout)
+				return
+			}
+			c, ok := lookupErrorCode(args[0])
+			if !ok {
+				pterm.Error.Printfln("unknown error code %s (see vira explain --list)", args[0])
+				exit(1)
+			}
+			printExplanation(os.Stdout, c)
+		},
+	}
+	cmd.Flags().BoolVar(&list, "list", false, "list all error codes")
+	return cmd
+}
+
+func listErrorCodes(w io.Writer) {
+	codes := append([]errorCode(nil), errorCodes...)
+	sort.Slice(codes, func(i, j int) bool { return codes[i].code < codes[j].code })
+	for _, c := range codes {
+		fmt.Fprintf(w, "%s  %s\n", c.code, c.title)
+	}
+}
+
+func printExplanation(w io.Writer, c errorCode) {
+	fmt.Fprintf(w, "%s: %s\n\n%s\n", c.code, c.title, c.explain)
+	if c.wrong != "" {
+		fmt.Fprintf(w, "\nErroneous code example:\n\n%s\n", indent(c.wrong, "    "))
+	}
+	if c.fixed != "" {
+		fmt.Fprintf(w, "\nCorrected:\n\n%s\n", indent(c.fixed, "    "))
+	}
+	if len(c.seeAlso) > 0 {
+		fmt.Fprintf(w, "\nSee also: %s\n", strings.Join(c.seeAlso, ", "))
+	}
+}
+
+func indent(s, prefix string) string {
+	return prefix + strings.ReplaceAll(s, "\n", "\n"+prefix)
+}
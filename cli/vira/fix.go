@@ -0,0 +1,389 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"vira/pkg/diagnostics"
+)
+
+// maxFixRounds bounds how often a file is re-checked after applying fixes.
+// The tools stop at the first error, so each round usually fixes one.
+const maxFixRounds = 20
+
+func newFixCmd() *cobra.Command {
+	var dryRun, noBackup bool
+
+	cmd := &cobra.Command{
+		Use:   "fix [file...]",
+		Short: "Apply suggested fixes to source files",
+		Long: `Apply the machine-applicable suggestions of diagnostics, such as
+"did you mean X?" corrections and missing includes, to source files.
+
+Without arguments all compilation units of the current project are fixed.
+Before a file is changed, its original is saved next to it with an .orig
+suffix. With --dry-run, the changes are printed as a diff instead; since the
+tools stop at the first error, a dry run only shows the first fix of each
+file.
+
+With --json, nothing is changed; the diagnostics of each file are printed
+as JSON with their suggested fixes, as editors and other tools apply them.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			files := args
+			if len(files) == 0 {
+				proj, err := loadProject(".")
+				if err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+				if files, err = proj.compilationUnits(); err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+			}
+			if jsonOutput {
+				diags := []diagnostic{}
+				for _, file := range files {
+					found, err := checkSource(file)
+					if err != nil {
+						pterm.Error.Println(err)
+						exit(1)
+					}
+					diags = append(diags, found...)
+				}
+				if err := printJSON(diags); err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+				return
+			}
+			failed := false
+			for _, file := range files {
+				if err := fixFile(file, dryRun, !noBackup); err != nil {
+					pterm.Error.Println(err)
+					failed = true
+				}
+			}
+			if failed {
+				exit(1)
+			}
+		},
+	}
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "print the changes as a diff without writing them")
+	cmd.Flags().BoolVar(&noBackup, "no-backup", false, "do not keep .orig copies of changed files")
+	return cmd
+}
+
+// fixFile checks source and applies the first suggestion of every
+// diagnostic until none remain. Only suggestions whose edits change a file
+// count as fixes; a round that changes nothing ends the fixing, and the
+// diagnostics it could not fix are reported.
+func fixFile(source string, dryRun, backup bool) error {
+	source, err := filepath.Abs(source)
+	if err != nil {
+		return err
+	}
+	original := map[string]bool{}
+	fixed := 0
+	var remaining []diagnostic
+	for round := 0; round < maxFixRounds; round++ {
+		diags, err := checkSource(source)
+		if err != nil {
+			return err
+		}
+		contents := map[string]string{}
+		read := func(file string) (string, error) {
+			if data, ok := contents[file]; ok {
+				return data, nil
+			}
+			data, err := os.ReadFile(file)
+			contents[file] = string(data)
+			return string(data), err
+		}
+		edits := map[string][]textEdit{}
+		remaining = nil
+		applied := 0
+		for _, d := range diags {
+			if len(d.Suggestions) == 0 {
+				remaining = append(remaining, d)
+				continue
+			}
+			byFile := map[string][]textEdit{}
+			for _, e := range d.Suggestions[0].Edits {
+				byFile[e.File] = append(byFile[e.File], e)
+			}
+			changes := false
+			for file, fileEdits := range byFile {
+				data, err := read(file)
+				if err != nil {
+					return err
+				}
+				if diagnostics.ApplyEdits(data, fileEdits) != data {
+					changes = true
+				}
+			}
+			if !changes {
+				remaining = append(remaining, d)
+				continue
+			}
+			for file, fileEdits := range byFile {
+				edits[file] = append(edits[file], fileEdits...)
+			}
+			applied++
+		}
+		changed := false
+		for _, file := range sortedKeys(edits) {
+			data := contents[file]
+			updated := diagnostics.ApplyEdits(data, edits[file])
+			if updated == data {
+				continue
+			}
+			changed = true
+			if !original[file] {
+				original[file] = true
+				if backup && !dryRun {
+					if err := os.WriteFile(file+".orig", []byte(data), 0644); err != nil {
+						return err
+					}
+				}
+			}
+			if dryRun {
+				fmt.Print(unifiedDiff(displayPath(file), data, updated))
+				continue
+			}
+			if err := os.WriteFile(file, []byte(updated), 0644); err != nil {
+				return err
+			}
+		}
+		if !changed {
+			remaining = diags
+			break
+		}
+		fixed += applied
+		if dryRun {
+			return nil
+		}
+	}
+
+	if fixed > 0 {
+		pterm.Success.Printfln("Applied %d fix(es) to %s", fixed, displayPath(source))
+	}
+	for _, d := range remaining {
+		d.File = displayPath(d.File)
+		pterm.Warning.Println(d)
+	}
+	return nil
+}
+
+// suggestFixes returns the machine-applicable fixes for a diagnostic of
+// source, if any.
+func suggestFixes(source string, d diagnostic) []suggestion {
+	switch d.Code {
+	case "E0101":
+		return suggestInclude(source, strings.TrimPrefix(d.Message, "Cannot open include: "))
+	case "E0301":
+		name := strings.TrimPrefix(d.Message, "Undefined identifier: ")
+		file := d.File
+		if file == "" {
+			file = source
+		}
+		return append(suggestMissingInclude(file, name), suggestIdentifier(source, name)...)
+	}
+	return nil
+}
+
+// suggestIdentifier proposes renaming every use of an undefined name to the
+// closest function or macro declared in source or the files it includes.
+func suggestIdentifier(source, name string) []suggestion {
+	files := includeClosure(source)
+	var names []string
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		for _, sym := range scanSymbols(string(data)) {
+			names = append(names, sym.name)
+		}
+	}
+	match, ok := closestMatch(name, names)
+	if !ok {
+		return nil
+	}
+	s := suggestion{Message: fmt.Sprintf("did you mean `%s`?", match)}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		for _, t := range tokenize(string(data)) {
+			if t.kind == tokIdentifier && t.text == name {
+				s.Edits = append(s.Edits, textEdit{File: file, Line: t.line, Column: t.column, EndColumn: t.end(), NewText: match})
+			}
+		}
+	}
+	if len(s.Edits) == 0 {
+		return nil
+	}
+	return []suggestion{s}
+}
+
+// suggestMissingInclude proposes including the file that defines an
+// undefined name into file, if a source file of the project, or of the
+// directory of file outside of one, declares a function or macro of that
+// name. The include is added after the last include of file.
+func suggestMissingInclude(file, name string) []suggestion {
+	dir := filepath.Dir(file)
+	root := dir
+	if proj, err := loadProject(dir); err == nil {
+		root = proj.srcDir()
+	}
+	included := map[string]bool{}
+	for _, f := range includeClosure(file) {
+		included[f] = true
+	}
+	var best string
+	filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		hidden := strings.HasPrefix(d.Name(), ".") && path != root
+		if d.IsDir() {
+			if hidden || d.Name() == "target" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if hidden || filepath.Ext(path) != ".vira" || included[path] {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		for _, sym := range scanSymbols(string(data)) {
+			if sym.name == name && (best == "" || len(path) < len(best)) {
+				best = path
+			}
+		}
+		return nil
+	})
+	if best == "" {
+		return nil
+	}
+	rel, err := filepath.Rel(dir, best)
+	if err != nil {
+		return nil
+	}
+	rel = filepath.ToSlash(rel)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	line := 1
+	for i, text := range strings.Split(string(data), "\n") {
+		if _, _, ok := parseInclude(text); ok {
+			line = i + 2
+		}
+	}
+	return []suggestion{{
+		Message: fmt.Sprintf("add missing include \"%s\"", rel),
+		Edits:   []textEdit{{File: file, Line: line, Column: 1, EndColumn: 1, NewText: "#include \"" + rel + "\"\n"}},
+	}}
+}
+
+// suggestInclude proposes the closest existing .vira file for an include
+// that could not be opened.
+func suggestInclude(source, name string) []suggestion {
+	for _, file := range includeClosure(source) {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		dir := filepath.Dir(file)
+		entries, err := os.ReadDir(filepath.Join(dir, filepath.Dir(name)))
+		if err != nil {
+			continue
+		}
+		var candidates []string
+		for _, e := range entries {
+			if !e.IsDir() && filepath.Ext(e.Name()) == ".vira" {
+				candidates = append(candidates, filepath.ToSlash(filepath.Join(filepath.Dir(name), e.Name())))
+			}
+		}
+		match, ok := closestMatch(name, candidates)
+		if !ok {
+			continue
+		}
+		for i, line := range strings.Split(string(data), "\n") {
+			inc, system, ok := parseInclude(line)
+			if !ok || system || inc != name {
+				continue
+			}
+			col := strings.Index(line, `"`+name+`"`) + 2
+			return []suggestion{{
+				Message: fmt.Sprintf("did you mean \"%s\"?", match),
+				Edits:   []textEdit{{File: file, Line: i + 1, Column: col, EndColumn: col + len(name), NewText: match}},
+			}}
+		}
+	}
+	return nil
+}
+
+// closestMatch returns the candidate closest to name by edit distance, if it
+// is close enough to be a likely typo.
+func closestMatch(name string, candidates []string) (string, bool) {
+	limit := max(1, len(name)/3)
+	best, bestDist := "", limit+1
+	for _, c := range candidates {
+		if c == name {
+			continue
+		}
+		d := editDistance(name, c)
+		if d < bestDist || d == bestDist && c < best {
+			best, bestDist = c, d
+		}
+	}
+	return best, bestDist <= limit
+}
+
+// editDistance is the Levenshtein distance between a and b, counting an
+// adjacent transposition as one edit.
+func editDistance(a, b string) int {
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
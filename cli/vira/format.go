@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+const defaultIndentWidth = 4
+
+func newFmtCmd() *cobra.Command {
+	var check bool
+
+	cmd := &cobra.Command{
+		Use:   "fmt [file...]",
+		Short: "Format source files",
+		Long: `Format source files in place.
+
+Without arguments all source files of the current project are formatted.
+Each line is indented by how deeply it is nested in braces, preprocessor
+directives start at the beginning of the line, trailing white space is
+removed and files end in a single newline. Indentation is set in the
+[format] section of vira.toml:
+
+    [format]
+    indent-width = 2
+    use-tabs = false
+
+With --check, files are not changed; those that are not formatted are
+listed and the command fails.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			proj, err := loadProject(".")
+			if err != nil && (err != errNoProject || len(args) == 0) {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			var cfg FormatConfig
+			files := args
+			if proj != nil {
+				cfg = proj.manifest.Format
+				if len(files) == 0 {
+					if files, err = proj.sourceFiles(); err != nil {
+						pterm.Error.Println(err)
+						exit(1)
+					}
+				}
+			}
+			unformatted := 0
+			for _, file := range files {
+				data, err := os.ReadFile(file)
+				if err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+				formatted := formatSource(string(data), cfg)
+				if formatted == string(data) {
+					continue
+				}
+				unformatted++
+				if check {
+					fmt.Println(displayPath(file))
+					continue
+				}
+				if err := os.WriteFile(file, []byte(formatted), 0644); err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+			}
+			if check && unformatted > 0 {
+				pterm.Error.Printfln("%d file(s) are not formatted; run vira fmt", unformatted)
+				exit(1)
+			}
+			if !check && unformatted > 0 {
+				pterm.Success.Printfln("Formatted %d file(s)", unformatted)
+			}
+		},
+	}
+	cmd.Flags().BoolVar(&check, "check", false, "list unformatted files instead of formatting them")
+	return cmd
+}
+
+// projectFormatConfig returns the [format] section of the project that file
+// belongs to, which is empty outside of a project.
+func projectFormatConfig(file string) FormatConfig {
+	proj, err := loadProject(filepath.Dir(file))
+	if err != nil {
+		return FormatConfig{}
+	}
+	return proj.manifest.Format
+}
+
+// formatSourceLines returns the lines of src as vira fmt writes them.
+// Lines are only ever reindented or trimmed, never joined or split, so line
+// n of the result is line n of src; the last line is empty when src ends in
+// a newline.
+func formatSourceLines(src string, cfg FormatConfig) []string {
+	unit := strings.Repeat(" ", defaultIndentWidth)
+	if cfg.IndentWidth > 0 {
+		unit = strings.Repeat(" ", cfg.IndentWidth)
+	}
+	if cfg.UseTabs != nil && *cfg.UseTabs {
+		unit = "\t"
+	}
+	lines := strings.Split(src, "\n")
+	depth := 0
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			lines[i] = line
+			continue
+		}
+		opens, closes, leading := braceBalance(line)
+		indent := max(depth-leading, 0)
+		lines[i] = strings.Repeat(unit, indent) + line
+		depth = max(depth+opens-closes, 0)
+	}
+	return lines
+}
+
+// formatSource formats src as vira fmt does, ending it in a single newline.
+func formatSource(src string, cfg FormatConfig) string {
+	lines := formatSourceLines(src, cfg)
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// braceBalance counts the braces of line outside of strings and comments,
+// and how many of the closing ones come before anything else.
+func braceBalance(line string) (opens, closes, leading int) {
+	inString := false
+	counting := true
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case inString:
+			if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '/' && i+1 < len(line) && line[i+1] == '/':
+			return opens, closes, leading
+		case c == '{':
+			opens++
+		case c == '}':
+			closes++
+			if counting {
+				leading++
+			}
+		}
+		if c != '}' && c != ' ' && c != '\t' {
+			counting = false
+		}
+	}
+	return opens, closes, leading
+}
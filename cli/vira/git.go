@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pterm/pterm"
+)
+
+// gitSource identifies a git dependency in vira.lock, without the commit:
+// git+<url>, followed by ?branch=, ?tag= or ?rev= when one was given.
+func (d Dependency) gitSource() string {
+	source := "git+" + d.Git
+	switch {
+	case d.Branch != "":
+		source += "?branch=" + url.QueryEscape(d.Branch)
+	case d.Tag != "":
+		source += "?tag=" + url.QueryEscape(d.Tag)
+	case d.Rev != "":
+		source += "?rev=" + url.QueryEscape(d.Rev)
+	}
+	return source
+}
+
+// gitRef is the revision to check out: a commit or a full ref name.
+func (d Dependency) gitRef() string {
+	switch {
+	case d.Branch != "":
+		return "refs/heads/" + d.Branch
+	case d.Tag != "":
+		return "refs/tags/" + d.Tag
+	case d.Rev != "":
+		return d.Rev
+	}
+	return "HEAD"
+}
+
+// parseGitSource splits a locked git source into the repository URL and the
+// pinned commit, which must be a full SHA-1 or SHA-256 object id.
+func parseGitSource(source string) (repo, commit string, ok bool) {
+	rest, ok := strings.CutPrefix(source, "git+")
+	if !ok {
+		return "", "", false
+	}
+	rest, commit, _ = strings.Cut(rest, "#")
+	repo, _, _ = strings.Cut(rest, "?")
+	return repo, commit, isCommitID(commit)
+}
+
+// isCommitID reports whether s is a full git object id. Only these are
+// used as directory names and passed to git checkout.
+func isCommitID(s string) bool {
+	return (len(s) == 40 || len(s) == 64) && isLowerHex(s)
+}
+
+func runGit(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v\n%s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// gitCacheDir returns the directory below cache/git for repo, named after
+// the last path element and a hash of the URL.
+func gitCacheDir(kind, repo string) (string, error) {
+	cache, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(repo))
+	name := strings.TrimSuffix(filepath.Base(strings.TrimSuffix(repo, "/")), ".git")
+	return filepath.Join(cache, "git", kind, name+"-"+hex.EncodeToString(sum[:])[:16]), nil
+}
+
+// gitDatabase returns the bare clone of repo in the cache, cloning it or, if
+// fetch is set, fetching all branches and tags first. In offline mode, an
+// existing clone is used as it is.
+func gitDatabase(repo string, fetch bool) (string, error) {
+	// git would take a URL starting with a dash for an option.
+	if strings.HasPrefix(repo, "-") {
+		return "", fmt.Errorf("invalid git repository %q", repo)
+	}
+	db, err := gitCacheDir("db", repo)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(db); err != nil {
+		if offlineMode() {
+			return "", offlineError("cloning " + repo)
+		}
+		unlock, err := lockPath(db)
+		if err != nil {
+			return "", err
+		}
+		defer unlock()
+		if _, err := os.Stat(db); err == nil {
+			return db, nil
+		}
+		pterm.Info.Printfln("Cloning %s", repo)
+		tmp := db + ".tmp"
+		os.RemoveAll(tmp)
+		if _, err := runGit("", "clone", "--quiet", "--bare", "--", repo, tmp); err != nil {
+			os.RemoveAll(tmp)
+			return "", err
+		}
+		return db, os.Rename(tmp, db)
+	}
+	if fetch && !offlineMode() {
+		pterm.Info.Printfln("Fetching %s", repo)
+		if _, err := runGit(db, "fetch", "--quiet", "--force", "--", repo, "+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"); err != nil {
+			return "", err
+		}
+	}
+	return db, nil
+}
+
+// gitCheckout returns a checkout of commit from repo in the cache.
+func gitCheckout(repo, commit string) (string, error) {
+	if !isCommitID(commit) {
+		return "", fmt.Errorf("invalid commit %q for %s", commit, repo)
+	}
+	base, err := gitCacheDir("checkouts", repo)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(base, commit)
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return dir, nil
+	}
+	db, err := gitDatabase(repo, false)
+	if err != nil {
+		return "", err
+	}
+	unlock, err := lockPath(dir)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return dir, nil
+	}
+	if _, err := runGit(db, "cat-file", "-e", commit+"^{commit}"); err != nil {
+		if offlineMode() {
+			return "", offlineError(fmt.Sprintf("fetching commit %s of %s", commit, repo))
+		}
+		if db, err = gitDatabase(repo, true); err != nil {
+			return "", err
+		}
+		if _, err := runGit(db, "cat-file", "-e", commit+"^{commit}"); err != nil {
+			return "", fmt.Errorf("commit %s not found in %s", commit, repo)
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return "", err
+	}
+	if _, err := runGit("", "clone", "--quiet", "--no-checkout", db, dir); err != nil {
+		return "", err
+	}
+	if _, err := runGit(dir, "checkout", "--quiet", "--detach", commit); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// gitPackage fetches the git dependency name and returns it as a registry
+// entry with a single version, whose URL is the locked source. The commit
+// in locked, if any, is reused instead of resolving the ref again.
+func gitPackage(name string, dep Dependency, locked string) (registryPackage, error) {
+	commit := ""
+	if repo, c, ok := parseGitSource(locked); ok && repo == dep.Git && strings.HasPrefix(locked, dep.gitSource()+"#") {
+		commit = c
+	}
+	if commit == "" {
+		db, err := gitDatabase(dep.Git, true)
+		if err != nil {
+			return registryPackage{}, err
+		}
+		if commit, err = runGit(db, "rev-parse", "--verify", dep.gitRef()+"^{commit}"); err != nil {
+			return registryPackage{}, fmt.Errorf("dependency %s: cannot find %s in %s", name, dep.gitRef(), dep.Git)
+		}
+	}
+	dir, err := gitCheckout(dep.Git, commit)
+	if err != nil {
+		return registryPackage{}, err
+	}
+	m, err := loadManifest(filepath.Join(dir, manifestName))
+	if err != nil {
+		return registryPackage{}, fmt.Errorf("dependency %s: %v", name, err)
+	}
+	if m.Package.Name != name {
+		return registryPackage{}, fmt.Errorf("dependency %s: %s contains package %s", name, dep.Git, m.Package.Name)
+	}
+	rec := registryVersion{Version: m.Package.Version, URL: dep.gitSource() + "#" + commit}
+	for _, depName := range m.sortedDependencies() {
+		d := m.Dependencies[depName]
+		if d.Git != "" || d.Path != "" {
+			return registryPackage{}, fmt.Errorf("dependency %s: git and path dependencies of a git dependency are not supported", name)
+		}
+		if rec.Dependencies == nil {
+			rec.Dependencies = map[string]string{}
+		}
+		rec.Dependencies[depName] = d.Version
+	}
+	return registryPackage{Name: name, Versions: []registryVersion{rec}}, nil
+}
+
+// withGitDependencies returns idx with the registry entries of the
+// manifest's git dependencies replaced by the fetched repositories. Commits
+// recorded in old are kept unless update is set.
+func withGitDependencies(m *Manifest, idx *registryIndex, old *lockfile, update bool) (*registryIndex, error) {
+	git := map[string]registryPackage{}
+	for _, name := range m.sortedDependencies() {
+		dep := m.Dependencies[name]
+		if dep.Git == "" {
+			continue
+		}
+		locked := ""
+		if old != nil && !update {
+			for _, pkg := range old.Packages {
+				if pkg.Name == name && strings.HasPrefix(pkg.Source, "git+") {
+					locked = pkg.Source
+				}
+			}
+		}
+		pkg, err := gitPackage(name, dep, locked)
+		if err != nil {
+			return nil, err
+		}
+		git[name] = pkg
+	}
+	return overlayIndex(idx, git), nil
+}
+
+// overlayIndex returns idx with the entries for the packages in pkgs
+// replaced, so they resolve to the given versions only.
+func overlayIndex(idx *registryIndex, pkgs map[string]registryPackage) *registryIndex {
+	if len(pkgs) == 0 {
+		return idx
+	}
+	out := &registryIndex{}
+	for _, pkg := range idx.Libraries {
+		if _, ok := pkgs[pkg.Name]; !ok {
+			out.Libraries = append(out.Libraries, pkg)
+		}
+	}
+	for _, name := range sortedKeys(pkgs) {
+		out.Libraries = append(out.Libraries, pkgs[name])
+	}
+	return out
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+func newGraphCmd() *cobra.Command {
+	var format string
+	var depth int
+
+	cmd := &cobra.Command{
+		Use:   "graph",
+		Short: "Print the module and package dependency graph of the project",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			proj, err := loadProject(".")
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			g, err := projectGraph(proj)
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			if depth >= 0 {
+				g = g.limitDepth(g.root, depth)
+			}
+			g.markCycles()
+			switch format {
+			case "dot":
+				err = g.writeDOT(os.Stdout)
+			case "json":
+				err = g.writeJSON(os.Stdout)
+			default:
+				err = fmt.Errorf("unknown format %q (use dot or json)", format)
+			}
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+		},
+	}
+	cmd.Flags().StringVar(&format, "format", "dot", "output format: dot or json")
+	cmd.Flags().IntVar(&depth, "depth", -1, "only show nodes up to this distance from the package (-1 for all)")
+	return cmd
+}
+
+type graphNode struct {
+	ID    string `json:"id"`
+	Kind  string `json:"kind"`
+	Label string `json:"label"`
+}
+
+type graphEdge struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Cycle bool   `json:"cycle,omitempty"`
+}
+
+type depGraph struct {
+	root   string
+	nodes  map[string]graphNode
+	edges  []graphEdge
+	cycles [][]string
+}
+
+func newDepGraph() *depGraph {
+	return &depGraph{nodes: map[string]graphNode{}}
+}
+
+func (g *depGraph) addNode(id, kind, label string) {
+	if _, ok := g.nodes[id]; !ok {
+		g.nodes[id] = graphNode{ID: id, Kind: kind, Label: label}
+	}
+}
+
+func (g *depGraph) addEdge(from, to string) {
+	for _, e := range g.edges {
+		if e.From == from && e.To == to {
+			return
+		}
+	}
+	g.edges = append(g.edges, graphEdge{From: from, To: to})
+}
+
+func (g *depGraph) successors(id string) []string {
+	var out []string
+	for _, e := range g.edges {
+		if e.From == id {
+			out = append(out, e.To)
+		}
+	}
+	return out
+}
+
+// projectGraph builds a graph with the package, its resolved dependencies
+// and the edges between them, as vira tree shows them, and its source
+// modules and the includes between them.
+func projectGraph(proj *project) (*depGraph, error) {
+	g := newDepGraph()
+	pkg := proj.manifest.Package
+	g.root = "package:" + pkg.Name
+	g.addNode(g.root, "package", pkg.Name+" "+pkg.Version)
+
+	res, _, err := proj.resolve(resolveOptions{})
+	if err != nil {
+		return nil, err
+	}
+	packageID := func(key string) string {
+		if key == res.root {
+			return g.root
+		}
+		return "package:" + key
+	}
+	for _, key := range sortedKeys(res.packages) {
+		if key != res.root {
+			dep := res.packages[key]
+			g.addNode(packageID(key), "dependency", dep.Name+" "+dep.Version)
+		}
+	}
+	for _, key := range sortedKeys(res.packages) {
+		for _, dep := range res.packages[key].Deps {
+			g.addEdge(packageID(key), packageID(dep))
+		}
+	}
+
+	files, err := proj.sourceFiles()
+	if err != nil {
+		return nil, err
+	}
+	units, err := proj.compilationUnits()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var walk func(file string)
+	walk = func(file string) {
+		id := "module:" + filepath.ToSlash(proj.rel(file))
+		g.addNode(id, "module", filepath.ToSlash(proj.rel(file)))
+		if seen[file] {
+			return
+		}
+		seen[file] = true
+		for _, inc := range sourceIncludes(file) {
+			if inc.system {
+				sysID := "include:" + inc.name
+				g.addNode(sysID, "system", "<"+inc.name+">")
+				g.addEdge(id, sysID)
+				continue
+			}
+			path := filepath.Join(filepath.Dir(file), inc.name)
+			g.addEdge(id, "module:"+filepath.ToSlash(proj.rel(path)))
+			walk(path)
+		}
+	}
+	// Files that only include each other are in no compilation unit, but
+	// are still walked so that the cycle shows up.
+	for _, file := range files {
+		walk(file)
+	}
+	for _, unit := range units {
+		g.addEdge(g.root, "module:"+filepath.ToSlash(proj.rel(unit)))
+	}
+	return g, nil
+}
+
+type includeRef struct {
+	name   string
+	system bool
+}
+
+func sourceIncludes(file string) []includeRef {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	var refs []includeRef
+	for _, line := range strings.Split(string(data), "\n") {
+		if name, system, ok := parseInclude(line); ok {
+			refs = append(refs, includeRef{name: name, system: system})
+		}
+	}
+	return refs
+}
+
+// limitDepth returns the subgraph of nodes within depth edges of root.
+func (g *depGraph) limitDepth(root string, depth int) *depGraph {
+	dist := map[string]int{root: 0}
+	queue := []string{root}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if dist[id] == depth {
+			continue
+		}
+		for _, next := range g.successors(id) {
+			if _, ok := dist[next]; !ok {
+				dist[next] = dist[id] + 1
+				queue = append(queue, next)
+			}
+		}
+	}
+	sub := newDepGraph()
+	sub.root = root
+	for id := range dist {
+		sub.nodes[id] = g.nodes[id]
+	}
+	for _, e := range g.edges {
+		_, from := dist[e.From]
+		_, to := dist[e.To]
+		if from && to {
+			sub.edges = append(sub.edges, e)
+		}
+	}
+	return sub
+}
+
+// markCycles finds the strongly connected components of the graph with
+// Tarjan's algorithm and flags every edge inside a cycle.
+func (g *depGraph) markCycles() {
+	index := map[string]int{}
+	low := map[string]int{}
+	onStack := map[string]bool{}
+	var stack []string
+	next := 0
+	component := map[string]int{}
+	var cycles [][]string
+
+	var connect func(string)
+	connect = func(v string) {
+		index[v], low[v] = next, next
+		next++
+		stack = append(stack, v)
+		onStack[v] = true
+		for _, w := range g.successors(v) {
+			if _, ok := index[w]; !ok {
+				connect(w)
+				low[v] = min(low[v], low[w])
+			} else if onStack[w] {
+				low[v] = min(low[v], index[w])
+			}
+		}
+		if low[v] != index[v] {
+			return
+		}
+		var scc []string
+		for {
+			w := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[w] = false
+			component[w] = len(cycles) + 1
+			scc = append(scc, w)
+			if w == v {
+				break
+			}
+		}
+		sort.Strings(scc)
+		cycles = append(cycles, scc)
+	}
+
+	for _, id := range g.sortedNodes() {
+		if _, ok := index[id]; !ok {
+			connect(id)
+		}
+	}
+
+	g.cycles = nil
+	for i := range g.edges {
+		e := &g.edges[i]
+		e.Cycle = component[e.From] == component[e.To] && (e.From == e.To || len(cycles[component[e.From]-1]) > 1)
+	}
+	for _, scc := range cycles {
+		if len(scc) > 1 || g.hasEdge(scc[0], scc[0]) {
+			g.cycles = append(g.cycles, scc)
+		}
+	}
+}
+
+func (g *depGraph) hasEdge(from, to string) bool {
+	for _, e := range g.edges {
+		if e.From == from && e.To == to {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *depGraph) sortedNodes() []string {
+	ids := make([]string, 0, len(g.nodes))
+	for id := range g.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (g *depGraph) writeDOT(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("digraph vira {\n")
+	b.WriteString("    rankdir=LR;\n")
+	for _, id := range g.sortedNodes() {
+		n := g.nodes[id]
+		shape := "box"
+		switch n.Kind {
+		case "package":
+			shape = "box3d"
+		case "dependency":
+			shape = "component"
+		case "system":
+			shape = "note"
+		}
+		fmt.Fprintf(&b, "    %q [label=%q, shape=%s];\n", n.ID, n.Label, shape)
+	}
+	for _, e := range g.edges {
+		if e.Cycle {
+			fmt.Fprintf(&b, "    %q -> %q [color=red, penwidth=2];\n", e.From, e.To)
+		} else {
+			fmt.Fprintf(&b, "    %q -> %q;\n", e.From, e.To)
+		}
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (g *depGraph) writeJSON(w io.Writer) error {
+	nodes := make([]graphNode, 0, len(g.nodes))
+	for _, id := range g.sortedNodes() {
+		nodes = append(nodes, g.nodes[id])
+	}
+	cycles := g.cycles
+	if cycles == nil {
+		cycles = [][]string{}
+	}
+	edges := g.edges
+	if edges == nil {
+		edges = []graphEdge{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(map[string]any{
+		"root":   g.root,
+		"nodes":  nodes,
+		"edges":  edges,
+		"cycles": cycles,
+	})
+}
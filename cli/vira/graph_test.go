@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestGraph checks that vira graph shows the same resolved packages and
+// edges as vira tree, for the manifest of TestTree.
+func TestGraph(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, manifestName), []byte(treeManifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "src", "main.vira"), []byte("int main() { return 0; }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	registry, err := filepath.Abs(filepath.Join("testdata", "registry.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("VIRA_REGISTRY", registry)
+
+	stdout, stderr, err := runVira(t, dir, "graph", "--format", "json")
+	if err != nil {
+		t.Fatalf("vira graph: %v\n%s", err, stderr)
+	}
+	var g struct {
+		Nodes []graphNode `json:"nodes"`
+		Edges []graphEdge `json:"edges"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &g); err != nil {
+		t.Fatalf("vira graph printed %s", stdout)
+	}
+	var labels []string
+	for _, n := range g.Nodes {
+		if n.Kind == "dependency" {
+			labels = append(labels, n.Label)
+		}
+	}
+	wantLabels := []string{"math 0.1.0", "math 0.2.1", "net 0.5.1", "std 1.1.0"}
+	if !reflect.DeepEqual(labels, wantLabels) {
+		t.Errorf("vira graph has dependencies %v, want %v", labels, wantLabels)
+	}
+	var edges [][2]string
+	for _, e := range g.Edges {
+		if e.To != "module:src/main.vira" {
+			edges = append(edges, [2]string{e.From, e.To})
+		}
+	}
+	wantEdges := [][2]string{
+		{"package:app", "package:math@0.1.0"},
+		{"package:app", "package:net@0.5.1"},
+		{"package:app", "package:std@1.1.0"},
+		{"package:math@0.2.1", "package:std@1.1.0"},
+		{"package:net@0.5.1", "package:math@0.2.1"},
+		{"package:net@0.5.1", "package:std@1.1.0"},
+	}
+	if !reflect.DeepEqual(edges, wantEdges) {
+		t.Errorf("vira graph has edges %v, want %v", edges, wantEdges)
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"vira/pkg/diagnostics"
+	"vira/pkg/toolchain"
+)
+
+func newIDECmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ide",
+		Short: "Generate files for editor support",
+		Long: `Generate the files editors need to support Vira: highlighting grammars,
+and the configuration to use the Vira language server.`,
+	}
+
+	var format, output string
+	grammar := &cobra.Command{
+		Use:   "grammar",
+		Short: "Print a syntax highlighting grammar",
+		Long: `Print a syntax highlighting grammar for Vira, generated from the
+keywords and punctuators of the lexer the toolchain uses, so that editor
+plugins can regenerate theirs whenever the language changes.
+
+--format textmate prints a TextMate grammar as JSON, for VS Code, Sublime
+Text and other editors that read them. --format tree-sitter-queries prints
+highlights.scm for a tree-sitter grammar whose node names are the kinds of
+vira ast in snake_case, such as function and return_stmt, with
+preproc_include and preproc_define for directives.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			var text string
+			switch format {
+			case "textmate":
+				var b strings.Builder
+				enc := json.NewEncoder(&b)
+				enc.SetEscapeHTML(false)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(textMateGrammar()); err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+				text = b.String()
+			case "tree-sitter-queries":
+				text = treeSitterHighlights()
+			default:
+				pterm.Error.Printfln("unknown grammar format %q (use textmate or tree-sitter-queries)", format)
+				exit(1)
+			}
+			if output == "" {
+				fmt.Print(text)
+				return
+			}
+			if err := os.WriteFile(output, []byte(text), 0644); err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+		},
+	}
+	grammar.Flags().StringVar(&format, "format", "textmate", "grammar format: textmate or tree-sitter-queries")
+	grammar.Flags().StringVarP(&output, "output", "o", "", "write the grammar to this file instead of stdout")
+	cmd.AddCommand(grammar)
+
+	var dir string
+	var force bool
+	setup := &cobra.Command{
+		Use:         "setup vscode|nvim",
+		Annotations: map[string]string{skipToolchain: "true"},
+		Short:       "Set up an editor to use the Vira language server",
+		Long: `Write what an editor needs to use the Vira language server, the
+highlighting grammar and the problem matcher of --error-format=short.
+
+vscode writes the skeleton of a VS Code extension to --dir, vira-vscode by
+default, which is packaged and installed with:
+
+    cd vira-vscode && npm install && npx @vscode/vsce package
+    code --install-extension vira-0.1.0.vsix
+
+Its "$vira" problem matcher reads the output of vira build in tasks.
+
+nvim writes plugin/vira.lua to the Neovim configuration directory, or to
+--dir. It registers the vira filetype and the language server, through
+nvim-lspconfig if it is installed, and sets makeprg and errorformat so that
+:make builds the project and fills the quickfix list.
+
+Existing files are only replaced when confirmed, or with --force.`,
+		Args:      cobra.ExactArgs(1),
+		ValidArgs: []string{"vscode", "nvim"},
+		Run: func(cmd *cobra.Command, args []string) {
+			var files map[string]string
+			target := dir
+			switch args[0] {
+			case "vscode":
+				if target == "" {
+					target = "vira-vscode"
+				}
+				var err error
+				if files, err = vscodeExtension(); err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+			case "nvim":
+				if target == "" {
+					var err error
+					if target, err = nvimConfigDir(); err != nil {
+						pterm.Error.Println(err)
+						exit(1)
+					}
+				}
+				files = map[string]string{filepath.Join("plugin", "vira.lua"): nvimPlugin()}
+			default:
+				pterm.Error.Printfln("unknown editor %q (use vscode or nvim)", args[0])
+				exit(1)
+			}
+			var existing []string
+			for _, name := range sortedKeys(files) {
+				path := filepath.Join(target, name)
+				if _, err := os.Stat(path); err == nil && !force {
+					existing = append(existing, displayPath(path))
+				}
+			}
+			if len(existing) > 0 {
+				exists, them := "exists", "it"
+				if len(existing) > 1 {
+					exists, them = "exist", "them"
+				}
+				if !confirm(fmt.Sprintf("%s already %s. Replace %s?", strings.Join(existing, ", "), exists, them), false) {
+					pterm.Error.Printfln("%s already %s; use --force to replace %s", strings.Join(existing, ", "), exists, them)
+					exit(1)
+				}
+			}
+			for _, name := range sortedKeys(files) {
+				path := filepath.Join(target, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+				if err := os.WriteFile(path, []byte(files[name]), 0644); err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+				pterm.Success.Printfln("Wrote %s", displayPath(path))
+			}
+			if args[0] == "vscode" {
+				pterm.Info.Printfln("Install it with: cd %s && npm install && npx @vscode/vsce package && code --install-extension vira-%s.vsix", displayPath(target), vscodeExtensionVersion)
+				if _, err := exec.LookPath("code"); err != nil {
+					pterm.Warning.Println("the code command is not on PATH; install the .vsix from the Extensions view instead")
+				}
+			}
+		},
+	}
+	setup.Flags().StringVar(&dir, "dir", "", "directory to write the files to")
+	setup.Flags().BoolVar(&force, "force", false, "replace existing files")
+	cmd.AddCommand(setup)
+	return cmd
+}
+
+// vscodeExtensionVersion is the version of the generated VS Code extension.
+const vscodeExtensionVersion = "0.1.0"
+
+// vscodeExtension returns the files of the VS Code extension, by name.
+func vscodeExtension() (map[string]string, error) {
+	manifest := map[string]any{
+		"name":             "vira",
+		"displayName":      "Vira",
+		"description":      "Vira language support: highlighting, diagnostics and the Vira language server",
+		"publisher":        "vira-language",
+		"version":          vscodeExtensionVersion,
+		"engines":          map[string]any{"vscode": "^1.82.0"},
+		"main":             "./extension.js",
+		"activationEvents": []string{"onLanguage:vira"},
+		"dependencies":     map[string]any{"vscode-languageclient": "^9.0.1"},
+		"contributes": map[string]any{
+			"languages": []map[string]any{{
+				"id":            "vira",
+				"aliases":       []string{"Vira"},
+				"extensions":    []string{".vira"},
+				"configuration": "./language-configuration.json",
+			}},
+			"grammars": []map[string]any{{
+				"language":  "vira",
+				"scopeName": "source.vira",
+				"path":      "./syntaxes/vira.tmLanguage.json",
+			}},
+			"problemMatchers": []map[string]any{{
+				"name":         "vira",
+				"owner":        "vira",
+				"source":       "vira",
+				"fileLocation": []string{"autoDetect", "${workspaceFolder}"},
+				"pattern": map[string]any{
+					"regexp":   diagnostics.ShortPattern,
+					"file":     1,
+					"line":     2,
+					"column":   3,
+					"severity": 4,
+					"code":     5,
+					"message":  6,
+				},
+			}},
+			"configuration": map[string]any{
+				"title": "Vira",
+				"properties": map[string]any{
+					"vira.path": map[string]any{
+						"type":        "string",
+						"default":     "vira",
+						"description": "The vira command that runs the language server.",
+					},
+				},
+			},
+		},
+	}
+	pairs := [][]string{{"{", "}"}, {"(", ")"}, {"[", "]"}}
+	languageConfig := map[string]any{
+		"brackets":         pairs,
+		"autoClosingPairs": append(append([][]string{}, pairs...), []string{`"`, `"`}),
+		"surroundingPairs": append(append([][]string{}, pairs...), []string{`"`, `"`}),
+	}
+	files := map[string]string{"extension.js": vscodeExtensionJS}
+	for name, v := range map[string]any{
+		"package.json":                  manifest,
+		"language-configuration.json":   languageConfig,
+		"syntaxes/vira.tmLanguage.json": textMateGrammar(),
+	} {
+		var b strings.Builder
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(v); err != nil {
+			return nil, err
+		}
+		files[filepath.FromSlash(name)] = b.String()
+	}
+	return files, nil
+}
+
+const vscodeExtensionJS = `// Generated by vira ide setup vscode.
+const vscode = require("vscode");
+const { LanguageClient } = require("vscode-languageclient/node");
+
+let client;
+
+exports.activate = function () {
+  const command = vscode.workspace.getConfiguration("vira").get("path", "vira");
+  client = new LanguageClient(
+    "vira",
+    "Vira",
+    { command, args: ["lsp"] },
+    { documentSelector: [{ scheme: "file", language: "vira" }] },
+  );
+  return client.start();
+};
+
+exports.deactivate = function () {
+  return client && client.stop();
+};
+`
+
+// nvimConfigDir returns where Neovim reads its configuration from.
+func nvimConfigDir() (string, error) {
+	if runtime.GOOS == "windows" {
+		if dir := os.Getenv("LOCALAPPDATA"); dir != "" {
+			return filepath.Join(dir, "nvim"), nil
+		}
+	}
+	dir, err := toolchain.XDGDir("XDG_CONFIG_HOME", ".config")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "nvim"), nil
+}
+
+// nvimPlugin returns the Lua plugin that sets Neovim up for Vira.
+func nvimPlugin() string {
+	return `-- Generated by vira ide setup nvim.
+vim.filetype.add({ extension = { vira = "vira" } })
+
+local ok, configs = pcall(require, "lspconfig.configs")
+if ok then
+  if not configs.vira then
+    configs.vira = {
+      default_config = {
+        cmd = { "vira", "lsp" },
+        filetypes = { "vira" },
+        root_dir = require("lspconfig.util").root_pattern("vira.toml", ".git"),
+      },
+    }
+  end
+  require("lspconfig").vira.setup({})
+else
+  vim.api.nvim_create_autocmd("FileType", {
+    pattern = "vira",
+    callback = function(args)
+      local root = vim.fs.find({ "vira.toml", ".git" }, {
+        upward = true,
+        path = vim.fs.dirname(vim.api.nvim_buf_get_name(args.buf)),
+      })[1]
+      vim.lsp.start({
+        name = "vira",
+        cmd = { "vira", "lsp" },
+        root_dir = root and vim.fs.dirname(root),
+      })
+    end,
+  })
+end
+
+vim.api.nvim_create_autocmd("FileType", {
+  pattern = "vira",
+  callback = function()
+    vim.opt_local.makeprg = "vira build --error-format=short"
+    vim.opt_local.errorformat = "` + diagnostics.VimErrorFormat + `"
+  end,
+})
+`
+}
+
+// controlKeywords are the keywords that are not types.
+func controlKeywords() []string {
+	var words []string
+	for _, k := range viraKeywords {
+		if !slices.Contains(viraTypes, k) {
+			words = append(words, k)
+		}
+	}
+	return words
+}
+
+// operatorPunctuators splits the punctuators into operators and the
+// brackets and separators that delimit code.
+func operatorPunctuators() (operators, delimiters []string) {
+	for _, c := range viraPunctuators {
+		if strings.ContainsRune("(){}[];,", c) {
+			delimiters = append(delimiters, string(c))
+		} else {
+			operators = append(operators, string(c))
+		}
+	}
+	return operators, delimiters
+}
+
+func wordsPattern(words []string) string {
+	return `\b(?:` + strings.Join(words, "|") + `)\b`
+}
+
+func charsPattern(chars []string) string {
+	var b strings.Builder
+	b.WriteString("[")
+	for _, c := range chars {
+		b.WriteString(`\` + c)
+	}
+	b.WriteString("]")
+	return b.String()
+}
+
+// textMateGrammar builds the TextMate grammar for source.vira.
+func textMateGrammar() map[string]any {
+	operators, delimiters := operatorPunctuators()
+	types := wordsPattern(viraTypes)
+	ident := `[A-Za-z_][A-Za-z0-9_]*`
+	rule := func(match, scope string) map[string]any {
+		return map[string]any{"match": match, "name": scope}
+	}
+	captures := func(scopes ...string) map[string]any {
+		m := map[string]any{}
+		for i, scope := range scopes {
+			m[fmt.Sprint(i+1)] = map[string]any{"name": scope}
+		}
+		return m
+	}
+	return map[string]any{
+		"$schema":   "https://raw.githubusercontent.com/martinring/tmlanguage/master/tmlanguage.json",
+		"name":      "Vira",
+		"scopeName": "source.vira",
+		"fileTypes": []string{"vira"},
+		"patterns": []map[string]any{
+			{"include": "#directives"},
+			{"include": "#strings"},
+			{"include": "#functions"},
+			{"include": "#keywords"},
+			{"include": "#numbers"},
+			{"include": "#operators"},
+		},
+		"repository": map[string]any{
+			"directives": map[string]any{"patterns": []map[string]any{
+				{
+					"match":    `^\s*(#\s*include)\s*("[^"]*"|<[^>]*>)`,
+					"captures": captures("keyword.control.directive.include.vira", "string.quoted.other.include.vira"),
+				},
+				{
+					"match":    `^\s*(#\s*define)\s+(` + ident + `)`,
+					"captures": captures("keyword.control.directive.define.vira", "entity.name.constant.macro.vira"),
+				},
+				rule(`^\s*#\s*\w+`, "keyword.control.directive.vira"),
+			}},
+			"strings": map[string]any{"patterns": []map[string]any{
+				rule(`"[^"\n]*"?`, "string.quoted.double.vira"),
+			}},
+			"functions": map[string]any{"patterns": []map[string]any{
+				{
+					"match":    `(` + types + `)\s+(` + ident + `)\s*(?=\()`,
+					"captures": captures("storage.type.vira", "entity.name.function.vira"),
+				},
+				rule(`\b`+ident+`(?=\s*\()`, "entity.name.function.call.vira"),
+			}},
+			"keywords": map[string]any{"patterns": []map[string]any{
+				rule(types, "storage.type.vira"),
+				rule(wordsPattern(controlKeywords()), "keyword.control.vira"),
+			}},
+			"numbers": map[string]any{"patterns": []map[string]any{
+				rule(`\b[0-9]+\b`, "constant.numeric.integer.vira"),
+			}},
+			"operators": map[string]any{"patterns": []map[string]any{
+				rule(charsPattern(operators), "keyword.operator.vira"),
+				rule(charsPattern(delimiters), "punctuation.vira"),
+			}},
+		},
+	}
+}
+
+// treeSitterHighlights builds the highlights.scm queries.
+func treeSitterHighlights() string {
+	quote := func(words []string) string {
+		quoted := make([]string, len(words))
+		for i, w := range words {
+			quoted[i] = fmt.Sprintf("%q", w)
+		}
+		return strings.Join(quoted, " ")
+	}
+	operators, delimiters := operatorPunctuators()
+	var brackets, separators []string
+	for _, d := range delimiters {
+		if d == ";" || d == "," {
+			separators = append(separators, d)
+		} else {
+			brackets = append(brackets, d)
+		}
+	}
+	var b strings.Builder
+	b.WriteString("; Generated by vira ide grammar; do not edit.\n\n")
+	fmt.Fprintf(&b, "[%s] @keyword\n", quote(controlKeywords()))
+	fmt.Fprintf(&b, "[%s] @type.builtin\n\n", quote(viraTypes))
+	b.WriteString("(function name: (identifier) @function)\n")
+	b.WriteString("(preproc_define name: (identifier) @constant.macro)\n")
+	b.WriteString("(preproc_include) @keyword.directive\n")
+	b.WriteString("(preproc_define) @keyword.directive\n\n")
+	b.WriteString("(identifier) @variable\n")
+	b.WriteString("(number_literal) @number\n")
+	b.WriteString("(string_literal) @string\n\n")
+	fmt.Fprintf(&b, "[%s] @operator\n", quote(operators))
+	fmt.Fprintf(&b, "[%s] @punctuation.bracket\n", quote(brackets))
+	fmt.Fprintf(&b, "[%s] @punctuation.delimiter\n", quote(separators))
+	return b.String()
+}
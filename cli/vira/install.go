@@ -0,0 +1,358 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"vira/pkg/interrupt"
+	"vira/pkg/toolchain"
+)
+
+// installedTool is an entry of installed.json, which records what vira
+// install put into the user bin directory.
+type installedTool struct {
+	Version  string   `json:"version"`
+	Source   string   `json:"source"`
+	Binaries []string `json:"binaries"`
+}
+
+// userBinDir is where vira install places executables.
+func userBinDir() (string, error) {
+	if toolchain.UseXDG() {
+		return toolchain.XDGDir("XDG_BIN_HOME", filepath.Join(".local", "bin"))
+	}
+	home, err := toolchain.Home()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "bin"), nil
+}
+
+func installedPath() (string, error) {
+	dir, err := dataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "installed.json"), nil
+}
+
+func loadInstalled() (map[string]installedTool, error) {
+	file, err := installedPath()
+	if err != nil {
+		return nil, err
+	}
+	tools := map[string]installedTool{}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return tools, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &tools); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", file, err)
+	}
+	return tools, nil
+}
+
+func saveInstalled(tools map[string]installedTool) error {
+	file, err := installedPath()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(tools, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(file, append(data, '\n'), 0644)
+}
+
+func newInstallCmd() *cobra.Command {
+	var list, force bool
+	var localPath string
+
+	cmd := &cobra.Command{
+		Use:   "install [package[@requirement]]",
+		Short: "Build a package and install its executable",
+		Long: `Fetch a package from the registry, or take the project at --path, build it
+with the release profile and copy the executable into the user bin directory
+(~/.local/bin on Linux and ~/.vira/bin elsewhere, which should be on PATH).
+
+Use --list to show installed packages and vira uninstall to remove them.`,
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var err error
+			switch {
+			case list:
+				err = listInstalled()
+			case localPath != "":
+				err = installLocal(localPath, force)
+			case len(args) == 1:
+				err = installFromRegistry(args[0], force)
+			default:
+				err = errors.New("nothing to install: give a package name or --path")
+			}
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+		},
+	}
+	cmd.Flags().BoolVar(&list, "list", false, "list installed packages")
+	cmd.Flags().BoolVarP(&force, "force", "f", false, "reinstall even if the same version is installed")
+	cmd.Flags().StringVar(&localPath, "path", "", "install the project in this directory")
+	return cmd
+}
+
+func newUninstallCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "uninstall <package>...",
+		Short: "Remove packages installed with vira install",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			tools, err := loadInstalled()
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			bin, err := userBinDir()
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			for _, name := range args {
+				tool, ok := tools[name]
+				if !ok {
+					pterm.Error.Printfln("%s is not installed", name)
+					exit(1)
+				}
+				for _, b := range tool.Binaries {
+					if err := os.Remove(filepath.Join(bin, b)); err != nil && !errors.Is(err, os.ErrNotExist) {
+						pterm.Error.Println(err)
+						exit(1)
+					}
+				}
+				delete(tools, name)
+				pterm.Success.Printfln("Uninstalled %s v%s", name, tool.Version)
+			}
+			if err := saveInstalled(tools); err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+		},
+	}
+}
+
+func listInstalled() error {
+	tools, err := loadInstalled()
+	if err != nil {
+		return err
+	}
+	if len(tools) == 0 {
+		pterm.Info.Println("No packages installed")
+		return nil
+	}
+	for _, name := range sortedKeys(tools) {
+		tool := tools[name]
+		pterm.Println(name + " v" + tool.Version + " (" + tool.Source + ")")
+		for _, b := range tool.Binaries {
+			pterm.Println("    " + b)
+		}
+	}
+	return nil
+}
+
+func installFromRegistry(spec string, force bool) error {
+	name, raw, _ := strings.Cut(spec, "@")
+	idx, err := fetchRegistryIndex()
+	if err != nil {
+		return err
+	}
+	pkg := idx.lookup(name)
+	if pkg == nil {
+		return fmt.Errorf("package %s is not in the registry", name)
+	}
+	req, err := parseVersionReq(raw)
+	if err != nil {
+		return err
+	}
+	rec, ok := pkg.latestMatching(req)
+	if !ok {
+		return fmt.Errorf("no version of %s matches %s", name, raw)
+	}
+	if !force && alreadyInstalled(name, rec.Version) {
+		pterm.Info.Printfln("%s v%s is already installed (use --force to reinstall)", name, rec.Version)
+		return nil
+	}
+
+	dir, remove, err := interrupt.TempDir("vira-install-")
+	if err != nil {
+		return err
+	}
+	defer remove()
+	pterm.Info.Printfln("Downloading %s v%s", name, rec.Version)
+	data, err := readLocation(rec.URL)
+	if err != nil {
+		return fmt.Errorf("failed to download %s v%s from %s: %v", name, rec.Version, rec.URL, err)
+	}
+
+	// Packages are either published tarballs or a single source file.
+	var exe string
+	if strings.HasSuffix(rec.URL, ".tar.gz") || strings.HasSuffix(rec.URL, ".tgz") {
+		root, err := extractTarball(data, dir)
+		if err != nil {
+			return err
+		}
+		proj, err := loadProject(root)
+		if err != nil {
+			return err
+		}
+		if exe, err = proj.build(buildOptions{release: true}); err != nil {
+			return err
+		}
+	} else {
+		source := filepath.Join(dir, path.Base(rec.URL))
+		if err := os.WriteFile(source, data, 0644); err != nil {
+			return err
+		}
+		exe = filepath.Join(dir, "target", executableName(name))
+		pterm.Info.Printfln("Compiling %s", path.Base(rec.URL))
+		if err := buildExecutable(source, exe); err != nil {
+			return compileError(source, err)
+		}
+	}
+	return installBinary(name, rec.Version, rec.URL, exe)
+}
+
+func installLocal(dir string, force bool) error {
+	proj, err := loadProject(dir)
+	if err != nil {
+		return err
+	}
+	pkg := proj.manifest.Package
+	if !force && alreadyInstalled(pkg.Name, pkg.Version) {
+		pterm.Info.Printfln("%s v%s is already installed (use --force to reinstall)", pkg.Name, pkg.Version)
+		return nil
+	}
+	exe, err := proj.build(buildOptions{release: true})
+	if err != nil {
+		return err
+	}
+	return installBinary(pkg.Name, pkg.Version, proj.root, exe)
+}
+
+func alreadyInstalled(name, version string) bool {
+	tools, err := loadInstalled()
+	return err == nil && tools[name].Version == version
+}
+
+// installBinary copies exe into the user bin directory and records it.
+func installBinary(name, version, source, exe string) error {
+	bin, err := userBinDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(exe)
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(bin, executableName(name))
+	// Write next to the target and rename, so a running copy is not
+	// overwritten in place.
+	tmp := target + ".tmp"
+	if err := os.WriteFile(tmp, data, 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	tools, err := loadInstalled()
+	if err != nil {
+		return err
+	}
+	tools[name] = installedTool{Version: version, Source: source, Binaries: []string{filepath.Base(target)}}
+	if err := saveInstalled(tools); err != nil {
+		return err
+	}
+	pterm.Success.Printfln("Installed %s v%s to %s", name, version, target)
+	if !onPath(bin) {
+		pterm.Warning.Printfln("%s is not on PATH; add it to run installed packages by name", bin)
+	}
+	return nil
+}
+
+func onPath(dir string) bool {
+	for _, p := range filepath.SplitList(os.Getenv("PATH")) {
+		if filepath.Clean(p) == filepath.Clean(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// extractTarball unpacks a gzipped package tarball into dir and returns the
+// directory holding its vira.toml.
+func extractTarball(data []byte, dir string) (string, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	tr := tar.NewReader(gz)
+	root := ""
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return "", fmt.Errorf("invalid path %q in package", hdr.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return "", err
+		}
+		f, err := os.Create(target)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+		if path.Base(name) == manifestName && (root == "" || len(target) < len(root)) {
+			root = filepath.Dir(target)
+		}
+	}
+	if root == "" {
+		return "", fmt.Errorf("package has no %s", manifestName)
+	}
+	return root, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// jobServer is the GNU make jobserver vira build shares its parallelism
+// with when make (or ninja, or another tool speaking the protocol) runs it.
+// Every job but the first needs a token: a byte read from the jobserver and
+// written back once the job is done, so that all the tools under the same
+// make -jN run N jobs at most in total.
+type jobServer struct {
+	r, w *os.File
+}
+
+// jobServerFromEnv returns the jobserver MAKEFLAGS points to, or nil if
+// there is none or it cannot be used; make only passes it on to the
+// recipes it knows to be recursive, so the descriptors it names may well be
+// closed.
+func jobServerFromEnv() *jobServer {
+	var auth string
+	for _, flag := range strings.Fields(os.Getenv("MAKEFLAGS")) {
+		// --jobserver-fds is what make before 4.2 called it.
+		for _, prefix := range []string{"--jobserver-auth=", "--jobserver-fds="} {
+			if strings.HasPrefix(flag, prefix) {
+				auth = strings.TrimPrefix(flag, prefix)
+			}
+		}
+	}
+	if auth == "" {
+		return nil
+	}
+	if path, ok := strings.CutPrefix(auth, "fifo:"); ok {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			return nil
+		}
+		return &jobServer{r: f, w: f}
+	}
+	rfd, wfd, ok := strings.Cut(auth, ",")
+	if !ok {
+		// A Windows semaphore, which vira does not support.
+		return nil
+	}
+	r, err1 := strconv.Atoi(rfd)
+	w, err2 := strconv.Atoi(wfd)
+	if err1 != nil || err2 != nil || r < 0 || w < 0 {
+		return nil
+	}
+	js := &jobServer{r: os.NewFile(uintptr(r), "jobserver-r"), w: os.NewFile(uintptr(w), "jobserver-w")}
+	if js.r == nil || js.w == nil {
+		return nil
+	}
+	if _, err := js.r.Stat(); err != nil {
+		return nil
+	}
+	if _, err := js.w.Stat(); err != nil {
+		return nil
+	}
+	return js
+}
+
+// acquire waits for a token.
+func (js *jobServer) acquire() (byte, error) {
+	var token [1]byte
+	for {
+		n, err := js.r.Read(token[:])
+		if n == 1 {
+			return token[0], nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// interrupt makes an acquire waiting for a token return early, where the
+// descriptors allow it; otherwise the acquire returns once make has a token
+// free, which the caller gives back.
+func (js *jobServer) interrupt() {
+	js.r.SetReadDeadline(time.Now())
+}
+
+// release gives back a token acquire returned.
+func (js *jobServer) release(token byte) {
+	js.w.Write([]byte{token})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+func newLicenseCmd() *cobra.Command {
+	var output string
+
+	cmd := &cobra.Command{
+		Use:   "license",
+		Short: "Collect the license notices of all dependencies",
+		Long: `Collect the licenses of every package the project is built from, as
+resolved in vira.lock, into one document to ship with the executable: for
+each package its declared license, from its vira.toml or the registry
+index, followed by the text of its license files, such as LICENSE, COPYING
+or NOTICE.
+
+The document is printed, or written to the file given with --output, such
+as THIRD-PARTY-LICENSES.txt. Packages that declare no license and have no
+license file are warned about. With --json the licenses and the texts of
+the files are printed as JSON instead.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if output == "" && !jsonOutput {
+				// stdout carries the document.
+				pterm.SetDefaultOutput(os.Stderr)
+			}
+			proj, err := loadProject(".")
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			notices, err := proj.licenseNotices()
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			for _, n := range notices {
+				if n.License == "" && len(n.Files) == 0 {
+					pterm.Warning.Printfln("%s v%s declares no license and has no license file", n.Name, n.Version)
+				}
+			}
+			if jsonOutput {
+				if err := printJSON(notices); err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+				return
+			}
+			if output == "" {
+				writeLicenseNotices(os.Stdout, proj, notices)
+				return
+			}
+			f, err := os.Create(output)
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			writeLicenseNotices(f, proj, notices)
+			if err := f.Close(); err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			pterm.Success.Printfln("Wrote the licenses of %d packages to %s", len(notices), output)
+		},
+	}
+	cmd.Flags().StringVarP(&output, "output", "o", "", "write the document to this file instead of printing it")
+	return cmd
+}
+
+// licenseNotice is the license information of one dependency.
+type licenseNotice struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// License is the declared SPDX expression, if any.
+	License string        `json:"license,omitempty"`
+	Files   []licenseFile `json:"files"`
+}
+
+type licenseFile struct {
+	Name string `json:"name"`
+	Text string `json:"text"`
+}
+
+// licenseFilePrefixes start the names of the files whose text is collected,
+// compared without case.
+var licenseFilePrefixes = []string{"LICENSE", "LICENCE", "COPYING", "COPYRIGHT", "NOTICE", "UNLICENSE"}
+
+// licenseNotices returns the license information of every package locked
+// for the project, in the order of vira.lock.
+func (p *project) licenseNotices() ([]licenseNotice, error) {
+	_, lf, err := p.resolve(resolveOptions{})
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := p.sourceDirs(lf)
+	if err != nil {
+		return nil, err
+	}
+	idx, _ := cachedIndex(registryURL())
+	notices := []licenseNotice{}
+	for _, pkg := range lf.Packages[1:] {
+		n := licenseNotice{Name: pkg.Name, Version: pkg.Version, Files: []licenseFile{}}
+		root := packageRoot(dirs[pkg.key()])
+		if m, err := loadManifest(filepath.Join(root, manifestName)); err == nil {
+			n.License = m.Package.License
+		}
+		if n.License == "" && idx != nil && pkg.Registry == "" {
+			if rp := idx.lookup(pkg.Name); rp != nil {
+				n.License = rp.License
+			}
+		}
+		if n.Files, err = licenseFiles(root); err != nil {
+			return nil, fmt.Errorf("%s v%s: %v", pkg.Name, pkg.Version, err)
+		}
+		notices = append(notices, n)
+	}
+	return notices, nil
+}
+
+// packageRoot returns the project directory of a dependency given the
+// directory its sources are included from, which is src/ if it has one.
+func packageRoot(dir string) string {
+	if filepath.Base(dir) != "src" {
+		return dir
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), manifestName)); err == nil {
+		return filepath.Dir(dir)
+	}
+	return dir
+}
+
+// licenseFiles reads the license files at the top of dir.
+func licenseFiles(dir string) ([]licenseFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := []licenseFile{}
+	for _, e := range entries {
+		if e.IsDir() || !isLicenseFile(e.Name()) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, licenseFile{Name: e.Name(), Text: string(data)})
+	}
+	return files, nil
+}
+
+func isLicenseFile(name string) bool {
+	upper := strings.ToUpper(name)
+	for _, prefix := range licenseFilePrefixes {
+		if strings.HasPrefix(upper, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeLicenseNotices writes the notices as a plain text document.
+func writeLicenseNotices(w io.Writer, p *project, notices []licenseNotice) {
+	rule := strings.Repeat("=", 78)
+	fmt.Fprintf(w, "Third-party licenses of %s v%s\n\n", p.manifest.Package.Name, p.manifest.Package.Version)
+	if len(notices) == 0 {
+		fmt.Fprintln(w, "The project has no dependencies.")
+		return
+	}
+	fmt.Fprintf(w, "%s is built from the following packages, distributed under these licenses.\n", p.manifest.Package.Name)
+	for _, n := range notices {
+		fmt.Fprintf(w, "\n%s\n%s v%s\n", rule, n.Name, n.Version)
+		license := n.License
+		if license == "" {
+			license = "not declared"
+		}
+		fmt.Fprintf(w, "License: %s\n%s\n", license, rule)
+		if len(n.Files) == 0 {
+			fmt.Fprintln(w, "\nThe package has no license file.")
+		}
+		for _, f := range n.Files {
+			fmt.Fprintf(w, "\n%s:\n\n%s", f.Name, f.Text)
+			if !strings.HasSuffix(f.Text, "\n") {
+				fmt.Fprintln(w)
+			}
+		}
+	}
+}
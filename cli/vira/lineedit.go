@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+
+	"vira/pkg/terminal"
+)
+
+// errLineCancelled is returned for a line given up with Ctrl-C.
+var errLineCancelled = errors.New("cancelled")
+
+// lineReader reads the lines of the REPL.
+type lineReader interface {
+	// readLine shows prompt and reads a line. Pasted text may hold several
+	// lines.
+	readLine(prompt string) (string, error)
+}
+
+// plainReader reads lines from input that is not a terminal, such as a
+// script piped into the REPL.
+type plainReader struct {
+	r   *bufio.Reader
+	out io.Writer
+}
+
+func (p *plainReader) readLine(prompt string) (string, error) {
+	fmt.Fprint(p.out, prompt)
+	line, err := p.r.ReadString('\n')
+	if err != nil && (line == "" || !errors.Is(err, io.EOF)) {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// lineEditor edits lines at a terminal with the keys of readline: the
+// arrows, Home and End, Ctrl-A, -E, -B, -F, -K, -U, -W, -L and -D, the
+// history with Up and Down or Ctrl-P and -N, and completion with Tab. Text
+// pasted while the terminal brackets pastes comes in whole, newlines and
+// all.
+type lineEditor struct {
+	in  *os.File
+	out *os.File
+	r   *bufio.Reader
+	// history holds the lines entered, the oldest first.
+	history []string
+	// complete returns the completions of the word that ends line.
+	complete func(line string) []string
+}
+
+func newLineEditor(in, out *os.File, history []string, complete func(string) []string) *lineEditor {
+	return &lineEditor{in: in, out: out, r: bufio.NewReader(in), history: history, complete: complete}
+}
+
+// lineState is the line being edited.
+type lineState struct {
+	prompt string
+	buf    []rune
+	pos    int
+}
+
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	restore, err := terminal.Raw(e.in, e.out)
+	if err != nil {
+		return "", err
+	}
+	defer restore()
+	// Have the terminal mark pastes.
+	fmt.Fprint(e.out, "\x1b[?2004h")
+	defer fmt.Fprint(e.out, "\x1b[?2004l")
+
+	s := &lineState{prompt: prompt}
+	// entry is the history entry shown, len(e.history) for the new line,
+	// which is kept in pending while older entries are shown.
+	entry, pending := len(e.history), ""
+	showEntry := func(i int) {
+		if i < 0 || i > len(e.history) || i == entry {
+			return
+		}
+		if entry == len(e.history) {
+			pending = string(s.buf)
+		}
+		entry = i
+		if i == len(e.history) {
+			s.buf = []rune(pending)
+		} else {
+			s.buf = []rune(e.history[i])
+		}
+		s.pos = len(s.buf)
+	}
+	e.redraw(s)
+	for {
+		r, _, err := e.r.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			return string(s.buf), nil
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errLineCancelled
+		case 4: // Ctrl-D
+			if len(s.buf) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			s.delete(s.pos, s.pos+1)
+		case 127, 8: // Backspace
+			s.delete(s.pos-1, s.pos)
+		case 1: // Ctrl-A
+			s.pos = 0
+		case 5: // Ctrl-E
+			s.pos = len(s.buf)
+		case 2: // Ctrl-B
+			s.pos = max(s.pos-1, 0)
+		case 6: // Ctrl-F
+			s.pos = min(s.pos+1, len(s.buf))
+		case 11: // Ctrl-K
+			s.delete(s.pos, len(s.buf))
+		case 21: // Ctrl-U
+			s.delete(0, s.pos)
+		case 23: // Ctrl-W
+			s.delete(s.wordStart(), s.pos)
+		case 12: // Ctrl-L
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+		case 16: // Ctrl-P
+			showEntry(entry - 1)
+		case 14: // Ctrl-N
+			showEntry(entry + 1)
+		case '\t':
+			e.completeWord(s)
+		case 27:
+			switch seq := e.escapeSequence(); seq {
+			case "[A", "OA":
+				showEntry(entry - 1)
+			case "[B", "OB":
+				showEntry(entry + 1)
+			case "[C", "OC":
+				s.pos = min(s.pos+1, len(s.buf))
+			case "[D", "OD":
+				s.pos = max(s.pos-1, 0)
+			case "[H", "OH", "[1~", "[7~":
+				s.pos = 0
+			case "[F", "OF", "[4~", "[8~":
+				s.pos = len(s.buf)
+			case "[3~":
+				s.delete(s.pos, s.pos+1)
+			case "[200~":
+				pasted, err := e.paste()
+				if err != nil {
+					return "", err
+				}
+				s.insert([]rune(pasted))
+				if strings.Contains(pasted, "\n") {
+					e.redraw(s)
+					// Code of several lines is entered as it is pasted.
+					fmt.Fprint(e.out, "\r\n")
+					return string(s.buf), nil
+				}
+			}
+		default:
+			if unicode.IsPrint(r) {
+				s.insert([]rune{r})
+			}
+		}
+		e.redraw(s)
+	}
+}
+
+// escapeSequence reads the rest of the escape sequence of a key, such as
+// "[A" for Up.
+func (e *lineEditor) escapeSequence() string {
+	var seq []rune
+	for {
+		r, _, err := e.r.ReadRune()
+		if err != nil {
+			return string(seq)
+		}
+		seq = append(seq, r)
+		switch {
+		case len(seq) == 1 && r != '[' && r != 'O':
+			return string(seq)
+		case len(seq) > 1 && (r >= 'A' && r <= 'Z' || r == '~'):
+			return string(seq)
+		case len(seq) > 8:
+			return string(seq)
+		}
+	}
+}
+
+// paste reads pasted text up to the end of the paste.
+func (e *lineEditor) paste() (string, error) {
+	const end = "\x1b[201~"
+	var b strings.Builder
+	for {
+		r, _, err := e.r.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		if r == '\r' {
+			r = '\n'
+		}
+		b.WriteRune(r)
+		if text := b.String(); strings.HasSuffix(text, end) {
+			return strings.TrimSuffix(text, end), nil
+		}
+	}
+}
+
+func (s *lineState) insert(rs []rune) {
+	s.buf = append(s.buf[:s.pos], append(rs, s.buf[s.pos:]...)...)
+	s.pos += len(rs)
+}
+
+// delete removes the runes from i to j, as far as the line has them.
+func (s *lineState) delete(i, j int) {
+	i, j = max(i, 0), min(j, len(s.buf))
+	if i >= j {
+		return
+	}
+	s.buf = append(s.buf[:i], s.buf[j:]...)
+	if s.pos > j {
+		s.pos -= j - i
+	} else if s.pos > i {
+		s.pos = i
+	}
+}
+
+// wordStart returns where the word before the cursor starts.
+func (s *lineState) wordStart() int {
+	i := s.pos
+	for i > 0 && s.buf[i-1] == ' ' {
+		i--
+	}
+	for i > 0 && s.buf[i-1] != ' ' {
+		i--
+	}
+	return i
+}
+
+// completeWord completes the word before the cursor: as far as all the
+// completions agree, and with a list of them when they agree no further.
+func (e *lineEditor) completeWord(s *lineState) {
+	if e.complete == nil {
+		return
+	}
+	line := string(s.buf[:s.pos])
+	word := []rune(line[strings.LastIndexFunc(line, isWordBreak)+1:])
+	candidates := e.complete(line)
+	if len(candidates) == 0 {
+		return
+	}
+	common := []rune(candidates[0])
+	for _, c := range candidates[1:] {
+		rs := []rune(c)
+		n := 0
+		for n < len(common) && n < len(rs) && common[n] == rs[n] {
+			n++
+		}
+		common = common[:n]
+	}
+	if len(common) > len(word) {
+		s.insert(common[len(word):])
+		if len(candidates) == 1 && !strings.HasSuffix(candidates[0], "/") && !strings.HasSuffix(candidates[0], `\`) {
+			s.insert([]rune{' '})
+		}
+		return
+	}
+	if len(candidates) > 1 {
+		fmt.Fprint(e.out, "\r\n"+strings.Join(candidates, "  ")+"\r\n")
+	}
+}
+
+// isWordBreak reports whether r ends a word that Tab completes.
+func isWordBreak(r rune) bool {
+	return !(r == '_' || r == ':' || r == '.' || r == '/' || r == '\\' || r == '-' || unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+// redraw shows the line with the cursor where it is. Lines of pasted code
+// are shown one after another.
+func (e *lineEditor) redraw(s *lineState) {
+	text := strings.ReplaceAll(string(s.buf), "\n", "\r\n")
+	back := len(s.buf) - s.pos
+	fmt.Fprint(e.out, "\r\x1b[K"+s.prompt+text)
+	if back > 0 {
+		fmt.Fprintf(e.out, "\x1b[%dD", back)
+	}
+}
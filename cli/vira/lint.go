@@ -0,0 +1,421 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"vira/pkg/diagnostics"
+)
+
+// Lint levels, as written in the [lints] section of vira.toml.
+const (
+	lintAllow = "allow"
+	lintWarn  = "warn"
+	lintDeny  = "deny"
+)
+
+// lintRule is a style or correctness check over a single source file.
+type lintRule struct {
+	name        string
+	level       string
+	description string
+	check       func(f *lintFile) []diagnostic
+}
+
+var lintRules = []lintRule{
+	{
+		name:        "unused-include",
+		level:       lintWarn,
+		description: "an included file declares nothing the including file uses",
+		check:       checkUnusedIncludes,
+	},
+	{
+		name:        "shadowed-macro",
+		level:       lintWarn,
+		description: "a macro redefines an earlier macro or has the name of a function",
+		check:       checkShadowedMacros,
+	},
+	{
+		name:        "naming-convention",
+		level:       lintWarn,
+		description: "functions are lower_snake_case and macros UPPER_SNAKE_CASE",
+		check:       checkNaming,
+	},
+	{
+		name:        "unreachable-code",
+		level:       lintDeny,
+		description: "statements after a return statement are never executed",
+		check:       checkUnreachable,
+	},
+}
+
+// lintFile is a source file with everything the rules look at: its parse
+// tree, and the macros of its directives, which the preprocessor consumes
+// before plsa sees the code.
+type lintFile struct {
+	path  string
+	lines []string
+	root  *astNode
+	// functions are the Function nodes of root defined in the file itself.
+	functions []*astNode
+	macros    []symbol
+}
+
+func loadLintFile(path string) (*lintFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	root, err := parseAST(path)
+	if err != nil {
+		return nil, err
+	}
+	src := string(data)
+	f := &lintFile{
+		path:   path,
+		lines:  strings.Split(src, "\n"),
+		root:   root,
+		macros: scanMacros(src),
+	}
+	f.functions = f.nodes("Function")
+	return f, nil
+}
+
+// nodes returns the nodes of root of kind that are in the file itself
+// rather than in a file it includes, and whose names are where the file
+// has them rather than in the body of a macro.
+func (f *lintFile) nodes(kind string) []*astNode {
+	file := displayPath(f.path)
+	var nodes []*astNode
+	f.root.walk(func(n *astNode) {
+		if n.Kind != kind || n.File != file || n.Line < 1 || n.Line > len(f.lines) {
+			return
+		}
+		if n.Value != "" && !nameAt(f.lines[n.Line-1], n.Column, n.Value) {
+			return
+		}
+		nodes = append(nodes, n)
+	})
+	return nodes
+}
+
+// lintLevels returns the level of every rule, applying the overrides of a
+// [lints] manifest section.
+func lintLevels(overrides map[string]string) (map[string]string, error) {
+	levels := map[string]string{}
+	for _, r := range lintRules {
+		levels[r.name] = r.level
+	}
+	for name, level := range overrides {
+		if _, ok := levels[name]; !ok {
+			return nil, fmt.Errorf("unknown lint %q in [lints]", name)
+		}
+		switch level {
+		case lintAllow, lintWarn, lintDeny:
+			levels[name] = level
+		default:
+			return nil, fmt.Errorf("lint %q: level must be allow, warn or deny, not %q", name, level)
+		}
+	}
+	return levels, nil
+}
+
+func newLintCmd() *cobra.Command {
+	var fix, list bool
+
+	cmd := &cobra.Command{
+		Use:   "lint [file...]",
+		Short: "Check source files for style and correctness problems",
+		Long: `Check source files for style and correctness problems.
+
+Without arguments all source files of the current project are checked. The
+level of each lint can be set in the [lints] section of vira.toml:
+
+    [lints]
+    naming-convention = "allow"
+    unused-include = "deny"
+
+Lints at the deny level make the command fail. With --fix, problems that
+have an automatic fix are corrected in place.
+
+The lints look at the parse tree of each file, so the file must parse,
+and at its directives, which the preprocessor removes from the tree.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if list {
+				for _, r := range lintRules {
+					fmt.Printf("%-18s %-5s  %s\n", r.name, r.level, r.description)
+				}
+				return
+			}
+			proj, err := loadProject(".")
+			if err != nil && (err != errNoProject || len(args) == 0) {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			var overrides map[string]string
+			files := args
+			if proj != nil {
+				overrides = proj.manifest.Lints
+				if len(files) == 0 {
+					if files, err = proj.sourceFiles(); err != nil {
+						pterm.Error.Println(err)
+						exit(1)
+					}
+				}
+			}
+			levels, err := lintLevels(overrides)
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			denied, err := runLints(files, levels, fix)
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			if denied > 0 {
+				pterm.Error.Printfln("%d problem(s) at the deny level", denied)
+				exit(1)
+			}
+		},
+	}
+	cmd.Flags().BoolVar(&fix, "fix", false, "apply automatic fixes")
+	cmd.Flags().BoolVar(&list, "list", false, "list all lints and their default levels")
+	return cmd
+}
+
+// runLints checks files and prints the problems found, returning how many
+// were at the deny level.
+func runLints(files []string, levels map[string]string, fix bool) (int, error) {
+	denied, fixed := 0, 0
+	edits := map[string][]textEdit{}
+	for _, path := range files {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return 0, err
+		}
+		f, err := loadLintFile(path)
+		if err != nil {
+			return 0, err
+		}
+		for _, r := range lintRules {
+			level := levels[r.name]
+			if level == lintAllow {
+				continue
+			}
+			for _, d := range r.check(f) {
+				if fix && len(d.Suggestions) > 0 {
+					for _, e := range d.Suggestions[0].Edits {
+						edits[e.File] = append(edits[e.File], e)
+					}
+					fixed++
+					continue
+				}
+				d.File = displayPath(d.File)
+				d.Code = r.name
+				d.Severity = diagnostics.Warning
+				if level == lintDeny {
+					d.Severity = diagnostics.Error
+					denied++
+				}
+				switch {
+				case errorFormat != errorFormatHuman:
+					fmt.Fprint(diagnosticsOutput(), formatLines([]diagnostic{d}))
+					continue
+				case level == lintDeny:
+					pterm.Error.Println(d)
+				default:
+					pterm.Warning.Println(d)
+				}
+				for _, s := range d.Suggestions {
+					pterm.Println("  help: " + s.Message)
+				}
+			}
+		}
+	}
+	for _, file := range sortedKeys(edits) {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return 0, err
+		}
+		if err := os.WriteFile(file, []byte(diagnostics.ApplyEdits(string(data), edits[file])), 0644); err != nil {
+			return 0, err
+		}
+	}
+	if fixed > 0 {
+		pterm.Success.Printfln("Fixed %d problem(s)", fixed)
+	}
+	return denied, nil
+}
+
+func lintDiagnostic(file string, line, column int, msg string) diagnostic {
+	return diagnostic{File: file, Line: line, Column: column, Message: msg}
+}
+
+// usedNames returns the identifiers f refers to, including those in the
+// bodies of the macros it uses, and the macros it uses, which the parse
+// tree has only as their expansions.
+func (f *lintFile) usedNames() map[string]bool {
+	used := map[string]bool{}
+	file := displayPath(f.path)
+	f.root.walk(func(n *astNode) {
+		if n.Kind == "Identifier" && n.File == file {
+			used[n.Value] = true
+		}
+	})
+	for _, t := range tokenize(strings.Join(f.lines, "\n")) {
+		if t.kind == tokIdentifier {
+			used[t.text] = true
+		}
+	}
+	for _, n := range f.functions {
+		delete(used, n.Value)
+	}
+	return used
+}
+
+// declaredNames returns the functions and macros declared in file and the
+// files it includes.
+func (f *lintFile) declaredNames(file string) []string {
+	var names []string
+	closure := includeClosure(file)
+	for _, c := range closure {
+		data, err := os.ReadFile(c)
+		if err != nil {
+			continue
+		}
+		for _, sym := range scanMacros(string(data)) {
+			names = append(names, sym.name)
+		}
+	}
+	f.root.walk(func(n *astNode) {
+		if n.Kind != "Function" {
+			return
+		}
+		for _, c := range closure {
+			if n.File == displayPath(c) {
+				names = append(names, n.Value)
+			}
+		}
+	})
+	return names
+}
+
+func checkUnusedIncludes(f *lintFile) []diagnostic {
+	used := f.usedNames()
+	var diags []diagnostic
+	for i, line := range f.lines {
+		name, system, ok := parseInclude(line)
+		if !ok || system {
+			continue
+		}
+		target := filepath.Join(filepath.Dir(f.path), name)
+		if _, err := os.Stat(target); err != nil {
+			continue
+		}
+		isUsed := false
+		for _, name := range f.declaredNames(target) {
+			if used[name] {
+				isUsed = true
+			}
+		}
+		if isUsed {
+			continue
+		}
+		d := lintDiagnostic(f.path, i+1, 1, fmt.Sprintf("%q is included but nothing it declares is used", name))
+		d.Suggestions = []suggestion{{
+			Message: "remove the include",
+			Edits:   []textEdit{{File: f.path, Line: i + 1, Column: 1, EndLine: i + 2, EndColumn: 1}},
+		}}
+		diags = append(diags, d)
+	}
+	return diags
+}
+
+func checkShadowedMacros(f *lintFile) []diagnostic {
+	// The tree has the functions of the file and of every file it includes.
+	functions := map[string]bool{}
+	f.root.walk(func(n *astNode) {
+		if n.Kind == "Function" {
+			functions[n.Value] = true
+		}
+	})
+	// Macros seen so far, mapped to where they were defined.
+	defined := map[string]string{}
+	var diags []diagnostic
+	for i, line := range f.lines {
+		if name, system, ok := parseInclude(line); ok && !system {
+			target := filepath.Join(filepath.Dir(f.path), name)
+			for _, file := range includeClosure(target) {
+				data, err := os.ReadFile(file)
+				if err != nil {
+					continue
+				}
+				for _, sym := range scanMacros(string(data)) {
+					defined[sym.name] = fmt.Sprintf("%s:%d", displayPath(file), sym.line)
+				}
+			}
+			continue
+		}
+		for _, sym := range f.macros {
+			if sym.line != i+1 {
+				continue
+			}
+			if where, ok := defined[sym.name]; ok {
+				diags = append(diags, lintDiagnostic(f.path, sym.line, sym.column,
+					fmt.Sprintf("macro %s redefines the macro defined at %s", sym.name, where)))
+			} else if functions[sym.name] {
+				diags = append(diags, lintDiagnostic(f.path, sym.line, sym.column,
+					fmt.Sprintf("macro %s shadows the function %s", sym.name, sym.name)))
+			}
+			defined[sym.name] = fmt.Sprintf("%s:%d", displayPath(f.path), sym.line)
+		}
+	}
+	return diags
+}
+
+var (
+	snakeCase      = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+	upperSnakeCase = regexp.MustCompile(`^[A-Z_][A-Z0-9_]*$`)
+)
+
+func checkNaming(f *lintFile) []diagnostic {
+	var diags []diagnostic
+	for _, n := range f.functions {
+		if !snakeCase.MatchString(n.Value) {
+			diags = append(diags, lintDiagnostic(f.path, n.Line, n.Column,
+				fmt.Sprintf("function %s should have a lower_snake_case name", n.Value)))
+		}
+	}
+	for _, sym := range f.macros {
+		if !upperSnakeCase.MatchString(sym.name) {
+			diags = append(diags, lintDiagnostic(f.path, sym.line, sym.column,
+				fmt.Sprintf("macro %s should have an UPPER_SNAKE_CASE name", sym.name)))
+		}
+	}
+	sort.SliceStable(diags, func(i, j int) bool { return diags[i].Line < diags[j].Line })
+	return diags
+}
+
+func checkUnreachable(f *lintFile) []diagnostic {
+	var diags []diagnostic
+	for _, fn := range f.functions {
+		// Report the first statement following a return statement.
+		for i, stmt := range fn.Children {
+			if stmt.Kind == "ReturnStmt" && i+1 < len(fn.Children) {
+				next := fn.Children[i+1]
+				diags = append(diags, lintDiagnostic(f.path, next.Line, next.Column, "unreachable code after return"))
+				break
+			}
+		}
+	}
+	sort.Slice(diags, func(i, j int) bool { return diags[i].Line < diags[j].Line })
+	return diags
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+const (
+	lockfileName    = "vira.lock"
+	lockfileVersion = 1
+)
+
+// lockfile pins the resolved dependency graph of a project: exact versions,
+// where each package was downloaded from and the SHA-256 of its source.
+type lockfile struct {
+	Version  int             `toml:"version"`
+	Packages []lockedPackage `toml:"package"`
+}
+
+type lockedPackage struct {
+	Name     string   `toml:"name"`
+	Version  string   `toml:"version"`
+	Source   string   `toml:"source,omitempty"`
+	Checksum string   `toml:"checksum,omitempty"`
+	Features []string `toml:"features,omitempty"`
+	// Registry names the alternative registry the package came from.
+	Registry string `toml:"registry,omitempty"`
+	// Dependencies are written as "name version".
+	Dependencies []string `toml:"dependencies,omitempty"`
+}
+
+func (l lockedPackage) key() string {
+	return pkgKey(l.Name, l.Version)
+}
+
+// label is the version, followed by the short commit for git packages.
+func (l lockedPackage) label() string {
+	if _, commit, ok := parseGitSource(l.Source); ok && len(commit) > 8 {
+		return l.Version + " (" + commit[:8] + ")"
+	}
+	return l.Version
+}
+
+func (p *project) lockPath() string {
+	return filepath.Join(p.root, lockfileName)
+}
+
+// loadLockfile returns the project's lockfile, or nil if there is none.
+func (p *project) loadLockfile() (*lockfile, error) {
+	var lf lockfile
+	_, err := toml.DecodeFile(p.lockPath(), &lf)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", lockfileName, err)
+	}
+	if lf.Version != lockfileVersion {
+		return nil, fmt.Errorf("%s: unsupported version %d", lockfileName, lf.Version)
+	}
+	// The first package is the project itself, which has no source; callers
+	// take the dependencies as the packages after it.
+	if len(lf.Packages) == 0 || lf.Packages[0].Source != "" {
+		return nil, fmt.Errorf("%s is damaged; delete it and rebuild", lockfileName)
+	}
+	// The lockfile is checked in, so its checksums and commits end up in
+	// cache paths only once they are known to be plain hashes.
+	for _, pkg := range lf.Packages {
+		if pkg.Checksum != "" && !isSHA256(pkg.Checksum) {
+			return nil, fmt.Errorf("%s: invalid checksum for %s", lockfileName, pkg.Name)
+		}
+		if strings.HasPrefix(pkg.Source, "git+") {
+			if _, _, ok := parseGitSource(pkg.Source); !ok {
+				return nil, fmt.Errorf("%s: invalid git source for %s", lockfileName, pkg.Name)
+			}
+		}
+	}
+	return &lf, nil
+}
+
+// String renders the lockfile. The output is stable so that unchanged
+// resolutions leave the file untouched.
+func (lf *lockfile) String() string {
+	var sb strings.Builder
+	sb.WriteString("# This file is generated by vira. Do not edit it by hand.\n")
+	fmt.Fprintf(&sb, "version = %d\n", lf.Version)
+	list := func(items []string) string {
+		quoted := make([]string, len(items))
+		for i, item := range items {
+			quoted[i] = strconv.Quote(item)
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	}
+	for _, pkg := range lf.Packages {
+		sb.WriteString("\n[[package]]\n")
+		fmt.Fprintf(&sb, "name = %s\n", strconv.Quote(pkg.Name))
+		fmt.Fprintf(&sb, "version = %s\n", strconv.Quote(pkg.Version))
+		if pkg.Source != "" {
+			fmt.Fprintf(&sb, "source = %s\n", strconv.Quote(pkg.Source))
+		}
+		if pkg.Registry != "" {
+			fmt.Fprintf(&sb, "registry = %s\n", strconv.Quote(pkg.Registry))
+		}
+		if pkg.Checksum != "" {
+			fmt.Fprintf(&sb, "checksum = %s\n", strconv.Quote(pkg.Checksum))
+		}
+		if len(pkg.Features) > 0 {
+			fmt.Fprintf(&sb, "features = %s\n", list(pkg.Features))
+		}
+		if len(pkg.Dependencies) > 0 {
+			fmt.Fprintf(&sb, "dependencies = %s\n", list(pkg.Dependencies))
+		}
+	}
+	return sb.String()
+}
+
+func (lf *lockfile) lookup(key string) *lockedPackage {
+	for i := range lf.Packages {
+		if lf.Packages[i].key() == key {
+			return &lf.Packages[i]
+		}
+	}
+	return nil
+}
+
+// resolution rebuilds the dependency graph recorded in the lockfile. The
+// first package is the project itself.
+func (lf *lockfile) resolution() *resolution {
+	res := &resolution{packages: map[string]*resolvedPackage{}}
+	for i, pkg := range lf.Packages {
+		rp := &resolvedPackage{Name: pkg.Name, Version: pkg.Version, Features: pkg.Features}
+		for _, dep := range pkg.Dependencies {
+			name, version, _ := strings.Cut(dep, " ")
+			rp.Deps = append(rp.Deps, pkgKey(name, version))
+		}
+		if i == 0 {
+			res.root = pkg.key()
+		}
+		res.packages[pkg.key()] = rp
+	}
+	return res
+}
+
+// satisfies reports whether the lockfile still fits the project: the
+// locked dependencies of the project and of its path dependencies are
+// exactly those of their manifests, and each locked version meets its
+// requirement, comes from the requested source and has the requested
+// features.
+func (lf *lockfile) satisfies(p *project) bool {
+	if len(lf.Packages) == 0 {
+		return false
+	}
+	root := lf.Packages[0]
+	if root.Name != p.manifest.Package.Name || root.Version != p.manifest.Package.Version {
+		return false
+	}
+	return lf.satisfiesDependencies(p, root, p.manifest, p.root, map[string]bool{})
+}
+
+func (lf *lockfile) satisfiesDependencies(p *project, pkg lockedPackage, m *Manifest, dir string, seen map[string]bool) bool {
+	if seen[pkg.key()] {
+		return true
+	}
+	seen[pkg.key()] = true
+	if len(pkg.Dependencies) != len(m.Dependencies) {
+		return false
+	}
+	for _, dep := range pkg.Dependencies {
+		name, version, _ := strings.Cut(dep, " ")
+		want, ok := m.Dependencies[name]
+		if !ok {
+			return false
+		}
+		req, err := parseVersionReq(want.Version)
+		if err != nil {
+			return false
+		}
+		v, err := parseVersion(version)
+		if err != nil || !req.matches(v) {
+			return false
+		}
+		locked := lf.lookup(pkgKey(name, version))
+		if locked == nil {
+			return false
+		}
+		for _, f := range want.Features {
+			if !containsString(locked.Features, f) {
+				return false
+			}
+		}
+		if locked.Registry != want.Registry {
+			return false
+		}
+		switch {
+		case want.Git != "":
+			if !strings.HasPrefix(locked.Source, want.gitSource()+"#") {
+				return false
+			}
+		case want.Path != "":
+			local, err := loadPathDependency(dir, name, want)
+			if err != nil || locked.Source != p.pathSource(local.dir) || local.manifest.Package.Version != locked.Version {
+				return false
+			}
+			if !lf.satisfiesDependencies(p, *locked, local.manifest, local.dir, seen) {
+				return false
+			}
+		case strings.HasPrefix(locked.Source, "git+") || strings.HasPrefix(locked.Source, "path+"):
+			return false
+		}
+	}
+	return true
+}
+
+// newLockfile records res, taking the source of every package from idx.
+// Checksums come from the index, or are reused from old when the source is
+// unchanged. Nothing is downloaded: packages the index publishes no checksum
+// for get theirs when their sources are first used, in sourceDirs.
+func newLockfile(res *resolution, idx *registryIndex, old *lockfile) *lockfile {
+	lf := &lockfile{Version: lockfileVersion}
+	keys := []string{res.root}
+	for _, key := range sortedKeys(res.packages) {
+		if key != res.root {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		pkg := res.packages[key]
+		locked := lockedPackage{Name: pkg.Name, Version: pkg.Version, Features: pkg.Features}
+		for _, dep := range pkg.Deps {
+			d := res.packages[dep]
+			locked.Dependencies = append(locked.Dependencies, d.Name+" "+d.Version)
+		}
+		if key != res.root {
+			entry := idx.lookup(pkg.Name)
+			rec, _ := entry.version(pkg.Version)
+			locked.Source = rec.URL
+			locked.Registry = entry.Registry
+			switch prev := old.lookupSame(key, rec.URL); {
+			case strings.HasPrefix(rec.URL, "git+"):
+				// The commit in the source pins the contents.
+			case strings.HasPrefix(rec.URL, "path+"):
+				// Local sources are used as they are.
+			case rec.Checksum != "":
+				locked.Checksum = rec.Checksum
+			case prev != nil:
+				locked.Checksum = prev.Checksum
+			}
+		}
+		lf.Packages = append(lf.Packages, locked)
+	}
+	return lf
+}
+
+// lookupSame returns the locked package with key if it came from source.
+// It may be called on a nil lockfile.
+func (lf *lockfile) lookupSame(key, source string) *lockedPackage {
+	if lf == nil {
+		return nil
+	}
+	if prev := lf.lookup(key); prev != nil && prev.Source == source {
+		return prev
+	}
+	return nil
+}
+
+type resolveOptions struct {
+	// locked fails instead of changing vira.lock.
+	locked bool
+	// update re-resolves every dependency instead of keeping locked versions.
+	update bool
+	// strategy overrides the one in the manifest.
+	strategy string
+}
+
+// resolve returns the project's dependency graph. An up-to-date vira.lock is
+// used as is; otherwise dependencies are resolved against the registry,
+// keeping locked versions where they still fit, and vira.lock is rewritten.
+func (p *project) resolve(opts resolveOptions) (*resolution, *lockfile, error) {
+	old, err := p.loadLockfile()
+	if err != nil {
+		return nil, nil, err
+	}
+	if old != nil && !opts.update && old.satisfies(p) {
+		p.warnYanked(old)
+		return old.resolution(), old, nil
+	}
+	if opts.locked {
+		if old == nil {
+			return nil, nil, fmt.Errorf("%s is missing and --locked was given", lockfileName)
+		}
+		return nil, nil, fmt.Errorf("%s needs to be updated but --locked was given", lockfileName)
+	}
+
+	idx, err := p.dependencyIndex(old, opts.update)
+	if err != nil {
+		return nil, nil, err
+	}
+	prefer := map[string]bool{}
+	if old != nil && !opts.update {
+		for _, pkg := range old.Packages {
+			prefer[pkg.key()] = true
+		}
+	}
+	strategy := opts.strategy
+	if strategy == "" {
+		strategy = p.manifest.Resolver.Strategy
+	}
+	res, err := resolveDependencies(p.manifest, idx, prefer, strategy)
+	if err != nil {
+		return nil, nil, err
+	}
+	lf := newLockfile(res, idx, old)
+	p.warnYanked(lf)
+	if old == nil || old.String() != lf.String() {
+		if err := os.WriteFile(p.lockPath(), []byte(lf.String()), 0644); err != nil {
+			return nil, nil, err
+		}
+	}
+	return res, lf, nil
+}
+
+// dependencyIndex returns the registry index that the project's
+// dependencies resolve from, with the entries of alternative registries, git
+// and path dependencies filled in. Git commits locked in old are kept unless
+// update is set.
+func (p *project) dependencyIndex(old *lockfile, update bool) (*registryIndex, error) {
+	idx, err := fetchRegistryIndex()
+	if err != nil {
+		return nil, err
+	}
+	if idx, err = p.withAlternativeRegistries(idx); err != nil {
+		return nil, err
+	}
+	if idx, err = withGitDependencies(p.manifest, idx, old, update); err != nil {
+		return nil, err
+	}
+	return p.withPathDependencies(idx)
+}
+
+// warnYanked warns about registry packages in lf whose versions have been
+// yanked. It goes by the registry indexes as last fetched, so that using an
+// up-to-date lockfile needs no network access.
+func (p *project) warnYanked(lf *lockfile) {
+	indexes := map[string]*registryIndex{}
+	for _, pkg := range lf.Packages[1:] {
+		if strings.HasPrefix(pkg.Source, "git+") || strings.HasPrefix(pkg.Source, "path+") {
+			continue
+		}
+		idx, ok := indexes[pkg.Registry]
+		if !ok {
+			location := registryURL()
+			if pkg.Registry != "" {
+				cfg, err := loadGlobalConfig()
+				if err != nil {
+					continue
+				}
+				reg, err := cfg.registry(pkg.Registry)
+				if err != nil {
+					continue
+				}
+				location = reg.Index
+			}
+			idx, _ = cachedIndex(location)
+			indexes[pkg.Registry] = idx
+		}
+		if idx == nil || idx.lookup(pkg.Name) == nil {
+			continue
+		}
+		if rec, ok := idx.lookup(pkg.Name).version(pkg.Version); ok && rec.Yanked {
+			pterm.Warning.Printfln("%s v%s has been yanked, but is kept because %s pins it; run vira update-deps to move to another version", pkg.Name, pkg.Version, lockfileName)
+		}
+	}
+}
+
+// sourceDirs returns, for every dependency locked in lf, the directory
+// holding its sources. Registry packages come from the source cache, checked
+// against their recorded checksums; git packages are checked out at the
+// locked commit and path packages are used in place. Registry packages
+// locked without a checksum get the one of the sources downloaded now, which
+// is written to vira.lock so that later downloads must match it.
+func (p *project) sourceDirs(lf *lockfile) (map[string]string, error) {
+	dirs := map[string]string{}
+	recorded := false
+	for i := range lf.Packages[1:] {
+		pkg := &lf.Packages[i+1]
+		if dir, ok := p.pathSourceDir(pkg.Source); ok {
+			dirs[pkg.key()] = packageIncludeDir(dir)
+			continue
+		}
+		if repo, commit, ok := parseGitSource(pkg.Source); ok {
+			dir, err := gitCheckout(repo, commit)
+			if err != nil {
+				return nil, err
+			}
+			dirs[pkg.key()] = packageIncludeDir(dir)
+			continue
+		}
+		if pkg.Checksum == "" {
+			file, err := cachedPackage(*pkg)
+			if err != nil {
+				return nil, err
+			}
+			if pkg.Checksum, err = fileHash(file); err != nil {
+				return nil, err
+			}
+			recorded = true
+		}
+		dir, err := packageSourceDir(*pkg)
+		if err != nil {
+			return nil, err
+		}
+		dirs[pkg.key()] = dir
+	}
+	if recorded {
+		if err := os.WriteFile(p.lockPath(), []byte(lf.String()), 0644); err != nil {
+			return nil, err
+		}
+	}
+	return dirs, nil
+}
+
+func newUpdateDepsCmd() *cobra.Command {
+	var strategy string
+
+	cmd := &cobra.Command{
+		Use:   "update-deps",
+		Short: "Resolve dependencies again and update vira.lock",
+		Long: `Resolve every dependency again, ignoring the versions in vira.lock, and
+rewrite the lockfile.
+
+By default the newest versions allowed by the requirements are picked. With
+the minimal strategy, set by --strategy or in vira.toml, the oldest are
+picked instead, which checks that the lower bounds of the requirements
+really work:
+
+    [resolver]
+    strategy = "minimal"`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			proj, err := loadProject(".")
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			old, err := proj.loadLockfile()
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			_, lf, err := proj.resolve(resolveOptions{update: true, strategy: strategy})
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			printLockChanges(old, lf)
+		},
+	}
+	cmd.Flags().StringVar(&strategy, "strategy", "", "resolution strategy: maximal or minimal")
+	return cmd
+}
+
+// printLockChanges lists the packages added, removed or changed between two
+// lockfiles.
+func printLockChanges(old, lf *lockfile) {
+	before := map[string]string{}
+	if old != nil {
+		for _, pkg := range old.Packages[1:] {
+			before[pkg.Name] = joinVersions(before[pkg.Name], pkg.label())
+		}
+	}
+	after := map[string]string{}
+	for _, pkg := range lf.Packages[1:] {
+		after[pkg.Name] = joinVersions(after[pkg.Name], pkg.label())
+	}
+	changed := false
+	for _, name := range sortedKeys(after) {
+		switch prev, ok := before[name]; {
+		case !ok:
+			pterm.Info.Printfln("Adding %s v%s", name, after[name])
+		case prev != after[name]:
+			pterm.Info.Printfln("Updating %s v%s -> v%s", name, prev, after[name])
+		default:
+			continue
+		}
+		changed = true
+	}
+	for _, name := range sortedKeys(before) {
+		if _, ok := after[name]; !ok {
+			pterm.Info.Printfln("Removing %s v%s", name, before[name])
+			changed = true
+		}
+	}
+	if !changed {
+		pterm.Success.Println("Dependencies are up to date")
+	}
+}
+
+func joinVersions(list, v string) string {
+	if list == "" {
+		return v
+	}
+	return list + ", v" + v
+}
@@ -0,0 +1,809 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"vira/pkg/diagnostics"
+	"vira/pkg/logging"
+)
+
+func newLSPCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "lsp",
+		Short: "Run the Vira language server over stdio",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			// stdout carries the protocol, so never print anything else there.
+			server := newLSPServer(os.Stdin, os.Stdout)
+			if err := server.serve(); err != nil {
+				logging.Error("language server failed", "err", err)
+				exit(1)
+			}
+			if !server.shutdown {
+				exit(1)
+			}
+		},
+	}
+}
+
+// lspChangeDelay is how long the server waits after the last edit of a
+// document before checking it, so that it does not run the toolchain on
+// every keystroke.
+const lspChangeDelay = 300 * time.Millisecond
+
+type lspServer struct {
+	conn *rpcConn
+
+	// mu guards the documents, which are checked in the background while
+	// the client keeps editing them.
+	mu   sync.Mutex
+	docs map[string]string
+	// versions counts the edits of each open document, so that the result
+	// of a check that the document has changed since is dropped.
+	versions map[string]int
+	// pending holds the timers of the checks scheduled after an edit.
+	pending map[string]*time.Timer
+	// diags holds the diagnostics last published for each document, whose
+	// suggestions are offered as code actions.
+	diags map[string][]diagnostic
+	// root is the workspace the client opened, whose files index covers.
+	root  string
+	index *symbolIndex
+	// hints are the client's inlay hint settings.
+	hints    lspInlayHintSettings
+	shutdown bool
+}
+
+func newLSPServer(r io.Reader, w io.Writer) *lspServer {
+	return &lspServer{
+		conn:     newRPCConn(r, w),
+		docs:     map[string]string{},
+		versions: map[string]int{},
+		pending:  map[string]*time.Timer{},
+		diags:    map[string][]diagnostic{},
+	}
+}
+
+// LSP protocol types, limited to the fields the server uses.
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspTextDocument struct {
+	URI  string `json:"uri"`
+	Text string `json:"text,omitempty"`
+}
+
+type lspTextDocumentPositionParams struct {
+	TextDocument lspTextDocument `json:"textDocument"`
+	Position     lspPosition     `json:"position"`
+}
+
+type lspDiagnostic struct {
+	Range              lspRange                   `json:"range"`
+	Severity           int                        `json:"severity"`
+	Code               string                     `json:"code,omitempty"`
+	Source             string                     `json:"source"`
+	Message            string                     `json:"message"`
+	RelatedInformation []lspDiagnosticRelatedInfo `json:"relatedInformation,omitempty"`
+}
+
+type lspDiagnosticRelatedInfo struct {
+	Location struct {
+		URI   string   `json:"uri"`
+		Range lspRange `json:"range"`
+	} `json:"location"`
+	Message string `json:"message"`
+}
+
+type lspTextEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+type lspCodeAction struct {
+	Title       string          `json:"title"`
+	Kind        string          `json:"kind"`
+	Diagnostics []lspDiagnostic `json:"diagnostics"`
+	IsPreferred bool            `json:"isPreferred,omitempty"`
+	Edit        struct {
+		Changes map[string][]lspTextEdit `json:"changes"`
+	} `json:"edit"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspSymbolInformation struct {
+	Name          string      `json:"name"`
+	Kind          int         `json:"kind"`
+	Location      lspLocation `json:"location"`
+	ContainerName string      `json:"containerName,omitempty"`
+}
+
+type lspDocumentSymbol struct {
+	Name           string   `json:"name"`
+	Detail         string   `json:"detail,omitempty"`
+	Kind           int      `json:"kind"`
+	Range          lspRange `json:"range"`
+	SelectionRange lspRange `json:"selectionRange"`
+}
+
+const (
+	lspSeverityError   = 1
+	lspSeverityWarning = 2
+
+	lspSymbolFunction = 12
+	lspSymbolConstant = 14
+)
+
+func (s *lspServer) serve() error {
+	for {
+		msg, err := s.conn.read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		var req rpcRequest
+		if err := json.Unmarshal(msg, &req); err != nil {
+			s.conn.write(rpcErrorResponse{JSONRPC: "2.0", Error: rpcError{Code: rpcParseError, Message: err.Error()}})
+			continue
+		}
+		if req.Method == "exit" {
+			return nil
+		}
+		result, err := s.handle(req)
+		if req.ID == nil {
+			if err != nil {
+				logging.Error("notification failed", "method", req.Method, "err", err)
+			}
+			continue
+		}
+		if err != nil {
+			var rpcErr *rpcError
+			if !errors.As(err, &rpcErr) {
+				rpcErr = &rpcError{Code: rpcInternalError, Message: err.Error()}
+			}
+			s.conn.write(rpcErrorResponse{JSONRPC: "2.0", ID: req.ID, Error: *rpcErr})
+			continue
+		}
+		s.conn.write(rpcResponse{JSONRPC: "2.0", ID: req.ID, Result: result})
+	}
+}
+
+func (s *lspServer) handle(req rpcRequest) (any, error) {
+	switch req.Method {
+	case "initialize":
+		var params struct {
+			RootURI               string `json:"rootUri"`
+			InitializationOptions struct {
+				InlayHints lspInlayHintSettings `json:"inlayHints"`
+			} `json:"initializationOptions"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		s.hints.merge(params.InitializationOptions.InlayHints)
+		if params.RootURI != "" {
+			root, err := uriToPath(params.RootURI)
+			if err != nil {
+				return nil, err
+			}
+			s.root = root
+		}
+		return map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync": map[string]any{
+					"openClose": true,
+					"change":    1, // full document sync
+					"save":      map[string]any{"includeText": false},
+				},
+				"hoverProvider":                   true,
+				"documentSymbolProvider":          true,
+				"workspaceSymbolProvider":         true,
+				"inlayHintProvider":               true,
+				"definitionProvider":              true,
+				"referencesProvider":              true,
+				"documentFormattingProvider":      true,
+				"documentRangeFormattingProvider": true,
+				"semanticTokensProvider": map[string]any{
+					"legend": map[string]any{"tokenTypes": lspTokenTypes, "tokenModifiers": lspTokenModifiers},
+					"full":   true,
+					"range":  true,
+				},
+				"codeActionProvider": map[string]any{"codeActionKinds": []string{"quickfix"}},
+			},
+			"serverInfo": map[string]any{"name": "vira"},
+		}, nil
+	case "initialized":
+		return nil, nil
+	case "workspace/didChangeConfiguration":
+		var params struct {
+			Settings struct {
+				Vira struct {
+					InlayHints lspInlayHintSettings `json:"inlayHints"`
+				} `json:"vira"`
+			} `json:"settings"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		s.hints.merge(params.Settings.Vira.InlayHints)
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var params struct {
+			TextDocument lspTextDocument `json:"textDocument"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		s.setDocument(params.TextDocument.URI, params.TextDocument.Text)
+		return nil, s.publishDiagnostics(params.TextDocument.URI)
+	case "textDocument/didChange":
+		var params struct {
+			TextDocument   lspTextDocument `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		if n := len(params.ContentChanges); n > 0 {
+			s.setDocument(params.TextDocument.URI, params.ContentChanges[n-1].Text)
+			s.scheduleDiagnostics(params.TextDocument.URI)
+		}
+		return nil, nil
+	case "textDocument/didSave":
+		var params struct {
+			TextDocument lspTextDocument `json:"textDocument"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		return nil, s.publishDiagnostics(params.TextDocument.URI)
+	case "textDocument/didClose":
+		var params struct {
+			TextDocument lspTextDocument `json:"textDocument"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		s.closeDocument(params.TextDocument.URI)
+		return nil, s.conn.write(rpcNotification{
+			JSONRPC: "2.0",
+			Method:  "textDocument/publishDiagnostics",
+			Params:  map[string]any{"uri": params.TextDocument.URI, "diagnostics": []lspDiagnostic{}},
+		})
+	case "textDocument/hover":
+		var params lspTextDocumentPositionParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.hover(params, s.document(params.TextDocument.URI)), nil
+	case "textDocument/documentSymbol":
+		var params struct {
+			TextDocument lspTextDocument `json:"textDocument"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		return documentSymbols(s.document(params.TextDocument.URI)), nil
+	case "workspace/symbol":
+		var params struct {
+			Query string `json:"query"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.workspaceSymbols(params.Query)
+	case "textDocument/definition":
+		var params lspTextDocumentPositionParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.locations(params, true, false)
+	case "textDocument/references":
+		var params struct {
+			lspTextDocumentPositionParams
+			Context struct {
+				IncludeDeclaration bool `json:"includeDeclaration"`
+			} `json:"context"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.locations(params.lspTextDocumentPositionParams, false, params.Context.IncludeDeclaration)
+	case "textDocument/formatting", "textDocument/rangeFormatting":
+		var params struct {
+			TextDocument lspTextDocument `json:"textDocument"`
+			Range        *lspRange       `json:"range"`
+			Options      struct {
+				TabSize      int  `json:"tabSize"`
+				InsertSpaces bool `json:"insertSpaces"`
+			} `json:"options"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		path, err := uriToPath(params.TextDocument.URI)
+		if err != nil {
+			return nil, err
+		}
+		// The project's [format] section wins over the editor's settings.
+		cfg := projectFormatConfig(path)
+		if cfg.IndentWidth == 0 {
+			cfg.IndentWidth = params.Options.TabSize
+		}
+		if cfg.UseTabs == nil {
+			useTabs := !params.Options.InsertSpaces
+			cfg.UseTabs = &useTabs
+		}
+		return formattingEdits(s.document(params.TextDocument.URI), cfg, params.Range), nil
+	case "textDocument/semanticTokens/full", "textDocument/semanticTokens/range":
+		var params struct {
+			TextDocument lspTextDocument `json:"textDocument"`
+			Range        *lspRange       `json:"range"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		path, err := uriToPath(params.TextDocument.URI)
+		if err != nil {
+			return nil, err
+		}
+		text := s.document(params.TextDocument.URI)
+		first, last := 0, strings.Count(text, "\n")
+		if params.Range != nil {
+			first, last = params.Range.Start.Line, params.Range.End.Line
+		}
+		return map[string]any{"data": semanticTokens(path, text, first, last)}, nil
+	case "textDocument/inlayHint":
+		var params struct {
+			TextDocument lspTextDocument `json:"textDocument"`
+			Range        lspRange        `json:"range"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		path, err := uriToPath(params.TextDocument.URI)
+		if err != nil {
+			return nil, err
+		}
+		text := s.document(params.TextDocument.URI)
+		return inlayHints(path, text, params.Range.Start.Line, params.Range.End.Line, s.hints), nil
+	case "textDocument/codeAction":
+		var params struct {
+			TextDocument lspTextDocument `json:"textDocument"`
+			Range        lspRange        `json:"range"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.codeActions(params.TextDocument.URI, params.Range), nil
+	}
+	if req.ID == nil || strings.HasPrefix(req.Method, "$/") {
+		return nil, nil
+	}
+	return nil, &rpcError{Code: rpcMethodNotFound, Message: "method not supported: " + req.Method}
+}
+
+// document returns the text of the open document uri.
+func (s *lspServer) document(uri string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.docs[uri]
+}
+
+func (s *lspServer) setDocument(uri, text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.docs[uri] = text
+	s.versions[uri]++
+}
+
+func (s *lspServer) closeDocument(uri string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t := s.pending[uri]; t != nil {
+		t.Stop()
+	}
+	delete(s.pending, uri)
+	delete(s.docs, uri)
+	delete(s.versions, uri)
+	delete(s.diags, uri)
+}
+
+// scheduleDiagnostics checks uri once it has not been edited for
+// lspChangeDelay.
+func (s *lspServer) scheduleDiagnostics(uri string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t := s.pending[uri]; t != nil {
+		t.Stop()
+	}
+	s.pending[uri] = time.AfterFunc(lspChangeDelay, func() {
+		if err := s.publishDiagnostics(uri); err != nil {
+			logging.Error("checking failed", "uri", uri, "err", err)
+		}
+	})
+}
+
+// publishDiagnostics checks the document uri with the toolchain, as it is
+// in the editor rather than on disk, and sends the result to the client
+// unless the document changed in the meantime.
+func (s *lspServer) publishDiagnostics(uri string) error {
+	path, err := uriToPath(uri)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if t := s.pending[uri]; t != nil {
+		t.Stop()
+		delete(s.pending, uri)
+	}
+	text, open := s.docs[uri]
+	version := s.versions[uri]
+	s.mu.Unlock()
+
+	var diags []diagnostic
+	if open {
+		diags, err = checkText(path, text)
+	} else {
+		diags, err = checkSource(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.versions[uri] != version {
+		return nil
+	}
+	s.diags[uri] = diags
+	items := []lspDiagnostic{}
+	for _, d := range diags {
+		items = append(items, toLSPDiagnostic(d, text))
+	}
+	return s.conn.write(rpcNotification{
+		JSONRPC: "2.0",
+		Method:  "textDocument/publishDiagnostics",
+		Params:  map[string]any{"uri": uri, "diagnostics": items},
+	})
+}
+
+func toLSPDiagnostic(d diagnostic, text string) lspDiagnostic {
+	severity := lspSeverityError
+	if d.Severity == diagnostics.Warning {
+		severity = lspSeverityWarning
+	}
+	message := d.Message
+	for _, note := range d.Notes {
+		message += "\nnote: " + note
+	}
+	for _, s := range d.Suggestions {
+		message += "\nhelp: " + s.Message
+	}
+	diag := lspDiagnostic{
+		Range:    lspSpanRange(d.Primary(), text),
+		Severity: severity,
+		Code:     d.Code,
+		Source:   "vira",
+		Message:  message,
+	}
+	for _, s := range d.Secondary {
+		var info lspDiagnosticRelatedInfo
+		info.Location.URI = pathToURI(s.File)
+		info.Location.Range = lspSpanRange(s, "")
+		info.Message = s.Label
+		diag.RelatedInformation = append(diag.RelatedInformation, info)
+	}
+	return diag
+}
+
+// codeActions offers the suggestions of the diagnostics of uri that overlap
+// rng as quick fixes.
+func (s *lspServer) codeActions(uri string, rng lspRange) []lspCodeAction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	actions := []lspCodeAction{}
+	text := s.docs[uri]
+	for _, d := range s.diags[uri] {
+		diag := toLSPDiagnostic(d, text)
+		if positionBefore(diag.Range.End, rng.Start) || positionBefore(rng.End, diag.Range.Start) {
+			continue
+		}
+		for i, sug := range d.Suggestions {
+			action := lspCodeAction{
+				Title:       sug.Message,
+				Kind:        "quickfix",
+				Diagnostics: []lspDiagnostic{diag},
+				IsPreferred: i == 0,
+			}
+			action.Edit.Changes = map[string][]lspTextEdit{}
+			for _, e := range sug.Edits {
+				editURI := pathToURI(e.File)
+				span := diagnostics.Span{Line: e.Line, Column: e.Column, EndLine: e.EndLine, EndColumn: e.EndColumn}
+				action.Edit.Changes[editURI] = append(action.Edit.Changes[editURI], lspTextEdit{Range: lspSpanRange(span, ""), NewText: e.NewText})
+			}
+			actions = append(actions, action)
+		}
+	}
+	return actions
+}
+
+func positionBefore(a, b lspPosition) bool {
+	return a.Line < b.Line || a.Line == b.Line && a.Character < b.Character
+}
+
+// updateIndex brings the index of the workspace up to date with the files
+// on disk, and returns the unsaved text of the open documents by path.
+func (s *lspServer) updateIndex() (map[string]string, error) {
+	if s.index == nil {
+		root := s.root
+		if root == "" {
+			var err error
+			if root, err = os.Getwd(); err != nil {
+				return nil, err
+			}
+		}
+		s.index = loadSymbolIndex(root)
+	}
+	if err := s.index.update(); err != nil {
+		return nil, err
+	}
+	overlay := map[string]string{}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for uri, text := range s.docs {
+		if p, err := uriToPath(uri); err == nil {
+			overlay[p] = text
+		}
+	}
+	return overlay, nil
+}
+
+// workspaceSymbols finds the functions and macros of the workspace whose
+// names fuzzily match query.
+func (s *lspServer) workspaceSymbols(query string) ([]lspSymbolInformation, error) {
+	overlay, err := s.updateIndex()
+	if err != nil {
+		return nil, err
+	}
+	found := s.index.search(query, overlay)
+	items := []lspSymbolInformation{}
+	for _, path := range sortedKeys(found) {
+		container := path
+		if rel, err := filepath.Rel(s.index.root, path); err == nil && !strings.HasPrefix(rel, "..") {
+			container = filepath.ToSlash(rel)
+		}
+		for _, n := range found[path] {
+			kind := lspSymbolFunction
+			if n.Kind == symMacro {
+				kind = lspSymbolConstant
+			}
+			start := lspPosition{Line: n.Line - 1, Character: n.Column - 1}
+			end := lspPosition{Line: n.Line - 1, Character: n.Column - 1 + len(n.Name)}
+			items = append(items, lspSymbolInformation{
+				Name:          n.Name,
+				Kind:          kind,
+				Location:      lspLocation{URI: pathToURI(path), Range: lspRange{Start: start, End: end}},
+				ContainerName: container,
+			})
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	return items, nil
+}
+
+// locations finds the name at the position of params across the workspace:
+// where it is defined, preferring a definition in the same document, or
+// where it is used, optionally with its definitions.
+func (s *lspServer) locations(params lspTextDocumentPositionParams, definition, includeDeclaration bool) ([]lspLocation, error) {
+	path, err := uriToPath(params.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+	name := wordAt(s.document(params.TextDocument.URI), params.Position.Line+1, params.Position.Character+1)
+	if name == "" || isKeyword(name) {
+		return []lspLocation{}, nil
+	}
+	overlay, err := s.updateIndex()
+	if err != nil {
+		return nil, err
+	}
+	defs := s.index.lookup(name, overlay, true)
+	if definition {
+		if local := defs[path]; local != nil {
+			return sortedLocations(map[string][]indexedName{path: local}), nil
+		}
+		return sortedLocations(defs), nil
+	}
+	uses := s.index.lookup(name, overlay, false)
+	for file, names := range defs {
+		isDef := map[indexedName]bool{}
+		for _, n := range names {
+			isDef[n] = true
+		}
+		kept := names[:0:0]
+		if includeDeclaration {
+			kept = append(kept, names...)
+		}
+		for _, n := range uses[file] {
+			if !isDef[n] {
+				kept = append(kept, n)
+			}
+		}
+		uses[file] = kept
+	}
+	return sortedLocations(uses), nil
+}
+
+// formattingEdits returns the edits that format the lines of text that rng
+// touches, or all of text when rng is nil. Each reindented line is an edit
+// of its own, so that the editor keeps the cursor and folds elsewhere.
+func formattingEdits(text string, cfg FormatConfig, rng *lspRange) []lspTextEdit {
+	lines := strings.Split(text, "\n")
+	formatted := formatSourceLines(text, cfg)
+	first, last := 0, len(lines)-1
+	// Formatting the whole document also ends it in a single newline: the
+	// lines from keep on are removed, and a missing newline is added.
+	keep := len(lines)
+	if rng == nil {
+		keep = strings.Count(formatSource(text, cfg), "\n")
+		last = keep - 1
+	} else {
+		first, last = rng.Start.Line, min(rng.End.Line, last)
+		if rng.End.Character == 0 && last > first {
+			last--
+		}
+	}
+	edits := []lspTextEdit{}
+	for i := first; i <= last; i++ {
+		newText := formatted[i]
+		if rng == nil && i == keep-1 && keep == len(lines) {
+			newText += "\n"
+		} else if newText == lines[i] {
+			continue
+		}
+		edits = append(edits, lspTextEdit{
+			Range:   lspRange{Start: lspPosition{Line: i}, End: lspPosition{Line: i, Character: len(lines[i])}},
+			NewText: newText,
+		})
+	}
+	if rng == nil && keep < len(lines) && (keep < len(lines)-1 || lines[keep] != "") {
+		end := lspPosition{Line: len(lines) - 1, Character: len(lines[len(lines)-1])}
+		edits = append(edits, lspTextEdit{Range: lspRange{Start: lspPosition{Line: keep}, End: end}})
+	}
+	return edits
+}
+
+// lspSpanRange converts a span to an LSP range. Without an end column, the
+// range covers the word at the start in text.
+func lspSpanRange(s diagnostics.Span, text string) lspRange {
+	start := lspPosition{Line: s.Line - 1, Character: s.Column - 1}
+	end := start
+	switch {
+	case s.EndColumn > 0:
+		end.Character = s.EndColumn - 1
+		if s.EndLine > 0 {
+			end.Line = s.EndLine - 1
+		}
+	case wordAt(text, s.Line, s.Column) != "":
+		end.Character += len(wordAt(text, s.Line, s.Column))
+	default:
+		end.Character++
+	}
+	return lspRange{Start: start, End: end}
+}
+
+var keywordDocs = map[string]string{
+	"int":    "`int` — the 32-bit signed integer type; also introduces function definitions.",
+	"return": "`return expr;` — returns the value of expr from the enclosing function.",
+	"if":     "`if` — conditional statement (reserved).",
+	"else":   "`else` — alternative branch of an `if` (reserved).",
+	"while":  "`while` — loop statement (reserved).",
+	"for":    "`for` — loop statement (reserved).",
+}
+
+func (s *lspServer) hover(params lspTextDocumentPositionParams, text string) any {
+	word := wordAt(text, params.Position.Line+1, params.Position.Character+1)
+	if word == "" {
+		return nil
+	}
+	var value string
+	if doc, ok := keywordDocs[word]; ok {
+		value = doc
+	}
+	for _, sym := range scanSymbols(text) {
+		if sym.name != word {
+			continue
+		}
+		switch sym.kind {
+		case symFunction:
+			value = fmt.Sprintf("```vira\n%s\n```\nDefined on line %d.", sym.detail, sym.line)
+		case symMacro:
+			value = fmt.Sprintf("```vira\n%s\n```\nMacro defined on line %d.", sym.detail, sym.line)
+		}
+		break
+	}
+	if value == "" {
+		return nil
+	}
+	return map[string]any{"contents": map[string]any{"kind": "markdown", "value": value}}
+}
+
+func documentSymbols(text string) []lspDocumentSymbol {
+	items := []lspDocumentSymbol{}
+	for _, sym := range scanSymbols(text) {
+		kind := lspSymbolFunction
+		if sym.kind == symMacro {
+			kind = lspSymbolConstant
+		}
+		items = append(items, lspDocumentSymbol{
+			Name:   sym.name,
+			Detail: sym.detail,
+			Kind:   kind,
+			Range: lspRange{
+				Start: lspPosition{Line: sym.startLine - 1, Character: sym.startColumn - 1},
+				End:   lspPosition{Line: sym.endLine - 1, Character: sym.endColumn - 1},
+			},
+			SelectionRange: lspRange{
+				Start: lspPosition{Line: sym.line - 1, Character: sym.column - 1},
+				End:   lspPosition{Line: sym.line - 1, Character: sym.column - 1 + len(sym.name)},
+			},
+		})
+	}
+	return items
+}
+
+func uriToPath(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("unsupported URI scheme %q", u.Scheme)
+	}
+	path := u.Path
+	// file:///C:/dir/file.vira
+	if runtime.GOOS == "windows" && len(path) > 2 && path[0] == '/' && path[2] == ':' {
+		path = path[1:]
+	}
+	return filepath.FromSlash(path), nil
+}
+
+func pathToURI(path string) string {
+	path = filepath.ToSlash(path)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
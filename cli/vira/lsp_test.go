@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// TestLSPCapabilities checks that the initialize response announces the
+// requests the server handles, since clients send no others.
+func TestLSPCapabilities(t *testing.T) {
+	s := newLSPServer(strings.NewReader(""), &bytes.Buffer{})
+	result, err := s.handle(rpcRequest{Method: "initialize", Params: json.RawMessage(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp struct {
+		Capabilities map[string]any `json:"capabilities"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		"hoverProvider",
+		"documentSymbolProvider",
+		"workspaceSymbolProvider",
+		"definitionProvider",
+		"referencesProvider",
+		"documentFormattingProvider",
+		"inlayHintProvider",
+	} {
+		if resp.Capabilities[name] != true {
+			t.Errorf("initialize does not announce %s: %s", name, data)
+		}
+	}
+}
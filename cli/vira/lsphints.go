@@ -0,0 +1,153 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// Inlay hints show what the source leaves implicit: the type a macro
+// evaluates to, which its #define does not state, and the value a macro
+// stands for where it is used. Vira functions take no parameters yet, so
+// there are no parameter name hints.
+
+// lspInlayHintSettings toggles the kinds of inlay hints. The client sets
+// them in the initializationOptions of initialize, or later as the
+// vira.inlayHints settings of workspace/didChangeConfiguration.
+type lspInlayHintSettings struct {
+	Types       *bool `json:"types"`
+	MacroValues *bool `json:"macroValues"`
+}
+
+// merge applies the settings given in other.
+func (h *lspInlayHintSettings) merge(other lspInlayHintSettings) {
+	if other.Types != nil {
+		h.Types = other.Types
+	}
+	if other.MacroValues != nil {
+		h.MacroValues = other.MacroValues
+	}
+}
+
+// hintEnabled reports whether a setting is on; hints are shown unless turned
+// off.
+func hintEnabled(setting *bool) bool {
+	return setting == nil || *setting
+}
+
+type lspInlayHint struct {
+	Position    lspPosition `json:"position"`
+	Label       string      `json:"label"`
+	Kind        int         `json:"kind,omitempty"`
+	PaddingLeft bool        `json:"paddingLeft,omitempty"`
+}
+
+const lspInlayHintType = 1
+
+// maxMacroValueHint is the longest macro value shown at its uses; longer
+// ones would push the code out of view.
+const maxMacroValueHint = 24
+
+// macroDefinition is the body of a #define and the type it evaluates to,
+// if that can be told.
+type macroDefinition struct {
+	body  string
+	isInt bool
+}
+
+// inlayHints returns the hints for text, the contents of path, on the lines
+// from first to last, 0-based and inclusive.
+func inlayHints(path, text string, first, last int, settings lspInlayHintSettings) []lspInlayHint {
+	var sources []string
+	for _, file := range includeClosure(path) {
+		if file == path {
+			continue
+		}
+		if data, err := os.ReadFile(file); err == nil {
+			sources = append(sources, string(data))
+		}
+	}
+	sources = append(sources, text)
+	macros := map[string]*macroDefinition{}
+	for _, src := range sources {
+		for _, sym := range scanMacros(src) {
+			fields := strings.Fields(strings.TrimPrefix(sym.detail, "#"))
+			macros[sym.name] = &macroDefinition{body: strings.Join(fields[2:], " ")}
+		}
+	}
+	// The functions are those of the parse tree, which has the ones of the
+	// included files too.
+	kinds, _ := documentNames(path, text)
+	functions := map[string]bool{}
+	for name, kind := range kinds {
+		if kind == symFunction {
+			functions[name] = true
+		}
+	}
+	// A macro is an int when its body is made of numbers, operators, calls
+	// and other int macros; resolve them until nothing changes.
+	for changed := true; changed; {
+		changed = false
+		for _, m := range macros {
+			if !m.isInt && intExpression(m.body, macros, functions) {
+				m.isInt, changed = true, true
+			}
+		}
+	}
+
+	hints := []lspInlayHint{}
+	for _, t := range tokenize(text) {
+		line := t.line - 1
+		if line < first || line > last {
+			continue
+		}
+		switch t.kind {
+		case tokDirective:
+			fields := strings.Fields(strings.TrimPrefix(t.text, "#"))
+			if !hintEnabled(settings.Types) || len(fields) < 3 || fields[0] != "define" || !macros[fields[1]].isInt {
+				continue
+			}
+			afterDefine := strings.Index(t.text, "define") + len("define")
+			nameEnd := afterDefine + strings.Index(t.text[afterDefine:], fields[1]) + len(fields[1])
+			hints = append(hints, lspInlayHint{
+				Position: lspPosition{Line: line, Character: t.column - 1 + nameEnd},
+				Label:    ": int",
+				Kind:     lspInlayHintType,
+			})
+		case tokIdentifier:
+			m := macros[t.text]
+			if !hintEnabled(settings.MacroValues) || m == nil || m.body == "" || len(m.body) > maxMacroValueHint {
+				continue
+			}
+			hints = append(hints, lspInlayHint{
+				Position:    lspPosition{Line: line, Character: t.end() - 1},
+				Label:       "= " + m.body,
+				PaddingLeft: true,
+			})
+		}
+	}
+	return hints
+}
+
+// intExpression reports whether body evaluates to an int.
+func intExpression(body string, macros map[string]*macroDefinition, functions map[string]bool) bool {
+	toks := tokenize(body)
+	if len(toks) == 0 {
+		return false
+	}
+	for _, t := range toks {
+		switch t.kind {
+		case tokNumber:
+		case tokPunct:
+			if !strings.Contains("+-*/()", t.text) {
+				return false
+			}
+		case tokIdentifier:
+			if m := macros[t.text]; !functions[t.text] && (m == nil || !m.isInt) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The language server answers go-to-definition, find-references and
+// workspace symbol searches from an index of the names every .vira file of
+// the workspace defines and uses. The index is kept below cacheDir, one
+// file per workspace, and only the files that changed since it was written
+// are read again.
+
+// symbolIndexVersion is bumped whenever what is indexed changes, so that an
+// index written by an older vira is rebuilt rather than trusted.
+const symbolIndexVersion = 3
+
+type symbolIndex struct {
+	Version int                     `json:"version"`
+	Files   map[string]*indexedFile `json:"files"`
+
+	root string
+	path string
+}
+
+// indexedFile is what the index knows about one file: when it was read, and
+// where it defines and uses names.
+type indexedFile struct {
+	ModTime     time.Time     `json:"modTime"`
+	Size        int64         `json:"size"`
+	Definitions []indexedName `json:"definitions,omitempty"`
+	Uses        []indexedName `json:"uses,omitempty"`
+}
+
+// indexedName is an occurrence of a name at a 1-based line and column.
+// Definitions also record whether they are a function or a macro.
+type indexedName struct {
+	Name   string     `json:"name"`
+	Line   int        `json:"line"`
+	Column int        `json:"column"`
+	Kind   symbolKind `json:"kind,omitempty"`
+}
+
+// loadSymbolIndex returns the index of the workspace in root as it was last
+// saved. A missing or unreadable index is started afresh.
+func loadSymbolIndex(root string) *symbolIndex {
+	sum := sha256.Sum256([]byte(root))
+	x := &symbolIndex{root: root}
+	if path, err := cacheSubdir("lsp", hex.EncodeToString(sum[:8])+".json"); err == nil {
+		x.path = path
+		if data, err := os.ReadFile(path); err == nil {
+			json.Unmarshal(data, x)
+		}
+	}
+	if x.Version != symbolIndexVersion || x.Files == nil {
+		x.Version = symbolIndexVersion
+		x.Files = map[string]*indexedFile{}
+	}
+	return x
+}
+
+// update reads the files of the workspace that were added or changed since
+// they were indexed and forgets those that were removed. The index is saved
+// if anything changed.
+func (x *symbolIndex) update() error {
+	seen := map[string]bool{}
+	changed := false
+	err := filepath.WalkDir(x.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		// Hidden files include the copies of unsaved documents that are
+		// checked next to the originals.
+		hidden := strings.HasPrefix(d.Name(), ".") && path != x.root
+		if d.IsDir() {
+			if hidden || d.Name() == "target" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if hidden || filepath.Ext(path) != ".vira" {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		seen[path] = true
+		if f := x.Files[path]; f != nil && f.ModTime.Equal(info.ModTime()) && f.Size == info.Size() {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		f := indexText(path, string(data))
+		f.ModTime, f.Size = info.ModTime(), info.Size()
+		x.Files[path] = f
+		changed = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for path := range x.Files {
+		if !seen[path] {
+			delete(x.Files, path)
+			changed = true
+		}
+	}
+	if !changed || x.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(x.path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(x.path, data, 0644)
+}
+
+// indexText finds the top-level declarations of text, the contents of
+// path, and every use of an identifier in it. Functions and identifiers
+// come from the parse tree, and macros from the directives; without a
+// tree, everything is found by scanning.
+func indexText(path, text string) *indexedFile {
+	f := &indexedFile{}
+	root := parseDocument(path, text)
+	if root == nil {
+		for _, sym := range scanSymbols(text) {
+			f.Definitions = append(f.Definitions, indexedName{Name: sym.name, Line: sym.line, Column: sym.column, Kind: sym.kind})
+		}
+		for _, t := range tokenize(text) {
+			if t.kind == tokIdentifier {
+				f.Uses = append(f.Uses, indexedName{Name: t.text, Line: t.line, Column: t.column})
+			}
+		}
+		return f
+	}
+	lines := strings.Split(text, "\n")
+	file := displayPath(path)
+	parsed := map[[2]int]bool{}
+	root.walk(func(n *astNode) {
+		if n.File != file || n.Line < 1 || n.Line > len(lines) || !nameAt(lines[n.Line-1], n.Column, n.Value) {
+			return
+		}
+		switch n.Kind {
+		case "Function":
+			f.Definitions = append(f.Definitions, indexedName{Name: n.Value, Line: n.Line, Column: n.Column, Kind: symFunction})
+		case "Identifier":
+			f.Uses = append(f.Uses, indexedName{Name: n.Value, Line: n.Line, Column: n.Column})
+		default:
+			return
+		}
+		parsed[[2]int{n.Line, n.Column}] = true
+	})
+	for _, sym := range scanMacros(text) {
+		f.Definitions = append(f.Definitions, indexedName{Name: sym.name, Line: sym.line, Column: sym.column, Kind: sym.kind})
+	}
+	// The preprocessor replaces the uses of macros with their bodies, so
+	// they are the identifiers of text the tree does not have.
+	for _, t := range tokenize(text) {
+		if t.kind == tokIdentifier && !parsed[[2]int{t.line, t.column}] {
+			f.Uses = append(f.Uses, indexedName{Name: t.text, Line: t.line, Column: t.column})
+		}
+	}
+	sort.Slice(f.Uses, func(i, j int) bool {
+		a, b := f.Uses[i], f.Uses[j]
+		return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+	})
+	return f
+}
+
+// withOverlay returns the indexed files, with the open documents of overlay,
+// keyed by path, indexed from their unsaved text instead.
+func (x *symbolIndex) withOverlay(overlay map[string]string) map[string]*indexedFile {
+	files := make(map[string]*indexedFile, len(x.Files))
+	for path, f := range x.Files {
+		files[path] = f
+	}
+	for path, text := range overlay {
+		files[path] = indexText(path, text)
+	}
+	return files
+}
+
+// lookup returns the occurrences of name across the workspace, by file, in
+// the definitions or the uses. Open documents are looked up in their
+// unsaved text given by overlay, keyed by path.
+func (x *symbolIndex) lookup(name string, overlay map[string]string, definitions bool) map[string][]indexedName {
+	files := x.withOverlay(overlay)
+	found := map[string][]indexedName{}
+	for path, f := range files {
+		names := f.Uses
+		if definitions {
+			names = f.Definitions
+		}
+		for _, n := range names {
+			if n.Name == name {
+				found[path] = append(found[path], n)
+			}
+		}
+	}
+	return found
+}
+
+// search returns the definitions across the workspace whose names match
+// query, by file. A name matches when it contains the letters of query in
+// order, ignoring case, so that "rdcfg" finds read_config.
+func (x *symbolIndex) search(query string, overlay map[string]string) map[string][]indexedName {
+	files := x.withOverlay(overlay)
+	query = strings.ToLower(query)
+	found := map[string][]indexedName{}
+	for path, f := range files {
+		for _, n := range f.Definitions {
+			if fuzzyMatch(strings.ToLower(n.Name), query) {
+				found[path] = append(found[path], n)
+			}
+		}
+	}
+	return found
+}
+
+func fuzzyMatch(name, query string) bool {
+	for _, c := range query {
+		i := strings.IndexRune(name, c)
+		if i < 0 {
+			return false
+		}
+		name = name[i+1:]
+	}
+	return true
+}
+
+// sortedLocations flattens found into LSP locations, ordered by file and
+// position.
+func sortedLocations(found map[string][]indexedName) []lspLocation {
+	locations := []lspLocation{}
+	for _, path := range sortedKeys(found) {
+		names := found[path]
+		sort.Slice(names, func(i, j int) bool {
+			return names[i].Line < names[j].Line || names[i].Line == names[j].Line && names[i].Column < names[j].Column
+		})
+		for _, n := range names {
+			start := lspPosition{Line: n.Line - 1, Character: n.Column - 1}
+			end := lspPosition{Line: n.Line - 1, Character: n.Column - 1 + len(n.Name)}
+			locations = append(locations, lspLocation{URI: pathToURI(path), Range: lspRange{Start: start, End: end}})
+		}
+	}
+	return locations
+}
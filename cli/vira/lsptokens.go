@@ -0,0 +1,159 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// Semantic tokens let editors color Vira code by what a name is, which a
+// TextMate grammar cannot tell: a function from a macro from a variable.
+// The tokens come from the same lexer as the other editor features, and
+// names are resolved against the parse tree of the document, which has the
+// functions of the files it includes, and against the macros their
+// directives define.
+
+// lspTokenTypes is the legend of token types announced to the client; a
+// token refers to its type by index.
+var lspTokenTypes = []string{"keyword", "type", "function", "macro", "variable", "number", "string"}
+
+// lspTokenModifiers is the legend of token modifiers, a bit set per token.
+var lspTokenModifiers = []string{"declaration"}
+
+const (
+	lspTokenKeyword = iota
+	lspTokenType
+	lspTokenFunction
+	lspTokenMacro
+	lspTokenVariable
+	lspTokenNumber
+	lspTokenString
+)
+
+const lspModifierDeclaration = 1 << 0
+
+// semanticToken is a token of a single line, at a 0-based line and
+// character.
+type semanticToken struct {
+	line, char, length int
+	typ, modifiers     int
+}
+
+// semanticTokens classifies the tokens of text, the contents of path, on
+// the lines from first to last, 0-based and inclusive, and encodes them
+// relative to each other as the protocol wants them.
+func semanticTokens(path, text string, first, last int) []int {
+	kinds, declared := documentNames(path, text)
+
+	var toks []semanticToken
+	lexed := tokenize(text)
+	for i, t := range lexed {
+		if t.line-1 < first || t.line-1 > last {
+			continue
+		}
+		tok := semanticToken{line: t.line - 1, char: t.column - 1, length: len(t.text)}
+		switch t.kind {
+		case tokKeyword:
+			tok.typ = lspTokenKeyword
+			if t.text == "int" {
+				tok.typ = lspTokenType
+			}
+		case tokNumber:
+			tok.typ = lspTokenNumber
+		case tokString:
+			tok.typ = lspTokenString
+		case tokIdentifier:
+			kind, known := kinds[t.text]
+			switch {
+			case known && kind == symMacro:
+				tok.typ = lspTokenMacro
+			case known, i+1 < len(lexed) && lexed[i+1].text == "(":
+				tok.typ = lspTokenFunction
+			default:
+				tok.typ = lspTokenVariable
+			}
+			if declared[[2]int{t.line, t.column}] {
+				tok.modifiers = lspModifierDeclaration
+			}
+		case tokDirective:
+			toks = append(toks, directiveTokens(t, declared)...)
+			continue
+		default:
+			continue
+		}
+		toks = append(toks, tok)
+	}
+
+	data := make([]int, 0, 5*len(toks))
+	prevLine, prevChar := 0, 0
+	for _, tok := range toks {
+		char := tok.char
+		if tok.line == prevLine {
+			char -= prevChar
+		}
+		data = append(data, tok.line-prevLine, char, tok.length, tok.typ, tok.modifiers)
+		prevLine, prevChar = tok.line, tok.char
+	}
+	return data
+}
+
+// documentNames returns the kinds of the names text, the contents of path,
+// and the files it includes declare, and the positions of the names text
+// declares. Without a parse tree the functions are found by scanning.
+func documentNames(path, text string) (map[string]symbolKind, map[[2]int]bool) {
+	kinds := map[string]symbolKind{}
+	declared := map[[2]int]bool{}
+	root := parseDocument(path, text)
+	scan := scanMacros
+	if root == nil {
+		scan = scanSymbols
+	}
+	for _, file := range includeClosure(path) {
+		if file == path {
+			continue
+		}
+		if data, err := os.ReadFile(file); err == nil {
+			for _, sym := range scan(string(data)) {
+				kinds[sym.name] = sym.kind
+			}
+		}
+	}
+	for _, sym := range scan(text) {
+		kinds[sym.name] = sym.kind
+		declared[[2]int{sym.line, sym.column}] = true
+	}
+	if root == nil {
+		return kinds, declared
+	}
+	lines := strings.Split(text, "\n")
+	file := displayPath(path)
+	root.walk(func(n *astNode) {
+		if n.Kind != "Function" {
+			return
+		}
+		kinds[n.Value] = symFunction
+		if n.File == file && n.Line >= 1 && n.Line <= len(lines) && nameAt(lines[n.Line-1], n.Column, n.Value) {
+			declared[[2]int{n.Line, n.Column}] = true
+		}
+	})
+	return kinds, declared
+}
+
+// directiveTokens splits a preprocessor directive into the directive
+// itself, a keyword, and the name of the macro it defines.
+func directiveTokens(t token, declared map[[2]int]bool) []semanticToken {
+	fields := strings.Fields(strings.TrimPrefix(t.text, "#"))
+	if len(fields) == 0 {
+		return nil
+	}
+	nameEnd := strings.Index(t.text, fields[0]) + len(fields[0])
+	toks := []semanticToken{{line: t.line - 1, char: t.column - 1, length: nameEnd, typ: lspTokenKeyword}}
+	if fields[0] == "define" && len(fields) >= 2 {
+		column := t.column + nameEnd + strings.Index(t.text[nameEnd:], fields[1])
+		tok := semanticToken{line: t.line - 1, char: column - 1, length: len(fields[1]), typ: lspTokenMacro}
+		if declared[[2]int{t.line, column}] {
+			tok.modifiers = lspModifierDeclaration
+		}
+		toks = append(toks, tok)
+	}
+	return toks
+}
@@ -1,37 +1,92 @@
 package main
 
 import (
+	"encoding/json"
+	"log/slog"
 	"os"
 	"os/exec"
-	"path/filepath"
-	"runtime"
+	"strings"
+	"sync"
 
 	"github.com/pterm/pterm"
 	"github.com/spf13/cobra"
+
+	"vira/pkg/diagnostics"
+	"vira/pkg/interrupt"
+	"vira/pkg/logging"
+	"vira/pkg/terminal"
+	"vira/pkg/toolchain"
 )
 
-var binPath string
+// systemBinPath is toolchain.SystemBinDir, resolved when a command first
+// needs it rather than at startup, so that commands which do not run the
+// toolchain, such as vira --help, work on any platform.
+var systemBinPath = sync.OnceValues(toolchain.SystemBinDir)
 
-func init() {
-	osName := runtime.GOOS
-	if osName == "linux" {
-		binPath = "/usr/lib/vira-lang/bin"
-	} else if osName == "windows" {
-		programFiles := os.Getenv("ProgramFiles")
-		if programFiles == "" {
-			programFiles = "C:\\Program Files"
-		}
-		binPath = filepath.Join(programFiles, "ViraLang", "bin")
-	} else {
-		pterm.Fatal.Println("Unsupported OS")
-		os.Exit(1)
-	}
+// logLevel and logFormat are set by --log-level and --log-format.
+var logLevel, logFormat string
+
+// assumeYes is set by --yes: questions are answered with yes without being
+// asked.
+var assumeYes bool
+
+// jsonOutput is set by --json: commands that support it print their result
+// to stdout as JSON for scripts, and the human output goes to stderr.
+var jsonOutput bool
+
+// printJSON writes the result of a command to stdout for --json.
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
 }
 
+// skipToolchain is the annotation of commands that run without selecting the
+// project's toolchain, because they manage or install toolchains themselves
+// or do not need one. It applies to their subcommands too.
+const skipToolchain = "skipToolchain"
+
 func main() {
 	var rootCmd = &cobra.Command{
 		Use:   "vira",
 		Short: "Vira general CLI tool",
+		Long: `Vira general CLI tool.
+
+A command vira does not know is run as the executable vira-<command> from
+PATH, with the remaining arguments, so that plugins can add commands.`,
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			if jsonOutput {
+				pterm.SetDefaultOutput(os.Stderr)
+				terminal.Setup(os.Stderr)
+			} else {
+				terminal.Setup(os.Stdout)
+			}
+			if err := logging.Setup("vira", logLevel, logFormat, slog.LevelWarn); err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			if errorFormat != errorFormatHuman && errorFormat != errorFormatShort && errorFormat != errorFormatGitHub {
+				pterm.Error.Printfln("unknown error format %q (use human, short or github)", errorFormat)
+				exit(1)
+			}
+			if err := migrateLegacyHome(); err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			startTelemetry(cmd)
+			for c := cmd; c != nil; c = c.Parent() {
+				if c.Annotations[skipToolchain] == "true" {
+					return
+				}
+			}
+			if err := selectProjectToolchain(); err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+		},
+		PersistentPostRun: func(cmd *cobra.Command, args []string) {
+			finishTelemetry(0)
+		},
 	}
 
 	var compileCmd = &cobra.Command{
@@ -43,82 +98,129 @@ func main() {
 		},
 	}
 
+	var repair bool
 	var updateCmd = &cobra.Command{
 		Use:   "update",
 		Short: "Update Vira tools",
+		Long: `Update Vira tools to the latest release.
+
+With --repair, the active toolchain is downloaded again at its current
+version and unpacked over the installed one, restoring tools that are
+missing or damaged.`,
 		Run: func(cmd *cobra.Command, args []string) {
+			if repair {
+				if err := repairToolchain(); err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+				return
+			}
 			update()
 		},
 	}
+	updateCmd.Flags().BoolVar(&repair, "repair", false, "download the active toolchain again to restore missing or damaged tools")
+
+	rootCmd.PersistentFlags().StringVar(&errorFormat, "error-format", errorFormatHuman, "how to show diagnostics: human, short for one line each, or github for GitHub Actions annotations")
+	rootCmd.PersistentFlags().IntVar(&maxErrors, "max-errors", maxErrors, "stop showing diagnostics after this many errors, or 0 for no limit")
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "", "log what vira does behind its output from this level on: "+strings.Join(logging.Levels(), ", ")+" (VIRA_LOG; warn by default)")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "", "write the log as text or json (VIRA_LOG_FORMAT; text by default)")
+	rootCmd.PersistentFlags().BoolVarP(&assumeYes, "yes", "y", false, "answer yes to questions, such as whether to install a toolchain a project needs")
+	rootCmd.PersistentFlags().BoolVar(&jsonOutput, "json", false, "print the result as JSON on stdout, for commands that support it, and everything else on stderr")
+	rootCmd.PersistentFlags().BoolVar(&offlineFlag, "offline", false, "work without network access, using only vendored sources and local caches")
+	rootCmd.AddCommand(compileCmd, updateCmd, newScriptCmd(), newReplCmd(), newLSPCmd(), newDAPCmd(), newBuildCmd(), newBuildServerCmd(), newGraphCmd(), newTreeCmd(), newExpandCmd(), newASTCmd(), newIDECmd(), newExplainCmd(), newFixCmd(), newLintCmd(), newFmtCmd(), newAuditCmd(), newVendorCmd(), newPublishCmd(), newAddCmd(), newRemoveCmd(), newSearchCmd(), newInstallCmd(), newUninstallCmd(), newLoginCmd(), newLogoutCmd(), newUpdateDepsCmd(), newYankCmd(), newOutdatedCmd(), newToolchainCmd(), newComponentCmd(), newSetupCmd(), newDoctorCmd(), newConfigCmd(), newReportCmd(), newTelemetryCmd(), newCacheCmd(), newManCmd(), newSelfCmd(), newStatsCmd(), newLicenseCmd(), newNewCmd(), newTaskCmd(), newVerifyBuildCmd(), newTestCmd(), newBenchCmd(), newProfileCmd(), newRunCmd(), newBindgenCmd())
 
-	rootCmd.AddCommand(compileCmd, updateCmd)
+	interrupt.Handle(func(code int) {
+		noteTelemetryError(interrupt.ErrInterrupted)
+		pterm.Warning.Println("Interrupted")
+		exit(code)
+	})
+
+	if exe, ok := findPlugin(rootCmd, os.Args[1:]); ok {
+		code, err := runPlugin(exe, os.Args[2:])
+		if err != nil {
+			pterm.Error.Println(err)
+		}
+		os.Exit(code)
+	}
 
 	if err := rootCmd.Execute(); err != nil {
 		pterm.Error.Println(err)
-		os.Exit(1)
+		exit(1)
 	}
 }
 
 func compile(inputFile string) {
-	outputPre := inputFile + ".pre"
-
-	pterm.DefaultSection.Println("Preprocessing")
-	preprocessor := filepath.Join(binPath, "preprocessor")
-	if runtime.GOOS == "windows" {
-		preprocessor += ".exe"
-	}
-	cmdPre := exec.Command(preprocessor, inputFile, outputPre)
-	if out, err := cmdPre.CombinedOutput(); err != nil {
-		pterm.Error.Println(string(out))
-		os.Exit(1)
+	if err := ensureTools("preprocessor", "plsa", "compiler"); err != nil {
+		pterm.Error.Println(err)
+		exit(1)
 	}
-	pterm.Success.Println("Preprocessing done")
-
-	pterm.DefaultSection.Println("Parsing and Checking")
-	plsa := filepath.Join(binPath, "plsa")
-	if runtime.GOOS == "windows" {
-		plsa += ".exe"
+	// The preprocessed file and the object are written next to the input,
+	// as input.vira.pre and input.vira.o.
+	b, err := newObjectBuild(inputFile, inputFile+".o")
+	if err != nil {
+		pterm.Error.Println(err)
+		exit(1)
 	}
-	cmdPlsa := exec.Command(plsa, outputPre)
-	if out, err := cmdPlsa.CombinedOutput(); err != nil {
-		pterm.Error.Println(string(out))
-		os.Exit(1)
+	sections := []struct{ title, done string }{
+		{"Preprocessing", "Preprocessing done"},
+		{"Parsing and Checking", "PLSA done"},
+		{"Compiling", "Compilation done"},
 	}
-	pterm.Success.Println("PLSA done")
-
-	// Assume diagnostic needs error simulation, but for now skip or mock
-	// diagnostic := filepath.Join(binPath, "diagnostic")
-	// cmdDiag := exec.Command(diagnostic, "--source", outputPre, "--message", "error", "--line", "1", "--column", "1")
-	// if out, err := cmdDiag.CombinedOutput(); err != nil {
-	// 	pterm.Error.Println(string(out))
-	// 	os.Exit(1)
-	// }
-	// pterm.Success.Println("Diagnostic done")
-
-	pterm.DefaultSection.Println("Compiling")
-	compiler := filepath.Join(binPath, "compiler")
-	if runtime.GOOS == "windows" {
-		compiler += ".exe"
+	for i, section := range sections {
+		pterm.DefaultSection.Println(section.title)
+		if err := b.stage(i); err != nil {
+			printError(compileError(b.source, err))
+			exit(1)
+		}
+		pterm.Success.Println(section.done)
 	}
-	outputObj := inputFile + ".o"
-	cmdComp := exec.Command(compiler, outputPre, outputObj)
-	if out, err := cmdComp.CombinedOutput(); err != nil {
-		pterm.Error.Println(string(out))
-		os.Exit(1)
+	if warnings := diagnostics.Dedup(b.warnings); len(warnings) > 0 {
+		printDiagnostics(warnings)
 	}
-	pterm.Success.Println("Compilation done")
 }
 
 func update() {
+	if offlineMode() {
+		pterm.Error.Println(offlineError("updating Vira"))
+		exit(1)
+	}
 	pterm.DefaultSection.Println("Updating Vira")
-	updater := filepath.Join(binPath, "updater")
-	if runtime.GOOS == "windows" {
-		updater += ".exe"
+	// With toolchains managed by vira toolchain, the latest toolchain on the
+	// default's channel is installed next to the others instead of replacing
+	// the system one.
+	if current := defaultToolchain(); current != "" {
+		version, err := installToolchain(toolchainChannel(current), nil)
+		if err == nil && trackedChannel() == "" {
+			err = setDefaultToolchain(version, "")
+		}
+		if err == nil && jsonOutput {
+			err = printJSON(updateResult{Toolchain: version})
+		}
+		if err != nil {
+			pterm.Error.Println(err)
+			exit(1)
+		}
+		return
 	}
-	cmdUpdate := exec.Command(updater)
-	if out, err := cmdUpdate.CombinedOutput(); err != nil {
+	cmdUpdate := exec.Command(toolPath("updater"))
+	if out, err := interrupt.CombinedOutput(cmdUpdate); err != nil {
 		pterm.Error.Println(string(out))
-		os.Exit(1)
+		exit(1)
 	}
 	pterm.Success.Println("Update done")
+	if jsonOutput {
+		if err := printJSON(updateResult{System: true}); err != nil {
+			pterm.Error.Println(err)
+			exit(1)
+		}
+	}
+}
+
+// updateResult is what vira update prints with --json.
+type updateResult struct {
+	// Toolchain is the version now installed, when toolchains are managed
+	// by vira toolchain.
+	Toolchain string `json:"toolchain,omitempty"`
+	// System is set when the system toolchain was updated in place.
+	System bool `json:"system,omitempty"`
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+func newManCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:         "man",
+		Annotations: map[string]string{skipToolchain: "true"},
+		Short:       "Generate man pages",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "generate <dir>",
+		Short: "Write a man page for every command into a directory",
+		Long: `Write a man page in section 1 for vira and each of its commands into dir,
+named after the command, such as vira-build.1 or vira-toolchain-install.1.
+The directory is created if needed and existing pages are replaced.
+
+vira setup installs the same pages where man finds them, so that man
+vira-build works; this command is for packagers and for installing them
+elsewhere.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			n, err := writeManPages(cmd.Root(), args[0])
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			pterm.Success.Printfln("Wrote %d man pages to %s", n, args[0])
+		},
+	})
+	return cmd
+}
+
+// writeManPages writes a page in section 1 for the command and each of its
+// subcommands into dir, such as vira-toolchain-install.1, and returns how
+// many it wrote.
+func writeManPages(cmd *cobra.Command, dir string) (int, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	n := 0
+	var write func(c *cobra.Command) error
+	write = func(c *cobra.Command) error {
+		if err := os.WriteFile(filepath.Join(dir, manName(c)+".1"), []byte(manPage(c)), 0644); err != nil {
+			return err
+		}
+		n++
+		for _, sub := range c.Commands() {
+			if sub.IsAvailableCommand() {
+				if err := write(sub); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return n, write(cmd)
+}
+
+// manName is the name of the page of c, its command path joined by dashes.
+func manName(c *cobra.Command) string {
+	return strings.ReplaceAll(c.CommandPath(), " ", "-")
+}
+
+func manPage(c *cobra.Command) string {
+	name := manName(c)
+	var b strings.Builder
+	fmt.Fprintf(&b, ".TH %s 1 \"\" \"Vira\" \"Vira Manual\"\n", strings.ToUpper(name))
+	fmt.Fprintf(&b, ".SH NAME\n%s \\- %s\n", roff(name), roff(c.Short))
+	fmt.Fprintf(&b, ".SH SYNOPSIS\n.B %s\n", roff(c.UseLine()))
+	description := c.Long
+	if description == "" {
+		description = c.Short
+	}
+	b.WriteString(".SH DESCRIPTION\n")
+	for i, para := range strings.Split(description, "\n\n") {
+		if i > 0 {
+			b.WriteString(".PP\n")
+		}
+		b.WriteString(roff(para) + "\n")
+	}
+
+	manFlags(&b, "OPTIONS", c.NonInheritedFlags())
+	manFlags(&b, "OPTIONS INHERITED FROM PARENT COMMANDS", c.InheritedFlags())
+
+	if c.Example != "" {
+		fmt.Fprintf(&b, ".SH EXAMPLES\n.PP\n.RS\n.nf\n%s\n.fi\n.RE\n", roff(c.Example))
+	}
+
+	var related []string
+	if c.HasParent() {
+		related = append(related, manName(c.Parent()))
+	}
+	for _, sub := range c.Commands() {
+		if sub.IsAvailableCommand() {
+			related = append(related, manName(sub))
+		}
+	}
+	if len(related) > 0 {
+		b.WriteString(".SH SEE ALSO\n")
+		for i, r := range related {
+			sep := ","
+			if i == len(related)-1 {
+				sep = ""
+			}
+			fmt.Fprintf(&b, ".BR %s (1)%s\n", roff(r), sep)
+		}
+	}
+	return b.String()
+}
+
+// manFlags writes a section titled title listing the visible flags of set,
+// or nothing if there are none.
+func manFlags(b *strings.Builder, title string, set *pflag.FlagSet) {
+	var flags []*pflag.Flag
+	set.VisitAll(func(f *pflag.Flag) {
+		if !f.Hidden {
+			flags = append(flags, f)
+		}
+	})
+	if len(flags) == 0 {
+		return
+	}
+	fmt.Fprintf(b, ".SH %s\n", title)
+	for _, f := range flags {
+		b.WriteString(".TP\n")
+		if f.Shorthand != "" {
+			fmt.Fprintf(b, "\\fB\\-%s\\fR, ", f.Shorthand)
+		}
+		fmt.Fprintf(b, "\\fB\\-\\-%s\\fR", roff(f.Name))
+		if f.Value.Type() != "bool" {
+			fmt.Fprintf(b, " \\fI%s\\fR", f.Value.Type())
+		}
+		fmt.Fprintf(b, "\n%s\n", roff(f.Usage))
+	}
+}
+
+// roff escapes text for a man page.
+func roff(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\e`)
+	s = strings.ReplaceAll(s, "-", `\-`)
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, ".") || strings.HasPrefix(line, "'") {
+			lines[i] = `\&` + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
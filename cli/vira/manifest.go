@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+)
+
+const manifestName = "vira.toml"
+
+// Manifest is the contents of a project's vira.toml.
+type Manifest struct {
+	Package      PackageInfo           `toml:"package"`
+	Dependencies map[string]Dependency `toml:"dependencies,omitempty"`
+	// Lints maps lint names to allow, warn or deny.
+	Lints    map[string]string `toml:"lints,omitempty"`
+	Audit    AuditConfig       `toml:"audit,omitempty"`
+	Resolver ResolverConfig    `toml:"resolver,omitempty"`
+	// Diagnostics configures how the build treats what the tools report.
+	Diagnostics DiagnosticsConfig `toml:"diagnostics,omitempty"`
+	Format      FormatConfig      `toml:"format,omitempty"`
+	// Tasks are the commands vira task runs, by name.
+	Tasks map[string]Task `toml:"tasks,omitempty"`
+	// Profiles configures the debug and release profiles of vira build.
+	Profiles map[string]ProfileConfig `toml:"profile,omitempty"`
+}
+
+// ProfileConfig is a [profile.<name>] section.
+type ProfileConfig struct {
+	// Signing, if set, signs the executables the profile builds.
+	Signing *SigningConfig `toml:"signing,omitempty"`
+}
+
+// SigningConfig is a [profile.<name>.signing] section. How executables are
+// signed depends on the platform they are built for: with Authenticode on
+// Windows, codesign on macOS and a detached GPG signature elsewhere.
+// Secrets come from VIRA_SIGNING_PASSWORD, or the keychain or certificate
+// store of the system, never from the manifest.
+type SigningConfig struct {
+	// Identity is the codesign identity, the GPG key ID, or the subject of
+	// the certificate in the Windows certificate store.
+	Identity string `toml:"identity,omitempty"`
+	// Certificate is a PKCS#12 file with the Authenticode certificate and
+	// key, relative to the manifest, instead of the certificate store.
+	Certificate string `toml:"certificate,omitempty"`
+	// Keychain is the macOS keychain with the identity, relative to the
+	// manifest, if not the default one.
+	Keychain string `toml:"keychain,omitempty"`
+	// TimestampURL is the timestamp server that countersigns Authenticode
+	// and codesign signatures, so that they outlive the certificate.
+	TimestampURL string `toml:"timestamp-url,omitempty"`
+}
+
+// Task is an entry of [tasks]. It is written either as a command string or
+// as a table.
+type Task struct {
+	// Run lists the commands of the task, run one after another by the
+	// shell in the project root.
+	Run []string `toml:"run,omitempty"`
+	// Depends lists the tasks that must succeed before this one runs.
+	Depends     []string `toml:"depends,omitempty"`
+	Description string   `toml:"description,omitempty"`
+}
+
+func (t *Task) UnmarshalTOML(v any) error {
+	switch v := v.(type) {
+	case string:
+		t.Run = []string{v}
+	case map[string]any:
+		for key, value := range v {
+			var ok bool
+			switch key {
+			case "run":
+				var s string
+				if s, ok = value.(string); ok {
+					t.Run = []string{s}
+				} else {
+					t.Run, ok = taskStrings(value)
+				}
+			case "depends":
+				t.Depends, ok = taskStrings(value)
+			case "description":
+				if t.Description, ok = value.(string); !ok {
+					return fmt.Errorf("task field %q must be a string", key)
+				}
+			default:
+				return fmt.Errorf("unknown task field %q", key)
+			}
+			if !ok {
+				return fmt.Errorf("task field %q must be a string or an array of strings", key)
+			}
+		}
+		if len(t.Run) == 0 && len(t.Depends) == 0 {
+			return fmt.Errorf("a task needs run or depends")
+		}
+	default:
+		return fmt.Errorf("task must be a command string or a table")
+	}
+	return nil
+}
+
+func taskStrings(value any) ([]string, bool) {
+	list, ok := value.([]any)
+	if !ok {
+		return nil, false
+	}
+	out := make([]string, 0, len(list))
+	for _, item := range list {
+		s, ok := item.(string)
+		if !ok {
+			return nil, false
+		}
+		out = append(out, s)
+	}
+	return out, true
+}
+
+// FormatConfig is the [format] section, read by vira fmt and the language
+// server. Editors' own settings apply to what it leaves out.
+type FormatConfig struct {
+	// IndentWidth is how many spaces a level of indentation is, 4 by
+	// default.
+	IndentWidth int `toml:"indent-width,omitempty"`
+	// UseTabs indents with one tab per level instead of spaces.
+	UseTabs *bool `toml:"use-tabs,omitempty"`
+}
+
+// DiagnosticsConfig is the [diagnostics] section.
+type DiagnosticsConfig struct {
+	// Werror lists the codes of warnings that fail the build as errors, or
+	// "all" for every warning.
+	Werror []string `toml:"werror,omitempty"`
+}
+
+// ResolverConfig is the [resolver] section.
+type ResolverConfig struct {
+	// Strategy is maximal (the default) or minimal.
+	Strategy string `toml:"strategy,omitempty"`
+}
+
+// AuditConfig is the [audit] section.
+type AuditConfig struct {
+	// Ignore lists advisory IDs that have been reviewed and accepted.
+	Ignore []string `toml:"ignore,omitempty"`
+}
+
+type PackageInfo struct {
+	Name        string   `toml:"name"`
+	Version     string   `toml:"version"`
+	Authors     []string `toml:"authors,omitempty"`
+	Description string   `toml:"description,omitempty"`
+	License     string   `toml:"license,omitempty"`
+	// Toolchain is the toolchain version, or the stable channel, that the
+	// project needs. A vira-toolchain.toml takes precedence.
+	Toolchain string `toml:"toolchain,omitempty"`
+}
+
+// Dependency is an entry of [dependencies]. It is written either as a bare
+// version requirement ("^1.2") or as a table.
+type Dependency struct {
+	Version  string   `toml:"version,omitempty"`
+	Features []string `toml:"features,omitempty"`
+	// Git is the URL of a repository to take the dependency from instead of
+	// the registry. At most one of Branch, Tag and Rev selects the commit;
+	// without any, the default branch is used.
+	Git    string `toml:"git,omitempty"`
+	Branch string `toml:"branch,omitempty"`
+	Tag    string `toml:"tag,omitempty"`
+	Rev    string `toml:"rev,omitempty"`
+	// Path is a directory with the dependency's project, relative to the
+	// manifest. Version, if given, is what a published package depends on.
+	Path string `toml:"path,omitempty"`
+	// Registry names an alternative registry from the global configuration
+	// to take the dependency from.
+	Registry string `toml:"registry,omitempty"`
+}
+
+func (d *Dependency) UnmarshalTOML(v any) error {
+	switch v := v.(type) {
+	case string:
+		d.Version = v
+	case map[string]any:
+		for key, value := range v {
+			var err error
+			switch key {
+			case "version":
+				d.Version, err = tomlString(key, value)
+			case "features":
+				d.Features, err = tomlStrings(key, value)
+			case "git":
+				d.Git, err = tomlString(key, value)
+			case "branch":
+				d.Branch, err = tomlString(key, value)
+			case "tag":
+				d.Tag, err = tomlString(key, value)
+			case "rev":
+				d.Rev, err = tomlString(key, value)
+			case "path":
+				d.Path, err = tomlString(key, value)
+			case "registry":
+				d.Registry, err = tomlString(key, value)
+			default:
+				err = fmt.Errorf("unknown dependency field %q", key)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		refs := 0
+		for _, ref := range []string{d.Branch, d.Tag, d.Rev} {
+			if ref != "" {
+				refs++
+			}
+		}
+		if refs > 0 && d.Git == "" {
+			return fmt.Errorf("dependency fields branch, tag and rev need git")
+		}
+		if refs > 1 {
+			return fmt.Errorf("only one of branch, tag and rev may be given")
+		}
+		if d.Path != "" && d.Git != "" {
+			return fmt.Errorf("a dependency cannot have both path and git")
+		}
+		if d.Registry != "" && (d.Path != "" || d.Git != "") {
+			return fmt.Errorf("a dependency with registry cannot have path or git")
+		}
+	default:
+		return fmt.Errorf("dependency must be a version string or a table")
+	}
+	return nil
+}
+
+func tomlString(key string, value any) (string, error) {
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("dependency field %q must be a string", key)
+	}
+	return s, nil
+}
+
+func tomlStrings(key string, value any) ([]string, error) {
+	list, ok := value.([]any)
+	if !ok {
+		return nil, fmt.Errorf("dependency field %q must be an array of strings", key)
+	}
+	out := make([]string, 0, len(list))
+	for _, item := range list {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("dependency field %q must be an array of strings", key)
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// sortedDependencies returns the names of m's dependencies in order.
+func (m *Manifest) sortedDependencies() []string {
+	names := make([]string, 0, len(m.Dependencies))
+	for name := range m.Dependencies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func loadManifest(path string) (*Manifest, error) {
+	var m Manifest
+	if _, err := toml.DecodeFile(path, &m); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if m.Package.Name == "" {
+		return nil, fmt.Errorf("%s: missing package.name", path)
+	}
+	return &m, nil
+}
+
+var errNoProject = errors.New("could not find " + manifestName + " in the current directory or any parent directory")
+
+// findProjectRoot walks up from dir to the closest directory containing a
+// manifest.
+func findProjectRoot(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, manifestName)); err == nil {
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", errNoProject
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// The functions below edit vira.toml as text so that comments, ordering and
+// formatting the user chose are kept.
+
+// tomlTableHeader returns the name of the table a "[name]" line opens.
+// Array-of-tables headers are reported with ok set but an empty name.
+func tomlTableHeader(line string) (name string, ok bool) {
+	line = strings.TrimSpace(stripTOMLComment(line))
+	if !strings.HasPrefix(line, "[") || !strings.HasSuffix(line, "]") {
+		return "", false
+	}
+	if strings.HasPrefix(line, "[[") {
+		return "", true
+	}
+	parts := strings.Split(line[1:len(line)-1], ".")
+	for i, p := range parts {
+		parts[i] = unquoteTOMLKey(p)
+	}
+	return strings.Join(parts, "."), true
+}
+
+// tomlKey returns the key of a "key = value" line.
+func tomlKey(line string) (string, bool) {
+	key, _, ok := strings.Cut(stripTOMLComment(line), "=")
+	if !ok {
+		return "", false
+	}
+	return unquoteTOMLKey(key), true
+}
+
+func unquoteTOMLKey(key string) string {
+	key = strings.TrimSpace(key)
+	if len(key) >= 2 && (key[0] == '"' || key[0] == '\'') && key[len(key)-1] == key[0] {
+		return key[1 : len(key)-1]
+	}
+	return key
+}
+
+// stripTOMLComment removes a trailing comment that is not inside a string.
+func stripTOMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0 && c == '\\' && quote == '"':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// tableRange returns the lines [start, end) belonging to the named table,
+// excluding its header, or ok=false if the table does not exist.
+func tableRange(lines []string, table string) (start, end int, ok bool) {
+	for i, line := range lines {
+		name, isHeader := tomlTableHeader(line)
+		if !isHeader {
+			continue
+		}
+		if ok {
+			return start, i, true
+		}
+		if name == table {
+			start, ok = i+1, true
+		}
+	}
+	return start, len(lines), ok
+}
+
+// tomlBareKey quotes key unless it can be written bare.
+func tomlBareKey(key string) string {
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return strconv.Quote(key)
+		}
+	}
+	return key
+}
+
+// dependencyValue renders a dependency as the value of a [dependencies] key:
+// a plain version requirement, or an inline table when it has more.
+func dependencyValue(dep Dependency) string {
+	var fields []string
+	for _, f := range []struct{ key, value string }{
+		{"version", dep.Version},
+		{"git", dep.Git},
+		{"branch", dep.Branch},
+		{"tag", dep.Tag},
+		{"rev", dep.Rev},
+		{"path", dep.Path},
+		{"registry", dep.Registry},
+	} {
+		if f.value != "" {
+			fields = append(fields, f.key+" = "+strconv.Quote(f.value))
+		}
+	}
+	if len(dep.Features) > 0 {
+		features := make([]string, len(dep.Features))
+		for i, f := range dep.Features {
+			features[i] = strconv.Quote(f)
+		}
+		fields = append(fields, "features = ["+strings.Join(features, ", ")+"]")
+	}
+	if len(fields) == 1 && dep.Version != "" {
+		return strconv.Quote(dep.Version)
+	}
+	return "{ " + strings.Join(fields, ", ") + " }"
+}
+
+// setDependency adds or replaces the dependency name in the manifest source.
+func setDependency(src, name string, dep Dependency) string {
+	line := tomlBareKey(name) + " = " + dependencyValue(dep)
+	lines := strings.Split(src, "\n")
+	if start, end, ok := tableRange(lines, "dependencies"); ok {
+		for i := start; i < end; i++ {
+			if key, ok := tomlKey(lines[i]); ok && key == name {
+				lines[i] = line
+				return strings.Join(lines, "\n")
+			}
+		}
+	}
+
+	// Replace a [dependencies.name] table with a key in [dependencies].
+	src, _ = removeDependency(src, name)
+	lines = strings.Split(src, "\n")
+	start, end, ok := tableRange(lines, "dependencies")
+	if !ok {
+		src = strings.TrimRight(src, "\n")
+		if src != "" {
+			src += "\n\n"
+		}
+		return src + "[dependencies]\n" + line + "\n"
+	}
+	// Insert after the last key of the table, before trailing blank lines.
+	at := end
+	for at > start && strings.TrimSpace(lines[at-1]) == "" {
+		at--
+	}
+	lines = append(lines[:at], append([]string{line}, lines[at:]...)...)
+	return strings.Join(lines, "\n")
+}
+
+// removeDependency deletes the dependency name, written either as a key of
+// [dependencies] or as a [dependencies.name] table.
+func removeDependency(src, name string) (string, bool) {
+	lines := strings.Split(src, "\n")
+	if start, end, ok := tableRange(lines, "dependencies."+name); ok {
+		// Drop the header and the blank lines in front of it; the blank
+		// lines ending the table then separate its neighbours.
+		begin := start - 1
+		for begin > 0 && strings.TrimSpace(lines[begin-1]) == "" {
+			begin--
+		}
+		for end > start && strings.TrimSpace(lines[end-1]) == "" && end < len(lines) {
+			end--
+		}
+		lines = append(lines[:begin], lines[end:]...)
+		return strings.Join(lines, "\n"), true
+	}
+	if start, end, ok := tableRange(lines, "dependencies"); ok {
+		for i := start; i < end; i++ {
+			if key, ok := tomlKey(lines[i]); ok && key == name {
+				lines = append(lines[:i], lines[i+1:]...)
+				return strings.Join(lines, "\n"), true
+			}
+		}
+	}
+	return src, false
+}
+
+// setTOMLValue sets key of table, or a top-level key if table is empty, to
+// the already rendered value, adding the key or the table if needed.
+func setTOMLValue(src, table, key, value string) string {
+	line := tomlBareKey(key) + " = " + value
+	lines := strings.Split(src, "\n")
+	start, end, ok := tomlKeysRange(lines, table)
+	if ok {
+		for i := start; i < end; i++ {
+			if k, ok := tomlKey(lines[i]); ok && k == key {
+				lines[i] = line
+				return strings.Join(lines, "\n")
+			}
+		}
+		at := end
+		for at > start && strings.TrimSpace(lines[at-1]) == "" {
+			at--
+		}
+		insert := []string{line}
+		if at < len(lines) {
+			if _, isHeader := tomlTableHeader(lines[at]); isHeader {
+				// Keep a blank line between a new top-level key and the
+				// table after it.
+				insert = append(insert, "")
+			}
+		}
+		lines = append(lines[:at], append(insert, lines[at:]...)...)
+		return strings.Join(lines, "\n")
+	}
+	src = strings.TrimRight(src, "\n")
+	if src != "" {
+		src += "\n\n"
+	}
+	return src + "[" + table + "]\n" + line + "\n"
+}
+
+// removeTOMLValue deletes key of table, or a top-level key if table is
+// empty.
+func removeTOMLValue(src, table, key string) (string, bool) {
+	lines := strings.Split(src, "\n")
+	start, end, ok := tomlKeysRange(lines, table)
+	if !ok {
+		return src, false
+	}
+	for i := start; i < end; i++ {
+		if k, ok := tomlKey(lines[i]); ok && k == key {
+			lines = append(lines[:i], lines[i+1:]...)
+			return strings.Join(lines, "\n"), true
+		}
+	}
+	return src, false
+}
+
+// tomlKeysRange is tableRange, where the empty table name stands for the
+// top-level keys in front of the first table.
+func tomlKeysRange(lines []string, table string) (start, end int, ok bool) {
+	if table != "" {
+		return tableRange(lines, table)
+	}
+	for i, line := range lines {
+		if _, isHeader := tomlTableHeader(line); isHeader {
+			return 0, i, true
+		}
+	}
+	return 0, len(lines), true
+}
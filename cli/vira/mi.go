@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A minimal client for the GDB/MI machine interface, which both gdb and
+// lldb-mi implement. It is used by the debug adapter.
+
+// miRecord is one line of MI output.
+type miRecord struct {
+	token string
+	// kind is one of '^' (result), '*' (exec async), '+' (status async),
+	// '=' (notify async), '~' (console), '@' (target) and '&' (log). Lines
+	// that are not MI output (typically the debuggee's own output) have
+	// kind 0 and their text in text.
+	kind   byte
+	class  string
+	values map[string]any
+	text   string
+}
+
+func (r miRecord) str(key string) string {
+	s, _ := r.values[key].(string)
+	return s
+}
+
+type miClient struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	mu      sync.Mutex
+	next    int
+	pending map[string]chan miRecord
+
+	// events receives every record that is not the answer to a command.
+	events chan miRecord
+}
+
+func startMI(debugger string) (*miClient, error) {
+	var cmd *exec.Cmd
+	switch debugger {
+	case "gdb":
+		cmd = exec.Command("gdb", "--interpreter=mi2", "--quiet", "--nx")
+	case "lldb":
+		cmd = exec.Command("lldb-mi")
+	default:
+		return nil, fmt.Errorf("unsupported debugger %q (use gdb or lldb)", debugger)
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	c := &miClient{
+		cmd:     cmd,
+		stdin:   stdin,
+		pending: map[string]chan miRecord{},
+		events:  make(chan miRecord, 64),
+	}
+	go c.readLoop(stdout)
+	return c, nil
+}
+
+func (c *miClient) readLoop(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "(gdb)" || line == "(gdb) " {
+			continue
+		}
+		rec := parseMIRecord(line)
+		if rec.kind == '^' && rec.token != "" {
+			c.mu.Lock()
+			ch := c.pending[rec.token]
+			delete(c.pending, rec.token)
+			c.mu.Unlock()
+			if ch != nil {
+				ch <- rec
+				continue
+			}
+		}
+		c.events <- rec
+	}
+	c.mu.Lock()
+	for token, ch := range c.pending {
+		close(ch)
+		delete(c.pending, token)
+	}
+	c.mu.Unlock()
+	close(c.events)
+}
+
+// run sends an MI command and waits for its result record. An ^error result
+// is returned as an error.
+func (c *miClient) run(command string) (miRecord, error) {
+	c.mu.Lock()
+	c.next++
+	token := strconv.Itoa(c.next)
+	ch := make(chan miRecord, 1)
+	c.pending[token] = ch
+	c.mu.Unlock()
+
+	if _, err := fmt.Fprintf(c.stdin, "%s%s\n", token, command); err != nil {
+		return miRecord{}, err
+	}
+	rec, ok := <-ch
+	if !ok {
+		return miRecord{}, fmt.Errorf("debugger exited")
+	}
+	if rec.class == "error" {
+		return rec, fmt.Errorf("%s", rec.str("msg"))
+	}
+	return rec, nil
+}
+
+func (c *miClient) close() {
+	fmt.Fprintln(c.stdin, "-gdb-exit")
+	c.stdin.Close()
+	c.cmd.Wait()
+}
+
+func parseMIRecord(line string) miRecord {
+	i := 0
+	for i < len(line) && line[i] >= '0' && line[i] <= '9' {
+		i++
+	}
+	token, rest := line[:i], line[i:]
+	if rest == "" || !strings.ContainsRune("^*+=~@&", rune(rest[0])) {
+		return miRecord{text: line}
+	}
+	rec := miRecord{token: token, kind: rest[0]}
+	rest = rest[1:]
+	if strings.ContainsRune("~@&", rune(rec.kind)) {
+		s, _, err := parseMIString(rest)
+		if err != nil {
+			return miRecord{text: line}
+		}
+		rec.text = s
+		return rec
+	}
+	class, results, _ := strings.Cut(rest, ",")
+	rec.class = class
+	rec.values = map[string]any{}
+	p := &miParser{s: results}
+	for p.pos < len(p.s) {
+		key, value, err := p.result()
+		if err != nil {
+			break
+		}
+		rec.values[key] = value
+		if !p.accept(',') {
+			break
+		}
+	}
+	return rec
+}
+
+type miParser struct {
+	s   string
+	pos int
+}
+
+func (p *miParser) accept(c byte) bool {
+	if p.pos < len(p.s) && p.s[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *miParser) result() (string, any, error) {
+	eq := strings.IndexByte(p.s[p.pos:], '=')
+	if eq < 0 {
+		return "", nil, fmt.Errorf("expected result at %d", p.pos)
+	}
+	key := p.s[p.pos : p.pos+eq]
+	p.pos += eq + 1
+	value, err := p.value()
+	return key, value, err
+}
+
+// value parses a c-string, a tuple ({...}, returned as a map) or a list
+// ([...], returned as a slice).
+func (p *miParser) value() (any, error) {
+	if p.pos >= len(p.s) {
+		return nil, fmt.Errorf("unexpected end of record")
+	}
+	switch p.s[p.pos] {
+	case '"':
+		s, n, err := parseMIString(p.s[p.pos:])
+		p.pos += n
+		return s, err
+	case '{':
+		p.pos++
+		tuple := map[string]any{}
+		for !p.accept('}') {
+			key, value, err := p.result()
+			if err != nil {
+				return nil, err
+			}
+			tuple[key] = value
+			p.accept(',')
+		}
+		return tuple, nil
+	case '[':
+		p.pos++
+		var list []any
+		for !p.accept(']') {
+			var item any
+			var err error
+			if p.s[p.pos] == '"' || p.s[p.pos] == '{' || p.s[p.pos] == '[' {
+				item, err = p.value()
+			} else {
+				// Lists of results such as [frame={...},frame={...}].
+				_, item, err = p.result()
+			}
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+			p.accept(',')
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", p.s[p.pos], p.pos)
+}
+
+// parseMIString decodes a C-style quoted string at the start of s and
+// returns it with the number of bytes consumed.
+func parseMIString(s string) (string, int, error) {
+	if s == "" || s[0] != '"' {
+		return "", 0, fmt.Errorf("expected string")
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			return b.String(), i + 1, nil
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			default:
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", len(s), fmt.Errorf("unterminated string")
+}
+
+// miQuote quotes s as an MI c-string argument.
+func miQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
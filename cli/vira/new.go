@@ -0,0 +1,259 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"vira/pkg/interrupt"
+)
+
+// builtinTemplates holds the templates vira new has without any download,
+// one directory each.
+//
+//go:embed all:templates
+var builtinTemplates embed.FS
+
+// defaultTemplate is the template vira new uses without --template.
+const defaultTemplate = "cli"
+
+func newNewCmd() *cobra.Command {
+	var template, name, author string
+
+	cmd := &cobra.Command{
+		Use:         "new <path>",
+		Annotations: map[string]string{skipToolchain: "true"},
+		Short:       "Create a project from a template",
+		Long: `Create a new project in the directory path, which must not exist or be
+empty, from a template: the built-in cli (the default), lib or embedded
+templates, a directory, a git repository given by its URL, optionally
+followed by #branch, #tag or #commit, or any other name, which is looked up
+in the registry and downloaded as a package.
+
+{{name}}, {{author}} and {{year}} are replaced in the names and contents of
+the files of the template by the name of the project, which is the base
+name of path unless given with --name, the author from --author or git's
+user.name and user.email, and the current year. The name, version and
+authors in vira.toml are set for the new project whatever the template has.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			dir := args[0]
+			if name == "" {
+				abs, err := filepath.Abs(dir)
+				if err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+				name = filepath.Base(abs)
+			}
+			if !packageNamePattern.MatchString(name) {
+				pterm.Error.Printfln("%q is not a valid package name: it must start with a lowercase letter and contain only a-z, 0-9, - and _; pick one with --name", name)
+				exit(1)
+			}
+			if author == "" {
+				author = gitAuthor()
+			}
+			if err := newProject(dir, template, templateVars{name: name, author: author}); err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			pterm.Success.Printfln("Created %s in %s from the %s template", name, dir, template)
+		},
+	}
+	cmd.Flags().StringVarP(&template, "template", "t", defaultTemplate, "cli, lib, embedded, a directory, a git URL or a template package of the registry")
+	cmd.Flags().StringVar(&name, "name", "", "name of the package (the base name of the path by default)")
+	cmd.Flags().StringVar(&author, "author", "", "author of the package (git's user.name and user.email by default)")
+	return cmd
+}
+
+// templateVars are the values substituted into a template.
+type templateVars struct {
+	name, author string
+}
+
+func (v templateVars) replacer() *strings.Replacer {
+	return strings.NewReplacer("{{name}}", v.name, "{{author}}", v.author, "{{year}}", strconv.Itoa(time.Now().Year()))
+}
+
+// gitAuthor returns the author git commits as, or "" if git has none.
+func gitAuthor() string {
+	name, _ := runGit("", "config", "user.name")
+	email, _ := runGit("", "config", "user.email")
+	switch {
+	case name == "":
+		return email
+	case email == "":
+		return name
+	}
+	return name + " <" + email + ">"
+}
+
+// newProject creates the project in dir from template.
+func newProject(dir, template string, vars templateVars) error {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("%s already exists and is not empty", dir)
+	}
+	src, cleanup, err := fetchTemplate(template)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if _, err := fs.Stat(src, manifestName); err != nil {
+		return fmt.Errorf("the template %s has no %s", template, manifestName)
+	}
+
+	// A project created halfway is removed again.
+	_, statErr := os.Stat(dir)
+	removeHalfway := func() {
+		if os.IsNotExist(statErr) {
+			os.RemoveAll(dir)
+		} else {
+			removeContents(dir)
+		}
+	}
+	defer interrupt.Cleanup(removeHalfway)()
+	if err := writeProject(src, dir, vars); err != nil {
+		removeHalfway()
+		return err
+	}
+	return nil
+}
+
+// removeContents removes everything in dir, but not dir itself.
+func removeContents(dir string) {
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		os.RemoveAll(filepath.Join(dir, e.Name()))
+	}
+}
+
+// writeProject writes the files of the template src into dir, with its
+// manifest set up for the new package.
+func writeProject(src fs.FS, dir string, vars templateVars) error {
+	if err := copyTemplate(src, dir, vars.replacer()); err != nil {
+		return err
+	}
+	manifest := filepath.Join(dir, manifestName)
+	data, err := os.ReadFile(manifest)
+	if err != nil {
+		return err
+	}
+	text := setTOMLValue(string(data), "package", "name", strconv.Quote(vars.name))
+	text = setTOMLValue(text, "package", "version", strconv.Quote("0.1.0"))
+	if vars.author != "" {
+		text = setTOMLValue(text, "package", "authors", "["+strconv.Quote(vars.author)+"]")
+	} else {
+		text, _ = removeTOMLValue(text, "package", "authors")
+	}
+	return os.WriteFile(manifest, []byte(text), 0644)
+}
+
+// fetchTemplate returns the files of template and a function that removes
+// any download of them.
+func fetchTemplate(template string) (fs.FS, func(), error) {
+	none := func() {}
+	if !strings.ContainsAny(template, `/\.:`) {
+		if sub, err := fs.Sub(builtinTemplates, path.Join("templates", template)); err == nil {
+			if _, err := fs.Stat(sub, "."); err == nil {
+				return sub, none, nil
+			}
+		}
+	}
+	if info, err := os.Stat(template); err == nil && info.IsDir() {
+		return os.DirFS(template), none, nil
+	}
+	if strings.Contains(template, "://") || strings.HasPrefix(template, "git@") {
+		repo, ref, _ := strings.Cut(template, "#")
+		if ref == "" {
+			ref = "HEAD"
+		}
+		db, err := gitDatabase(repo, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		commit, err := runGit(db, "rev-parse", "--verify", ref+"^{commit}")
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s has no %s: %v", repo, ref, err)
+		}
+		dir, err := gitCheckout(repo, commit)
+		if err != nil {
+			return nil, nil, err
+		}
+		return os.DirFS(dir), none, nil
+	}
+
+	idx, err := fetchRegistryIndex()
+	if err != nil {
+		return nil, nil, err
+	}
+	pkg := idx.lookup(template)
+	if pkg == nil {
+		return nil, nil, fmt.Errorf("there is no template %s: it is not built in (cli, lib, embedded), a directory, a git URL or a package of the registry", template)
+	}
+	rec, ok := pkg.latestMatching(versionReq{})
+	if !ok {
+		return nil, nil, fmt.Errorf("the registry has no version of the template %s", template)
+	}
+	pterm.Info.Printfln("Downloading the template %s v%s", template, rec.Version)
+	data, err := readLocation(rec.URL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to download %s v%s from %s: %v", template, rec.Version, rec.URL, err)
+	}
+	tmp, remove, err := interrupt.TempDir("vira-template-")
+	if err != nil {
+		return nil, nil, err
+	}
+	root, err := extractTarball(data, tmp)
+	if err != nil {
+		remove()
+		return nil, nil, err
+	}
+	return os.DirFS(root), remove, nil
+}
+
+// copyTemplate copies the files of src into dir, replacing the variables
+// of r in their names and in the contents of text files. Version control
+// metadata is left out.
+func copyTemplate(src fs.FS, dir string, r *strings.Replacer) error {
+	return fs.WalkDir(src, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return fs.SkipDir
+		}
+		target := filepath.Join(dir, filepath.FromSlash(r.Replace(name)))
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		data, err := fs.ReadFile(src, name)
+		if err != nil {
+			return err
+		}
+		if utf8.Valid(data) {
+			data = []byte(r.Replace(string(data)))
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(target); err == nil {
+			return errors.New(name + " of the template turns into a file that already exists")
+		}
+		return os.WriteFile(target, data, info.Mode().Perm()|0200)
+	})
+}
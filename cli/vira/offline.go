@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// offlineFlag is set by the global --offline flag.
+var offlineFlag bool
+
+// offlineMode reports whether network access is disabled, by --offline,
+// VIRA_OFFLINE=1 or offline = true in config.toml. Commands then work from
+// vendored sources and the caches only.
+func offlineMode() bool {
+	if offlineFlag {
+		return true
+	}
+	if v := os.Getenv("VIRA_OFFLINE"); v != "" {
+		return v != "0" && v != "false"
+	}
+	cfg, err := loadGlobalConfig()
+	return err == nil && cfg.Offline
+}
+
+// offlineError reports that offline mode prevented what.
+func offlineError(what string) error {
+	return &offlineModeError{what: what}
+}
+
+type offlineModeError struct {
+	what string
+}
+
+func (e *offlineModeError) Error() string {
+	return e.what + " needs network access, but offline mode is on (--offline, VIRA_OFFLINE or offline in config.toml)"
+}
+
+func isRemote(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+func httpCachePath(location string) (string, error) {
+	sum := sha256.Sum256([]byte(location))
+	return cacheSubdir("http", hex.EncodeToString(sum[:16]))
+}
+
+// readCachedCopy reads a local file, or the copy of a remote document that
+// readCachedLocation last saved, without network access.
+func readCachedCopy(location string) ([]byte, error) {
+	if !isRemote(location) {
+		return readLocation(location)
+	}
+	file, err := httpCachePath(location)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(file)
+}
+
+// readCachedLocation is readLocation for documents such as the registry
+// index that are fetched again on every use: a copy of each remote document
+// is kept in the cache and read instead in offline mode.
+func readCachedLocation(location string) ([]byte, error) {
+	if !isRemote(location) {
+		return readLocation(location)
+	}
+	file, err := httpCachePath(location)
+	if err != nil {
+		return nil, err
+	}
+	if offlineMode() {
+		data, err := os.ReadFile(file)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, offlineError("fetching " + location + ", which is not cached yet,")
+		}
+		return data, err
+	}
+	data, err := readLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err == nil {
+		os.WriteFile(file, data, 0644)
+	}
+	return data, nil
+}
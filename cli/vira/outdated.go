@@ -0,0 +1,156 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+// outdatedPackage is a locked package with newer versions in the registry,
+// as printed with --json.
+type outdatedPackage struct {
+	Name       string `json:"name"`
+	Current    string `json:"current"`
+	Compatible string `json:"compatible"`
+	Latest     string `json:"latest"`
+	Direct     bool   `json:"direct"`
+}
+
+func newOutdatedCmd() *cobra.Command {
+	var exitCode bool
+
+	cmd := &cobra.Command{
+		Use:   "outdated",
+		Short: "List dependencies with newer versions in the registry",
+		Long: `List the packages in vira.lock that have newer versions in the registry.
+
+For each, the locked version is shown with the newest version that every
+requirement on the package allows, which vira update-deps would move to, and
+the newest version overall, which may need a requirement in vira.toml to be
+raised. Git and path dependencies are not checked.
+
+With --exit-code, the command exits with status 1 if anything is outdated,
+for use in CI.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			proj, err := loadProject(".")
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			outdated, err := proj.outdated()
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			if jsonOutput {
+				if err := printJSON(outdated); err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+			} else if len(outdated) == 0 {
+				pterm.Success.Println("All dependencies are up to date")
+			} else {
+				data := pterm.TableData{{"Name", "Current", "Compatible", "Latest", "Kind"}}
+				for _, o := range outdated {
+					kind := "transitive"
+					if o.Direct {
+						kind = "direct"
+					}
+					data = append(data, []string{o.Name, o.Current, sameOrDash(o.Compatible, o.Current), sameOrDash(o.Latest, o.Current), kind})
+				}
+				pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+			}
+			if exitCode && len(outdated) > 0 {
+				exit(1)
+			}
+		},
+	}
+	cmd.Flags().BoolVar(&exitCode, "exit-code", false, "exit with status 1 if any dependency is outdated")
+	return cmd
+}
+
+func sameOrDash(v, current string) string {
+	if v == current {
+		return "-"
+	}
+	return v
+}
+
+// outdated compares the locked registry packages against the registry. The
+// compatible version is the newest one that all requirements on the
+// package, from vira.toml and from the locked packages depending on it,
+// allow.
+func (p *project) outdated() ([]outdatedPackage, error) {
+	res, lf, err := p.resolve(resolveOptions{})
+	if err != nil {
+		return nil, err
+	}
+	idx, err := p.dependencyIndex(lf, false)
+	if err != nil {
+		return nil, err
+	}
+	dependents := res.dependents()
+	outdated := []outdatedPackage{}
+	for _, locked := range lf.Packages[1:] {
+		if strings.HasPrefix(locked.Source, "git+") || strings.HasPrefix(locked.Source, "path+") {
+			continue
+		}
+		pkg := idx.lookup(locked.Name)
+		current, err := parseVersion(locked.Version)
+		if pkg == nil || err != nil {
+			continue
+		}
+		var reqs []versionReq
+		direct := false
+		for _, parent := range dependents[locked.key()] {
+			raw := ""
+			if parent == res.root {
+				direct = true
+				raw = p.manifest.Dependencies[locked.Name].Version
+			} else {
+				pp := idx.lookup(res.packages[parent].Name)
+				if pp == nil {
+					continue
+				}
+				rec, ok := pp.version(res.packages[parent].Version)
+				if !ok {
+					continue
+				}
+				raw = rec.Dependencies[locked.Name]
+			}
+			if req, err := parseVersionReq(raw); err == nil {
+				reqs = append(reqs, req)
+			}
+		}
+
+		o := outdatedPackage{Name: locked.Name, Current: locked.Version, Compatible: locked.Version, Direct: direct}
+		latest, compatible := false, false
+		for _, rec := range pkg.sortedVersions() {
+			v, _ := parseVersion(rec.Version)
+			if rec.Yanked || v.compare(current) <= 0 {
+				continue
+			}
+			if !latest {
+				o.Latest, latest = rec.Version, true
+			}
+			if !compatible && matchesAll(reqs, v) {
+				o.Compatible, compatible = rec.Version, true
+			}
+		}
+		if latest {
+			outdated = append(outdated, o)
+		}
+	}
+	return outdated, nil
+}
+
+func matchesAll(reqs []versionReq, v semVersion) bool {
+	for _, req := range reqs {
+		if !req.matches(v) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// pathPackage is a project used as a path dependency.
+type pathPackage struct {
+	dir      string
+	manifest *Manifest
+}
+
+// pathSource identifies the path dependency in dir in vira.lock: path+
+// followed by the directory relative to the project root.
+func (p *project) pathSource(dir string) string {
+	rel, err := filepath.Rel(p.root, dir)
+	if err != nil {
+		rel = dir
+	}
+	return "path+" + filepath.ToSlash(rel)
+}
+
+// pathSourceDir is the inverse of pathSource.
+func (p *project) pathSourceDir(source string) (string, bool) {
+	rel, ok := strings.CutPrefix(source, "path+")
+	if !ok {
+		return "", false
+	}
+	return filepath.Join(p.root, filepath.FromSlash(rel)), true
+}
+
+// packageIncludeDir is the directory of a dependency's project that is
+// passed to the preprocessor: src/ if there is one, else the root.
+func packageIncludeDir(dir string) string {
+	if info, err := os.Stat(filepath.Join(dir, "src")); err == nil && info.IsDir() {
+		return filepath.Join(dir, "src")
+	}
+	return dir
+}
+
+// loadPathDependency loads the project at dep.Path, relative to base, and
+// checks that it is the package name.
+func loadPathDependency(base, name string, dep Dependency) (pathPackage, error) {
+	dir := filepath.Join(base, filepath.FromSlash(dep.Path))
+	m, err := loadManifest(filepath.Join(dir, manifestName))
+	if err != nil {
+		return pathPackage{}, fmt.Errorf("path dependency %s: %v", name, err)
+	}
+	if m.Package.Name != name {
+		return pathPackage{}, fmt.Errorf("path dependency %s: %s contains package %s", name, dep.Path, m.Package.Name)
+	}
+	return pathPackage{dir: dir, manifest: m}, nil
+}
+
+// pathDependencies returns the project's path dependencies, including those
+// of other path dependencies, by package name.
+func (p *project) pathDependencies() (map[string]pathPackage, error) {
+	pkgs := map[string]pathPackage{}
+	var walk func(m *Manifest, base string) error
+	walk = func(m *Manifest, base string) error {
+		for _, name := range m.sortedDependencies() {
+			dep := m.Dependencies[name]
+			if dep.Path == "" {
+				continue
+			}
+			pkg, err := loadPathDependency(base, name, dep)
+			if err != nil {
+				return err
+			}
+			if prev, ok := pkgs[name]; ok {
+				if prev.dir != pkg.dir {
+					return fmt.Errorf("path dependency %s is used from both %s and %s", name, p.rel(prev.dir), p.rel(pkg.dir))
+				}
+				continue
+			}
+			pkgs[name] = pkg
+			if err := walk(pkg.manifest, pkg.dir); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return pkgs, walk(p.manifest, p.root)
+}
+
+// withPathDependencies returns idx with the registry entries of path
+// dependencies replaced by the local projects.
+func (p *project) withPathDependencies(idx *registryIndex) (*registryIndex, error) {
+	pkgs, err := p.pathDependencies()
+	if err != nil {
+		return nil, err
+	}
+	local := map[string]registryPackage{}
+	for name, pkg := range pkgs {
+		rec := registryVersion{Version: pkg.manifest.Package.Version, URL: p.pathSource(pkg.dir)}
+		for _, depName := range pkg.manifest.sortedDependencies() {
+			d := pkg.manifest.Dependencies[depName]
+			if d.Git != "" {
+				return nil, fmt.Errorf("path dependency %s: git dependencies of path dependencies are not supported", name)
+			}
+			if rec.Dependencies == nil {
+				rec.Dependencies = map[string]string{}
+			}
+			rec.Dependencies[depName] = d.Version
+		}
+		local[name] = registryPackage{Name: name, Versions: []registryVersion{rec}}
+	}
+	return overlayIndex(idx, local), nil
+}
+
+// pathDependencySources lists the source files of all path dependencies, so
+// that changing them rebuilds the project.
+func (p *project) pathDependencySources() ([]string, error) {
+	pkgs, err := p.pathDependencies()
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, name := range sortedKeys(pkgs) {
+		err := filepath.WalkDir(packageIncludeDir(pkgs[name].dir), func(file string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() && (d.Name() == "target" || d.Name() == ".git") {
+				return filepath.SkipDir
+			}
+			if !d.IsDir() && filepath.Ext(file) == ".vira" {
+				files = append(files, file)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/pterm/pterm"
+
+	"vira/pkg/toolchain"
+)
+
+// State the CLI writes itself lives in one directory per user, ~/.vira, or
+// VIRA_HOME if set. On Linux it follows the XDG Base Directory
+// specification instead, unless VIRA_HOME is set:
+//
+//	$XDG_CONFIG_HOME/vira  config.toml, credentials.json
+//	$XDG_CACHE_HOME/vira   downloaded sources and indexes
+//	$XDG_DATA_HOME/vira    toolchains, installed.json, completions
+//	~/.local/bin           executables from vira install and the shims
+
+func configDir() (string, error) {
+	return toolchain.UserDir("XDG_CONFIG_HOME", ".config", "")
+}
+
+func cacheDir() (string, error) {
+	return toolchain.UserDir("XDG_CACHE_HOME", ".cache", "cache")
+}
+
+func dataDir() (string, error) {
+	return toolchain.UserDir("XDG_DATA_HOME", filepath.Join(".local", "share"), "")
+}
+
+// manDir is where vira setup installs man pages: a directory man finds by
+// itself next to the bin directory on PATH.
+func manDir() (string, error) {
+	if toolchain.UseXDG() {
+		dir, err := toolchain.XDGDir("XDG_DATA_HOME", filepath.Join(".local", "share"))
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, "man", "man1"), nil
+	}
+	home, err := toolchain.Home()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "share", "man", "man1"), nil
+}
+
+// migrateLegacyHome moves the state of an older version from ~/.vira into
+// the XDG directories. Entries that already exist in the new place are left
+// where they are.
+func migrateLegacyHome() error {
+	if !toolchain.UseXDG() {
+		return nil
+	}
+	legacy, err := toolchain.Home()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(legacy); err != nil {
+		return nil
+	}
+	leftover := filepath.Join(legacy, "MOVED")
+	if _, err := os.Stat(leftover); err == nil {
+		return nil
+	}
+	config, err := configDir()
+	if err != nil {
+		return err
+	}
+	cache, err := cacheDir()
+	if err != nil {
+		return err
+	}
+	data, err := dataDir()
+	if err != nil {
+		return err
+	}
+	bin, err := userBinDir()
+	if err != nil {
+		return err
+	}
+	moves := map[string]string{
+		"config.toml":      filepath.Join(config, "config.toml"),
+		"credentials.json": filepath.Join(config, "credentials.json"),
+		"cache":            cache,
+		"toolchains":       filepath.Join(data, "toolchains"),
+		"installed.json":   filepath.Join(data, "installed.json"),
+		"completions":      filepath.Join(data, "completions"),
+	}
+	man, err := manDir()
+	if err != nil {
+		return err
+	}
+	for sub, to := range map[string]string{"bin": bin, filepath.Join("share", "man", "man1"): man} {
+		entries, _ := os.ReadDir(filepath.Join(legacy, sub))
+		for _, e := range entries {
+			moves[filepath.Join(sub, e.Name())] = filepath.Join(to, e.Name())
+		}
+	}
+
+	pterm.Info.Printfln("Moving %s to the XDG base directories", legacy)
+	for _, name := range sortedKeys(moves) {
+		from, to := filepath.Join(legacy, name), moves[name]
+		if _, err := os.Lstat(from); err != nil {
+			continue
+		}
+		if _, err := os.Lstat(to); err == nil {
+			pterm.Warning.Printfln("%s already exists; leaving %s in place", to, from)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(from, to); err != nil {
+			return err
+		}
+	}
+	for _, dir := range []string{"bin", filepath.Join("share", "man", "man1"), filepath.Join("share", "man"), "share"} {
+		os.Remove(filepath.Join(legacy, dir))
+	}
+	if err := os.Remove(legacy); err != nil && !errors.Is(err, os.ErrNotExist) {
+		// Keeps the move from being tried again on every run.
+		os.WriteFile(leftover, []byte("Moved to the XDG base directories by vira; what is left here was not moved.\n"), 0644)
+		pterm.Warning.Printfln("%s is not empty after the move; remove what is left by hand", legacy)
+	}
+	// The shims of the old layout look for toolchains in ~/.vira.
+	if defaultToolchain() != "" {
+		return writeToolchainShims()
+	}
+	if !onPath(bin) {
+		pterm.Warning.Printfln("executables are now installed to %s, which is not on PATH", bin)
+	}
+	return nil
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"vira/pkg/diagnostics"
+	"vira/pkg/interrupt"
+)
+
+// toolPath returns the location of a binary of the active toolchain. Where
+// there is no toolchain directory, the path is relative and will not be
+// found; ensureTools reports why.
+func toolPath(name string) string {
+	dir, _ := toolchainBinDir()
+	path := filepath.Join(dir, name)
+	if runtime.GOOS == "windows" {
+		path += ".exe"
+	}
+	return path
+}
+
+// objectFile returns the path the compiler actually writes for output, which
+// on Windows has ".o" rewritten to ".obj".
+func objectFile(output string) string {
+	if runtime.GOOS == "windows" {
+		return strings.ReplaceAll(output, ".o", ".obj")
+	}
+	return output
+}
+
+func executableName(name string) string {
+	if runtime.GOOS == "windows" {
+		return name + ".exe"
+	}
+	return name
+}
+
+// stageError carries the combined output of a pipeline tool that failed.
+type stageError struct {
+	stage  string
+	output string
+	err    error
+	// args is the command line of the tool, run in dir.
+	args []string
+	dir  string
+	// pre and origins are set when the tool ran on preprocessed output, so
+	// that what it reports can be traced back to the sources.
+	pre     string
+	origins []lineOrigin
+}
+
+func (e *stageError) Error() string {
+	out := strings.TrimSpace(e.output)
+	if out == "" {
+		return fmt.Sprintf("%s failed: %v", e.stage, e.err)
+	}
+	return fmt.Sprintf("%s failed: %v\n%s", e.stage, e.err, out)
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+// runStage runs a pipeline tool in dir and wraps any failure in a stageError.
+func runStage(stage, dir, tool string, args ...string) error {
+	_, err := runStageOutput(stage, dir, tool, args...)
+	return err
+}
+
+// runStageOutput is runStage returning the output of a tool that succeeded,
+// which may still hold warnings.
+func runStageOutput(stage, dir, tool string, args ...string) (string, error) {
+	cmd := exec.Command(tool, args...)
+	cmd.Dir = dir
+	logf("%s: running %s in %s", stage, strings.Join(cmd.Args, " "), dir)
+	defer traceSpan("stage", stage, map[string]any{"args": strings.Join(cmd.Args, " ")})()
+	start := time.Now()
+	var out []byte
+	var err error
+	ran := false
+	if pool := activeToolPool; pool != nil {
+		var text string
+		text, ran, err = pool.run(tool, dir, args)
+		out = []byte(text)
+	}
+	if !ran {
+		out, err = interrupt.CombinedOutput(cmd)
+	}
+	result := "succeeded"
+	if err != nil {
+		result = "failed: " + err.Error()
+	}
+	logf("%s %s after %s", stage, result, time.Since(start).Round(time.Millisecond))
+	if len(out) > 0 {
+		logf("%s output:\n%s", stage, out)
+	}
+	if err != nil {
+		return "", &stageError{stage: stage, output: string(out), err: err, args: cmd.Args, dir: dir}
+	}
+	return string(out), nil
+}
+
+// compileObject runs preprocessor, plsa and compiler on source and writes the
+// object file to obj. Intermediate files are placed next to obj. Includes are
+// resolved relative to the directory of source, and system includes are also
+// searched for in includeDirs.
+func compileObject(source, obj string, includeDirs ...string) (string, error) {
+	obj, _, err := compileObjectWarnings(source, obj, includeDirs...)
+	return obj, err
+}
+
+// compileObjectWarnings is compileObject also returning the warnings the
+// tools reported while compiling source successfully.
+func compileObjectWarnings(source, obj string, includeDirs ...string) (string, []diagnostic, error) {
+	if err := ensureTools("preprocessor", "plsa", "compiler"); err != nil {
+		return "", nil, err
+	}
+	b, err := newObjectBuild(source, obj, includeDirs...)
+	if err != nil {
+		return "", nil, err
+	}
+	for stage := 0; stage < objectStages; stage++ {
+		if err := b.stage(stage); err != nil {
+			return "", nil, err
+		}
+	}
+	return b.written(), b.warnings, nil
+}
+
+// objectBuild is the compilation of a source file into an object in
+// stages: preprocessing, analysis by plsa and code generation. Each stage
+// needs the previous one of the same file only, so builds of several files
+// can interleave their stages.
+type objectBuild struct {
+	source, obj string
+	includeDirs []string
+	workDir     string
+	pre         string
+	origins     []lineOrigin
+	warnings    []diagnostic
+	// target is the platform to write the object for, nil for the host.
+	target *crossTarget
+}
+
+// written is the object file the compiler writes for b.
+func (b *objectBuild) written() string {
+	return b.target.objectFile(b.obj)
+}
+
+// objectStages is the number of stages of an objectBuild.
+const objectStages = 3
+
+func newObjectBuild(source, obj string, includeDirs ...string) (*objectBuild, error) {
+	source, err := filepath.Abs(source)
+	if err != nil {
+		return nil, err
+	}
+	obj, err = filepath.Abs(obj)
+	if err != nil {
+		return nil, err
+	}
+	workDir := filepath.Dir(obj)
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		return nil, err
+	}
+	return &objectBuild{
+		source:      source,
+		obj:         obj,
+		includeDirs: includeDirs,
+		workDir:     workDir,
+		pre:         strings.TrimSuffix(obj, filepath.Ext(obj)) + ".pre",
+	}, nil
+}
+
+// stage runs stage n of the build, collecting the warnings of the tool.
+func (b *objectBuild) stage(n int) error {
+	if n == 0 {
+		origins, err := preprocess(b.source, b.pre, b.includeDirs...)
+		b.origins = origins
+		return err
+	}
+	args := []string{"plsa", b.pre}
+	if n == 2 {
+		args = []string{"compiler", b.pre, b.obj, "--no-link"}
+		if b.target != nil {
+			args = append(args, "--target", b.target.compilerTriple())
+		}
+		// An object the compiler did not finish would look up to date.
+		defer interrupt.Cleanup(func() { os.Remove(b.written()) })()
+	}
+	out, err := runStageOutput(args[0], b.workDir, toolPath(args[0]), args[1:]...)
+	if err != nil {
+		var stageErr *stageError
+		if errors.As(err, &stageErr) {
+			stageErr.pre, stageErr.origins = b.pre, b.origins
+		}
+		return err
+	}
+	diags := parseDiagnostics(b.source, out)
+	diagnostics.Remap(diags, b.origins, b.pre, b.source)
+	for _, d := range diags {
+		if d.Severity == diagnostics.Warning {
+			b.warnings = append(b.warnings, d)
+		}
+	}
+	return nil
+}
+
+func linker() string {
+	switch runtime.GOOS {
+	case "windows":
+		return "link.exe"
+	case "darwin":
+		return "clang"
+	default:
+		return "gcc"
+	}
+}
+
+// linkExecutable links objs into the executable exe with the platform
+// linker, passing flags through to it.
+func linkExecutable(objs []string, exe string, flags ...string) error {
+	if err := os.MkdirAll(filepath.Dir(exe), 0755); err != nil {
+		return err
+	}
+	var args []string
+	if runtime.GOOS == "windows" {
+		args = append(args, "/OUT:"+exe, "/ENTRY:main", "/SUBSYSTEM:CONSOLE")
+		args = append(args, flags...)
+		args = append(args, objs...)
+	} else {
+		args = append(args, objs...)
+		args = append(args, flags...)
+		args = append(args, "-o", exe)
+	}
+	defer interrupt.Cleanup(func() { os.Remove(exe) })()
+	return runStage("linker", filepath.Dir(exe), linker(), args...)
+}
+
+// buildExecutable compiles a single source file into exe.
+func buildExecutable(source, exe string) error {
+	obj, err := compileObject(source, strings.TrimSuffix(exe, filepath.Ext(exe))+".o")
+	if err != nil {
+		return err
+	}
+	return linkExecutable([]string{obj}, exe)
+}
+
+// checkSource runs the preprocessor and plsa over source and returns the
+// problems they report. The returned error is only set when a tool could not
+// be run at all.
+func checkSource(source string) ([]diagnostic, error) {
+	source, err := filepath.Abs(source)
+	if err != nil {
+		return nil, err
+	}
+	dir, remove, err := interrupt.TempDir("vira-check-")
+	if err != nil {
+		return nil, err
+	}
+	defer remove()
+	pre := filepath.Join(dir, strings.TrimSuffix(filepath.Base(source), filepath.Ext(source))+".pre")
+
+	if err := ensureTools("preprocessor", "plsa"); err != nil {
+		return nil, err
+	}
+	origins, err := preprocess(source, pre)
+	if err == nil {
+		var stageErr *stageError
+		if err = runStage("plsa", dir, toolPath("plsa"), pre); errors.As(err, &stageErr) {
+			stageErr.pre, stageErr.origins = pre, origins
+		}
+	}
+	return stageDiagnostics(source, err)
+}
+
+// checkText is checkSource for text, the unsaved contents of source. The
+// text is written to a hidden file next to source for the duration of the
+// check, so that its includes resolve as they would for source itself.
+func checkText(source, text string) ([]diagnostic, error) {
+	source, err := filepath.Abs(source)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(source), "."+filepath.Base(source)+".*"+filepath.Ext(source))
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(text)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	diags, err := checkSource(f.Name())
+	rename := func(file *string) {
+		if *file == f.Name() {
+			*file = source
+		}
+	}
+	for i := range diags {
+		d := &diags[i]
+		rename(&d.File)
+		for j := range d.Secondary {
+			rename(&d.Secondary[j].File)
+		}
+		for j := range d.Suggestions {
+			for k := range d.Suggestions[j].Edits {
+				rename(&d.Suggestions[j].Edits[k].File)
+			}
+		}
+	}
+	return diags, err
+}
+
+// stageDiagnostics turns the error of a failed stage into diagnostics for
+// source, passing through errors that did not come from the tool itself.
+func stageDiagnostics(source string, err error) ([]diagnostic, error) {
+	if err == nil {
+		return nil, nil
+	}
+	var stageErr *stageError
+	if !errors.As(err, &stageErr) || !toolFailed(err) {
+		return nil, err
+	}
+	diags := parseDiagnostics(source, stageErr.output)
+	if stageErr.origins != nil {
+		diagnostics.Remap(diags, stageErr.origins, stageErr.pre, source)
+	}
+	for i := range diags {
+		diags[i].Suggestions = suggestFixes(source, diags[i])
+	}
+	return diags, nil
+}
+
+// lineOrigin is the source location an output line of the preprocessor came
+// from.
+type lineOrigin = diagnostics.Origin
+
+// preprocess runs the preprocessor on source, writing pre, and returns the
+// origin of every line of pre. System includes are also searched for in
+// includeDirs.
+func preprocess(source, pre string, includeDirs ...string) ([]lineOrigin, error) {
+	source, err := filepath.Abs(source)
+	if err != nil {
+		return nil, err
+	}
+	pre, err = filepath.Abs(pre)
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureTools("preprocessor"); err != nil {
+		return nil, err
+	}
+	mapFile := pre + ".map"
+	dir := filepath.Dir(source)
+	args := []string{source, pre, "--map", mapFile}
+	for _, inc := range includeDirs {
+		args = append(args, "-I", inc)
+	}
+	if err := runStage("preprocessor", dir, toolPath("preprocessor"), args...); err != nil {
+		return nil, err
+	}
+	// Included files are opened relative to the preprocessor's working
+	// directory.
+	return diagnostics.ReadLineMap(mapFile, dir)
+}
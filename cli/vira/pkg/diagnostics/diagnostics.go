@@ -0,0 +1,297 @@
+// Package diagnostics models the problems the Vira toolchain reports about
+// source code and renders them with the source they point at.
+//
+// It is shared by vira and virac, so that the build, the language server
+// and vira fix describe a problem the same way.
+package diagnostics
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"vira/pkg/i18n"
+)
+
+// Severity is how serious a diagnostic is.
+type Severity string
+
+const (
+	Error   Severity = "error"
+	Warning Severity = "warning"
+	Note    Severity = "note"
+	Help    Severity = "help"
+)
+
+// Diagnostic is a problem in source code. Its primary span is the location
+// given by File, Line and Column, up to EndLine and EndColumn if known.
+type Diagnostic struct {
+	File      string   `json:"file"`
+	Line      int      `json:"line"`
+	Column    int      `json:"column"`
+	EndLine   int      `json:"endLine,omitempty"`
+	EndColumn int      `json:"endColumn,omitempty"`
+	Severity  Severity `json:"severity"`
+	Code      string   `json:"code,omitempty"`
+	Message   string   `json:"message"`
+	// Label is shown under the primary span.
+	Label string `json:"label,omitempty"`
+	// Secondary spans point at related code, such as an earlier definition.
+	Secondary []Span   `json:"secondary,omitempty"`
+	Notes     []string `json:"notes,omitempty"`
+	// Suggestions are fixes that can be applied without human judgement.
+	Suggestions []Suggestion `json:"suggestions,omitempty"`
+}
+
+// Span is a range of source code from Line:Column up to EndLine:EndColumn.
+// An EndLine of zero means the span ends on Line, and an EndColumn of zero
+// that its end is not known.
+type Span struct {
+	File      string `json:"file"`
+	Line      int    `json:"line"`
+	Column    int    `json:"column"`
+	EndLine   int    `json:"endLine,omitempty"`
+	EndColumn int    `json:"endColumn,omitempty"`
+	Label     string `json:"label,omitempty"`
+}
+
+// Suggestion is a machine-applicable fix for a diagnostic.
+type Suggestion struct {
+	Message string `json:"message"`
+	Edits   []Edit `json:"edits"`
+}
+
+// Edit replaces the text of File from Line:Column up to EndLine:EndColumn.
+// An EndLine of zero means the edit ends on Line.
+type Edit struct {
+	File      string `json:"file"`
+	Line      int    `json:"line"`
+	Column    int    `json:"column"`
+	EndLine   int    `json:"endLine,omitempty"`
+	EndColumn int    `json:"endColumn"`
+	NewText   string `json:"newText"`
+}
+
+// Primary returns the span the diagnostic is about.
+func (d Diagnostic) Primary() Span {
+	return Span{File: d.File, Line: d.Line, Column: d.Column, EndLine: d.EndLine, EndColumn: d.EndColumn, Label: d.Label}
+}
+
+// String formats d on one line in the short error format, as
+// file:line:column: severity[code]: message.
+func (d Diagnostic) String() string {
+	return Short(d)
+}
+
+var (
+	locationPattern = regexp.MustCompile(`\s*at line (\d+), column (\d+)`)
+	// prefixPattern matches the "file:line:column: " some tools put in
+	// front of the severity.
+	prefixPattern = regexp.MustCompile(`^(\S+?):(\d+):(\d+): `)
+)
+
+// Parse extracts the diagnostics from the combined output of a toolchain
+// tool run on file. The tools print one line per diagnostic, starting with
+// "Error: " or "Warning: ", possibly with a code in brackets before the
+// colon, and optionally ending in "at line N, column M"; a "note: " line
+// after one adds a note to it. If the output has no such lines, all of it
+// is reported as a single error at the start of file.
+func Parse(file, output string) []Diagnostic {
+	var diags []Diagnostic
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		d := Diagnostic{File: file, Line: 1, Column: 1}
+		if m := prefixPattern.FindStringSubmatch(line); m != nil {
+			d.File = m[1]
+			d.Line, _ = strconv.Atoi(m[2])
+			d.Column, _ = strconv.Atoi(m[3])
+			line = line[len(m[0]):]
+		}
+		severity, code, msg, ok := cutSeverity(line)
+		switch {
+		case !ok:
+			continue
+		case severity == Note || severity == Help:
+			if len(diags) > 0 {
+				last := &diags[len(diags)-1]
+				last.Notes = append(last.Notes, msg)
+			}
+			continue
+		}
+		d.Severity = severity
+		d.Code = code
+		d.Message = msg
+		parseLocation(&d)
+		diags = append(diags, d)
+	}
+	if len(diags) == 0 && strings.TrimSpace(output) != "" {
+		d := Diagnostic{File: file, Line: 1, Column: 1, Severity: Error, Message: strings.TrimSpace(output)}
+		parseLocation(&d)
+		diags = append(diags, d)
+	}
+	return diags
+}
+
+// Recognized reports whether output has any line that Parse reads as a
+// diagnostic, rather than reporting all of it as one error.
+func Recognized(output string) bool {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if m := prefixPattern.FindString(line); m != "" {
+			line = line[len(m):]
+		}
+		if _, _, _, ok := cutSeverity(line); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// severityPattern matches the severity a diagnostic line starts with, and
+// the code that may follow it, as in "warning[W0003]: ".
+var severityPattern = regexp.MustCompile(`(?i)^(error|warning|note|help)(?:\[([\w-]+)\])?: `)
+
+// cutSeverity splits a line such as "Error: ..." or "warning[W0003]: ..."
+// into its severity, code and message.
+func cutSeverity(line string) (Severity, string, string, bool) {
+	m := severityPattern.FindStringSubmatch(line)
+	if m == nil {
+		return "", "", "", false
+	}
+	return Severity(strings.ToLower(m[1])), m[2], line[len(m[0]):], true
+}
+
+func parseLocation(d *Diagnostic) {
+	if m := locationPattern.FindStringSubmatchIndex(d.Message); m != nil {
+		d.Line, _ = strconv.Atoi(d.Message[m[2]:m[3]])
+		d.Column, _ = strconv.Atoi(d.Message[m[4]:m[5]])
+		d.Message = d.Message[:m[0]] + d.Message[m[1]:]
+	}
+}
+
+// Summary counts diagnostics by severity, as in "3 errors, 2 warnings".
+// It is empty if there are no errors or warnings.
+func Summary(diags []Diagnostic) string {
+	var errors, warnings int
+	for _, d := range diags {
+		switch d.Severity {
+		case Error:
+			errors++
+		case Warning:
+			warnings++
+		}
+	}
+	var parts []string
+	if errors > 0 {
+		parts = append(parts, i18n.Plural(errors, "%d error", "%d errors"))
+	}
+	if warnings > 0 {
+		parts = append(parts, i18n.Plural(warnings, "%d warning", "%d warnings"))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Limit splits diags after the limit-th error into those to show and those
+// to suppress, so that an error storm does not flood the terminal. A limit
+// of zero or less shows all of them.
+func Limit(diags []Diagnostic, limit int) (shown, suppressed []Diagnostic) {
+	if limit <= 0 {
+		return diags, nil
+	}
+	errors := 0
+	for i, d := range diags {
+		if d.Severity != Error {
+			continue
+		}
+		if errors++; errors == limit {
+			return diags[:i+1], diags[i+1:]
+		}
+	}
+	return diags, nil
+}
+
+// Dedup merges diagnostics that repeat the same problem at the same primary
+// location, as when every compilation unit that includes a broken file
+// reports its error again. The first of each is kept with a note on how
+// often it was reported, and the most repeated come first, since they are
+// usually the root cause of the rest; otherwise the order is kept.
+func Dedup(diags []Diagnostic) []Diagnostic {
+	type key struct {
+		file         string
+		line, column int
+		severity     Severity
+		code         string
+		message      string
+	}
+	var unique []Diagnostic
+	var counts []int
+	index := map[key]int{}
+	for _, d := range diags {
+		k := key{d.File, d.Line, d.Column, d.Severity, d.Code, d.Message}
+		if i, ok := index[k]; ok {
+			counts[i]++
+			continue
+		}
+		index[k] = len(unique)
+		unique = append(unique, d)
+		counts = append(counts, 1)
+	}
+	order := make([]int, len(unique))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return counts[order[i]] > counts[order[j]] })
+	result := make([]Diagnostic, len(unique))
+	for i, j := range order {
+		d := unique[j]
+		if counts[j] > 1 {
+			d.Notes = append(d.Notes[:len(d.Notes):len(d.Notes)], i18n.T("reported %d times", counts[j]))
+		}
+		result[i] = d
+	}
+	return result
+}
+
+// ApplyEdits applies edits, which must not overlap, to content. Edits
+// outside of content are ignored.
+func ApplyEdits(content string, edits []Edit) string {
+	var lineStart []int
+	for i, start := 0, 0; i >= 0; {
+		lineStart = append(lineStart, start)
+		i = strings.IndexByte(content[start:], '\n')
+		start += i + 1
+	}
+	offset := func(line, column int) int {
+		if line < 1 || line > len(lineStart) || column < 1 {
+			return -1
+		}
+		off := lineStart[line-1] + column - 1
+		if off > len(content) {
+			return -1
+		}
+		return off
+	}
+
+	type span struct {
+		start, end int
+		text       string
+	}
+	var spans []span
+	for _, e := range edits {
+		endLine := e.EndLine
+		if endLine == 0 {
+			endLine = e.Line
+		}
+		start, end := offset(e.Line, e.Column), offset(endLine, e.EndColumn)
+		if start < 0 || end < start {
+			continue
+		}
+		spans = append(spans, span{start, end, e.NewText})
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start > spans[j].start })
+	for _, s := range spans {
+		content = content[:s.start] + s.text + content[s.end:]
+	}
+	return content
+}
@@ -0,0 +1,64 @@
+package diagnostics
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Origin is the source line that a line of preprocessed output came from.
+type Origin struct {
+	File string
+	Line int
+}
+
+// ReadLineMap reads the line map the preprocessor writes with --map, one
+// "file<TAB>line" entry per line of its output. Relative file names are
+// resolved against dir, the preprocessor's working directory.
+func ReadLineMap(path, dir string) ([]Origin, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var origins []Origin
+	for _, entry := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		file, line, ok := strings.Cut(entry, "\t")
+		if !ok {
+			continue
+		}
+		n, _ := strconv.Atoi(line)
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		origins = append(origins, Origin{File: file, Line: n})
+	}
+	return origins, nil
+}
+
+// Remap moves diagnostics that tools reported against the preprocessed file
+// pre, or against source when they only know the line, to the lines of the
+// files the preprocessor read. Lines beyond origins are left alone.
+func Remap(diags []Diagnostic, origins []Origin, pre, source string) {
+	remap := func(file *string, line, endLine, endColumn *int) {
+		if *file != pre && *file != source || *line < 1 || *line > len(origins) {
+			return
+		}
+		o := origins[*line-1]
+		if *endLine > 0 && *endLine <= len(origins) && origins[*endLine-1].File == o.File {
+			*endLine = origins[*endLine-1].Line
+		} else if *endLine > 0 {
+			// The span ends in another file; keep only its start.
+			*endLine, *endColumn = 0, 0
+		}
+		*file, *line = o.File, o.Line
+	}
+	for i := range diags {
+		d := &diags[i]
+		remap(&d.File, &d.Line, &d.EndLine, &d.EndColumn)
+		for j := range d.Secondary {
+			s := &d.Secondary[j]
+			remap(&s.File, &s.Line, &s.EndLine, &s.EndColumn)
+		}
+	}
+}
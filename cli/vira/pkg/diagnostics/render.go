@@ -0,0 +1,429 @@
+package diagnostics
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"vira/pkg/i18n"
+)
+
+// Renderer formats diagnostics with the lines of source they point at:
+//
+//	error[E0002]: use of undeclared identifier `coutn`
+//	 --> src/main.vira:4:5
+//	  |
+//	4 |     coutn = 1;
+//	  |     ^^^^^
+//	  |
+//	  = help: did you mean `count`?
+//	  |
+//	4 |     count = 1;
+//	  |     ~~~~~
+type Renderer struct {
+	// Color enables ANSI colors.
+	Color bool
+	// Sources holds the text of files whose content differs from the
+	// disk, such as unsaved editor buffers, by path.
+	Sources map[string]string
+	// Path, if set, rewrites file names for display, such as to make them
+	// relative to the working directory.
+	Path func(string) string
+	// Link, if set, returns the URL that a location links to, which is
+	// written as an OSC 8 terminal hyperlink, or "" for no link.
+	Link func(file string, line, column int) string
+	// Width, if not zero, is the width of the terminal: source lines that
+	// do not fit are cut around the code they point at.
+	Width int
+
+	lines map[string][]string
+}
+
+const (
+	ansiReset  = "\x1b[0m"
+	ansiBold   = "\x1b[1m"
+	ansiRed    = "\x1b[1;31m"
+	ansiYellow = "\x1b[1;33m"
+	ansiBlue   = "\x1b[1;34m"
+	ansiCyan   = "\x1b[1;36m"
+	ansiGreen  = "\x1b[1;32m"
+)
+
+func (r *Renderer) style(code, s string) string {
+	if !r.Color || s == "" {
+		return s
+	}
+	return code + s + ansiReset
+}
+
+func severityColor(s Severity) string {
+	switch s {
+	case Error:
+		return ansiRed
+	case Warning:
+		return ansiYellow
+	case Help:
+		return ansiGreen
+	default:
+		return ansiCyan
+	}
+}
+
+func (r *Renderer) path(file string) string {
+	if r.Path != nil {
+		return r.Path(file)
+	}
+	return file
+}
+
+// location formats file:line:column, as a hyperlink if r has a link for it.
+func (r *Renderer) location(file string, line, column int) string {
+	text := fmt.Sprintf("%s:%d:%d", r.path(file), line, column)
+	if r.Link == nil {
+		return text
+	}
+	url := r.Link(file, line, column)
+	if url == "" {
+		return text
+	}
+	return "\x1b]8;;" + url + "\x1b\\" + text + "\x1b]8;;\x1b\\"
+}
+
+// line returns line n of file, if it can be read.
+func (r *Renderer) line(file string, n int) (string, bool) {
+	if r.lines == nil {
+		r.lines = map[string][]string{}
+	}
+	lines, ok := r.lines[file]
+	if !ok {
+		if text, ok := r.Sources[file]; ok {
+			lines = strings.Split(text, "\n")
+		} else if data, err := os.ReadFile(file); err == nil {
+			lines = strings.Split(string(data), "\n")
+		}
+		r.lines[file] = lines
+	}
+	if n < 1 || n > len(lines) {
+		return "", false
+	}
+	return strings.TrimRight(lines[n-1], "\r"), true
+}
+
+// Render writes d to w.
+func (r *Renderer) Render(w io.Writer, d Diagnostic) error {
+	_, err := io.WriteString(w, r.Format(d))
+	return err
+}
+
+// RenderAll writes diags to w, separated by blank lines.
+func (r *Renderer) RenderAll(w io.Writer, diags []Diagnostic) error {
+	for i, d := range diags {
+		if i > 0 {
+			if _, err := io.WriteString(w, "\n"); err != nil {
+				return err
+			}
+		}
+		if err := r.Render(w, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Format returns d as Render writes it.
+func (r *Renderer) Format(d Diagnostic) string {
+	var b strings.Builder
+	header := i18n.T(string(d.Severity))
+	if header == "" {
+		header = i18n.T(string(Error))
+	}
+	if d.Code != "" {
+		header += "[" + d.Code + "]"
+	}
+	b.WriteString(r.style(severityColor(d.Severity), header) + r.style(ansiBold, ": "+d.Message) + "\n")
+
+	// Spans are shown grouped by file, the primary span's file first.
+	primary := d.Primary()
+	spans := map[string][]Span{primary.File: {primary}}
+	files := []string{primary.File}
+	for _, s := range d.Secondary {
+		if _, ok := spans[s.File]; !ok {
+			files = append(files, s.File)
+		}
+		spans[s.File] = append(spans[s.File], s)
+	}
+	previews := make([][]previewLine, len(d.Suggestions))
+	for i, s := range d.Suggestions {
+		previews[i] = r.preview(s)
+	}
+	width := 1
+	for _, group := range spans {
+		for _, s := range group {
+			width = max(width, len(strconv.Itoa(s.Line)))
+		}
+	}
+	for _, lines := range previews {
+		for _, l := range lines {
+			width = max(width, len(strconv.Itoa(l.line)))
+		}
+	}
+	pad := strings.Repeat(" ", width)
+	gutter := r.style(ansiBlue, pad+" |")
+
+	for i, file := range files {
+		group := spans[file]
+		arrow := "-->"
+		if i > 0 {
+			arrow = ":::"
+		}
+		fmt.Fprintf(&b, "%s%s %s\n", pad, r.style(ansiBlue, arrow), r.location(file, group[0].Line, group[0].Column))
+		sort.SliceStable(group, func(i, j int) bool { return group[i].Line < group[j].Line })
+		shown := false
+		var start, end int
+		for j, s := range group {
+			text, ok := r.line(file, s.Line)
+			if !ok {
+				continue
+			}
+			if !shown {
+				b.WriteString(gutter + "\n")
+				shown = true
+			} else if s.Line > group[j-1].Line+1 {
+				b.WriteString(r.style(ansiBlue, "...") + "\n")
+			}
+			if j == 0 || s.Line != group[j-1].Line {
+				start, end = r.window(text, width+3, s)
+			}
+			text, s = clip(text, start, end, s)
+			if j == 0 || s.Line != group[j-1].Line {
+				fmt.Fprintf(&b, "%s %s\n", r.style(ansiBlue, fmt.Sprintf("%*d |", width, s.Line)), text)
+			}
+			marker, color := "-", ansiBlue
+			if i == 0 && j == indexOf(group, primary) {
+				marker, color = "^", severityColor(d.Severity)
+			}
+			underline := strings.Repeat(marker, spanWidth(text, s))
+			if s.Label != "" {
+				underline += " " + s.Label
+			}
+			fmt.Fprintf(&b, "%s %s%s\n", gutter, indent(text, s.Column), r.style(color, underline))
+		}
+	}
+
+	if len(d.Notes) > 0 || len(d.Suggestions) > 0 {
+		b.WriteString(gutter + "\n")
+	}
+	for _, note := range d.Notes {
+		fmt.Fprintf(&b, "%s %s %s\n", pad, r.style(ansiBlue, "="), r.style(ansiBold, i18n.T("note:"))+" "+note)
+	}
+	for i, s := range d.Suggestions {
+		fmt.Fprintf(&b, "%s %s %s\n", pad, r.style(ansiBlue, "="), r.style(ansiBold, i18n.T("help:"))+" "+s.Message)
+		lines := previews[i]
+		if len(lines) == 0 {
+			continue
+		}
+		file := primary.File
+		for j, l := range lines {
+			if j == maxPreviewLines {
+				fmt.Fprintf(&b, "%s %s\n", r.style(ansiBlue, "..."), i18n.T("and %d more", len(lines)-j))
+				break
+			}
+			if l.file != file {
+				fmt.Fprintf(&b, "%s%s %s:%d\n", pad, r.style(ansiBlue, ":::"), r.path(l.file), l.line)
+				file = l.file
+			}
+			if j == 0 || l.file != lines[j-1].file {
+				b.WriteString(gutter + "\n")
+			}
+			fmt.Fprintf(&b, "%s %s\n", r.style(ansiBlue, fmt.Sprintf("%*d |", width, l.line)), l.text)
+			var underline strings.Builder
+			underline.WriteString(indent(l.text, l.marks[0][0]+1))
+			for k, m := range l.marks {
+				if k > 0 {
+					underline.WriteString(strings.Repeat(" ", m[0]-l.marks[k-1][1]))
+				}
+				underline.WriteString(r.style(ansiGreen, strings.Repeat("~", max(m[1]-m[0], 1))))
+			}
+			fmt.Fprintf(&b, "%s %s\n", gutter, underline.String())
+		}
+	}
+	return b.String()
+}
+
+// maxPreviewLines bounds the changed lines shown for a suggestion.
+const maxPreviewLines = 3
+
+// previewLine is a source line as it reads with a suggestion applied. Marks
+// are the byte ranges of text that the suggestion inserted.
+type previewLine struct {
+	file  string
+	line  int
+	text  string
+	marks [][2]int
+}
+
+// preview returns the lines s changes, as they read with s applied, in file
+// and line order. It is empty if s has edits spanning lines or inserting
+// them, or if a changed line cannot be read.
+func (r *Renderer) preview(s Suggestion) []previewLine {
+	type key struct {
+		file string
+		line int
+	}
+	byLine := map[key][]Edit{}
+	var keys []key
+	for _, e := range s.Edits {
+		if e.EndLine != 0 && e.EndLine != e.Line || strings.Contains(e.NewText, "\n") {
+			return nil
+		}
+		k := key{e.File, e.Line}
+		if _, ok := byLine[k]; !ok {
+			keys = append(keys, k)
+		}
+		byLine[k] = append(byLine[k], e)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		if keys[i].file != keys[j].file {
+			return keys[i].file < keys[j].file
+		}
+		return keys[i].line < keys[j].line
+	})
+
+	var lines []previewLine
+	for _, k := range keys {
+		text, ok := r.line(k.file, k.line)
+		if !ok {
+			return nil
+		}
+		edits := byLine[k]
+		sort.Slice(edits, func(i, j int) bool { return edits[i].Column < edits[j].Column })
+		l := previewLine{file: k.file, line: k.line}
+		var b strings.Builder
+		pos := 0
+		for _, e := range edits {
+			start, end := e.Column-1, e.EndColumn-1
+			if start < pos || end < start || end > len(text) {
+				return nil
+			}
+			b.WriteString(text[pos:start])
+			l.marks = append(l.marks, [2]int{b.Len(), b.Len() + len(e.NewText)})
+			b.WriteString(e.NewText)
+			pos = end
+		}
+		b.WriteString(text[pos:])
+		l.text = b.String()
+		lines = append(lines, l)
+	}
+	return lines
+}
+
+// ellipsis marks where a source line was cut.
+const ellipsis = "..."
+
+// window returns the part of text to show so that the line fits the
+// terminal after a gutter of the given width, keeping the code s points at
+// in view: all of text if it fits or no width is set.
+func (r *Renderer) window(text string, gutter int, s Span) (start, end int) {
+	room := r.Width - gutter
+	if r.Width == 0 || len(text) <= room || room <= 4*len(ellipsis) {
+		return 0, len(text)
+	}
+	// A third of the room goes to the code before the span.
+	start = max(s.Column-1-room/3, 0)
+	if start > 0 {
+		room -= len(ellipsis)
+	}
+	end = start + room
+	if end < len(text) {
+		end -= len(ellipsis)
+	} else {
+		end = len(text)
+		start = len(text) - room
+	}
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end--
+	}
+	return start, end
+}
+
+// clip returns the part of text between start and end, with ellipses where
+// it was cut, and s moved along.
+func clip(text string, start, end int, s Span) (string, Span) {
+	if start == 0 && end == len(text) {
+		return text, s
+	}
+	shown := text[start:end]
+	shift := start
+	if start > 0 {
+		shown = ellipsis + shown
+		shift -= len(ellipsis)
+	}
+	if end < len(text) {
+		shown += ellipsis
+	}
+	s.Column = max(s.Column-shift, 1)
+	if s.EndColumn != 0 && (s.EndLine == 0 || s.EndLine == s.Line) {
+		s.EndColumn = max(s.EndColumn-shift, s.Column)
+		if end < len(text) {
+			s.EndColumn = min(s.EndColumn, len(shown)-len(ellipsis)+1)
+		}
+	}
+	return shown, s
+}
+
+func indexOf(spans []Span, s Span) int {
+	for i := range spans {
+		if spans[i] == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// indent returns the whitespace that lines up the underline with column of
+// text, keeping tabs so that it lines up in any terminal.
+func indent(text string, column int) string {
+	var b strings.Builder
+	for i := 0; i < column-1 && i < len(text); i++ {
+		if text[i] == '\t' {
+			b.WriteByte('\t')
+		} else {
+			b.WriteByte(' ')
+		}
+	}
+	for i := len(text); i < column-1; i++ {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// spanWidth is the number of characters to underline for s on text: up to
+// its end column on the same line, or to the end of the word at its start.
+func spanWidth(text string, s Span) int {
+	start := s.Column - 1
+	if start < 0 || start > len(text) {
+		return 1
+	}
+	switch {
+	case (s.EndLine == 0 || s.EndLine == s.Line) && s.EndColumn > s.Column:
+		return min(s.EndColumn, len(text)+1) - s.Column
+	case s.EndLine > s.Line:
+		return max(len(text)-start, 1)
+	}
+	end := start
+	for end < len(text) && isWordByte(text[end]) {
+		end++
+	}
+	return max(end-start, 1)
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
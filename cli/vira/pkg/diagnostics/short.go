@@ -0,0 +1,61 @@
+package diagnostics
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The short error format writes each diagnostic on a line of its own:
+//
+//	file:line:column: severity[code]: message
+//
+// Editors and CI scripts parse it, so it only ever changes in ways that
+// ShortPattern and VimErrorFormat keep matching:
+//
+//   - file is the path as the caller gives it, and never empty;
+//   - line and column are decimal and count from 1;
+//   - severity is error, warning, note or help, in lower case;
+//   - [code] is left out when the diagnostic has none, and otherwise holds
+//     letters, digits, underscores and hyphens only, as in E0042 or
+//     naming-convention;
+//   - message is never empty and never spans lines: each run of white
+//     space in it, line breaks included, becomes a single space.
+//
+// Notes, suggestions and secondary spans are not part of the short format.
+const (
+	// ShortPattern is a regular expression that matches a line of the short
+	// format, with the file, line, column, severity, code and message as its
+	// groups, in that order. It can be used as is in the pattern of a VS Code
+	// problem matcher.
+	ShortPattern = `^(.*?):(\d+):(\d+): (error|warning|note|help)(?:\[([\w-]+)\])?: (.*)$`
+	// VimErrorFormat is the 'errorformat' to read the short format into
+	// Vim's quickfix list.
+	VimErrorFormat = `%f:%l:%c: %t%*[^:]: %m`
+)
+
+// Short formats d on one line in the short error format.
+func Short(d Diagnostic) string {
+	file := d.File
+	if file == "" {
+		file = "-"
+	}
+	line, column := max(d.Line, 1), max(d.Column, 1)
+	severity := strings.ToLower(string(d.Severity))
+	switch Severity(severity) {
+	case Error, Warning, Note, Help:
+	default:
+		severity = string(Error)
+	}
+	if d.Code != "" && strings.IndexFunc(d.Code, notCodeRune) < 0 {
+		severity += "[" + d.Code + "]"
+	}
+	message := strings.Join(strings.Fields(d.Message), " ")
+	if message == "" {
+		message = "(no message)"
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s", file, line, column, severity, message)
+}
+
+func notCodeRune(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-')
+}
@@ -0,0 +1,153 @@
+package diagnostics
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestShort(t *testing.T) {
+	tests := []struct {
+		name string
+		d    Diagnostic
+		want string
+	}{
+		{
+			name: "code",
+			d:    Diagnostic{File: "src/main.vira", Line: 4, Column: 5, Severity: Error, Code: "E0301", Message: "undeclared identifier x"},
+			want: "src/main.vira:4:5: error[E0301]: undeclared identifier x",
+		},
+		{
+			name: "hyphenated code",
+			d:    Diagnostic{File: "src/main.vira", Line: 1, Column: 9, Severity: Warning, Code: "naming-convention", Message: "macro Answer is not UPPER_SNAKE_CASE"},
+			want: "src/main.vira:1:9: warning[naming-convention]: macro Answer is not UPPER_SNAKE_CASE",
+		},
+		{
+			name: "missing code",
+			d:    Diagnostic{File: "a.vira", Line: 2, Column: 3, Severity: Note, Message: "declared here"},
+			want: "a.vira:2:3: note: declared here",
+		},
+		{
+			name: "code that would break the format",
+			d:    Diagnostic{File: "a.vira", Line: 2, Column: 3, Severity: Error, Code: "E1]: x", Message: "m"},
+			want: "a.vira:2:3: error: m",
+		},
+		{
+			name: "message over several lines",
+			d:    Diagnostic{File: "a.vira", Line: 1, Column: 1, Severity: Help, Message: "  add a return\n\tstatement\r\n"},
+			want: "a.vira:1:1: help: add a return statement",
+		},
+		{
+			name: "empty message",
+			d:    Diagnostic{File: "a.vira", Line: 1, Column: 1, Severity: Error},
+			want: "a.vira:1:1: error: (no message)",
+		},
+		{
+			name: "no location",
+			d:    Diagnostic{Severity: Error, Message: "linking failed"},
+			want: "-:1:1: error: linking failed",
+		},
+		{
+			name: "severity in capitals",
+			d:    Diagnostic{File: "a.vira", Line: 7, Column: 2, Severity: "WARNING", Message: "m"},
+			want: "a.vira:7:2: warning: m",
+		},
+		{
+			name: "unknown severity",
+			d:    Diagnostic{File: "a.vira", Line: 7, Column: 2, Severity: "fatal", Message: "m"},
+			want: "a.vira:7:2: error: m",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Short(tt.d); got != tt.want {
+				t.Errorf("Short() = %q, want %q", got, tt.want)
+			}
+			if got := tt.d.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// shortFields are the parts of a line of the short format.
+type shortFields struct {
+	file, line, column, severity, code, message string
+}
+
+var shortDiagnostics = []struct {
+	d    Diagnostic
+	want shortFields
+}{
+	{
+		Diagnostic{File: "src/main.vira", Line: 12, Column: 5, Severity: Error, Code: "E0301", Message: "undeclared identifier x"},
+		shortFields{"src/main.vira", "12", "5", "error", "E0301", "undeclared identifier x"},
+	},
+	{
+		Diagnostic{File: "src/main.vira", Line: 1, Column: 9, Severity: Warning, Code: "unused-include", Message: `"util.vira" is included but nothing it declares is used`},
+		shortFields{"src/main.vira", "1", "9", "warning", "unused-include", `"util.vira" is included but nothing it declares is used`},
+	},
+	{
+		Diagnostic{File: "lib/a b.vira", Line: 3, Column: 1, Severity: Note, Message: "expected: int"},
+		shortFields{"lib/a b.vira", "3", "1", "note", "", "expected: int"},
+	},
+	{
+		Diagnostic{File: `C:\src\main.vira`, Line: 2, Column: 4, Severity: Help, Message: "multi\nline"},
+		shortFields{`C:\src\main.vira`, "2", "4", "help", "", "multi line"},
+	},
+}
+
+func TestShortPattern(t *testing.T) {
+	re := regexp.MustCompile(ShortPattern)
+	for _, tt := range shortDiagnostics {
+		line := Short(tt.d)
+		m := re.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("ShortPattern does not match %q", line)
+			continue
+		}
+		got := shortFields{m[1], m[2], m[3], m[4], m[5], m[6]}
+		if got != tt.want {
+			t.Errorf("ShortPattern on %q = %+v, want %+v", line, got, tt.want)
+		}
+	}
+}
+
+// vimPattern translates the items of an errorformat that VimErrorFormat
+// uses into a regular expression, with a group for each of %f, %l, %c, %t
+// and %m.
+func vimPattern(t *testing.T, format string) *regexp.Regexp {
+	items := strings.NewReplacer(
+		`%\*\[\^:\]`, `[^:]*`, // %*[^:], as QuoteMeta leaves it
+		"%f", `(.+?)`,
+		"%l", `(\d+)`,
+		"%c", `(\d+)`,
+		"%t", `(.)`,
+		"%m", `(.*)`,
+	)
+	pattern := items.Replace(regexp.QuoteMeta(format))
+	if strings.Contains(pattern, "%") {
+		t.Fatalf("VimErrorFormat %q has an item the test does not know", format)
+	}
+	return regexp.MustCompile("^" + pattern + "$")
+}
+
+func TestVimErrorFormat(t *testing.T) {
+	re := vimPattern(t, VimErrorFormat)
+	for _, tt := range shortDiagnostics {
+		line := Short(tt.d)
+		m := re.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("VimErrorFormat does not match %q", line)
+			continue
+		}
+		file, lnum, col, typ, message := m[1], m[2], m[3], m[4], m[5]
+		if file != tt.want.file || lnum != tt.want.line || col != tt.want.column || message != tt.want.message {
+			t.Errorf("VimErrorFormat on %q = %q, %s, %s, %q", line, file, lnum, col, message)
+		}
+		// Vim takes the type from the first letter of the severity.
+		if typ != tt.want.severity[:1] {
+			t.Errorf("VimErrorFormat on %q gives type %q, want %q", line, typ, tt.want.severity[:1])
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Package i18n translates the messages of vira and virac.
+//
+// Messages are looked up by their English text, which is also what is shown
+// when the catalog of the selected language has no translation for them.
+// Catalogs live in locales/<language>.toml: plain keys map a message to its
+// translation, and the [plural] table maps the singular of a counted
+// message to its one and other forms.
+package i18n
+
+import (
+	"embed"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+)
+
+//go:embed locales/*.toml
+var locales embed.FS
+
+type catalog struct {
+	messages map[string]string
+	plurals  map[string]pluralForms
+}
+
+type pluralForms struct {
+	One   string `toml:"one"`
+	Other string `toml:"other"`
+}
+
+var (
+	mu sync.Mutex
+	// language is the selected language, or "" before one is selected.
+	language string
+	selected *catalog
+)
+
+// Languages lists the languages there are catalogs for, besides English.
+func Languages() []string {
+	entries, _ := locales.ReadDir("locales")
+	var langs []string
+	for _, e := range entries {
+		langs = append(langs, strings.TrimSuffix(e.Name(), ".toml"))
+	}
+	return langs
+}
+
+// SetLanguage selects the language of messages, such as "es" or "pt_BR".
+// A language without a catalog falls back to the catalog of its base
+// language, and then to English.
+func SetLanguage(lang string) {
+	mu.Lock()
+	defer mu.Unlock()
+	setLanguage(lang)
+}
+
+func setLanguage(lang string) {
+	language, selected = "en", nil
+	for _, name := range candidates(lang) {
+		if c, err := loadCatalog(name); err == nil {
+			language, selected = name, c
+			return
+		}
+	}
+}
+
+// Language returns the selected language, detecting it from the environment
+// on first use: VIRA_LANG, or else the locale in LC_ALL, LC_MESSAGES or LANG.
+func Language() string {
+	mu.Lock()
+	defer mu.Unlock()
+	if language == "" {
+		setLanguage(detect())
+	}
+	return language
+}
+
+// current returns the catalog of the selected language, or nil for English.
+func current() *catalog {
+	mu.Lock()
+	defer mu.Unlock()
+	if language == "" {
+		setLanguage(detect())
+	}
+	return selected
+}
+
+func detect() string {
+	for _, name := range []string{"VIRA_LANG", "LC_ALL", "LC_MESSAGES", "LANG"} {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// candidates turns a locale such as "pt_BR.UTF-8@euro" into the catalog
+// names to try, "pt_BR" and "pt".
+func candidates(lang string) []string {
+	lang, _, _ = strings.Cut(lang, ".")
+	lang, _, _ = strings.Cut(lang, "@")
+	lang = strings.ReplaceAll(lang, "-", "_")
+	if lang == "" || lang == "C" || lang == "POSIX" {
+		return nil
+	}
+	base, region, ok := strings.Cut(lang, "_")
+	base = strings.ToLower(base)
+	if !ok {
+		return []string{base}
+	}
+	return []string{base + "_" + strings.ToUpper(region), base}
+}
+
+func loadCatalog(name string) (*catalog, error) {
+	data, err := locales.ReadFile(path.Join("locales", name+".toml"))
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]any
+	if _, err := toml.Decode(string(data), &raw); err != nil {
+		return nil, fmt.Errorf("locales/%s.toml: %v", name, err)
+	}
+	c := &catalog{messages: map[string]string{}, plurals: map[string]pluralForms{}}
+	for key, value := range raw {
+		switch value := value.(type) {
+		case string:
+			c.messages[key] = value
+		case map[string]any:
+			if key != "plural" {
+				continue
+			}
+			for msg, forms := range value {
+				forms, _ := forms.(map[string]any)
+				one, _ := forms["one"].(string)
+				other, _ := forms["other"].(string)
+				c.plurals[msg] = pluralForms{One: one, Other: other}
+			}
+		}
+	}
+	return c, nil
+}
+
+// T translates msg and, if args are given, formats it with them as
+// fmt.Sprintf does.
+func T(msg string, args ...any) string {
+	if c := current(); c != nil {
+		if translated, ok := c.messages[msg]; ok && translated != "" {
+			msg = translated
+		}
+	}
+	if len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
+
+// Plural formats the count n with one, as in "%d error", if n is 1 and with
+// other otherwise, translating them by one.
+func Plural(n int, one, other string) string {
+	if c := current(); c != nil {
+		if forms, ok := c.plurals[one]; ok {
+			if forms.One != "" {
+				one = forms.One
+			}
+			if forms.Other != "" {
+				other = forms.Other
+			}
+		}
+	}
+	if n == 1 {
+		return fmt.Sprintf(one, n)
+	}
+	return fmt.Sprintf(other, n)
+}
@@ -0,0 +1,40 @@
+//go:build !windows
+
+package interrupt
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// processGroup is the process group a tool leads.
+type processGroup struct {
+	pid int
+}
+
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+func newProcessGroup(p *os.Process) (processGroup, error) {
+	return processGroup{pid: p.Pid}, nil
+}
+
+func (g processGroup) kill() {
+	syscall.Kill(-g.pid, syscall.SIGKILL)
+}
+
+func (g processGroup) close() {}
+
+func (g processGroup) signal(sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return errors.New("unsupported signal " + sig.String())
+	}
+	return syscall.Kill(-g.pid, s)
+}
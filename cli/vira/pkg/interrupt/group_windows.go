@@ -0,0 +1,61 @@
+package interrupt
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// processGroup is the job object a tool runs in, which its children join.
+type processGroup struct {
+	job windows.Handle
+}
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func newProcessGroup(p *os.Process) (processGroup, error) {
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return processGroup{}, err
+	}
+	// Closing the job, as when vira dies, also ends the processes in it.
+	info := windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION{
+		BasicLimitInformation: windows.JOBOBJECT_BASIC_LIMIT_INFORMATION{
+			LimitFlags: windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE,
+		},
+	}
+	if _, err := windows.SetInformationJobObject(job, windows.JobObjectExtendedLimitInformation, uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info))); err != nil {
+		windows.CloseHandle(job)
+		return processGroup{}, err
+	}
+	process, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, uint32(p.Pid))
+	if err != nil {
+		windows.CloseHandle(job)
+		return processGroup{}, err
+	}
+	defer windows.CloseHandle(process)
+	if err := windows.AssignProcessToJobObject(job, process); err != nil {
+		windows.CloseHandle(job)
+		return processGroup{}, err
+	}
+	return processGroup{job: job}, nil
+}
+
+func (g processGroup) kill() {
+	windows.TerminateJobObject(g.job, 1)
+}
+
+func (g processGroup) signal(sig os.Signal) error {
+	if sig != os.Kill {
+		return errors.New("processes on Windows can only be killed, not sent " + sig.String())
+	}
+	g.kill()
+	return nil
+}
+
+func (g processGroup) close() {
+	windows.CloseHandle(g.job)
+}
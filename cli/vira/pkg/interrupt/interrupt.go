@@ -0,0 +1,219 @@
+// Package interrupt stops vira and virac cleanly on SIGINT and SIGTERM.
+//
+// Toolchain tools are started in a process group of their own, a job object
+// on Windows, so that an interrupt stops them together with anything they
+// started. Temporary directories, lock files and partly written outputs
+// are registered with Cleanup while they exist and removed on an
+// interrupt, after which the command exits with ExitCode.
+package interrupt
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// ExitCode is the exit status of an interrupted command, 130 as shells
+// report for Ctrl-C.
+const ExitCode = 130
+
+// ErrInterrupted is returned for processes that are not started because
+// the command was interrupted.
+var ErrInterrupted = errors.New("interrupted")
+
+var state struct {
+	sync.Mutex
+	interrupted bool
+	next        int
+	cleanups    map[int]func()
+	groups      map[*os.Process]processGroup
+	// foreground is the process Foreground runs, if any.
+	foreground *os.Process
+}
+
+// Handle installs the handler for SIGINT and SIGTERM: it stops the running
+// tools, runs the cleanups, newest first, and then calls exit with
+// ExitCode. A second signal exits at once. While a command runs with
+// Foreground, signals are left to it instead.
+func Handle(exit func(code int)) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for s := range signals {
+			state.Lock()
+			fg := state.foreground
+			if fg == nil {
+				state.interrupted = true
+				state.Unlock()
+				break
+			}
+			state.Unlock()
+			// Ctrl-C reaches the foreground process from the terminal.
+			if s == syscall.SIGTERM {
+				fg.Signal(s)
+			}
+		}
+		go func() {
+			<-signals
+			os.Exit(ExitCode)
+		}()
+		state.Lock()
+		groups := state.groups
+		state.groups = nil
+		cleanups := state.cleanups
+		state.cleanups = nil
+		next := state.next
+		state.Unlock()
+
+		for _, g := range groups {
+			g.kill()
+		}
+		for id := next - 1; id >= 0; id-- {
+			if f, ok := cleanups[id]; ok {
+				f()
+			}
+		}
+		exit(ExitCode)
+	}()
+}
+
+// Interrupted reports whether the command was interrupted.
+func Interrupted() bool {
+	state.Lock()
+	defer state.Unlock()
+	return state.interrupted
+}
+
+// Cleanup registers f to run on an interrupt, and returns the function that
+// unregisters it once what f cleans up is gone. If the command was already
+// interrupted, f runs at once.
+func Cleanup(f func()) (done func()) {
+	state.Lock()
+	if state.interrupted {
+		state.Unlock()
+		f()
+		return func() {}
+	}
+	if state.cleanups == nil {
+		state.cleanups = map[int]func(){}
+	}
+	id := state.next
+	state.next++
+	state.cleanups[id] = f
+	state.Unlock()
+	return func() {
+		state.Lock()
+		delete(state.cleanups, id)
+		state.Unlock()
+	}
+}
+
+// TempDir creates a temporary directory like os.MkdirTemp that is removed
+// on an interrupt. remove removes it otherwise.
+func TempDir(pattern string) (dir string, remove func(), err error) {
+	dir, err = os.MkdirTemp("", pattern)
+	if err != nil {
+		return "", nil, err
+	}
+	done := Cleanup(func() { os.RemoveAll(dir) })
+	return dir, func() {
+		os.RemoveAll(dir)
+		done()
+	}, nil
+}
+
+// Start starts cmd in a process group of its own that an interrupt stops.
+// Its process must be waited for with Wait.
+func Start(cmd *exec.Cmd) error {
+	setProcessGroup(cmd)
+	state.Lock()
+	defer state.Unlock()
+	if state.interrupted {
+		return ErrInterrupted
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	g, err := newProcessGroup(cmd.Process)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	if state.groups == nil {
+		state.groups = map[*os.Process]processGroup{}
+	}
+	state.groups[cmd.Process] = g
+	return nil
+}
+
+// Wait waits for a process started with Start. Once the command is
+// interrupted, Wait does not return: the process is about to exit, and the
+// caller would only report the stopped tool as failed.
+func Wait(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	state.Lock()
+	if g, ok := state.groups[cmd.Process]; ok {
+		g.close()
+		delete(state.groups, cmd.Process)
+	}
+	interrupted := state.interrupted
+	state.Unlock()
+	if interrupted {
+		select {}
+	}
+	return err
+}
+
+// Signal sends sig to the process group of cmd, started with Start and not
+// waited for yet. Windows has no signals but os.Kill, which ends the job
+// object; others fail there.
+func Signal(cmd *exec.Cmd, sig os.Signal) error {
+	state.Lock()
+	g, ok := state.groups[cmd.Process]
+	state.Unlock()
+	if !ok {
+		return os.ErrProcessDone
+	}
+	return g.signal(sig)
+}
+
+// CombinedOutput runs cmd like its CombinedOutput method, in a process
+// group that an interrupt stops.
+func CombinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	var b bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &b, &b
+	if err := Start(cmd); err != nil {
+		return nil, err
+	}
+	err := Wait(cmd)
+	return b.Bytes(), err
+}
+
+// Foreground runs cmd in the process group of the command itself, so that
+// it shares the terminal and Ctrl-C reaches it directly, and lets cmd
+// decide how to stop: while it runs, an interrupt does not stop the
+// command, and SIGTERM is passed on to cmd. It is meant for programs the
+// user runs through vira, such as plugins, rather than for tools.
+func Foreground(cmd *exec.Cmd) error {
+	state.Lock()
+	if state.interrupted {
+		state.Unlock()
+		return ErrInterrupted
+	}
+	if err := cmd.Start(); err != nil {
+		state.Unlock()
+		return err
+	}
+	state.foreground = cmd.Process
+	state.Unlock()
+	err := cmd.Wait()
+	state.Lock()
+	state.foreground = nil
+	state.Unlock()
+	return err
+}
@@ -0,0 +1,218 @@
+// Package logging is the logger vira, virac and the updater share for what
+// goes on behind their output: the tools they run, what they download and
+// cache, and problems they work around.
+//
+// Messages have one of the levels trace, debug, info, warn and error and go
+// to stderr, from the level chosen with --log-level or VIRA_LOG on, as
+// lines of text or, with --log-format json or VIRA_LOG_FORMAT=json, as JSON
+// objects for tools to collect. Attributes follow the message as key=value
+// pairs, or as fields of the JSON object.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// LevelTrace is below debug, for the most detailed messages, such as the
+// full output of tools.
+const LevelTrace = slog.LevelDebug - 4
+
+// levelOff is above every level, for turning logging off.
+const levelOff = slog.LevelError + 4
+
+var levelNames = []struct {
+	name  string
+	level slog.Level
+}{
+	{"trace", LevelTrace},
+	{"debug", slog.LevelDebug},
+	{"info", slog.LevelInfo},
+	{"warn", slog.LevelWarn},
+	{"error", slog.LevelError},
+	{"off", levelOff},
+}
+
+// Levels returns the names of the levels, from the most detailed on.
+func Levels() []string {
+	var names []string
+	for _, l := range levelNames {
+		names = append(names, l.name)
+	}
+	return names
+}
+
+// ParseLevel returns the level called name.
+func ParseLevel(name string) (slog.Level, error) {
+	for _, l := range levelNames {
+		if strings.EqualFold(name, l.name) {
+			return l.level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q (use %s)", name, strings.Join(Levels(), ", "))
+}
+
+func levelName(level slog.Level) string {
+	name := "error"
+	for _, l := range levelNames {
+		if level >= l.level && l.level != levelOff {
+			name = l.name
+		}
+	}
+	return name
+}
+
+var (
+	mu     sync.Mutex
+	logger = slog.New(newTextHandler(os.Stderr, "vira", slog.LevelWarn))
+)
+
+// Setup makes program log at level in format, text or json. Empty values
+// are taken from VIRA_LOG and VIRA_LOG_FORMAT, and else are defaultLevel and
+// text.
+func Setup(program, level, format string, defaultLevel slog.Level) error {
+	if level == "" {
+		level = os.Getenv("VIRA_LOG")
+	}
+	if format == "" {
+		format = os.Getenv("VIRA_LOG_FORMAT")
+	}
+	minLevel := defaultLevel
+	if level != "" {
+		var err error
+		if minLevel, err = ParseLevel(level); err != nil {
+			return err
+		}
+	}
+	var handler slog.Handler
+	switch format {
+	case "", "text":
+		handler = newTextHandler(os.Stderr, program, minLevel)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+			Level: minLevel,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if a.Key == slog.LevelKey && len(groups) == 0 {
+					return slog.String(slog.LevelKey, levelName(a.Value.Any().(slog.Level)))
+				}
+				return a
+			},
+		}).WithAttrs([]slog.Attr{slog.String("program", program)})
+	default:
+		return fmt.Errorf("unknown log format %q (use text or json)", format)
+	}
+	mu.Lock()
+	logger = slog.New(handler)
+	mu.Unlock()
+	return nil
+}
+
+func current() *slog.Logger {
+	mu.Lock()
+	defer mu.Unlock()
+	return logger
+}
+
+// Enabled reports whether messages at level are logged, for skipping work
+// that only serves them.
+func Enabled(level slog.Level) bool {
+	return current().Enabled(context.Background(), level)
+}
+
+// Trace logs msg with the attributes given as key-value pairs in args.
+func Trace(msg string, args ...any) {
+	current().Log(context.Background(), LevelTrace, msg, args...)
+}
+
+// Debug is Trace at the debug level.
+func Debug(msg string, args ...any) {
+	current().Debug(msg, args...)
+}
+
+// Info is Trace at the info level.
+func Info(msg string, args ...any) {
+	current().Info(msg, args...)
+}
+
+// Warn is Trace at the warn level.
+func Warn(msg string, args ...any) {
+	current().Warn(msg, args...)
+}
+
+// Error is Trace at the error level.
+func Error(msg string, args ...any) {
+	current().Error(msg, args...)
+}
+
+// textHandler writes a record as a line of "program: level: message
+// key=value...". Groups are flattened into dotted keys.
+type textHandler struct {
+	mu      *sync.Mutex
+	w       io.Writer
+	program string
+	level   slog.Level
+	prefix  string
+	attrs   string
+}
+
+func newTextHandler(w io.Writer, program string, level slog.Level) *textHandler {
+	return &textHandler{mu: &sync.Mutex{}, w: w, program: program, level: level}
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %s: %s%s", h.program, levelName(r.Level), r.Message, h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		writeAttr(&b, h.prefix, a)
+		return true
+	})
+	b.WriteByte('\n')
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b strings.Builder
+	for _, a := range attrs {
+		writeAttr(&b, h.prefix, a)
+	}
+	h2 := *h
+	h2.attrs += b.String()
+	return &h2
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.prefix += name + "."
+	return &h2
+}
+
+func writeAttr(b *strings.Builder, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		for _, g := range a.Value.Group() {
+			writeAttr(b, prefix+a.Key+".", g)
+		}
+		return
+	}
+	value := a.Value.String()
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+		value = strconv.Quote(value)
+	}
+	fmt.Fprintf(b, " %s%s=%s", prefix, a.Key, value)
+}
@@ -0,0 +1,81 @@
+// Package terminal tells vira and virac how they are run: by someone at a
+// terminal, or by a script or a continuous integration service, where
+// nobody answers questions and output is read from a log.
+//
+// Without a terminal or in CI, output is plain, without colors or the
+// padding of sections, questions are not asked, and diagnostics are not
+// shortened to the width of a terminal.
+package terminal
+
+import (
+	"os"
+
+	"github.com/pterm/pterm"
+	"golang.org/x/term"
+)
+
+// CI reports whether a continuous integration service runs the command, as
+// GitHub Actions, GitLab CI and most others announce by setting CI.
+func CI() bool {
+	v := os.Getenv("CI")
+	return v != "" && v != "0" && v != "false"
+}
+
+// IsTerminal reports whether f is a terminal, and not /dev/null, which is a
+// character device as well.
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	if null, err := os.Stat(os.DevNull); err == nil && os.SameFile(info, null) {
+		return false
+	}
+	return true
+}
+
+// Interactive reports whether someone can answer questions: stdin and
+// stderr are terminals and no CI service runs the command.
+func Interactive() bool {
+	return !CI() && IsTerminal(os.Stdin) && IsTerminal(os.Stderr)
+}
+
+// Setup makes the output of pterm plain when out, where it goes, is not a
+// terminal or in CI: without colors, and with sections as plain lines in
+// the order they happen.
+func Setup(out *os.File) {
+	if !CI() && IsTerminal(out) {
+		return
+	}
+	pterm.DisableStyling()
+	pterm.DefaultSection = *pterm.DefaultSection.WithLevel(0).WithTopPadding(0).WithBottomPadding(0)
+}
+
+// Width returns the width of the terminal f, or 0 when f is not a terminal
+// or in CI, where lines are never shortened.
+func Width(f *os.File) int {
+	if CI() || !IsTerminal(f) {
+		return 0
+	}
+	w, _, err := term.GetSize(int(f.Fd()))
+	if err != nil {
+		return 0
+	}
+	return w
+}
+
+// Raw puts the terminal in into raw mode, where keys are read as they are
+// pressed and not echoed, for editing lines, and returns the function that
+// restores it. Keys such as the arrows arrive as VT escape sequences, and
+// out understands them, on every platform.
+func Raw(in, out *os.File) (restore func(), err error) {
+	state, err := term.MakeRaw(int(in.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	restoreVT := enableVT(in, out)
+	return func() {
+		restoreVT()
+		term.Restore(int(in.Fd()), state)
+	}, nil
+}
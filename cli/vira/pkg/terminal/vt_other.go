@@ -0,0 +1,10 @@
+//go:build !windows
+
+package terminal
+
+import "os"
+
+// enableVT does nothing: terminals outside Windows always speak VT.
+func enableVT(in, out *os.File) (restore func()) {
+	return func() {}
+}
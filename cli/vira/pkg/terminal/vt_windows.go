@@ -0,0 +1,25 @@
+package terminal
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// enableVT turns on the VT sequences of the console, for keys read from in
+// and for output to out, and returns the function that turns the latter off
+// again; raw mode restores in.
+func enableVT(in, out *os.File) (restore func()) {
+	var mode uint32
+	if windows.GetConsoleMode(windows.Handle(in.Fd()), &mode) == nil {
+		windows.SetConsoleMode(windows.Handle(in.Fd()), mode|windows.ENABLE_VIRTUAL_TERMINAL_INPUT)
+	}
+	var outMode uint32
+	if windows.GetConsoleMode(windows.Handle(out.Fd()), &outMode) != nil {
+		return func() {}
+	}
+	windows.SetConsoleMode(windows.Handle(out.Fd()), outMode|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING)
+	return func() {
+		windows.SetConsoleMode(windows.Handle(out.Fd()), outMode)
+	}
+}
@@ -0,0 +1,260 @@
+// Package toolchain locates Vira toolchains the same way for vira, virac
+// and programs using package vira: the per-user directories they live in,
+// the default chosen with vira toolchain use, and the toolchain a project
+// pins.
+//
+// Toolchains managed by vira toolchain live side by side in Dir:
+//
+//	<version>/bin/       the binaries of a release
+//	<version>/version.json
+//	default              the version that is used unless VIRA_TOOLCHAIN is set
+//	channel              the channel the default follows, if any
+package toolchain
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Channels name the newest toolchain of a kind: the stable releases, or the
+// nightly builds, whose versions are nightly-YYYY-MM-DD.
+const (
+	Stable  = "stable"
+	Nightly = "nightly"
+)
+
+// IsChannel reports whether name is a channel rather than a version.
+func IsChannel(name string) bool {
+	return name == Stable || name == Nightly
+}
+
+// VersionPattern matches the toolchain versions that can name a directory
+// of Dir.
+var VersionPattern = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z.+-]*$`)
+
+// SystemBinDir returns the directory of the system toolchain: next to the
+// running executable, given by VIRA_BIN_PATH, or where the installer puts
+// it.
+func SystemBinDir() (string, error) {
+	if dir, ok := RelocatedBinDir(); ok {
+		return dir, nil
+	}
+	if dir := os.Getenv("VIRA_BIN_PATH"); dir != "" {
+		return dir, nil
+	}
+	switch runtime.GOOS {
+	case "linux":
+		return "/usr/lib/vira-lang/bin", nil
+	case "windows":
+		programFiles := os.Getenv("ProgramFiles")
+		if programFiles == "" {
+			programFiles = `C:\Program Files`
+		}
+		return filepath.Join(programFiles, "ViraLang", "bin"), nil
+	default:
+		return "", fmt.Errorf("unsupported OS %s: set VIRA_BIN_PATH to the directory of the Vira toolchain", runtime.GOOS)
+	}
+}
+
+// RelocatedBinDir finds the toolchain binaries relative to the running
+// executable, so that an install under any prefix works, as with Homebrew,
+// Nix, a portable zip or a container image: either <prefix>/bin/vira next
+// to <prefix>/lib/vira-lang/bin, or every binary in one directory.
+func RelocatedBinDir() (string, bool) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", false
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+	dir := filepath.Dir(exe)
+	suffix := ""
+	if runtime.GOOS == "windows" {
+		suffix = ".exe"
+	}
+	for _, candidate := range []string{filepath.Join(dir, "..", "lib", "vira-lang", "bin"), dir} {
+		for _, tool := range []string{"preprocessor", "plsa", "compiler"} {
+			if _, err := os.Stat(filepath.Join(candidate, tool+suffix)); err == nil {
+				return filepath.Clean(candidate), true
+			}
+		}
+	}
+	return "", false
+}
+
+// State vira writes itself lives in one directory per user, ~/.vira, or
+// VIRA_HOME if set. On Linux it follows the XDG Base Directory
+// specification instead, unless VIRA_HOME is set.
+
+// Home is the per-user directory for state vira writes itself, on systems
+// that keep it in one place. It can be overridden with VIRA_HOME.
+func Home() (string, error) {
+	if home := os.Getenv("VIRA_HOME"); home != "" {
+		return home, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".vira"), nil
+}
+
+// UseXDG reports whether state goes to the XDG base directories rather
+// than Home.
+func UseXDG() bool {
+	return runtime.GOOS == "linux" && os.Getenv("VIRA_HOME") == ""
+}
+
+// XDGDir returns the directory in the XDG variable env, or fallback below
+// the home directory if it is unset or relative, as the specification
+// requires.
+func XDGDir(env, fallback string) (string, error) {
+	if dir := os.Getenv(env); filepath.IsAbs(dir) {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, fallback), nil
+}
+
+// UserDir returns the directory for one kind of state: vira in the XDG
+// directory in env, or the subdirectory sub of Home.
+func UserDir(env, fallback, sub string) (string, error) {
+	if UseXDG() {
+		dir, err := XDGDir(env, fallback)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, "vira"), nil
+	}
+	home, err := Home()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, sub), nil
+}
+
+// Dir is the directory toolchains are installed in: vira/toolchains below
+// XDG_DATA_HOME on Linux, and ~/.vira/toolchains elsewhere.
+func Dir() (string, error) {
+	dir, err := UserDir("XDG_DATA_HOME", filepath.Join(".local", "share"), "")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "toolchains"), nil
+}
+
+// Default returns the version made the default with vira toolchain use,
+// or "" for the system installation.
+func Default() string {
+	dir, err := Dir()
+	if err != nil {
+		return ""
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "default"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Active returns the toolchain version in use: VIRA_TOOLCHAIN, or else the
+// default. "" means the system installation.
+func Active() string {
+	switch v := os.Getenv("VIRA_TOOLCHAIN"); v {
+	case "":
+		return Default()
+	case "system":
+		return ""
+	default:
+		return v
+	}
+}
+
+// BinDir returns the directory of the binaries of the active toolchain, or
+// SystemBinDir if the system installation is active or the active
+// toolchain is not installed.
+func BinDir() (string, error) {
+	if v := Active(); VersionPattern.MatchString(v) && !IsChannel(v) {
+		if dir, err := Dir(); err == nil {
+			if _, err := os.Stat(filepath.Join(dir, v, "version.json")); err == nil {
+				return filepath.Join(dir, v, "bin"), nil
+			}
+		}
+	}
+	return SystemBinDir()
+}
+
+// FileName pins the toolchain of the projects below its directory.
+const FileName = "vira-toolchain.toml"
+
+// pinFile is vira-toolchain.toml. Either field may be given; a project
+// pinned to a channel uses its latest toolchain, while a version, such as
+// nightly-2025-06-01, keeps builds reproducible.
+type pinFile struct {
+	Toolchain struct {
+		Version string `toml:"version"`
+		Channel string `toml:"channel"`
+	} `toml:"toolchain"`
+}
+
+// manifestFile is the part of vira.toml that pins a toolchain.
+type manifestFile struct {
+	Package struct {
+		Toolchain string `toml:"toolchain"`
+	} `toml:"package"`
+}
+
+// Pinned returns the toolchain pinned for dir by the closest
+// vira-toolchain.toml, or the toolchain key of the closest vira.toml,
+// along with the file that pins it. It returns "" if nothing is pinned.
+func Pinned(dir string) (string, string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", "", err
+	}
+	for {
+		file := filepath.Join(dir, FileName)
+		var pf pinFile
+		if _, err := toml.DecodeFile(file, &pf); err == nil {
+			if channel := pf.Toolchain.Channel; channel != "" {
+				if !IsChannel(channel) {
+					return "", "", fmt.Errorf("%s: unknown channel %q (use stable or nightly)", file, channel)
+				}
+				if pf.Toolchain.Version == "" {
+					return channel, file, nil
+				}
+			}
+			if pf.Toolchain.Version == "" {
+				return "", "", fmt.Errorf("%s: missing toolchain.version or toolchain.channel", file)
+			}
+			return pf.Toolchain.Version, file, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return "", "", fmt.Errorf("%s: %v", file, err)
+		}
+		file = filepath.Join(dir, "vira.toml")
+		var m manifestFile
+		if _, err := toml.DecodeFile(file, &m); err == nil {
+			if m.Package.Toolchain != "" {
+				return m.Package.Toolchain, file, nil
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return "", "", fmt.Errorf("%s: %v", file, err)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", nil
+		}
+		dir = parent
+	}
+}
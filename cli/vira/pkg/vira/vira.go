@@ -0,0 +1,370 @@
+// Package vira compiles and runs Vira programs from Go, for build tools,
+// playgrounds and test harnesses that would otherwise run vira and parse
+// what it prints.
+//
+// It drives the tools of a Vira toolchain the way vira build does: the
+// preprocessor, plsa, which checks the program, and the compiler, and then
+// the platform linker. Problems in the source come back as diagnostics,
+// pointing at the files the preprocessor read:
+//
+//	tc, err := vira.DefaultToolchain()
+//	...
+//	res, err := tc.Run(ctx, "main.vira", "int main() { return 6 * 7; }", nil)
+//	var cerr *vira.CompileError
+//	if errors.As(err, &cerr) {
+//		for _, d := range cerr.Diagnostics {
+//			fmt.Println(d)
+//		}
+//	}
+//
+// A Toolchain holds no state of its own, so it is safe to use from several
+// goroutines.
+package vira
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"vira/pkg/diagnostics"
+	"vira/pkg/toolchain"
+)
+
+// Toolchain is the tools of an installed Vira toolchain.
+type Toolchain struct {
+	// BinDir is the directory of the preprocessor, plsa and compiler.
+	BinDir string
+	// Linker is the platform linker, gcc, clang on macOS or link.exe on
+	// Windows if empty.
+	Linker string
+}
+
+// DefaultToolchain returns the toolchain vira uses outside a project that
+// pins one: the one VIRA_TOOLCHAIN names or vira toolchain use made the
+// default, and otherwise the system toolchain, found next to the running
+// executable, in VIRA_BIN_PATH or where the installer puts it.
+func DefaultToolchain() (*Toolchain, error) {
+	dir, err := toolchain.BinDir()
+	if err != nil {
+		return nil, err
+	}
+	return &Toolchain{BinDir: dir}, nil
+}
+
+// Options are the options of compiling a source file.
+type Options struct {
+	// IncludeDirs are searched for system includes, #include <file>.
+	// Includes in quotes are found relative to the source file.
+	IncludeDirs []string
+	// LinkFlags are passed to the linker.
+	LinkFlags []string
+}
+
+func (o *Options) includeDirs() []string {
+	if o == nil {
+		return nil
+	}
+	return o.IncludeDirs
+}
+
+func (o *Options) linkFlags() []string {
+	if o == nil {
+		return nil
+	}
+	return o.LinkFlags
+}
+
+// Result is the outcome of compiling a source file that succeeded.
+type Result struct {
+	// Path is the object or executable written.
+	Path string
+	// Warnings are the warnings the tools reported.
+	Warnings []diagnostics.Diagnostic
+}
+
+// RunResult is the outcome of running a program.
+type RunResult struct {
+	// ExitCode is the exit status of the program, which is what main
+	// returned.
+	ExitCode int
+	Stdout   []byte
+	Stderr   []byte
+	Warnings []diagnostics.Diagnostic
+}
+
+// CompileError is the failure of a tool of the toolchain on the source.
+type CompileError struct {
+	// Stage is the tool that failed: preprocessor, plsa, compiler or
+	// linker.
+	Stage string
+	// Output is what the tool printed.
+	Output string
+	// Diagnostics are the problems the tool reported, which may be none
+	// when its output is not in the form of diagnostics.
+	Diagnostics []diagnostics.Diagnostic
+	Err         error
+}
+
+func (e *CompileError) Error() string {
+	if len(e.Diagnostics) > 0 {
+		return fmt.Sprintf("%s failed: %s: %s", e.Stage, diagnostics.Summary(e.Diagnostics), e.Diagnostics[0])
+	}
+	if out := strings.TrimSpace(e.Output); out != "" {
+		return fmt.Sprintf("%s failed: %v\n%s", e.Stage, e.Err, out)
+	}
+	return fmt.Sprintf("%s failed: %v", e.Stage, e.Err)
+}
+
+func (e *CompileError) Unwrap() error {
+	return e.Err
+}
+
+// tool returns the path of a tool of the toolchain.
+func (t *Toolchain) tool(name string) (string, error) {
+	path := filepath.Join(t.BinDir, name)
+	if runtime.GOOS == "windows" {
+		path += ".exe"
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("the Vira toolchain in %s has no %s", t.BinDir, name)
+	}
+	return path, nil
+}
+
+func (t *Toolchain) linker() string {
+	switch {
+	case t.Linker != "":
+		return t.Linker
+	case runtime.GOOS == "windows":
+		return "link.exe"
+	case runtime.GOOS == "darwin":
+		return "clang"
+	}
+	return "gcc"
+}
+
+// run runs tool in dir, returning its combined output. Tools that fail
+// return a *CompileError without diagnostics.
+func run(ctx context.Context, stage, dir, tool string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, tool, args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return "", ctxErr
+		}
+		return "", &CompileError{Stage: stage, Output: string(out), Err: err}
+	}
+	return string(out), nil
+}
+
+// CompileFile compiles the source file into the object file obj.
+func (t *Toolchain) CompileFile(ctx context.Context, source, obj string, opts *Options) (*Result, error) {
+	source, err := filepath.Abs(source)
+	if err != nil {
+		return nil, err
+	}
+	if obj, err = filepath.Abs(obj); err != nil {
+		return nil, err
+	}
+	work, err := os.MkdirTemp("", "vira-compile-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(work)
+	if err := os.MkdirAll(filepath.Dir(obj), 0755); err != nil {
+		return nil, err
+	}
+
+	pre := filepath.Join(work, strings.TrimSuffix(filepath.Base(source), filepath.Ext(source))+".pre")
+	origins, err := t.preprocess(ctx, source, pre, opts.includeDirs())
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{Path: objectFile(obj)}
+	stages := [][]string{{"plsa", pre}, {"compiler", pre, obj, "--no-link"}}
+	for _, args := range stages {
+		tool, err := t.tool(args[0])
+		if err != nil {
+			return nil, err
+		}
+		out, err := run(ctx, args[0], work, tool, args[1:]...)
+		var cerr *CompileError
+		if errors.As(err, &cerr) {
+			cerr.Diagnostics = sourceDiagnostics(cerr.Output, source, pre, origins)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range sourceDiagnostics(out, source, pre, origins) {
+			if d.Severity == diagnostics.Warning {
+				res.Warnings = append(res.Warnings, d)
+			}
+		}
+	}
+	return res, nil
+}
+
+// CompileString compiles src, named name, into the object file obj. Its
+// includes in quotes are found relative to the current directory.
+func (t *Toolchain) CompileString(ctx context.Context, name, src, obj string, opts *Options) (*Result, error) {
+	source, remove, err := writeSource(name, src)
+	if err != nil {
+		return nil, err
+	}
+	defer remove()
+	res, err := t.CompileFile(ctx, source, obj, opts)
+	renameSource(res, err, source, name)
+	return res, err
+}
+
+// Link links the object files objs into the executable exe, passing flags
+// through to the linker.
+func (t *Toolchain) Link(ctx context.Context, objs []string, exe string, flags ...string) error {
+	if err := os.MkdirAll(filepath.Dir(exe), 0755); err != nil {
+		return err
+	}
+	var args []string
+	if runtime.GOOS == "windows" {
+		args = append(args, "/OUT:"+exe, "/ENTRY:main", "/SUBSYSTEM:CONSOLE")
+		args = append(append(args, flags...), objs...)
+	} else {
+		args = append(append(append(args, objs...), flags...), "-o", exe)
+	}
+	_, err := run(ctx, "linker", filepath.Dir(exe), t.linker(), args...)
+	return err
+}
+
+// BuildExecutable compiles the source file and links it into the
+// executable exe.
+func (t *Toolchain) BuildExecutable(ctx context.Context, source, exe string, opts *Options) (*Result, error) {
+	obj := strings.TrimSuffix(exe, filepath.Ext(exe)) + ".o"
+	res, err := t.CompileFile(ctx, source, obj, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(res.Path)
+	if err := t.Link(ctx, []string{res.Path}, exe, opts.linkFlags()...); err != nil {
+		return nil, err
+	}
+	return &Result{Path: exe, Warnings: res.Warnings}, nil
+}
+
+// Run compiles src, named name, into a temporary executable and runs it
+// with args. A program that returns a status other than 0 is not an error.
+func (t *Toolchain) Run(ctx context.Context, name, src string, opts *Options, args ...string) (*RunResult, error) {
+	source, remove, err := writeSource(name, src)
+	if err != nil {
+		return nil, err
+	}
+	defer remove()
+	exe := filepath.Join(filepath.Dir(source), "program")
+	if runtime.GOOS == "windows" {
+		exe += ".exe"
+	}
+	res, err := t.BuildExecutable(ctx, source, exe, opts)
+	renameSource(res, err, source, name)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, exe, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return nil, err
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	return &RunResult{ExitCode: cmd.ProcessState.ExitCode(), Stdout: stdout.Bytes(), Stderr: stderr.Bytes(), Warnings: res.Warnings}, nil
+}
+
+// preprocess runs the preprocessor on source, writing pre, and returns the
+// origin of every line of pre.
+func (t *Toolchain) preprocess(ctx context.Context, source, pre string, includeDirs []string) ([]diagnostics.Origin, error) {
+	tool, err := t.tool("preprocessor")
+	if err != nil {
+		return nil, err
+	}
+	mapFile := pre + ".map"
+	dir := filepath.Dir(source)
+	args := []string{source, pre, "--map", mapFile}
+	for _, inc := range includeDirs {
+		args = append(args, "-I", inc)
+	}
+	if _, err := run(ctx, "preprocessor", dir, tool, args...); err != nil {
+		var cerr *CompileError
+		if errors.As(err, &cerr) {
+			cerr.Diagnostics = diagnostics.Parse(source, cerr.Output)
+		}
+		return nil, err
+	}
+	// Included files are opened relative to the preprocessor's working
+	// directory.
+	return diagnostics.ReadLineMap(mapFile, dir)
+}
+
+// sourceDiagnostics parses what a tool printed about pre, the preprocessed
+// source, into diagnostics of the files the preprocessor read.
+func sourceDiagnostics(output, source, pre string, origins []diagnostics.Origin) []diagnostics.Diagnostic {
+	diags := diagnostics.Parse(source, output)
+	diagnostics.Remap(diags, origins, pre, source)
+	return diags
+}
+
+// objectFile returns the path the compiler writes for obj, which on
+// Windows ends in .obj rather than .o.
+func objectFile(obj string) string {
+	if runtime.GOOS == "windows" && strings.HasSuffix(obj, ".o") {
+		return obj + "bj"
+	}
+	return obj
+}
+
+// writeSource writes src to a temporary directory as the file name, and
+// returns its path and the function that removes it.
+func writeSource(name, src string) (string, func(), error) {
+	dir, err := os.MkdirTemp("", "vira-source-")
+	if err != nil {
+		return "", nil, err
+	}
+	remove := func() { os.RemoveAll(dir) }
+	path := filepath.Join(dir, filepath.Base(name))
+	if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+		remove()
+		return "", nil, err
+	}
+	return path, remove, nil
+}
+
+// renameSource has the diagnostics of res or err name the source as name
+// rather than the temporary file it was compiled from.
+func renameSource(res *Result, err error, path, name string) {
+	var diags []diagnostics.Diagnostic
+	var cerr *CompileError
+	switch {
+	case res != nil:
+		diags = res.Warnings
+	case errors.As(err, &cerr):
+		diags = cerr.Diagnostics
+	}
+	for i := range diags {
+		if diags[i].File == path {
+			diags[i].File = name
+		}
+		for j := range diags[i].Secondary {
+			if diags[i].Secondary[j].File == path {
+				diags[i].Secondary[j].File = name
+			}
+		}
+	}
+}
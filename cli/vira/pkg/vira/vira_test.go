@@ -0,0 +1,103 @@
+package vira
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"vira/pkg/diagnostics"
+)
+
+// testToolchain returns the default toolchain, skipping the test when it or
+// the linker is not installed.
+func testToolchain(t *testing.T) *Toolchain {
+	t.Helper()
+	tc, err := DefaultToolchain()
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, name := range []string{"preprocessor", "plsa", "compiler"} {
+		if _, err := tc.tool(name); err != nil {
+			t.Skip(err)
+		}
+	}
+	if _, err := exec.LookPath(tc.linker()); err != nil {
+		t.Skip(err)
+	}
+	return tc
+}
+
+// TestCompileErrorDiagnostics checks that an error in an included file is
+// reported at its line in that file, not in the preprocessed source.
+func TestCompileErrorDiagnostics(t *testing.T) {
+	tc := testToolchain(t)
+	dir := t.TempDir()
+	util := filepath.Join(dir, "util.vira")
+	if err := os.WriteFile(util, []byte("int twice(int x) {\n    return x * 2;\n}\n\nint broken() {\n    return missing;\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	source := filepath.Join(dir, "main.vira")
+	if err := os.WriteFile(source, []byte("#include \"util.vira\"\n\nint main() {\n    return twice(21);\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := tc.CompileFile(context.Background(), source, filepath.Join(dir, "main.o"), nil)
+	var cerr *CompileError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("CompileFile returned %v, want a *CompileError", err)
+	}
+	for _, d := range cerr.Diagnostics {
+		if d.Severity == diagnostics.Error && d.File == util && d.Line == 6 {
+			return
+		}
+	}
+	t.Errorf("no error at %s:6 in %+v", util, cerr.Diagnostics)
+}
+
+// TestRun checks that Run returns what main returned, with nil options.
+func TestRun(t *testing.T) {
+	tc := testToolchain(t)
+	res, err := tc.Run(context.Background(), "main.vira", "int main() {\n    return 6 * 7;\n}\n", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ExitCode != 42 {
+		t.Errorf("Run returned exit code %d, want 42", res.ExitCode)
+	}
+
+	res, err = tc.Run(context.Background(), "main.vira", "int main() {\n    return 0;\n}\n", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ExitCode != 0 {
+		t.Errorf("Run returned exit code %d, want 0", res.ExitCode)
+	}
+}
+
+// TestCompileStringNilOptions checks that a nil *Options compiles with the
+// defaults and that diagnostics name the source as given.
+func TestCompileStringNilOptions(t *testing.T) {
+	tc := testToolchain(t)
+	obj := filepath.Join(t.TempDir(), "main.o")
+	res, err := tc.CompileString(context.Background(), "main.vira", "int main() {\n    return 0;\n}\n", obj, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(res.Path); err != nil {
+		t.Errorf("CompileString wrote no object: %v", err)
+	}
+
+	_, err = tc.CompileString(context.Background(), "main.vira", "int main() {\n    return missing;\n}\n", obj, nil)
+	var cerr *CompileError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("CompileString returned %v, want a *CompileError", err)
+	}
+	for _, d := range cerr.Diagnostics {
+		if d.File != "main.vira" {
+			t.Errorf("diagnostic %v names %s, want main.vira", d, d.File)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"vira/pkg/interrupt"
+)
+
+// pluginPrefix starts the names of executables that add commands to vira:
+// vira foo runs vira-foo, as git and cargo do.
+const pluginPrefix = "vira-"
+
+// findPlugin returns the executable for the command args start with when
+// vira has no such command itself: vira-<command> on PATH, or in the user
+// bin directory where vira install puts executables.
+func findPlugin(root *cobra.Command, args []string) (string, bool) {
+	if len(args) == 0 || args[0] == "" || strings.HasPrefix(args[0], "-") || strings.ContainsAny(args[0], `/\`) {
+		return "", false
+	}
+	name := args[0]
+	// cobra adds these when the command runs.
+	switch name {
+	case "help", "completion", cobra.ShellCompRequestCmd, cobra.ShellCompNoDescRequestCmd:
+		return "", false
+	}
+	for _, c := range root.Commands() {
+		if c.Name() == name || c.HasAlias(name) {
+			return "", false
+		}
+	}
+	if path, err := exec.LookPath(pluginPrefix + name); err == nil {
+		return path, true
+	}
+	if bin, err := userBinDir(); err == nil {
+		if path, err := exec.LookPath(filepath.Join(bin, executableName(pluginPrefix+name))); err == nil {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// runPlugin runs the plugin exe with the arguments after its command and
+// returns its exit code. Besides the environment of vira, it gets VIRA,
+// the vira executable, and VIRA_MANIFEST_PATH, the manifest of the project
+// in the working directory if there is one. VIRA_HOME is passed on as it
+// is.
+func runPlugin(exe string, args []string) (int, error) {
+	cmd := exec.Command(exe, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = os.Environ()
+	if self, err := os.Executable(); err == nil {
+		cmd.Env = append(cmd.Env, "VIRA="+self)
+	}
+	if root, err := findProjectRoot("."); err == nil {
+		cmd.Env = append(cmd.Env, "VIRA_MANIFEST_PATH="+filepath.Join(root, manifestName))
+	}
+
+	return commandExitCode(interrupt.Foreground(cmd))
+}
+
+// commandExitCode turns the error of running a command that vira passes its
+// exit status on from into that status.
+func commandExitCode(err error) (int, error) {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if code := exitErr.ExitCode(); code >= 0 {
+			return code, nil
+		}
+		// Killed by a signal, most often Ctrl-C.
+		return interrupt.ExitCode, nil
+	}
+	if err != nil {
+		return 1, err
+	}
+	return 0, nil
+}
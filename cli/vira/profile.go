@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"vira/pkg/i18n"
+	"vira/pkg/interrupt"
+)
+
+func newProfileCmd() *cobra.Command {
+	var opts profileOptions
+
+	cmd := &cobra.Command{
+		Use:   "profile [-- args...]",
+		Short: "Build the project and profile a run of it",
+		Long: `Build the project with the release profile and debug information, into
+target/profile, and run it with args under the sampling profiler of the
+platform: perf on Linux, Instruments' xctrace on macOS and the Windows
+Performance Recorder (WPR, which needs an administrator) on Windows.
+
+The recording, perf.data, profile.trace or profile.etl, is kept in
+target/profile for the tools of the platform to open. On Linux and macOS
+the samples are also folded into one line per call stack, from the root,
+with the number of samples in it:
+
+    demo;main;compute 120
+
+which flamegraph.pl, inferno-flamegraph and speedscope turn into a flame
+graph. They are written to target/profile/<name>.folded, or the file given
+with --output, and the functions the most samples were taken in are
+listed. Recordings of WPR are left to the Windows Performance Analyzer.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if jsonOutput {
+				// stdout carries the result, and the program's output
+				// goes to stderr with vira's.
+				pterm.SetDefaultOutput(os.Stderr)
+			}
+			proj, err := loadProject(".")
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			opts.args = args
+			result, err := proj.profile(opts)
+			if err != nil {
+				printError(err)
+				exit(1)
+			}
+			if jsonOutput {
+				if err := printJSON(result); err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+				return
+			}
+			printProfile(result)
+		},
+	}
+	cmd.Flags().StringVarP(&opts.output, "output", "o", "", "write the folded stacks to this file")
+	cmd.Flags().IntVarP(&opts.frequency, "frequency", "F", 999, "samples per second, where the profiler lets it be set")
+	return cmd
+}
+
+type profileOptions struct {
+	args      []string
+	output    string
+	frequency int
+}
+
+// profileResult is the outcome of vira profile, as --json prints it.
+type profileResult struct {
+	Executable string `json:"executable"`
+	Profiler   string `json:"profiler"`
+	Recording  string `json:"recording"`
+	// Folded is the file of folded stacks, if the recording was folded.
+	Folded   string `json:"folded,omitempty"`
+	ExitCode int    `json:"exit_code"`
+	Samples  int    `json:"samples"`
+	// Functions are the functions with the most samples, the hottest
+	// first.
+	Functions []profileFunction `json:"functions"`
+}
+
+// profileFunction counts the samples taken in a function, Self, and in it
+// or anything it called, Total.
+type profileFunction struct {
+	Name  string `json:"name"`
+	Self  int    `json:"self"`
+	Total int    `json:"total"`
+}
+
+// profileDir is where vira profile builds the project and keeps the
+// recording, below target/.
+const profileDir = "profile"
+
+// profile builds the project and profiles a run of it.
+func (p *project) profile(opts profileOptions) (*profileResult, error) {
+	pterm.DefaultSection.Println(i18n.T("Building %s v%s", p.manifest.Package.Name, p.manifest.Package.Version))
+	exe, err := p.build(buildOptions{release: true, debugInfo: true, dir: profileDir})
+	if err != nil {
+		return nil, err
+	}
+	dir := p.targetDir(profileDir)
+	result := &profileResult{Executable: exe, Functions: []profileFunction{}}
+	var stacks map[string]int
+	switch runtime.GOOS {
+	case "linux":
+		result.Profiler = "perf"
+		result.Recording = filepath.Join(dir, "perf.data")
+		stacks, result.ExitCode, err = p.recordPerf(exe, opts, result.Recording)
+	case "darwin":
+		result.Profiler = "xctrace"
+		result.Recording = filepath.Join(dir, "profile.trace")
+		stacks, result.ExitCode, err = p.recordInstruments(exe, opts, result.Recording)
+	case "windows":
+		result.Profiler = "wpr"
+		result.Recording = filepath.Join(dir, "profile.etl")
+		result.ExitCode, err = p.recordWPR(exe, opts, result.Recording)
+	default:
+		return nil, fmt.Errorf("vira profile supports Linux, macOS and Windows, not %s", runtime.GOOS)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if result.ExitCode != 0 {
+		pterm.Warning.Printfln("The program exited with status %d", result.ExitCode)
+	}
+	if stacks == nil {
+		return result, nil
+	}
+
+	result.Folded = opts.output
+	if result.Folded == "" {
+		name := strings.TrimSuffix(filepath.Base(exe), filepath.Ext(exe))
+		result.Folded = filepath.Join(dir, name+".folded")
+	}
+	if err := writeFolded(result.Folded, stacks); err != nil {
+		return nil, err
+	}
+	for _, n := range stacks {
+		result.Samples += n
+	}
+	result.Functions = hottestFunctions(stacks, 10)
+	return result, nil
+}
+
+// runProfiled runs cmd, the profiler running the program, with the
+// terminal of vira, and returns the exit code of the program.
+func (p *project) runProfiled(cmd *exec.Cmd) (int, error) {
+	cmd.Dir = p.root
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if jsonOutput {
+		cmd.Stdout = os.Stderr
+	}
+	logf("profile: running %s", strings.Join(cmd.Args, " "))
+	err := interrupt.Start(cmd)
+	if err == nil {
+		err = interrupt.Wait(cmd)
+	}
+	return commandExitCode(err)
+}
+
+// profilerPath looks tool up on PATH, saying what it is for if it is not
+// there.
+func profilerPath(tool, what string) (string, error) {
+	path, err := exec.LookPath(tool)
+	if err != nil {
+		return "", fmt.Errorf("profiling on %s needs %s, %s, on PATH", runtime.GOOS, tool, what)
+	}
+	return path, nil
+}
+
+// recordPerf records a run of exe with perf record, with call graphs, and
+// folds what perf script makes of the recording.
+func (p *project) recordPerf(exe string, opts profileOptions, recording string) (map[string]int, int, error) {
+	perf, err := profilerPath("perf", "from the linux-tools or linux-perf package")
+	if err != nil {
+		return nil, 0, err
+	}
+	args := []string{"record", "-F", strconv.Itoa(opts.frequency), "-g", "-o", recording, "--", exe}
+	code, err := p.runProfiled(exec.Command(perf, append(args, opts.args...)...))
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := os.Stat(recording); err != nil {
+		return nil, 0, errors.New("perf recorded nothing; if it is not allowed to, lower kernel.perf_event_paranoid with sysctl")
+	}
+	script := exec.Command(perf, "script", "-i", recording)
+	var stderr strings.Builder
+	script.Stderr = &stderr
+	out, err := script.StdoutPipe()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := interrupt.Start(script); err != nil {
+		return nil, 0, err
+	}
+	stacks, parseErr := foldPerfScript(out, filepath.Base(exe))
+	if err := interrupt.Wait(script); err != nil {
+		return nil, 0, &stageError{stage: "perf script", output: stderr.String(), err: err}
+	}
+	return stacks, code, parseErr
+}
+
+// perfFrame matches a frame of perf script: the address, the symbol with
+// its offset, and the object it is in.
+var perfFrame = regexp.MustCompile(`^\s*[0-9a-f]+\s+(.+?)\s+\((.*)\)$`)
+
+// foldPerfScript folds the samples perf script prints, each a header line
+// and then its frames, the innermost first, until a blank line. Only the
+// samples of the program comm count.
+func foldPerfScript(r io.Reader, comm string) (map[string]int, error) {
+	stacks := map[string]int{}
+	var frames []string
+	inSample, counted := false, false
+	flush := func() {
+		if inSample && counted {
+			folded := []string{comm}
+			for i := len(frames) - 1; i >= 0; i-- {
+				folded = append(folded, frames[i])
+			}
+			stacks[strings.Join(folded, ";")]++
+		}
+		frames, inSample = nil, false
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.TrimSpace(line) == "":
+			flush()
+		case line[0] != ' ' && line[0] != '\t':
+			flush()
+			inSample = true
+			// perf cuts the command to 15 characters.
+			counted = strings.HasPrefix(comm, strings.Fields(line)[0])
+		case inSample:
+			m := perfFrame.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			sym := m[1]
+			if i := strings.LastIndex(sym, "+0x"); i > 0 {
+				sym = sym[:i]
+			}
+			if sym == "[unknown]" {
+				sym = "[" + filepath.Base(m[2]) + "]"
+			}
+			frames = append(frames, sym)
+		}
+	}
+	flush()
+	return stacks, sc.Err()
+}
+
+// recordInstruments records a run of exe with the Time Profiler of
+// Instruments and folds the samples xctrace exports from it.
+func (p *project) recordInstruments(exe string, opts profileOptions, recording string) (map[string]int, int, error) {
+	xctrace, err := profilerPath("xctrace", "which comes with Xcode")
+	if err != nil {
+		return nil, 0, err
+	}
+	// xctrace will not write over a recording.
+	if err := os.RemoveAll(recording); err != nil {
+		return nil, 0, err
+	}
+	args := []string{"record", "--template", "Time Profiler", "--output", recording, "--launch", "--", exe}
+	code, err := p.runProfiled(exec.Command(xctrace, append(args, opts.args...)...))
+	if err != nil {
+		return nil, 0, err
+	}
+	export := exec.Command(xctrace, "export", "--input", recording, "--xpath", `/trace-toc/run[@number="1"]/data/table[@schema="time-profile"]`)
+	out, err := interrupt.CombinedOutput(export)
+	if err != nil {
+		return nil, 0, &stageError{stage: "xctrace export", output: string(out), err: err}
+	}
+	stacks, err := foldTimeProfile(strings.NewReader(string(out)), filepath.Base(exe))
+	return stacks, code, err
+}
+
+// foldTimeProfile folds the rows of the time-profile table xctrace exports.
+// The export names an element, such as a frame or a whole backtrace, once,
+// with an id, and refers to it by that id after.
+func foldTimeProfile(r io.Reader, comm string) (map[string]int, error) {
+	stacks := map[string]int{}
+	frameNames := map[string]string{}
+	backtraces := map[string][]string{}
+	var frames []string
+	backtraceID, inBacktrace := "", false
+	attr := func(e xml.StartElement, name string) string {
+		for _, a := range e.Attr {
+			if a.Name.Local == name {
+				return a.Value
+			}
+		}
+		return ""
+	}
+	add := func(frames []string) {
+		folded := []string{comm}
+		for i := len(frames) - 1; i >= 0; i-- {
+			folded = append(folded, frames[i])
+		}
+		stacks[strings.Join(folded, ";")]++
+	}
+	dec := xml.NewDecoder(r)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return stacks, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading the export of xctrace: %v", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch {
+			case t.Name.Local == "backtrace" && attr(t, "ref") != "":
+				add(backtraces[attr(t, "ref")])
+			case t.Name.Local == "backtrace":
+				backtraceID, inBacktrace, frames = attr(t, "id"), true, nil
+			case t.Name.Local == "frame" && inBacktrace:
+				name := attr(t, "name")
+				if ref := attr(t, "ref"); ref != "" {
+					name = frameNames[ref]
+				} else if id := attr(t, "id"); id != "" {
+					if name == "" {
+						name = attr(t, "addr")
+					}
+					frameNames[id] = name
+				}
+				frames = append(frames, name)
+			}
+		case xml.EndElement:
+			if t.Name.Local == "backtrace" && inBacktrace {
+				backtraces[backtraceID] = frames
+				add(frames)
+				inBacktrace = false
+			}
+		}
+	}
+}
+
+// recordWPR records a run of exe with the CPU profile of the Windows
+// Performance Recorder.
+func (p *project) recordWPR(exe string, opts profileOptions, recording string) (int, error) {
+	wpr, err := profilerPath("wpr", "the Windows Performance Recorder")
+	if err != nil {
+		return 0, err
+	}
+	if out, err := interrupt.CombinedOutput(exec.Command(wpr, "-start", "CPU", "-filemode")); err != nil {
+		return 0, &stageError{stage: "wpr -start", output: string(out), err: err}
+	}
+	stopped := false
+	defer interrupt.Cleanup(func() {
+		if !stopped {
+			exec.Command(wpr, "-cancel").Run()
+		}
+	})()
+	code, err := p.runProfiled(exec.Command(exe, opts.args...))
+	if err != nil {
+		exec.Command(wpr, "-cancel").Run()
+		stopped = true
+		return 0, err
+	}
+	out, err := interrupt.CombinedOutput(exec.Command(wpr, "-stop", recording))
+	stopped = true
+	if err != nil {
+		return 0, &stageError{stage: "wpr -stop", output: string(out), err: err}
+	}
+	return code, nil
+}
+
+// writeFolded writes stacks to file, one "stack count" line each, sorted.
+func writeFolded(file string, stacks map[string]int) error {
+	var b strings.Builder
+	for _, stack := range sortedKeys(stacks) {
+		fmt.Fprintf(&b, "%s %d\n", stack, stacks[stack])
+	}
+	return os.WriteFile(file, []byte(b.String()), 0644)
+}
+
+// hottestFunctions returns the n functions of stacks with the most samples
+// of their own.
+func hottestFunctions(stacks map[string]int, n int) []profileFunction {
+	self := map[string]int{}
+	total := map[string]int{}
+	for stack, count := range stacks {
+		frames := strings.Split(stack, ";")
+		// The first frame is the program, not a function.
+		if len(frames) < 2 {
+			continue
+		}
+		frames = frames[1:]
+		self[frames[len(frames)-1]] += count
+		seen := map[string]bool{}
+		for _, f := range frames {
+			// Recursion counts a sample once.
+			if !seen[f] {
+				seen[f] = true
+				total[f] += count
+			}
+		}
+	}
+	functions := []profileFunction{}
+	for name, n := range self {
+		functions = append(functions, profileFunction{Name: name, Self: n, Total: total[name]})
+	}
+	sort.Slice(functions, func(i, j int) bool {
+		if functions[i].Self != functions[j].Self {
+			return functions[i].Self > functions[j].Self
+		}
+		return functions[i].Name < functions[j].Name
+	})
+	return functions[:min(n, len(functions))]
+}
+
+func printProfile(r *profileResult) {
+	pterm.Success.Printfln("Recorded %s with %s", r.Recording, r.Profiler)
+	if r.Folded == "" {
+		pterm.Info.Println("Open the recording in the Windows Performance Analyzer, wpa")
+		return
+	}
+	pterm.Success.Printfln("Wrote the folded stacks of %s to %s", i18n.Plural(r.Samples, "%d sample", "%d samples"), r.Folded)
+	if len(r.Functions) == 0 {
+		return
+	}
+	data := pterm.TableData{{"Function", "Self", "Total"}}
+	percent := func(n int) string {
+		return fmt.Sprintf("%.1f%%", float64(n)*100/float64(r.Samples))
+	}
+	for _, f := range r.Functions {
+		data = append(data, []string{f.Name, percent(f.Self), percent(f.Total)})
+	}
+	pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+var packageNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+
+type publishOptions struct {
+	dryRun     bool
+	allowDirty bool
+	registry   string
+	token      string
+}
+
+func newPublishCmd() *cobra.Command {
+	var opts publishOptions
+
+	cmd := &cobra.Command{
+		Use:   "publish",
+		Short: "Package the current project and upload it to a registry",
+		Long: `Package the current project and upload it to a registry.
+
+The package is a gzipped tarball of vira.toml, the sources in src/ and any
+README or LICENSE files, written to target/package/. Before uploading, the
+manifest is validated and the git working tree must be clean.
+
+The registry API is taken from --registry or VIRA_PUBLISH_REGISTRY, either
+of which may name a registry from config.toml, and the token from
+--token, VIRA_REGISTRY_TOKEN, the token saved with vira login or the
+configuration.
+With --dry-run, everything but the upload is done.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			opts.registry, opts.token = publishCredentials(opts.registry, opts.token)
+			proj, err := loadProject(".")
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			if err := proj.publish(opts); err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+		},
+	}
+	cmd.Flags().BoolVar(&opts.dryRun, "dry-run", false, "validate and package without uploading")
+	cmd.Flags().BoolVar(&opts.allowDirty, "allow-dirty", false, "allow uncommitted changes in the git working tree")
+	cmd.Flags().StringVar(&opts.registry, "registry", "", "registry API, or configured registry name, to upload to")
+	cmd.Flags().StringVar(&opts.token, "token", "", "API token for the registry")
+	return cmd
+}
+
+// publishCredentials fills in the registry API and token of the commands
+// that change a registry from the environment, vira login and the
+// configuration, in that order.
+func publishCredentials(registry, token string) (string, string) {
+	if registry == "" {
+		registry = os.Getenv("VIRA_PUBLISH_REGISTRY")
+	}
+	registry = resolveRegistryName(registry, func(r registryConfig) string { return r.Publish })
+	if token == "" {
+		token = os.Getenv("VIRA_REGISTRY_TOKEN")
+	}
+	if token == "" && registry != "" {
+		token = storedToken(registry)
+	}
+	if token == "" && registry != "" {
+		token = configuredToken(registry)
+	}
+	return registry, token
+}
+
+func (p *project) publish(opts publishOptions) error {
+	if err := p.validateForPublish(); err != nil {
+		return err
+	}
+	if !opts.allowDirty {
+		if err := p.checkClean(); err != nil {
+			return err
+		}
+	}
+	if !opts.dryRun && opts.registry == "" {
+		return errors.New("no registry to publish to (use --registry or VIRA_PUBLISH_REGISTRY)")
+	}
+	if !opts.dryRun && opts.token == "" {
+		return errors.New("no registry token (run vira login or use --token)")
+	}
+	if !opts.dryRun && offlineMode() {
+		return offlineError("uploading to " + opts.registry)
+	}
+
+	pkg := p.manifest.Package
+	files, err := p.packageFiles()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		pterm.Println("  " + f)
+	}
+	data, err := p.packageTarball(files)
+	if err != nil {
+		return err
+	}
+	archive := filepath.Join(p.root, "target", "package", pkg.Name+"-"+pkg.Version+".tar.gz")
+	if err := os.MkdirAll(filepath.Dir(archive), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(archive, data, 0644); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	pterm.Info.Printfln("Packaged %d files into %s (%d bytes, sha256 %s)", len(files), p.rel(archive), len(data), hex.EncodeToString(sum[:]))
+
+	if opts.dryRun {
+		pterm.Warning.Println("Dry run: not uploading")
+		return nil
+	}
+	if err := uploadPackage(opts.registry, opts.token, pkg.Name, pkg.Version, data); err != nil {
+		return err
+	}
+	pterm.Success.Printfln("Published %s v%s", pkg.Name, pkg.Version)
+	return nil
+}
+
+// validateForPublish reports every problem with the manifest that would make
+// the package unusable from a registry.
+func (p *project) validateForPublish() error {
+	pkg := p.manifest.Package
+	var problems []string
+	if !packageNamePattern.MatchString(pkg.Name) {
+		problems = append(problems, fmt.Sprintf("package.name %q must start with a lowercase letter and contain only a-z, 0-9, - and _", pkg.Name))
+	}
+	if pkg.Version == "" {
+		problems = append(problems, "package.version is missing")
+	} else if v, err := parseVersion(pkg.Version); err != nil || v.String() != strings.SplitN(pkg.Version, "+", 2)[0] {
+		problems = append(problems, fmt.Sprintf("package.version %q is not a full semantic version like 1.0.0", pkg.Version))
+	}
+	if pkg.Description == "" {
+		problems = append(problems, "package.description is missing")
+	}
+	if pkg.License == "" {
+		problems = append(problems, "package.license is missing")
+	}
+	if len(pkg.Authors) == 0 {
+		problems = append(problems, "package.authors is missing")
+	}
+	for _, name := range p.manifest.sortedDependencies() {
+		dep := p.manifest.Dependencies[name]
+		if dep.Git != "" {
+			problems = append(problems, fmt.Sprintf("dependency %s comes from git, which packages on a registry cannot use", name))
+		} else if dep.Path != "" && dep.Version == "" {
+			problems = append(problems, fmt.Sprintf("path dependency %s needs a version to be published", name))
+		} else if _, err := parseVersionReq(dep.Version); err != nil {
+			problems = append(problems, fmt.Sprintf("dependency %s: %v", name, err))
+		}
+	}
+	if files, err := p.sourceFiles(); err != nil || len(files) == 0 {
+		problems = append(problems, "src/ contains no .vira files")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("cannot publish %s:\n  %s", manifestName, strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// checkClean fails if the project is in a git working tree with
+// uncommitted changes. Projects outside of git are not checked.
+func (p *project) checkClean() error {
+	cmd := exec.Command("git", "status", "--porcelain", "--", ".")
+	cmd.Dir = p.root
+	out, err := cmd.Output()
+	if err != nil {
+		return nil
+	}
+	if dirty := strings.TrimSpace(string(out)); dirty != "" {
+		return fmt.Errorf("the git working tree has uncommitted changes (use --allow-dirty to publish anyway):\n%s", dirty)
+	}
+	return nil
+}
+
+// packageFiles lists the files going into the package, relative to the
+// project root and slash-separated.
+func (p *project) packageFiles() ([]string, error) {
+	files := []string{manifestName}
+	entries, err := os.ReadDir(p.root)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		upper := strings.ToUpper(e.Name())
+		if !e.IsDir() && (strings.HasPrefix(upper, "README") || strings.HasPrefix(upper, "LICENSE")) {
+			files = append(files, e.Name())
+		}
+	}
+	sources, err := p.sourceFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, src := range sources {
+		files = append(files, filepath.ToSlash(p.rel(src)))
+	}
+	return files, nil
+}
+
+// packageTarball writes files into a gzipped tarball below a
+// "<name>-<version>/" directory. Timestamps are fixed so that packaging the
+// same sources twice gives the same archive.
+func (p *project) packageTarball(files []string) ([]byte, error) {
+	prefix := p.manifest.Package.Name + "-" + p.manifest.Package.Version + "/"
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range files {
+		data, err := os.ReadFile(filepath.Join(p.root, filepath.FromSlash(name)))
+		if err != nil {
+			return nil, err
+		}
+		if name == manifestName {
+			data = []byte(p.publishedManifest(string(data)))
+		}
+		hdr := &tar.Header{
+			Name:    prefix + name,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: time.Unix(0, 0),
+			Format:  tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// publishedManifest drops the path from path dependencies, which then
+// resolve from the registry by their version.
+func (p *project) publishedManifest(src string) string {
+	for _, name := range p.manifest.sortedDependencies() {
+		if dep := p.manifest.Dependencies[name]; dep.Path != "" {
+			src = setDependency(src, name, Dependency{Version: dep.Version, Features: dep.Features})
+		}
+	}
+	return src
+}
+
+// uploadPackage sends the archive to PUT <registry>/packages/<name>/<version>.
+func uploadPackage(registry, token, name, version string, data []byte) error {
+	url := strings.TrimSuffix(registry, "/") + "/packages/" + name + "/" + version
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s v%s: %v", name, version, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("registry rejected %s v%s: %s\n%s", name, version, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
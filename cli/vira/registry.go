@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"vira/pkg/logging"
+)
+
+// defaultRegistry is the package index published from this repository.
+const defaultRegistry = "https://raw.githubusercontent.com/vira-language/vira/main/repository/virus.json"
+
+// registryIndex mirrors repository/virus.json.
+type registryIndex struct {
+	Libraries []registryPackage `json:"libraries"`
+}
+
+type registryPackage struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Keywords    []string          `json:"keywords,omitempty"`
+	License     string            `json:"license,omitempty"`
+	Downloads   int               `json:"downloads,omitempty"`
+	Versions    []registryVersion `json:"versions"`
+	// Registry names the alternative registry the package was taken from,
+	// or is empty for the default index.
+	Registry string `json:"-"`
+}
+
+type registryVersion struct {
+	Version string `json:"version"`
+	URL     string `json:"url"`
+	// Checksum is the SHA-256 of the source at URL, where the registry
+	// publishes it.
+	Checksum     string              `json:"checksum,omitempty"`
+	Dependencies map[string]string   `json:"dependencies,omitempty"`
+	Features     map[string][]string `json:"features,omitempty"`
+	// Yanked versions are not picked for new resolutions, but still used
+	// where a lockfile pins them.
+	Yanked bool `json:"yanked,omitempty"`
+}
+
+// registryURL returns the index location, which VIRA_REGISTRY overrides. It
+// may be a URL or a local path.
+func registryURL() string {
+	if url := os.Getenv("VIRA_REGISTRY"); url != "" {
+		return url
+	}
+	return defaultRegistry
+}
+
+func fetchRegistryIndex() (*registryIndex, error) {
+	return fetchIndex(registryURL())
+}
+
+func fetchIndex(location string) (*registryIndex, error) {
+	data, err := readCachedLocation(location)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch registry index %s: %v", location, err)
+	}
+	return decodeIndex(location, data)
+}
+
+// cachedIndex returns the registry index at location as last fetched,
+// without network access.
+func cachedIndex(location string) (*registryIndex, error) {
+	data, err := readCachedCopy(location)
+	if err != nil {
+		return nil, err
+	}
+	return decodeIndex(location, data)
+}
+
+func decodeIndex(location string, data []byte) (*registryIndex, error) {
+	var idx registryIndex
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("invalid registry index %s: %v", location, err)
+	}
+	return &idx, nil
+}
+
+// readLocation reads an http(s) URL or a local file. Requests carry the
+// token saved for the host or configured for its registry, if any.
+func readLocation(location string) ([]byte, error) {
+	if !isRemote(location) {
+		return os.ReadFile(strings.TrimPrefix(location, "file://"))
+	}
+	if offlineMode() {
+		return nil, offlineError("downloading " + location)
+	}
+	defer traceSpan("download", "download", map[string]any{"url": location})()
+	logging.Debug("downloading", "url", location)
+	req, err := http.NewRequest(http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	token := storedToken(location)
+	if token == "" {
+		token = configuredToken(location)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{status: resp.Status, code: resp.StatusCode}
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// statusError is a response to a download other than 200 OK. A 404 is
+// os.ErrNotExist, like a local file that is missing.
+type statusError struct {
+	status string
+	code   int
+}
+
+func (e *statusError) Error() string {
+	return "bad status: " + e.status
+}
+
+func (e *statusError) Is(target error) bool {
+	return target == os.ErrNotExist && e.code == http.StatusNotFound
+}
+
+func (idx *registryIndex) lookup(name string) *registryPackage {
+	for i := range idx.Libraries {
+		if idx.Libraries[i].Name == name {
+			return &idx.Libraries[i]
+		}
+	}
+	return nil
+}
+
+// sortedVersions returns the package's versions, newest first. Entries with
+// unparseable versions are skipped.
+func (p *registryPackage) sortedVersions() []registryVersion {
+	type parsed struct {
+		v   semVersion
+		rec registryVersion
+	}
+	var list []parsed
+	for _, rec := range p.Versions {
+		v, err := parseVersion(rec.Version)
+		if err != nil {
+			continue
+		}
+		list = append(list, parsed{v, rec})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].v.compare(list[j].v) > 0 })
+	out := make([]registryVersion, len(list))
+	for i, p := range list {
+		out[i] = p.rec
+	}
+	return out
+}
+
+// latestMatching returns the newest version of p that satisfies req and has
+// not been yanked.
+func (p *registryPackage) latestMatching(req versionReq) (registryVersion, bool) {
+	for _, rec := range p.sortedVersions() {
+		v, _ := parseVersion(rec.Version)
+		if req.matches(v) && !rec.Yanked {
+			return rec, true
+		}
+	}
+	return registryVersion{}, false
+}
+
+func (p *registryPackage) version(v string) (registryVersion, bool) {
+	for _, rec := range p.Versions {
+		if rec.Version == v {
+			return rec, true
+		}
+	}
+	return registryVersion{}, false
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"vira/pkg/interrupt"
+	"vira/pkg/terminal"
+)
+
+func newReplCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "repl",
+		Short: "Start an interactive Vira session",
+		Long: `Start an interactive session that evaluates Vira expressions and keeps
+declarations; :help lists its commands.
+
+At a terminal, lines are edited with the keys of readline, Tab completes
+the functions declared in the session, the commands and the files of
+:load, and the history of inputs, Up and Down, is kept across sessions in
+repl_history in the data directory. An input continues over several lines
+while braces or parentheses are open, and code of several lines pasted at
+once is entered whole.
+
+The REPL has the limits of the compiler: an expression is numbers joined
+by +, -, * and /, applied from left to right, so 1 + 2 * 3 is 9, and it
+cannot call functions yet, so the functions declared in the session are
+only compiled and listed, not used. Results are 32-bit ints, which wrap
+around on overflow.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runRepl(os.Stdin, os.Stdout); err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+		},
+	}
+}
+
+const replHelp = `Enter a declaration such as "int two() { return 2; }" to add it to the
+session, or an expression such as "1 + 2 * 3" to evaluate it.
+
+Operators apply from left to right, so 1 + 2 * 3 is 9, and results are
+32-bit ints. The compiler cannot call functions yet: declarations are
+compiled and listed, but expressions cannot use them.
+
+  :load <file>   add the declarations in file to the session
+  :type <expr>   check an expression and show its type
+  :decls         list the session's declarations
+  :history       show the input history
+  :reset         drop all declarations
+  :help          show this help
+  :quit          leave the REPL`
+
+// replSession holds the declarations entered so far. They are compiled once
+// into decls.o whenever they change, so evaluating an expression only has to
+// compile and link a small function against that object.
+type replSession struct {
+	dir     string
+	remove  func()
+	decls   []string
+	obj     string
+	history []string
+	evals   int
+	// harness is the object of the C main function that prints the value of
+	// an expression, once it has been compiled.
+	harness string
+}
+
+// replEvalFunction is the function an expression is compiled into, outside
+// of Windows.
+const replEvalFunction = "vira_repl_eval"
+
+// replHarness calls replEvalFunction and prints its value. The value is
+// printed rather than returned as the exit status, which Unix cuts to 8
+// bits.
+const replHarness = `#include <stdio.h>
+
+int ` + replEvalFunction + `(void);
+
+int main(void) {
+    printf("%d\n", ` + replEvalFunction + `());
+    return 0;
+}
+`
+
+func newReplSession() (*replSession, error) {
+	dir, remove, err := interrupt.TempDir("vira-repl-")
+	if err != nil {
+		return nil, err
+	}
+	return &replSession{dir: dir, remove: remove}, nil
+}
+
+func (s *replSession) close() {
+	s.remove()
+}
+
+func runRepl(in io.Reader, out io.Writer) error {
+	session, err := newReplSession()
+	if err != nil {
+		return err
+	}
+	defer session.close()
+
+	fmt.Fprintln(out, "Vira REPL. Type :help for help, :quit to exit.")
+	var reader lineReader = &plainReader{r: bufio.NewReader(in), out: out}
+	var editor *lineEditor
+	inFile, _ := in.(*os.File)
+	outFile, _ := out.(*os.File)
+	if inFile != nil && outFile != nil && terminal.IsTerminal(inFile) && terminal.IsTerminal(outFile) {
+		editor = newLineEditor(inFile, outFile, loadReplHistory(), session.completions)
+		reader = editor
+	}
+	for {
+		input, err := readReplInput(reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				fmt.Fprintln(out)
+				return nil
+			}
+			return err
+		}
+		if input == "" {
+			continue
+		}
+		session.history = append(session.history, input)
+		if editor != nil {
+			entry := historyEntry(input)
+			if n := len(editor.history); n == 0 || editor.history[n-1] != entry {
+				editor.history = append(editor.history, entry)
+				appendReplHistory(entry)
+			}
+		}
+
+		if strings.HasPrefix(input, ":") {
+			quit, err := session.meta(input, out)
+			if err != nil {
+				pterm.Error.Println(err)
+			}
+			if quit {
+				return nil
+			}
+			continue
+		}
+
+		if isDeclaration(input) {
+			if err := session.declare(input); err != nil {
+				pterm.Error.Println(err)
+			}
+			continue
+		}
+		result, err := session.eval(input)
+		if err != nil {
+			pterm.Error.Println(err)
+			continue
+		}
+		fmt.Fprintf(out, "= %d\n", result)
+	}
+}
+
+// readReplInput reads one logical input, continuing over several lines while
+// braces or parentheses are still open. An input cancelled with Ctrl-C is
+// empty.
+func readReplInput(reader lineReader) (string, error) {
+	var lines []string
+	prompt := "vira> "
+	for {
+		line, err := reader.readLine(prompt)
+		if errors.Is(err, errLineCancelled) {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, line)
+		input := strings.TrimSpace(strings.Join(lines, "\n"))
+		if input == "" || strings.HasPrefix(input, ":") || bracketDepth(input) <= 0 {
+			return input, nil
+		}
+		prompt = "  ... "
+	}
+}
+
+func bracketDepth(s string) int {
+	depth := 0
+	inString := false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			inString = !inString
+		case inString:
+		case r == '{' || r == '(' || r == '[':
+			depth++
+		case r == '}' || r == ')' || r == ']':
+			depth--
+		}
+	}
+	return depth
+}
+
+func isDeclaration(input string) bool {
+	return strings.HasPrefix(input, "int ") && strings.Contains(input, "{")
+}
+
+func (s *replSession) meta(input string, out io.Writer) (bool, error) {
+	name, arg, _ := strings.Cut(input, " ")
+	arg = strings.TrimSpace(arg)
+	switch name {
+	case ":quit", ":q", ":exit":
+		return true, nil
+	case ":help", ":h":
+		fmt.Fprintln(out, replHelp)
+	case ":load", ":l":
+		if arg == "" {
+			return false, fmt.Errorf("usage: :load <file>")
+		}
+		src, err := os.ReadFile(arg)
+		if err != nil {
+			return false, err
+		}
+		if err := s.declare(string(src)); err != nil {
+			return false, err
+		}
+		fmt.Fprintf(out, "loaded %s\n", arg)
+	case ":type", ":t":
+		if arg == "" {
+			return false, fmt.Errorf("usage: :type <expr>")
+		}
+		if err := s.check(arg); err != nil {
+			return false, err
+		}
+		// Every Vira expression is currently an int.
+		fmt.Fprintf(out, "%s : int\n", arg)
+	case ":decls":
+		for _, decl := range s.decls {
+			fmt.Fprintln(out, decl)
+		}
+	case ":history":
+		for i, entry := range s.history {
+			fmt.Fprintf(out, "%4d  %s\n", i+1, entry)
+		}
+	case ":reset":
+		s.decls = nil
+		s.obj = ""
+		fmt.Fprintln(out, "session cleared")
+	default:
+		return false, fmt.Errorf("unknown command %s (try :help)", name)
+	}
+	return false, nil
+}
+
+// declare adds decl to the session and recompiles the declarations object.
+// The session is left unchanged if decl does not compile.
+func (s *replSession) declare(decl string) error {
+	for _, name := range declaredFunctions(decl) {
+		if name == "main" || name == replEvalFunction {
+			return fmt.Errorf("%s is reserved for evaluating expressions in the REPL", name)
+		}
+	}
+	decls := append(append([]string(nil), s.decls...), strings.TrimSpace(decl))
+	src := filepath.Join(s.dir, "decls.vira")
+	if err := os.WriteFile(src, []byte(strings.Join(decls, "\n\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	obj, err := compileObject(src, filepath.Join(s.dir, "decls.o"))
+	if err != nil {
+		return err
+	}
+	s.decls = decls
+	s.obj = obj
+	return nil
+}
+
+func (s *replSession) check(expr string) error {
+	src := filepath.Join(s.dir, "check.vira")
+	if err := os.WriteFile(src, []byte(evalProgram(expr)), 0644); err != nil {
+		return err
+	}
+	if err := ensureTools("plsa"); err != nil {
+		return err
+	}
+	return runStage("plsa", s.dir, toolPath("plsa"), src)
+}
+
+// eval compiles expr into a function, links it with the session's
+// declarations and returns its value. Outside of Windows the program
+// prints the value; on Windows, where the exit status is a full 32-bit
+// int and programs are linked without the C runtime, the expression is
+// compiled into main and its value is the exit status.
+func (s *replSession) eval(expr string) (int32, error) {
+	s.evals++
+	base := filepath.Join(s.dir, fmt.Sprintf("eval%d", s.evals))
+	if err := os.WriteFile(base+".vira", []byte(evalProgram(expr)), 0644); err != nil {
+		return 0, err
+	}
+	obj, err := compileObject(base+".vira", base+".o")
+	if err != nil {
+		return 0, err
+	}
+	objs := []string{obj}
+	if s.obj != "" {
+		objs = append(objs, s.obj)
+	}
+	if runtime.GOOS != "windows" {
+		harness, err := s.harnessObject()
+		if err != nil {
+			return 0, err
+		}
+		objs = append(objs, harness)
+	}
+	exe := executableName(base)
+	if err := linkExecutable(objs, exe); err != nil {
+		return 0, err
+	}
+	defer os.Remove(exe)
+
+	out, err := interrupt.CombinedOutput(exec.Command(exe))
+	if runtime.GOOS == "windows" {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return int32(exitErr.ExitCode()), nil
+		}
+		return 0, err
+	}
+	if err != nil {
+		return 0, fmt.Errorf("evaluating %s: %v\n%s", expr, err, out)
+	}
+	value, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("evaluating %s: unexpected output %q", expr, out)
+	}
+	return int32(value), nil
+}
+
+// harnessObject compiles replHarness the first time it is needed.
+func (s *replSession) harnessObject() (string, error) {
+	if s.harness != "" {
+		return s.harness, nil
+	}
+	src := filepath.Join(s.dir, "harness.c")
+	if err := os.WriteFile(src, []byte(replHarness), 0644); err != nil {
+		return "", err
+	}
+	obj := filepath.Join(s.dir, "harness.o")
+	if err := runStage("linker", s.dir, linker(), "-c", src, "-o", obj); err != nil {
+		return "", err
+	}
+	s.harness = obj
+	return obj, nil
+}
+
+func evalProgram(expr string) string {
+	expr = strings.TrimSuffix(strings.TrimSpace(expr), ";")
+	function := replEvalFunction
+	if runtime.GOOS == "windows" {
+		function = "main"
+	}
+	return "int " + function + "() {\n    return " + expr + ";\n}\n"
+}
+
+// declaredFunctions returns the names of the functions declared in src.
+func declaredFunctions(src string) []string {
+	var names []string
+	fields := strings.FieldsFunc(src, func(r rune) bool {
+		return !(r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z')
+	})
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "int" {
+			names = append(names, fields[i+1])
+		}
+	}
+	return names
+}
+
+// replCommands are the commands Tab completes.
+var replCommands = []string{":decls", ":help", ":history", ":load", ":quit", ":reset", ":type"}
+
+// completions returns the completions of the word that ends line: the
+// commands at the start of the line, files after :load, and otherwise the
+// functions declared in the session and the keywords.
+func (s *replSession) completions(line string) []string {
+	word := line[strings.LastIndexFunc(line, isWordBreak)+1:]
+	var candidates []string
+	switch {
+	case strings.HasPrefix(line, ":load "), strings.HasPrefix(line, ":l "):
+		word = strings.TrimLeft(line[strings.Index(line, " "):], " ")
+		matches, _ := filepath.Glob(word + "*")
+		for _, m := range matches {
+			if info, err := os.Stat(m); err == nil && info.IsDir() {
+				m += string(filepath.Separator)
+			}
+			candidates = append(candidates, m)
+		}
+	case strings.HasPrefix(line, ":") && !strings.Contains(line, " "):
+		candidates = replCommands
+	default:
+		candidates = []string{"int", "return"}
+		for _, decl := range s.decls {
+			candidates = append(candidates, declaredFunctions(decl)...)
+		}
+	}
+	seen := map[string]bool{}
+	var matches []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, word) && !seen[c] {
+			seen[c] = true
+			matches = append(matches, c)
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// maxReplHistory is how many inputs the history keeps.
+const maxReplHistory = 1000
+
+func replHistoryPath() (string, error) {
+	dir, err := dataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "repl_history"), nil
+}
+
+// historyEntry turns an input into its entry in the history: one line, as
+// inputs of several lines are joined.
+func historyEntry(input string) string {
+	lines := strings.Split(input, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.Join(lines, " ")
+}
+
+// loadReplHistory reads the history of earlier sessions, which is empty
+// when there is none or it cannot be read.
+func loadReplHistory() []string {
+	path, err := replHistoryPath()
+	if err != nil {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	history := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(history) > maxReplHistory {
+		history = history[len(history)-maxReplHistory:]
+		if err := os.WriteFile(path, []byte(strings.Join(history, "\n")+"\n"), 0600); err != nil {
+			logf("repl: trimming the history: %v", err)
+		}
+	}
+	return history
+}
+
+// appendReplHistory adds entry to the history file. The REPL works without
+// one, so failures are only logged.
+func appendReplHistory(entry string) {
+	path, err := replHistoryPath()
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+	}
+	var f *os.File
+	if err == nil {
+		f, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	}
+	if err == nil {
+		_, err = f.WriteString(entry + "\n")
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		logf("repl: saving the history: %v", err)
+	}
+}
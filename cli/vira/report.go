@@ -0,0 +1,224 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"vira/pkg/diagnostics"
+)
+
+const newIssueURL = "https://github.com/vira-language/vira/issues/new"
+
+func newReportCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "report [file.vira...]",
+		Short: "Create a bug report bundle",
+		Long: `Create a bug report bundle to attach to an issue.
+
+The bundle is a gzipped tarball with the Vira and toolchain versions, the
+checksums of the toolchain's tools, the operating system and the VIRA_*
+environment variables, except those holding tokens or secrets. The given
+source files are added together with the files they include.
+
+The same bundle is created when a tool of the toolchain crashes during a
+build. Look through it before attaching it to an issue.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			file, err := writeBugReport(nil, args)
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			pterm.Success.Printfln("Wrote the bug report to %s", displayPath(file))
+			pterm.Info.Printfln("Attach it to a new issue at %s", newIssueURL)
+		},
+	}
+}
+
+// internalError reports whether err is a crash of a toolchain tool rather
+// than a problem in the sources: the tool was killed by a signal, or failed
+// without printing anything that reads as a diagnostic.
+func internalError(err error) (*stageError, bool) {
+	var stageErr *stageError
+	var exitErr *exec.ExitError
+	if !errors.As(err, &stageErr) || !errors.As(err, &exitErr) || stageErr.stage == "linker" {
+		return nil, false
+	}
+	if exitErr.ExitCode() < 0 {
+		return stageErr, true
+	}
+	return stageErr, !diagnostics.Recognized(stageErr.output) && codeForMessage(stageErr.output) == ""
+}
+
+// internalCompilerError reports a crash of a toolchain tool and where its
+// bug report was saved.
+func internalCompilerError(stageErr *stageError, source string) error {
+	msg := fmt.Sprintf("internal compiler error: %s crashed while compiling %s (%v)", stageErr.stage, displayPath(source), stageErr.err)
+	if out := strings.TrimSpace(stageErr.output); out != "" {
+		msg += "\n" + out
+	}
+	file, err := writeBugReport(stageErr, []string{source})
+	if err != nil {
+		return fmt.Errorf("%s\nthe bug report could not be written: %v", msg, err)
+	}
+	return fmt.Errorf("%s\nThis is a bug in Vira. A report was saved to %s; please look through it and attach it to a new issue at %s", msg, displayPath(file), newIssueURL)
+}
+
+// writeBugReport bundles what is known about the environment, the crash of
+// stage if any, and sources with the files they include. The bundle is
+// written to the target directory of the current project, or to the
+// temporary directory outside of one.
+func writeBugReport(stage *stageError, sources []string) (string, error) {
+	var report strings.Builder
+	fmt.Fprintf(&report, "created: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(&report, "os: %s/%s\n", runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(&report, "vira built with: %s\n", runtime.Version())
+	toolchain := activeToolchain()
+	if toolchain == "" {
+		toolchain = "system toolchain " + toolchainVersion()
+	}
+	if bin, err := toolchainBinDir(); err == nil {
+		fmt.Fprintf(&report, "toolchain: %s in %s\n", strings.TrimSpace(toolchain), bin)
+	} else {
+		fmt.Fprintf(&report, "toolchain: %s (%v)\n", strings.TrimSpace(toolchain), err)
+	}
+	report.WriteString("tools:\n")
+	for _, name := range []string{"preprocessor", "plsa", "compiler"} {
+		fmt.Fprintf(&report, "  %s: %s\n", name, toolChecksum(toolPath(name)))
+	}
+	fmt.Fprintf(&report, "linker: %s %s\n", linker(), linkerVersion())
+	report.WriteString("environment:\n")
+	for _, kv := range reportEnvironment() {
+		fmt.Fprintf(&report, "  %s\n", kv)
+	}
+	if stage != nil {
+		fmt.Fprintf(&report, "stage: %s\n", stage.stage)
+		fmt.Fprintf(&report, "command: %s\n", strings.Join(stage.args, " "))
+		fmt.Fprintf(&report, "directory: %s\n", stage.dir)
+		fmt.Fprintf(&report, "result: %v\n", stage.err)
+		fmt.Fprintf(&report, "output:\n%s\n", stage.output)
+	}
+
+	files := map[string]string{"report.txt": report.String()}
+	var inputs []string
+	if stage != nil {
+		// The arguments of the tool that name files are its inputs, such
+		// as the preprocessed source.
+		for _, arg := range stage.args[1:] {
+			path := arg
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(stage.dir, path)
+			}
+			if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+				inputs = append(inputs, path)
+			}
+		}
+	}
+	for _, source := range sources {
+		source, err := filepath.Abs(source)
+		if err != nil {
+			return "", err
+		}
+		if _, err := os.Stat(source); err != nil {
+			return "", err
+		}
+		inputs = append(inputs, includeClosure(source)...)
+	}
+	for _, input := range inputs {
+		data, err := os.ReadFile(input)
+		if err != nil {
+			continue
+		}
+		name := "files/" + strings.TrimPrefix(filepath.ToSlash(input), "/")
+		name = strings.ReplaceAll(name, ":", "")
+		files[name] = string(data)
+	}
+
+	dir := os.TempDir()
+	if root, err := findProjectRoot("."); err == nil {
+		dir = filepath.Join(root, "target")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	file := filepath.Join(dir, "vira-report-"+time.Now().Format("20060102-150405")+".tar.gz")
+	data, err := reportTarball(files)
+	if err != nil {
+		return "", err
+	}
+	return file, os.WriteFile(file, data, 0644)
+}
+
+// reportEnvironment lists the VIRA_* variables, leaving out those whose
+// names suggest they hold credentials.
+func reportEnvironment() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		upper := strings.ToUpper(name)
+		if !strings.HasPrefix(upper, "VIRA_") {
+			continue
+		}
+		if strings.Contains(upper, "TOKEN") || strings.Contains(upper, "SECRET") || strings.Contains(upper, "PASSWORD") || strings.Contains(upper, "KEY") {
+			env = append(env, name+"=<redacted>")
+			continue
+		}
+		env = append(env, kv)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// toolChecksum describes the binary at path by its size and SHA-256.
+func toolChecksum(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return path + ": " + err.Error()
+	}
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("%s (%s, sha256 %s)", path, formatSize(int64(len(data))), hex.EncodeToString(sum[:]))
+}
+
+// reportTarball writes files, by name, into a gzipped tarball.
+func reportTarball(files map[string]string) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for _, name := range sortedKeys(files) {
+		hdr := &tar.Header{
+			Name:    "vira-report/" + name,
+			Mode:    0644,
+			Size:    int64(len(files[name])),
+			ModTime: now,
+			Format:  tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write([]byte(files[name])); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// resolvedPackage is one package at one version in a resolution.
+type resolvedPackage struct {
+	Name     string
+	Version  string
+	Features []string
+	// Deps are the keys (name@version) of the packages this one depends on.
+	Deps []string
+}
+
+// resolution is the package graph selected for a project. The same package
+// may appear at several semver-incompatible versions, such as 1.x and 2.x.
+type resolution struct {
+	root     string
+	packages map[string]*resolvedPackage
+}
+
+func pkgKey(name, version string) string {
+	return name + "@" + version
+}
+
+// versionsOf returns the resolved versions of the named package, sorted.
+func (r *resolution) versionsOf(name string) []string {
+	var versions []string
+	for key, pkg := range r.packages {
+		if pkg.Name == name && key != r.root {
+			versions = append(versions, pkg.Version)
+		}
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// dependents maps each key to the keys of the packages depending on it.
+func (r *resolution) dependents() map[string][]string {
+	rev := map[string][]string{}
+	for key, pkg := range r.packages {
+		for _, dep := range pkg.Deps {
+			rev[dep] = append(rev[dep], key)
+		}
+	}
+	for key := range rev {
+		sort.Strings(rev[key])
+	}
+	return rev
+}
+
+// Resolution strategies, set in the [resolver] section of vira.toml.
+const (
+	// strategyMaximal picks the newest version allowed by the requirements.
+	strategyMaximal = "maximal"
+	// strategyMinimal picks the oldest, which checks that the lower bounds
+	// of the requirements are accurate.
+	strategyMinimal = "minimal"
+)
+
+// maxResolveSteps bounds the backtracking search.
+const maxResolveSteps = 100000
+
+// compatSlot names the range of versions of a package that are semver
+// compatible with v. A resolution holds at most one version per slot, so
+// "^1.2" and "^1.4" share a version while "^1" and "^2" do not.
+func compatSlot(name string, v semVersion) string {
+	switch {
+	case v.Major > 0:
+		return fmt.Sprintf("%s@%d", name, v.Major)
+	case v.Minor > 0:
+		return fmt.Sprintf("%s@0.%d", name, v.Minor)
+	}
+	return fmt.Sprintf("%s@0.0.%d", name, v.Patch)
+}
+
+// requirement is one edge of the dependency graph that is still to be
+// resolved.
+type requirement struct {
+	parent string
+	name   string
+	req    versionReq
+}
+
+// resolveConflict reports a package for which no version satisfies all the
+// requirements placed on it.
+type resolveConflict struct {
+	name        string
+	constraints []requirement
+	available   []string
+}
+
+func (c *resolveConflict) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "failed to select a version of %s that satisfies all requirements:", c.name)
+	for _, r := range c.constraints {
+		fmt.Fprintf(&sb, "\n  %s %s, required by %s", c.name, r.req, strings.Replace(r.parent, "@", " v", 1))
+	}
+	if len(c.available) == 0 {
+		sb.WriteString("\nthe registry has no usable versions of " + c.name)
+	} else {
+		sb.WriteString("\navailable versions: " + strings.Join(c.available, ", "))
+	}
+	return sb.String()
+}
+
+type resolver struct {
+	idx      *registryIndex
+	prefer   map[string]bool
+	minimal  bool
+	res      *resolution
+	records  map[string]registryVersion
+	selected map[string]string // compatibility slot -> key
+	// required holds the requirements on each package along the current
+	// search path, for conflict reports.
+	required map[string][]requirement
+	steps    int
+}
+
+// resolveDependencies selects one version of each package per compatibility
+// slot such that every requirement in the graph is satisfied, backtracking
+// when a choice leads to a conflict. Candidates are tried newest first, or
+// oldest first with the minimal strategy; versions whose keys are in prefer,
+// such as those of an existing lockfile, are always tried first. Yanked
+// versions are only used when preferred.
+func resolveDependencies(m *Manifest, idx *registryIndex, prefer map[string]bool, strategy string) (*resolution, error) {
+	if strategy == "" {
+		strategy = strategyMaximal
+	}
+	if strategy != strategyMaximal && strategy != strategyMinimal {
+		return nil, fmt.Errorf("unknown resolver strategy %q (expected %s or %s)", strategy, strategyMaximal, strategyMinimal)
+	}
+	res := &resolution{packages: map[string]*resolvedPackage{}}
+	root := &resolvedPackage{Name: m.Package.Name, Version: m.Package.Version}
+	res.root = pkgKey(root.Name, root.Version)
+	res.packages[res.root] = root
+
+	var queue []requirement
+	for _, name := range m.sortedDependencies() {
+		dep := m.Dependencies[name]
+		req, err := parseVersionReq(dep.Version)
+		if err != nil {
+			return nil, fmt.Errorf("dependency %s: %v", name, err)
+		}
+		queue = append(queue, requirement{res.root, name, req})
+	}
+	r := &resolver{
+		idx:      idx,
+		prefer:   prefer,
+		minimal:  strategy == strategyMinimal,
+		res:      res,
+		records:  map[string]registryVersion{},
+		selected: map[string]string{},
+		required: map[string][]requirement{},
+	}
+	if err := r.solve(queue); err != nil {
+		return nil, err
+	}
+
+	requested := map[string]map[string]bool{}
+	for key, rec := range r.records {
+		requested[key] = map[string]bool{}
+		if _, ok := rec.Features["default"]; ok {
+			requested[key]["default"] = true
+		}
+	}
+	for _, key := range root.Deps {
+		for _, f := range m.Dependencies[res.packages[key].Name].Features {
+			requested[key][f] = true
+		}
+	}
+
+	// Expand feature tables until nothing changes: a feature may enable
+	// other features of the same package or, as "dep/feature", of a
+	// dependency.
+	for changed := true; changed; {
+		changed = false
+		for key, features := range requested {
+			for f := range features {
+				for _, item := range r.records[key].Features[f] {
+					target, feature := key, item
+					if dep, depFeature, ok := strings.Cut(item, "/"); ok {
+						target, feature = "", depFeature
+						for _, child := range res.packages[key].Deps {
+							if res.packages[child].Name == dep {
+								target = child
+							}
+						}
+						if target == "" {
+							continue
+						}
+					}
+					if requested[target] == nil {
+						requested[target] = map[string]bool{}
+					}
+					if !requested[target][feature] {
+						requested[target][feature] = true
+						changed = true
+					}
+				}
+			}
+		}
+	}
+	for key, features := range requested {
+		pkg := res.packages[key]
+		for f := range features {
+			pkg.Features = append(pkg.Features, f)
+		}
+		sort.Strings(pkg.Features)
+	}
+	for _, pkg := range res.packages {
+		sort.Strings(pkg.Deps)
+	}
+	return res, nil
+}
+
+// solve resolves the requirements in queue in order. On failure, every
+// selection made by this call has been undone.
+func (r *resolver) solve(queue []requirement) error {
+	if len(queue) == 0 {
+		return nil
+	}
+	if r.steps++; r.steps > maxResolveSteps {
+		return fmt.Errorf("dependency resolution gave up after %d steps", maxResolveSteps)
+	}
+	item, rest := queue[0], queue[1:]
+	pkg := r.idx.lookup(item.name)
+	if pkg == nil {
+		return fmt.Errorf("package %s (required by %s) is not in the registry", item.name, strings.Replace(item.parent, "@", " v", 1))
+	}
+	r.required[item.name] = append(r.required[item.name], item)
+	defer func() { r.required[item.name] = r.required[item.name][:len(r.required[item.name])-1] }()
+
+	parent := r.res.packages[item.parent]
+	var failure *resolveConflict
+	for _, rec := range r.candidates(pkg, item.req) {
+		v, _ := parseVersion(rec.Version)
+		key := pkgKey(item.name, rec.Version)
+		slot := compatSlot(item.name, v)
+		sel, taken := r.selected[slot]
+		if taken && sel != key {
+			continue
+		}
+		hadEdge := containsString(parent.Deps, key)
+		if !hadEdge {
+			parent.Deps = append(parent.Deps, key)
+		}
+		next := rest
+		if !taken {
+			r.selected[slot] = key
+			r.records[key] = rec
+			r.res.packages[key] = &resolvedPackage{Name: item.name, Version: rec.Version}
+			next = append([]requirement(nil), rest...)
+			for _, name := range sortedKeys(rec.Dependencies) {
+				req, err := parseVersionReq(rec.Dependencies[name])
+				if err != nil {
+					return fmt.Errorf("%s (required by %s v%s): %v", name, item.name, rec.Version, err)
+				}
+				next = append(next, requirement{key, name, req})
+			}
+		}
+		err := r.solve(next)
+		if err == nil {
+			return nil
+		}
+		if !hadEdge {
+			parent.Deps = parent.Deps[:len(parent.Deps)-1]
+		}
+		if !taken {
+			delete(r.selected, slot)
+			delete(r.records, key)
+			delete(r.res.packages, key)
+		}
+		var conflict *resolveConflict
+		if !errors.As(err, &conflict) {
+			return err
+		}
+		// Report the conflict involving the most requirements, which is
+		// usually the one that explains the others.
+		if failure == nil || len(conflict.constraints) > len(failure.constraints) {
+			failure = conflict
+		}
+	}
+	if failure != nil {
+		return failure
+	}
+	conflict := &resolveConflict{name: item.name, constraints: append([]requirement(nil), r.required[item.name]...)}
+	for _, rec := range pkg.sortedVersions() {
+		if rec.Yanked {
+			conflict.available = append(conflict.available, rec.Version+" (yanked)")
+		} else {
+			conflict.available = append(conflict.available, rec.Version)
+		}
+	}
+	return conflict
+}
+
+// candidates returns the versions of pkg that satisfy req in the order they
+// should be tried.
+func (r *resolver) candidates(pkg *registryPackage, req versionReq) []registryVersion {
+	var preferred, others []registryVersion
+	for _, rec := range pkg.sortedVersions() {
+		v, _ := parseVersion(rec.Version)
+		if !req.matches(v) {
+			continue
+		}
+		if r.prefer[pkgKey(pkg.Name, rec.Version)] {
+			preferred = append(preferred, rec)
+		} else if !rec.Yanked {
+			others = append(others, rec)
+		}
+	}
+	if r.minimal {
+		for i, j := 0, len(others)-1; i < j; i, j = i+1, j-1 {
+			others[i], others[j] = others[j], others[i]
+		}
+	}
+	return append(preferred, others...)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"vira/pkg/i18n"
+	"vira/pkg/interrupt"
+)
+
+// stopSignals are the signals --stop-signal names.
+var stopSignals = map[string]syscall.Signal{
+	"TERM": syscall.SIGTERM,
+	"INT":  syscall.SIGINT,
+	"HUP":  syscall.SIGHUP,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+}
+
+func newRunCmd() *cobra.Command {
+	var opts runOptions
+
+	cmd := &cobra.Command{
+		Use:   "run [-- args...]",
+		Short: "Build the project and run it",
+		Long: `Build the project, with the release profile with --release, and run it
+with args in the project root, exiting with its exit status.
+
+With --watch, vira keeps running: whenever a source of the project or of
+its path dependencies, or vira.toml, changes, the project is rebuilt and
+the program restarted, for the quick edit and run loop of developing
+servers. The program is stopped with --stop-signal, SIGTERM by default,
+and killed if it is still running after --grace-period. The output of the
+program streams through while it runs; it gets no input from the terminal.
+A build that fails leaves the program running until the next change. On
+Windows, where there are no signals, the program is killed at once.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			sig, ok := stopSignals[strings.TrimPrefix(strings.ToUpper(opts.stopSignal), "SIG")]
+			if !ok {
+				pterm.Error.Printfln("unknown signal %q (use %s)", opts.stopSignal, strings.Join(sortedKeys(stopSignals), ", "))
+				exit(1)
+			}
+			opts.signal = sig
+			opts.args = args
+			proj, err := loadProject(".")
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			if opts.watch {
+				if err := proj.runWatching(opts); err != nil {
+					printError(err)
+					exit(1)
+				}
+				return
+			}
+			pterm.DefaultSection.Println(i18n.T("Building %s v%s", proj.manifest.Package.Name, proj.manifest.Package.Version))
+			exe, err := proj.build(buildOptions{release: opts.release})
+			if err != nil {
+				printError(err)
+				exit(1)
+			}
+			run := exec.Command(exe, args...)
+			run.Dir = proj.root
+			run.Stdin, run.Stdout, run.Stderr = os.Stdin, os.Stdout, os.Stderr
+			code, err := commandExitCode(interrupt.Foreground(run))
+			if err != nil {
+				pterm.Error.Println(err)
+			}
+			if code != 0 {
+				exit(code)
+			}
+		},
+	}
+	cmd.Flags().BoolVar(&opts.release, "release", false, "build with the release profile")
+	cmd.Flags().BoolVarP(&opts.watch, "watch", "w", false, "rebuild and restart the program when a source changes")
+	cmd.Flags().StringVar(&opts.stopSignal, "stop-signal", "TERM", "signal that stops the program before a restart: TERM, INT, HUP, QUIT or KILL")
+	cmd.Flags().DurationVar(&opts.gracePeriod, "grace-period", 5*time.Second, "how long the program gets to stop before it is killed")
+	return cmd
+}
+
+type runOptions struct {
+	release     bool
+	watch       bool
+	stopSignal  string
+	signal      syscall.Signal
+	gracePeriod time.Duration
+	args        []string
+}
+
+// watchInterval is how often --watch looks for changes.
+const watchInterval = 300 * time.Millisecond
+
+// fileStamp is what tells a file that changed from one that did not.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// watchedFiles returns the stamps of the files whose changes rebuild the
+// project: everything below src/, the sources of path dependencies and
+// the manifest.
+func (p *project) watchedFiles() map[string]fileStamp {
+	stamps := map[string]fileStamp{}
+	add := func(path string) {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			stamps[path] = fileStamp{info.ModTime(), info.Size()}
+		}
+	}
+	filepath.WalkDir(p.srcDir(), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			add(path)
+		}
+		return nil
+	})
+	if sources, err := p.pathDependencySources(); err == nil {
+		for _, src := range sources {
+			add(src)
+		}
+	}
+	add(filepath.Join(p.root, manifestName))
+	return stamps
+}
+
+// changedFiles lists the files that differ between the stamps before and
+// after, sorted.
+func changedFiles(before, after map[string]fileStamp) []string {
+	var changed []string
+	for path, s := range after {
+		if before[path] != s {
+			changed = append(changed, path)
+		}
+	}
+	for path := range before {
+		if _, ok := after[path]; !ok {
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// watchedProgram is a run of the program under --watch.
+type watchedProgram struct {
+	cmd *exec.Cmd
+	// exited is closed once the program has exited, with code its exit
+	// status.
+	exited chan struct{}
+	code   int
+}
+
+// runWatching builds and runs the project, and does so again on every
+// change, until vira is interrupted.
+func (p *project) runWatching(opts runOptions) error {
+	var prog *watchedProgram
+	stamps := p.watchedFiles()
+	for {
+		pterm.DefaultSection.Println(i18n.T("Building %s v%s", p.manifest.Package.Name, p.manifest.Package.Version))
+		exe, err := p.build(buildOptions{release: opts.release})
+		if err != nil {
+			printError(err)
+			if prog != nil {
+				pterm.Info.Println("The program keeps running until the build succeeds")
+			}
+		} else {
+			if prog != nil {
+				p.stopProgram(prog, opts)
+			}
+			if prog, err = p.startProgram(exe, opts.args); err != nil {
+				return err
+			}
+		}
+		pterm.Info.Println("Watching for changes, Ctrl-C to stop")
+
+		for {
+			time.Sleep(watchInterval)
+			if prog != nil {
+				select {
+				case <-prog.exited:
+					pterm.Info.Printfln("The program exited with status %d; it restarts on the next change", prog.code)
+					prog = nil
+				default:
+				}
+			}
+			current := p.watchedFiles()
+			changed := changedFiles(stamps, current)
+			if len(changed) == 0 {
+				continue
+			}
+			// Editors write files in several steps; wait until they are
+			// done.
+			for {
+				time.Sleep(watchInterval)
+				settled := p.watchedFiles()
+				if len(changedFiles(current, settled)) == 0 {
+					break
+				}
+				current = settled
+			}
+			stamps = current
+			pterm.Info.Printfln("%s changed", p.rel(changed[0]))
+			if err := p.reloadManifest(); err != nil {
+				printError(err)
+				continue
+			}
+			break
+		}
+	}
+}
+
+// reloadManifest reads vira.toml again, as it may have changed.
+func (p *project) reloadManifest() error {
+	reloaded, err := loadProject(p.root)
+	if err != nil {
+		return err
+	}
+	*p = *reloaded
+	return nil
+}
+
+// startProgram starts exe with args in a process group of its own.
+func (p *project) startProgram(exe string, args []string) (*watchedProgram, error) {
+	cmd := exec.Command(exe, args...)
+	cmd.Dir = p.root
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	pterm.Info.Printfln("Running %s", p.rel(exe))
+	if err := interrupt.Start(cmd); err != nil {
+		return nil, err
+	}
+	prog := &watchedProgram{cmd: cmd, exited: make(chan struct{})}
+	go func() {
+		prog.code, _ = commandExitCode(interrupt.Wait(cmd))
+		close(prog.exited)
+	}()
+	return prog, nil
+}
+
+// stopProgram stops prog with the stop signal of opts, and kills it if it
+// is still running after the grace period.
+func (p *project) stopProgram(prog *watchedProgram, opts runOptions) {
+	select {
+	case <-prog.exited:
+		return
+	default:
+	}
+	pterm.Info.Println("Stopping the program")
+	if err := interrupt.Signal(prog.cmd, opts.signal); err != nil {
+		logf("run: %v; killing the program", err)
+		interrupt.Signal(prog.cmd, os.Kill)
+	}
+	select {
+	case <-prog.exited:
+	case <-time.After(opts.gracePeriod):
+		pterm.Warning.Printfln("The program did not stop within %s and is killed", opts.gracePeriod)
+		interrupt.Signal(prog.cmd, os.Kill)
+		<-prog.exited
+	}
+	logf("run: the program stopped with exit status %d", prog.code)
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/rand"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// sbomComponent is an entry of a software bill of materials, independent of
+// the format it is written in.
+type sbomComponent struct {
+	ref     string
+	kind    string // library or application
+	name    string
+	version string
+	purl    string
+	sha256  string
+	license string
+	source  string
+	deps    []string
+}
+
+// sbom describes an executable: the project, the packages and native
+// libraries it is built from and the toolchain that built it.
+type sbom struct {
+	root       sbomComponent
+	packages   []sbomComponent
+	libraries  []sbomComponent
+	toolchain  []sbomComponent
+	serial     string
+	created    time.Time
+	executable string
+}
+
+func packageURL(name, version string) string {
+	return "pkg:vira/" + name + "@" + version
+}
+
+// collectSBOM gathers the bill of materials for the executable exe from the
+// project's lockfile, the toolchain and the libraries exe is linked against.
+func (p *project) collectSBOM(exe string) (*sbom, error) {
+	lf, err := p.loadLockfile()
+	if err != nil {
+		return nil, err
+	}
+	serial := make([]byte, 16)
+	rand.Read(serial)
+	serial[6] = serial[6]&0x0f | 0x40
+	serial[8] = serial[8]&0x3f | 0x80
+	h := hex.EncodeToString(serial)
+
+	pkg := p.manifest.Package
+	b := &sbom{
+		root: sbomComponent{
+			ref:     pkgKey(pkg.Name, pkg.Version),
+			kind:    "application",
+			name:    pkg.Name,
+			version: pkg.Version,
+			purl:    packageURL(pkg.Name, pkg.Version),
+			license: pkg.License,
+		},
+		serial:     h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:],
+		created:    time.Now().UTC(),
+		executable: exe,
+	}
+	if sum, err := fileHash(exe); err == nil {
+		b.root.sha256 = sum
+	}
+
+	if lf != nil && len(lf.Packages) > 0 {
+		// Licenses are taken from the registry index as last fetched, if
+		// it is at hand.
+		idx, _ := cachedIndex(registryURL())
+		for _, dep := range lf.Packages[0].Dependencies {
+			name, version, _ := strings.Cut(dep, " ")
+			b.root.deps = append(b.root.deps, pkgKey(name, version))
+		}
+		for _, locked := range lf.Packages[1:] {
+			c := sbomComponent{
+				ref:     locked.key(),
+				kind:    "library",
+				name:    locked.Name,
+				version: locked.Version,
+				purl:    packageURL(locked.Name, locked.Version),
+				sha256:  locked.Checksum,
+				source:  locked.Source,
+			}
+			if idx != nil && locked.Registry == "" {
+				if rp := idx.lookup(locked.Name); rp != nil {
+					c.license = rp.License
+				}
+			}
+			for _, dep := range locked.Dependencies {
+				name, version, _ := strings.Cut(dep, " ")
+				c.deps = append(c.deps, pkgKey(name, version))
+			}
+			b.packages = append(b.packages, c)
+		}
+	}
+
+	libs, err := nativeLibraries(exe)
+	if err != nil {
+		return nil, fmt.Errorf("reading the libraries %s links against: %v", exe, err)
+	}
+	for _, lib := range libs {
+		c := sbomComponent{ref: "native:" + lib, kind: "library", name: lib}
+		b.libraries = append(b.libraries, c)
+		b.root.deps = append(b.root.deps, c.ref)
+	}
+
+	version := toolchainVersion()
+	for _, tool := range []string{"preprocessor", "plsa", "compiler"} {
+		c := sbomComponent{ref: "toolchain:" + tool, kind: "application", name: "vira-" + tool, version: version}
+		if sum, err := fileHash(toolPath(tool)); err == nil {
+			c.sha256 = sum
+		}
+		b.toolchain = append(b.toolchain, c)
+	}
+	b.toolchain = append(b.toolchain, sbomComponent{ref: "toolchain:linker", kind: "application", name: linker(), version: linkerVersion()})
+	return b, nil
+}
+
+// toolchainVersion reads the version recorded next to the binaries of the
+// active toolchain.
+func toolchainVersion() string {
+	bin, err := toolchainBinDir()
+	if err != nil {
+		return ""
+	}
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(bin), "version.json"))
+	if err != nil {
+		return ""
+	}
+	var versions []string
+	if json.Unmarshal(data, &versions) != nil || len(versions) == 0 {
+		return ""
+	}
+	return versions[0]
+}
+
+var linkerVersionPattern = regexp.MustCompile(`\d+\.\d+(\.\d+)?`)
+
+func linkerVersion() string {
+	if runtime.GOOS == "windows" {
+		return ""
+	}
+	out, err := exec.Command(linker(), "--version").Output()
+	if err != nil {
+		return ""
+	}
+	first, _, _ := strings.Cut(string(out), "\n")
+	return linkerVersionPattern.FindString(first)
+}
+
+// nativeLibraries lists the shared libraries exe is dynamically linked
+// against.
+func nativeLibraries(exe string) ([]string, error) {
+	switch runtime.GOOS {
+	case "windows":
+		f, err := pe.Open(exe)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return f.ImportedLibraries()
+	case "darwin":
+		f, err := macho.Open(exe)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return f.ImportedLibraries()
+	default:
+		f, err := elf.Open(exe)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return f.ImportedLibraries()
+	}
+}
+
+// write writes the bill of materials in format, cyclonedx or spdx, next
+// to the executable and returns the file's path.
+func (b *sbom) write(format string) (string, error) {
+	var doc any
+	var file string
+	switch format {
+	case "cyclonedx":
+		doc, file = b.cycloneDX(), b.executable+".cdx.json"
+	case "spdx":
+		doc, file = b.spdx(), b.executable+".spdx.json"
+	default:
+		return "", fmt.Errorf("unknown SBOM format %q (use cyclonedx or spdx)", format)
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return file, os.WriteFile(file, append(data, '\n'), 0644)
+}
+
+func (b *sbom) cycloneDX() map[string]any {
+	component := func(c sbomComponent) map[string]any {
+		m := map[string]any{"type": c.kind, "bom-ref": c.ref, "name": c.name}
+		if c.version != "" {
+			m["version"] = c.version
+		}
+		if c.purl != "" {
+			m["purl"] = c.purl
+		}
+		if c.sha256 != "" {
+			m["hashes"] = []map[string]string{{"alg": "SHA-256", "content": c.sha256}}
+		}
+		if c.license != "" {
+			m["licenses"] = []map[string]string{{"expression": c.license}}
+		}
+		if c.source != "" {
+			kind := "distribution"
+			if strings.HasPrefix(c.source, "git+") {
+				kind = "vcs"
+			}
+			m["externalReferences"] = []map[string]string{{"type": kind, "url": c.source}}
+		}
+		return m
+	}
+	components := []map[string]any{}
+	var tools []map[string]any
+	dependencies := []map[string]any{{"ref": b.root.ref, "dependsOn": nonNil(b.root.deps)}}
+	for _, c := range b.packages {
+		components = append(components, component(c))
+		dependencies = append(dependencies, map[string]any{"ref": c.ref, "dependsOn": nonNil(c.deps)})
+	}
+	for _, c := range b.libraries {
+		components = append(components, component(c))
+	}
+	for _, c := range b.toolchain {
+		tools = append(tools, component(c))
+	}
+	return map[string]any{
+		"bomFormat":    "CycloneDX",
+		"specVersion":  "1.5",
+		"serialNumber": "urn:uuid:" + b.serial,
+		"version":      1,
+		"metadata": map[string]any{
+			"timestamp": b.created.Format(time.RFC3339),
+			"tools":     map[string]any{"components": tools},
+			"component": component(b.root),
+		},
+		"components":   components,
+		"dependencies": dependencies,
+	}
+}
+
+var spdxIDInvalid = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+func spdxID(ref string) string {
+	return "SPDXRef-" + spdxIDInvalid.ReplaceAllString(ref, "-")
+}
+
+func (b *sbom) spdx() map[string]any {
+	pkg := func(c sbomComponent) map[string]any {
+		m := map[string]any{
+			"SPDXID":           spdxID(c.ref),
+			"name":             c.name,
+			"downloadLocation": "NOASSERTION",
+			"filesAnalyzed":    false,
+			"licenseConcluded": "NOASSERTION",
+			"licenseDeclared":  "NOASSERTION",
+		}
+		if c.version != "" {
+			m["versionInfo"] = c.version
+		}
+		if c.source != "" && !strings.HasPrefix(c.source, "path+") {
+			m["downloadLocation"] = c.source
+		}
+		if c.license != "" {
+			m["licenseDeclared"] = c.license
+		}
+		if c.sha256 != "" {
+			m["checksums"] = []map[string]string{{"algorithm": "SHA256", "checksumValue": c.sha256}}
+		}
+		if c.purl != "" {
+			m["externalRefs"] = []map[string]string{{"referenceCategory": "PACKAGE-MANAGER", "referenceType": "purl", "referenceLocator": c.purl}}
+		}
+		return m
+	}
+	relationship := func(from, kind, to string) map[string]string {
+		return map[string]string{"spdxElementId": from, "relationshipType": kind, "relatedSpdxElement": to}
+	}
+
+	root := spdxID(b.root.ref)
+	packages := []map[string]any{pkg(b.root)}
+	relationships := []map[string]string{relationship("SPDXRef-DOCUMENT", "DESCRIBES", root)}
+	for _, c := range append([]sbomComponent{b.root}, b.packages...) {
+		if c.ref != b.root.ref {
+			packages = append(packages, pkg(c))
+		}
+		for _, dep := range c.deps {
+			if !strings.HasPrefix(dep, "native:") {
+				relationships = append(relationships, relationship(spdxID(c.ref), "DEPENDS_ON", spdxID(dep)))
+			}
+		}
+	}
+	for _, c := range b.libraries {
+		packages = append(packages, pkg(c))
+		relationships = append(relationships, relationship(root, "DYNAMIC_LINK", spdxID(c.ref)))
+	}
+	for _, c := range b.toolchain {
+		packages = append(packages, pkg(c))
+		relationships = append(relationships, relationship(spdxID(c.ref), "BUILD_TOOL_OF", root))
+	}
+	return map[string]any{
+		"spdxVersion":       "SPDX-2.3",
+		"dataLicense":       "CC0-1.0",
+		"SPDXID":            "SPDXRef-DOCUMENT",
+		"name":              b.root.name + "-" + b.root.version,
+		"documentNamespace": "https://spdx.org/spdxdocs/" + b.root.name + "-" + b.root.version + "-" + b.serial,
+		"creationInfo": map[string]any{
+			"created":  b.created.Format(time.RFC3339),
+			"creators": []string{"Tool: vira"},
+		},
+		"packages":      packages,
+		"relationships": relationships,
+	}
+}
+
+// nonNil keeps empty lists from being written as null.
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
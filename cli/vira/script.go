@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"vira/pkg/interrupt"
+)
+
+func newScriptCmd() *cobra.Command {
+	var rebuild bool
+
+	cmd := &cobra.Command{
+		Use:   "script [file.vira] [args...]",
+		Short: "Compile a single-file program into the cache and run it",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			code, err := runScript(args[0], args[1:], rebuild)
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			exit(code)
+		},
+	}
+	// Everything after the script path belongs to the script.
+	cmd.Flags().SetInterspersed(false)
+	cmd.Flags().BoolVar(&rebuild, "rebuild", false, "ignore the cache and recompile the script")
+	return cmd
+}
+
+// runScript builds file into the script cache unless an executable for the
+// same content already exists, runs it and returns its exit code.
+func runScript(file string, args []string, rebuild bool) (int, error) {
+	exe, err := cachedScript(file, rebuild)
+	if err != nil {
+		return 1, err
+	}
+
+	run := exec.Command(exe, args...)
+	run.Stdin = os.Stdin
+	run.Stdout = os.Stdout
+	run.Stderr = os.Stderr
+	if err := run.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode(), nil
+		}
+		return 1, err
+	}
+	return 0, nil
+}
+
+func cachedScript(file string, rebuild bool) (string, error) {
+	src, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	// The key covers what the executable is built from: the script, the
+	// files it includes and the toolchain that compiles them.
+	h := sha256.New()
+	for _, f := range includeClosure(file) {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%d\x00", len(data))
+		h.Write(data)
+	}
+	fmt.Fprintf(h, "toolchain\x00%s\x00", activeToolchain())
+	key := hex.EncodeToString(h.Sum(nil))
+
+	cache, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(cache, "scripts", key)
+	name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	exe := filepath.Join(dir, executableName(name))
+
+	if !rebuild {
+		if _, err := os.Stat(exe); err == nil {
+			return exe, nil
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	// A shebang line would be passed through to plsa by the preprocessor, so
+	// build a copy with it blanked out. The copy lives next to the original
+	// so relative includes still resolve.
+	source := file
+	if bytes.HasPrefix(src, []byte("#!")) {
+		if i := bytes.IndexByte(src, '\n'); i >= 0 {
+			src = src[i:]
+		} else {
+			src = nil
+		}
+		f, err := os.CreateTemp(filepath.Dir(file), "."+name+".*.vira")
+		if err != nil {
+			return "", err
+		}
+		source = f.Name()
+		defer interrupt.Cleanup(func() { os.Remove(source) })()
+		defer os.Remove(source)
+		_, err = f.Write(src)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Build into a temporary name of its own, so neither an interrupted
+	// build nor one running at the same time leaves a half-written
+	// executable that a later run would pick up.
+	out, err := os.CreateTemp(dir, executableName(name+"-*"))
+	if err != nil {
+		return "", err
+	}
+	out.Close()
+	tmp := out.Name()
+	defer interrupt.Cleanup(func() { os.Remove(tmp) })()
+	defer os.Remove(strings.TrimSuffix(tmp, filepath.Ext(tmp)) + ".o")
+	if err := buildExecutable(source, tmp); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, exe); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return exe, nil
+}
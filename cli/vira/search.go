@@ -0,0 +1,128 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+// searchResult is a package matching a search, as printed with --json.
+type searchResult struct {
+	Name        string   `json:"name"`
+	Version     string   `json:"version"`
+	Description string   `json:"description"`
+	Keywords    []string `json:"keywords"`
+	License     string   `json:"license"`
+	Downloads   int      `json:"downloads"`
+	score       int
+}
+
+func newSearchCmd() *cobra.Command {
+	var limit int
+
+	cmd := &cobra.Command{
+		Use:   "search [query...]",
+		Short: "Search the registry for packages",
+		Long: `Search the registry for packages whose name, keywords or description
+contain every word of the query. Without a query, all packages are listed.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			idx, err := fetchRegistryIndex()
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			results := searchRegistry(idx, args)
+			if limit > 0 && len(results) > limit {
+				results = results[:limit]
+			}
+			if jsonOutput {
+				if err := printJSON(results); err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+				return
+			}
+			if len(results) == 0 {
+				pterm.Warning.Printfln("No packages found for %q", strings.Join(args, " "))
+				return
+			}
+			data := pterm.TableData{{"Name", "Version", "Downloads", "License", "Description"}}
+			for _, r := range results {
+				data = append(data, []string{r.Name, r.Version, strconv.Itoa(r.Downloads), r.License, r.Description})
+			}
+			pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+		},
+	}
+	cmd.Flags().IntVar(&limit, "limit", 0, "show at most this many results")
+	return cmd
+}
+
+// searchRegistry returns the packages matching every term, best matches
+// first: name matches rank above keyword matches, which rank above
+// description matches.
+func searchRegistry(idx *registryIndex, terms []string) []searchResult {
+	results := []searchResult{}
+	for _, pkg := range idx.Libraries {
+		score := 0
+		for _, term := range terms {
+			s := matchScore(pkg, strings.ToLower(term))
+			if s == 0 {
+				score = -1
+				break
+			}
+			score += s
+		}
+		if score < 0 {
+			continue
+		}
+		r := searchResult{
+			Name:        pkg.Name,
+			Description: pkg.Description,
+			Keywords:    pkg.Keywords,
+			License:     pkg.License,
+			Downloads:   pkg.Downloads,
+			score:       score,
+		}
+		if r.Keywords == nil {
+			r.Keywords = []string{}
+		}
+		if rec, ok := pkg.latestMatching(versionReq{}); ok {
+			r.Version = rec.Version
+		}
+		results = append(results, r)
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		if results[i].Downloads != results[j].Downloads {
+			return results[i].Downloads > results[j].Downloads
+		}
+		return results[i].Name < results[j].Name
+	})
+	return results
+}
+
+func matchScore(pkg registryPackage, term string) int {
+	name := strings.ToLower(pkg.Name)
+	switch {
+	case name == term:
+		return 100
+	case strings.HasPrefix(name, term):
+		return 50
+	case strings.Contains(name, term):
+		return 30
+	}
+	for _, kw := range pkg.Keywords {
+		if strings.ToLower(kw) == term {
+			return 20
+		}
+	}
+	if strings.Contains(strings.ToLower(pkg.Description), term) {
+		return 10
+	}
+	return 0
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	registry, err := filepath.Abs(filepath.Join("testdata", "registry.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("VIRA_REGISTRY", registry)
+
+	tests := []struct {
+		query []string
+		want  []string
+	}{
+		{nil, []string{"math", "net", "std"}},
+		{[]string{"math"}, []string{"math"}},
+		{[]string{"socket", "address"}, []string{"net"}},
+		{[]string{"socket", "numeric"}, nil},
+	}
+	for _, tt := range tests {
+		stdout, stderr, err := runVira(t, t.TempDir(), append([]string{"search", "--json"}, tt.query...)...)
+		if err != nil {
+			t.Fatalf("vira search %v: %v\n%s", tt.query, err, stderr)
+		}
+		var results []searchResult
+		if err := json.Unmarshal([]byte(stdout), &results); err != nil {
+			t.Fatalf("vira search %v: %v\n%s", tt.query, err, stdout)
+		}
+		var names []string
+		for _, r := range results {
+			names = append(names, r.Name)
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("vira search %v found %v, want %v", tt.query, names, tt.want)
+		}
+	}
+
+	// The metadata comes from the index as the registry publishes it.
+	stdout, _, err := runVira(t, t.TempDir(), "search", "--json", "net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []searchResult
+	if err := json.Unmarshal([]byte(stdout), &results); err != nil || len(results) != 1 {
+		t.Fatalf("vira search net printed %s", stdout)
+	}
+	want := searchResult{
+		Name:        "net",
+		Version:     "0.5.1",
+		Description: "Networking primitives: sockets and addresses.",
+		Keywords:    []string{"network", "socket"},
+		License:     "MIT",
+	}
+	if !reflect.DeepEqual(results[0], want) {
+		t.Errorf("vira search net = %+v, want %+v", results[0], want)
+	}
+}
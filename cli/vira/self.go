@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"vira/pkg/i18n"
+)
+
+// fileRecordName is the file in a toolchain directory that records the
+// SHA-256 sum of every file installed into its bin directory, in the format
+// of sha256sum, for vira self verify.
+const fileRecordName = "files.sha256"
+
+func newSelfCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:         "self",
+		Annotations: map[string]string{skipToolchain: "true"},
+		Short:       "Manage the Vira installation",
+	}
+	var repair bool
+	verify := &cobra.Command{
+		Use:   "verify",
+		Short: "Check installed toolchains for damaged or changed files",
+		Long: `Check every toolchain installed with vira toolchain install, and the shims
+vira toolchain use writes, against what was installed: each file in a
+toolchain's bin directory is compared with the SHA-256 sum recorded when it
+was unpacked. Files that are missing, changed or not executable, and files
+nobody installed, such as the leftovers of an interrupted update, are
+listed by name.
+
+With --repair, the components the damaged files belong to are downloaded
+again, or, for toolchains installed as a whole, the release is downloaded
+again and only the damaged files are replaced. Files nobody installed are
+deleted.
+
+Toolchains installed before files were recorded can only be checked for
+missing components; --repair downloads them again and records their files.
+The system toolchain is not checked.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			ok, err := verifyInstallation(repair)
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			if !ok {
+				exit(1)
+			}
+		},
+	}
+	verify.Flags().BoolVar(&repair, "repair", false, "download damaged files again and delete files nobody installed")
+	cmd.AddCommand(verify)
+	return cmd
+}
+
+// fileProblem is a file of the installation that differs from what was
+// installed.
+type fileProblem struct {
+	File string `json:"file"`
+	// Problem is missing, modified, not executable or unexpected.
+	Problem string `json:"problem"`
+}
+
+// verifiedToolchain is the result of checking one toolchain, as vira self
+// verify --json prints it. A Toolchain of "" stands for the shims.
+type verifiedToolchain struct {
+	Toolchain string        `json:"toolchain,omitempty"`
+	Files     int           `json:"files"`
+	Recorded  bool          `json:"recorded"`
+	Problems  []fileProblem `json:"problems"`
+	Repaired  bool          `json:"repaired,omitempty"`
+}
+
+func (v *verifiedToolchain) name() string {
+	if v.Toolchain == "" {
+		return "The toolchain shims"
+	}
+	return "Toolchain " + v.Toolchain
+}
+
+// verifyInstallation checks the installed toolchains and the shims,
+// repairing them if asked, and reports whether everything is intact.
+func verifyInstallation(repair bool) (bool, error) {
+	versions, err := installedToolchains()
+	if err != nil {
+		return false, err
+	}
+	var results []*verifiedToolchain
+	for _, version := range versions {
+		v, err := verifyToolchain(version)
+		if err != nil {
+			return false, err
+		}
+		if repair && (len(v.Problems) > 0 || !v.Recorded) {
+			if err := repairToolchainFiles(version, v); err != nil {
+				return false, fmt.Errorf("repairing toolchain %s: %v", version, err)
+			}
+			if v, err = verifyToolchain(version); err != nil {
+				return false, err
+			}
+			v.Repaired = true
+		}
+		results = append(results, v)
+	}
+	if defaultToolchain() != "" {
+		v, err := verifyShims()
+		if err != nil {
+			return false, err
+		}
+		if repair && len(v.Problems) > 0 {
+			if err := writeToolchainShims(); err != nil {
+				return false, fmt.Errorf("repairing the toolchain shims: %v", err)
+			}
+			if v, err = verifyShims(); err != nil {
+				return false, err
+			}
+			v.Repaired = true
+		}
+		results = append(results, v)
+	}
+
+	ok := true
+	for _, v := range results {
+		ok = ok && len(v.Problems) == 0
+	}
+	if jsonOutput {
+		if results == nil {
+			results = []*verifiedToolchain{}
+		}
+		return ok, printJSON(results)
+	}
+	if len(results) == 0 {
+		pterm.Info.Println("No toolchains are installed with vira toolchain install; the system toolchain is not checked")
+		return true, nil
+	}
+	for _, v := range results {
+		switch {
+		case len(v.Problems) > 0:
+			pterm.Error.Printfln("%s has %s:", v.name(), i18n.Plural(len(v.Problems), "%d damaged or unexpected file", "%d damaged or unexpected files"))
+			for _, p := range v.Problems {
+				pterm.Println("  " + p.File + ": " + p.Problem)
+			}
+		case !v.Recorded:
+			pterm.Warning.Printfln("%s was installed without a record of its files, so only its components were checked (run vira self verify --repair to record them)", v.name())
+		case v.Repaired:
+			pterm.Success.Printfln("%s repaired: %s intact", v.name(), i18n.Plural(v.Files, "%d file", "%d files"))
+		default:
+			pterm.Success.Printfln("%s: %s intact", v.name(), i18n.Plural(v.Files, "%d file", "%d files"))
+		}
+	}
+	if !ok && !repair {
+		pterm.Info.Println("Run vira self verify --repair to download the damaged files again")
+	}
+	return ok, nil
+}
+
+// verifyToolchain compares the bin directory of an installed toolchain with
+// its record. Without a record, it only checks that the files of installed
+// components exist.
+func verifyToolchain(version string) (*verifiedToolchain, error) {
+	dir, err := toolchainDir(version)
+	if err != nil {
+		return nil, err
+	}
+	v := &verifiedToolchain{Toolchain: version, Problems: []fileProblem{}}
+	record, err := readFileRecord(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	v.Recorded = err == nil
+	expected := map[string]string{}
+	for name, sum := range record {
+		expected[name] = sum
+	}
+	if m, _, err := installedComponents(version); err == nil {
+		for _, c := range m.Components {
+			if !c.Installed {
+				continue
+			}
+			for _, f := range c.Files {
+				name := executableName(f)
+				if _, ok := expected[name]; !ok {
+					// Known to be needed, but with no sum to compare.
+					expected[name] = ""
+				}
+			}
+		}
+	}
+
+	bin := filepath.Join(dir, "bin")
+	for _, name := range sortedKeys(expected) {
+		file := filepath.Join(bin, name)
+		info, err := os.Stat(file)
+		if err != nil {
+			v.Problems = append(v.Problems, fileProblem{File: file, Problem: "missing"})
+			continue
+		}
+		v.Files++
+		if sum := expected[name]; sum != "" {
+			got, err := fileHash(file)
+			if err != nil {
+				return nil, err
+			}
+			if got != sum {
+				v.Problems = append(v.Problems, fileProblem{File: file, Problem: "modified"})
+				continue
+			}
+		}
+		if runtime.GOOS != "windows" && info.Mode()&0111 == 0 {
+			v.Problems = append(v.Problems, fileProblem{File: file, Problem: "not executable"})
+		}
+	}
+	if v.Recorded {
+		entries, err := os.ReadDir(bin)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		for _, e := range entries {
+			if _, ok := expected[e.Name()]; !ok {
+				v.Problems = append(v.Problems, fileProblem{File: filepath.Join(bin, e.Name()), Problem: "unexpected"})
+			}
+		}
+	}
+	return v, nil
+}
+
+// verifyShims compares the shims in the user bin directory with what
+// vira toolchain use writes.
+func verifyShims() (*verifiedToolchain, error) {
+	bin, err := userBinDir()
+	if err != nil {
+		return nil, err
+	}
+	v := &verifiedToolchain{Recorded: true, Problems: []fileProblem{}}
+	for _, name := range []string{"vira", "virac"} {
+		file, content := filepath.Join(bin, name), unixShim(name)
+		if runtime.GOOS == "windows" {
+			file, content = file+".cmd", windowsShim(name)
+		}
+		data, err := os.ReadFile(file)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			v.Problems = append(v.Problems, fileProblem{File: file, Problem: "missing"})
+			continue
+		case err != nil:
+			return nil, err
+		}
+		v.Files++
+		if string(data) != content {
+			v.Problems = append(v.Problems, fileProblem{File: file, Problem: "modified"})
+		}
+	}
+	return v, nil
+}
+
+// repairToolchainFiles downloads the files of a toolchain that v found
+// damaged again, or all of them if the toolchain has no record, and
+// deletes the files nobody installed.
+func repairToolchainFiles(version string, v *verifiedToolchain) error {
+	if offlineMode() {
+		return offlineError("repairing a toolchain")
+	}
+	dir, err := toolchainDir(version)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockPath(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var damaged map[string]bool
+	if v.Recorded {
+		damaged = map[string]bool{}
+		for _, p := range v.Problems {
+			name := filepath.Base(p.File)
+			if p.Problem == "unexpected" {
+				if err := os.Remove(p.File); err != nil && !errors.Is(err, os.ErrNotExist) {
+					return err
+				}
+				continue
+			}
+			damaged[name] = true
+		}
+		if len(damaged) == 0 {
+			return nil
+		}
+	}
+
+	pterm.Info.Printfln("Repairing toolchain %s", version)
+	if m, _, err := installedComponents(version); err == nil {
+		var names []string
+		for _, c := range m.Components {
+			if !c.Installed {
+				continue
+			}
+			for _, f := range c.Files {
+				if damaged == nil || damaged[executableName(f)] {
+					names = append(names, c.Name)
+					break
+				}
+			}
+		}
+		return m.install(version, dir, names)
+	}
+	file := "bin-" + runtime.GOOS + ".zip"
+	data, err := downloadRelease(version, file)
+	if err != nil {
+		return fmt.Errorf("failed to download toolchain %s: %v", version, err)
+	}
+	sums, err := unzipFiles(data, filepath.Join(dir, "bin"), damaged)
+	if err != nil {
+		return err
+	}
+	return recordFiles(dir, sums)
+}
+
+// readFileRecord reads the record of the toolchain in dir, mapping file
+// names in its bin directory to their SHA-256 sums.
+func readFileRecord(dir string) (map[string]string, error) {
+	f, err := os.Open(filepath.Join(dir, fileRecordName))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	record := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		sum, file, ok := strings.Cut(scanner.Text(), "  ")
+		if !ok {
+			continue
+		}
+		record[strings.TrimPrefix(file, "bin/")] = sum
+	}
+	return record, scanner.Err()
+}
+
+func writeFileRecord(dir string, record map[string]string) error {
+	var b bytes.Buffer
+	for _, name := range sortedKeys(record) {
+		fmt.Fprintf(&b, "%s  bin/%s\n", record[name], name)
+	}
+	return os.WriteFile(filepath.Join(dir, fileRecordName), b.Bytes(), 0644)
+}
+
+// recordFiles adds the sums of files unpacked into the bin directory of the
+// toolchain in dir to its record.
+func recordFiles(dir string, sums map[string]string) error {
+	record, err := readFileRecord(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		record = map[string]string{}
+	} else if err != nil {
+		return err
+	}
+	for name, sum := range sums {
+		record[name] = sum
+	}
+	return writeFileRecord(dir, record)
+}
+
+// forgetFiles removes files deleted from the bin directory of the
+// toolchain in dir from its record.
+func forgetFiles(dir string, names []string) error {
+	record, err := readFileRecord(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		delete(record, name)
+	}
+	return writeFileRecord(dir, record)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// semVersion is a semantic version. Build metadata is ignored.
+type semVersion struct {
+	Major, Minor, Patch int
+	Pre                 string
+}
+
+func parseVersion(s string) (semVersion, error) {
+	var v semVersion
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	s, _, _ = strings.Cut(s, "+")
+	s, v.Pre, _ = strings.Cut(s, "-")
+	parts := strings.Split(s, ".")
+	if len(parts) == 0 || len(parts) > 3 || parts[0] == "" {
+		return v, fmt.Errorf("invalid version %q", s)
+	}
+	nums := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("invalid version %q", s)
+		}
+		*nums[i] = n
+	}
+	return v, nil
+}
+
+func (v semVersion) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Pre != "" {
+		s += "-" + v.Pre
+	}
+	return s
+}
+
+// compare returns -1, 0 or 1. A pre-release sorts before its release.
+func (v semVersion) compare(o semVersion) int {
+	for _, d := range []int{v.Major - o.Major, v.Minor - o.Minor, v.Patch - o.Patch} {
+		if d != 0 {
+			if d < 0 {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case v.Pre == o.Pre:
+		return 0
+	case v.Pre == "":
+		return 1
+	case o.Pre == "":
+		return -1
+	case v.Pre < o.Pre:
+		return -1
+	}
+	return 1
+}
+
+// versionReq is a set of comparators that must all hold, such as
+// ">=1.2.0, <2.0.0". Caret, tilde and wildcard requirements are expanded
+// into comparators when parsed.
+type versionReq struct {
+	raw   string
+	preds []versionPred
+}
+
+type versionPred struct {
+	op string // one of = > >= < <=
+	v  semVersion
+}
+
+func (r versionReq) String() string {
+	return r.raw
+}
+
+// parseVersionReq parses a requirement. A bare version means a caret
+// requirement, as in "1.2" == "^1.2".
+func parseVersionReq(s string) (versionReq, error) {
+	req := versionReq{raw: strings.TrimSpace(s)}
+	if req.raw == "" || req.raw == "*" {
+		return req, nil
+	}
+	for _, part := range strings.Split(req.raw, ",") {
+		part = strings.TrimSpace(part)
+		preds, err := parseComparator(part)
+		if err != nil {
+			return req, fmt.Errorf("invalid version requirement %q: %v", s, err)
+		}
+		req.preds = append(req.preds, preds...)
+	}
+	return req, nil
+}
+
+func parseComparator(s string) ([]versionPred, error) {
+	op := ""
+	for _, candidate := range []string{">=", "<=", "^", "~", "=", ">", "<"} {
+		if strings.HasPrefix(s, candidate) {
+			op = candidate
+			s = strings.TrimSpace(s[len(candidate):])
+			break
+		}
+	}
+	// Count the given components; wildcards end the version early.
+	parts := strings.Split(s, ".")
+	given := 0
+	for _, p := range parts {
+		if p == "*" || p == "x" || p == "X" {
+			break
+		}
+		given++
+	}
+	if given == 0 {
+		if op != "" && op != "=" {
+			return nil, fmt.Errorf("wildcard cannot follow %s", op)
+		}
+		return nil, nil
+	}
+	v, err := parseVersion(strings.Join(parts[:given], "."))
+	if err != nil {
+		return nil, err
+	}
+
+	// upper returns the first version excluded when the first n components
+	// are kept fixed.
+	upper := func(n int) semVersion {
+		switch n {
+		case 1:
+			return semVersion{Major: v.Major + 1}
+		case 2:
+			return semVersion{Major: v.Major, Minor: v.Minor + 1}
+		}
+		return semVersion{Major: v.Major, Minor: v.Minor, Patch: v.Patch + 1}
+	}
+	lowerBound := versionPred{">=", v}
+
+	switch op {
+	case "", "^":
+		if given < 3 && wildcardIn(parts) {
+			return []versionPred{lowerBound, {"<", upper(given)}}, nil
+		}
+		// ^1.2.3 := >=1.2.3 <2.0.0, ^0.2.3 := >=0.2.3 <0.3.0,
+		// ^0.0.3 := >=0.0.3 <0.0.4, ^0.0 := >=0.0.0 <0.1.0.
+		switch {
+		case v.Major > 0 || given == 1:
+			return []versionPred{lowerBound, {"<", upper(1)}}, nil
+		case v.Minor > 0 || given == 2:
+			return []versionPred{lowerBound, {"<", upper(2)}}, nil
+		}
+		return []versionPred{lowerBound, {"<", upper(3)}}, nil
+	case "~":
+		if given == 1 {
+			return []versionPred{lowerBound, {"<", upper(1)}}, nil
+		}
+		return []versionPred{lowerBound, {"<", upper(2)}}, nil
+	case "=":
+		if given < 3 {
+			return []versionPred{lowerBound, {"<", upper(given)}}, nil
+		}
+		return []versionPred{{"=", v}}, nil
+	case ">":
+		if given < 3 {
+			return []versionPred{{">=", upper(given)}}, nil
+		}
+		return []versionPred{{">", v}}, nil
+	case "<=":
+		if given < 3 {
+			return []versionPred{{"<", upper(given)}}, nil
+		}
+	}
+	return []versionPred{{op, v}}, nil
+}
+
+func wildcardIn(parts []string) bool {
+	for _, p := range parts {
+		if p == "*" || p == "x" || p == "X" {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether v satisfies every comparator. Pre-releases only
+// match requirements that mention a pre-release of the same version.
+func (r versionReq) matches(v semVersion) bool {
+	if v.Pre != "" {
+		allowed := false
+		for _, p := range r.preds {
+			if p.v.Pre != "" && p.v.Major == v.Major && p.v.Minor == v.Minor && p.v.Patch == v.Patch {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	for _, p := range r.preds {
+		c := v.compare(p.v)
+		var ok bool
+		switch p.op {
+		case "=":
+			ok = c == 0
+		case ">":
+			ok = c > 0
+		case ">=":
+			ok = c >= 0
+		case "<":
+			ok = c < 0
+		case "<=":
+			ok = c <= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
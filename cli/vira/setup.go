@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+// setupMarker starts the blocks vira setup appends to shell profiles.
+const setupMarker = "# Added by vira setup"
+
+func newSetupCmd() *cobra.Command {
+	var toolchain string
+	var noModifyPath, noCompletions, noMan bool
+
+	cmd := &cobra.Command{
+		Use:         "setup",
+		Annotations: map[string]string{skipToolchain: "true"},
+		Short:       "Install Vira for the current user",
+		Long: `Install Vira for the current user from a standalone vira binary: download
+the toolchain, verify it against its published checksums, unpack it and make
+it the default, then put the user bin directory (~/.local/bin on Linux,
+~/.vira/bin elsewhere) on PATH in the shell profiles and install shell
+completions and man pages.
+
+Changing PATH is asked for first; without a terminal, PATH is left alone
+unless --yes is given. By default the latest stable toolchain is installed;
+--toolchain picks a version or the nightly channel. Running setup again is
+safe: profiles that were already changed are left alone.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setup(cmd.Root(), toolchain, !noModifyPath, !noCompletions, !noMan); err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+		},
+	}
+	cmd.Flags().StringVar(&toolchain, "toolchain", channelStable, "toolchain version or channel to install")
+	cmd.Flags().BoolVar(&noModifyPath, "no-modify-path", false, "do not change PATH in the shell profiles")
+	cmd.Flags().BoolVar(&noCompletions, "no-completions", false, "do not install shell completions")
+	cmd.Flags().BoolVar(&noMan, "no-man", false, "do not install man pages")
+	return cmd
+}
+
+func setup(root *cobra.Command, toolchain string, modifyPath, completions, man bool) error {
+	data, err := dataDir()
+	if err != nil {
+		return err
+	}
+	bin, err := userBinDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		return err
+	}
+	pterm.DefaultSection.Println("Setting up Vira")
+
+	var profiles []shellProfile
+	if completions {
+		if profiles, err = writeCompletions(root, data); err != nil {
+			return fmt.Errorf("installing shell completions: %v", err)
+		}
+	}
+	if modifyPath && !onPath(bin) && !confirm("Add "+bin+" to PATH in your shell profiles?", false) {
+		modifyPath = false
+	}
+	if modifyPath {
+		changed, err := addToPath(bin, profiles)
+		if err != nil {
+			return fmt.Errorf("adding %s to PATH: %v", bin, err)
+		}
+		for _, file := range changed {
+			pterm.Success.Printfln("Added %s to PATH in %s", bin, file)
+		}
+	}
+	if !onPath(bin) && modifyPath {
+		// The profiles only take effect in new shells; the shims are
+		// written for this one too.
+		os.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	}
+
+	version, err := installToolchain(toolchain, nil)
+	if err != nil {
+		return err
+	}
+	channel := ""
+	if isChannel(toolchain) {
+		channel = toolchain
+	}
+	if err := setDefaultToolchain(version, channel); err != nil {
+		return err
+	}
+
+	if man {
+		dir, err := manDir()
+		if err != nil {
+			return err
+		}
+		if _, err := writeManPages(root, dir); err != nil {
+			return fmt.Errorf("installing man pages: %v", err)
+		}
+		pterm.Success.Println("Installed man pages to " + dir)
+	}
+
+	pterm.Success.Printfln("Vira %s is installed", version)
+	if modifyPath && runtime.GOOS != "windows" {
+		pterm.Info.Println("Restart your shell, or run: export PATH=\"" + bin + ":$PATH\"")
+	} else if !modifyPath {
+		pterm.Info.Printfln("Add %s to PATH to use it", bin)
+	}
+	return nil
+}
+
+// shellProfile is a startup file of a shell that vira setup extends, with
+// the line that loads the completions for that shell, if any.
+type shellProfile struct {
+	file       string
+	completion string
+}
+
+// writeCompletions writes completion scripts for bash, zsh, fish and
+// PowerShell below data and returns the profiles that should load them.
+func writeCompletions(root *cobra.Command, data string) ([]shellProfile, error) {
+	dir := filepath.Join(data, "completions")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	userHome, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	var profiles []shellProfile
+	write := func(file string, gen func(*bytes.Buffer) error) error {
+		var buf bytes.Buffer
+		if err := gen(&buf); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(file, buf.Bytes(), 0644)
+	}
+
+	if runtime.GOOS == "windows" {
+		file := filepath.Join(dir, "vira.ps1")
+		if err := write(file, func(b *bytes.Buffer) error { return root.GenPowerShellCompletionWithDesc(b) }); err != nil {
+			return nil, err
+		}
+		pterm.Success.Println("Installed PowerShell completions to " + file)
+		pterm.Info.Println("Add . \"" + file + "\" to your PowerShell $PROFILE to load them")
+		return nil, nil
+	}
+
+	bash := filepath.Join(dir, "vira.bash")
+	if err := write(bash, func(b *bytes.Buffer) error { return root.GenBashCompletionV2(b, true) }); err != nil {
+		return nil, err
+	}
+	profiles = append(profiles, shellProfile{filepath.Join(userHome, ".bashrc"), `[ -f "` + bash + `" ] && . "` + bash + `"`})
+
+	zsh := filepath.Join(dir, "vira.zsh")
+	if err := write(zsh, func(b *bytes.Buffer) error { return root.GenZshCompletion(b) }); err != nil {
+		return nil, err
+	}
+	profiles = append(profiles, shellProfile{zshrc(userHome), `[ -f "` + zsh + `" ] && (( $+functions[compdef] )) && . "` + zsh + `"`})
+
+	// fish loads completions from its own directory by itself.
+	if usesFish(userHome) {
+		fish := filepath.Join(userHome, ".config", "fish", "completions", "vira.fish")
+		if err := write(fish, func(b *bytes.Buffer) error { return root.GenFishCompletion(b, true) }); err != nil {
+			return nil, err
+		}
+	}
+	pterm.Success.Println("Installed shell completions to " + dir)
+	return profiles, nil
+}
+
+func usesFish(userHome string) bool {
+	_, err := os.Stat(filepath.Join(userHome, ".config", "fish"))
+	return err == nil || filepath.Base(os.Getenv("SHELL")) == "fish"
+}
+
+func zshrc(userHome string) string {
+	if zdot := os.Getenv("ZDOTDIR"); zdot != "" {
+		return filepath.Join(zdot, ".zshrc")
+	}
+	return filepath.Join(userHome, ".zshrc")
+}
+
+// addToPath puts bin on PATH for new shells and returns the files it
+// changed. On Unix it appends to the profiles of the shells in use; on
+// Windows it changes the user's PATH environment variable.
+func addToPath(bin string, profiles []shellProfile) ([]string, error) {
+	if runtime.GOOS == "windows" {
+		return addToWindowsPath(bin)
+	}
+	userHome, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	if profiles == nil {
+		profiles = []shellProfile{{file: filepath.Join(userHome, ".bashrc")}, {file: zshrc(userHome)}}
+	}
+	profiles = append(profiles, shellProfile{file: filepath.Join(userHome, ".profile")})
+
+	shell := filepath.Base(os.Getenv("SHELL"))
+	export := `export PATH="` + bin + `:$PATH"`
+	var changed []string
+	for _, p := range profiles {
+		// Profiles of shells that are neither installed for the user
+		// nor the login shell are not created.
+		name := strings.TrimPrefix(filepath.Base(p.file), ".")
+		if _, err := os.Stat(p.file); err != nil && name != "profile" && name != shell+"rc" {
+			continue
+		}
+		lines := []string{export}
+		if p.completion != "" {
+			lines = append(lines, p.completion)
+		}
+		ok, err := appendToProfile(p.file, lines)
+		if err != nil {
+			return changed, err
+		}
+		if ok {
+			changed = append(changed, p.file)
+		}
+	}
+
+	if usesFish(userHome) {
+		file := filepath.Join(userHome, ".config", "fish", "conf.d", "vira.fish")
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return changed, err
+		}
+		ok, err := appendToProfile(file, []string{`contains "` + bin + `" $PATH; or set -gx PATH "` + bin + `" $PATH`})
+		if err != nil {
+			return changed, err
+		}
+		if ok {
+			changed = append(changed, file)
+		}
+	}
+	return changed, nil
+}
+
+// appendToProfile appends the lines that file does not have yet under
+// setupMarker. It reports whether the file changed.
+func appendToProfile(file string, lines []string) (bool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	var missing []string
+	for _, line := range lines {
+		if !bytes.Contains(data, []byte(line)) {
+			missing = append(missing, line)
+		}
+	}
+	if len(missing) == 0 {
+		return false, nil
+	}
+	block := setupMarker + "\n" + strings.Join(missing, "\n") + "\n"
+	if len(data) > 0 {
+		block = "\n" + block
+		if !bytes.HasSuffix(data, []byte("\n")) {
+			block = "\n" + block
+		}
+	}
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	_, err = f.WriteString(block)
+	return err == nil, err
+}
+
+func addToWindowsPath(bin string) ([]string, error) {
+	out, err := exec.Command("powershell", "-NoProfile", "-Command", "[Environment]::GetEnvironmentVariable('Path', 'User')").Output()
+	if err != nil {
+		return nil, err
+	}
+	current := strings.TrimSpace(string(out))
+	for _, p := range filepath.SplitList(current) {
+		if strings.EqualFold(filepath.Clean(p), filepath.Clean(bin)) {
+			return nil, nil
+		}
+	}
+	value := bin
+	if current != "" {
+		value += ";" + current
+	}
+	script := "[Environment]::SetEnvironmentVariable('Path', '" + strings.ReplaceAll(value, "'", "''") + "', 'User')"
+	if err := exec.Command("powershell", "-NoProfile", "-Command", script).Run(); err != nil {
+		return nil, err
+	}
+	return []string{"the user PATH environment variable"}, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"vira/pkg/interrupt"
+)
+
+// signingPasswordEnv holds the password of the Authenticode certificate
+// file or the passphrase of the GPG key.
+const signingPasswordEnv = "VIRA_SIGNING_PASSWORD"
+
+// signing returns the signing configuration of profile, or nil if its
+// executables are not signed.
+func (p *project) signing(profile string) *SigningConfig {
+	return p.manifest.Profiles[profile].Signing
+}
+
+// signaturePath returns where the detached signature of exe, built for
+// target, goes, or "" where signatures are part of the executable.
+func signaturePath(target *crossTarget, exe string) string {
+	switch target.goos() {
+	case "windows", "darwin":
+		return ""
+	}
+	return exe + ".asc"
+}
+
+// signExecutable signs exe, built for target, as cfg asks.
+func (p *project) signExecutable(cfg *SigningConfig, target *crossTarget, exe string) error {
+	password := os.Getenv(signingPasswordEnv)
+	switch target.goos() {
+	case "windows":
+		return p.signAuthenticode(cfg, exe, password)
+	case "darwin":
+		if runtime.GOOS != "darwin" {
+			return errors.New("macOS executables are signed with codesign, which only runs on macOS")
+		}
+		if cfg.Identity == "" {
+			return errors.New("signing with codesign needs an identity in the signing configuration")
+		}
+		args := []string{"--force", "--sign", cfg.Identity}
+		if cfg.Keychain != "" {
+			args = append(args, "--keychain", p.manifestPath(cfg.Keychain))
+		}
+		if cfg.TimestampURL != "" {
+			args = append(args, "--timestamp="+cfg.TimestampURL)
+		}
+		return runSigner(exe, "", "codesign", append(args, exe)...)
+	}
+	signature := signaturePath(target, exe)
+	args := []string{"--batch", "--yes", "--detach-sign", "--armor", "--output", signature}
+	if cfg.Identity != "" {
+		args = append(args, "--local-user", cfg.Identity)
+	}
+	if password != "" {
+		// The passphrase is read from stdin rather than asked for.
+		args = append(args, "--pinentry-mode", "loopback", "--passphrase-fd", "0")
+	}
+	defer interrupt.Cleanup(func() { os.Remove(signature) })()
+	return runSigner(exe, password, "gpg", append(args, exe)...)
+}
+
+// signAuthenticode signs exe with signtool on Windows, or osslsigncode
+// elsewhere, with the certificate file or, for signtool only, from the
+// certificate store.
+func (p *project) signAuthenticode(cfg *SigningConfig, exe, password string) error {
+	if runtime.GOOS == "windows" {
+		args := []string{"sign", "/fd", "sha256"}
+		switch {
+		case cfg.Certificate != "":
+			args = append(args, "/f", p.manifestPath(cfg.Certificate))
+			if password != "" {
+				args = append(args, "/p", password)
+			}
+		case cfg.Identity != "":
+			args = append(args, "/n", cfg.Identity)
+		default:
+			// The best certificate of the store.
+			args = append(args, "/a")
+		}
+		if cfg.TimestampURL != "" {
+			args = append(args, "/tr", cfg.TimestampURL, "/td", "sha256")
+		}
+		return runSigner(exe, "", "signtool", append(args, exe)...)
+	}
+
+	if cfg.Certificate == "" {
+		return errors.New("signing Windows executables outside Windows needs a certificate file in the signing configuration")
+	}
+	signed := exe + ".signed"
+	args := []string{"sign", "-pkcs12", p.manifestPath(cfg.Certificate), "-h", "sha256"}
+	if password != "" {
+		args = append(args, "-pass", password)
+	}
+	if cfg.TimestampURL != "" {
+		args = append(args, "-ts", cfg.TimestampURL)
+	}
+	defer interrupt.Cleanup(func() { os.Remove(signed) })()
+	if err := runSigner(exe, "", "osslsigncode", append(args, "-in", exe, "-out", signed)...); err != nil {
+		os.Remove(signed)
+		return err
+	}
+	return os.Rename(signed, exe)
+}
+
+// manifestPath resolves a path of the manifest, which is relative to it.
+func (p *project) manifestPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(p.root, path)
+}
+
+// runSigner runs the signing tool next to exe, with stdin as its input. The
+// password is kept out of the log.
+func runSigner(exe, stdin, tool string, args ...string) error {
+	path, err := exec.LookPath(tool)
+	if err != nil {
+		return fmt.Errorf("signing %s needs %s on PATH", filepath.Base(exe), tool)
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Dir = filepath.Dir(exe)
+	cmd.Stdin = strings.NewReader(stdin)
+	line := strings.Join(cmd.Args, " ")
+	if password := os.Getenv(signingPasswordEnv); password != "" {
+		line = strings.ReplaceAll(line, password, "***")
+	}
+	logf("sign: running %s", line)
+	out, err := interrupt.CombinedOutput(cmd)
+	if err != nil {
+		return &stageError{stage: "signing", output: string(out), err: err}
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"vira/pkg/logging"
+)
+
+func newStatsCmd() *cobra.Command {
+	var files bool
+
+	cmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Count the lines, files and functions of the project",
+		Long: `Count the lines, files, functions and macros of the project's sources,
+in total and for each module, a directory below src. --files lists every
+file as well; with --json the same numbers are printed for dashboards.
+
+Functions are counted in the parse tree plsa prints for each compilation
+unit when the toolchain has it, so that only real definitions count.
+Files that do not parse, or all of them without the toolchain, are
+scanned as the language server does instead.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			proj, err := loadProject(".")
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			stats, err := proj.stats()
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			if jsonOutput {
+				if err := printJSON(stats); err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+				return
+			}
+			printStats(stats, files)
+		},
+	}
+	cmd.Flags().BoolVar(&files, "files", false, "also list the numbers of every file")
+	return cmd
+}
+
+// sourceStats are the numbers of a file, a module or the whole project.
+type sourceStats struct {
+	Files     int `json:"files"`
+	Lines     int `json:"lines"`
+	Code      int `json:"code"`
+	Blank     int `json:"blank"`
+	Functions int `json:"functions"`
+	Macros    int `json:"macros"`
+}
+
+func (s *sourceStats) add(o sourceStats) {
+	s.Files += o.Files
+	s.Lines += o.Lines
+	s.Code += o.Code
+	s.Blank += o.Blank
+	s.Functions += o.Functions
+	s.Macros += o.Macros
+}
+
+type fileStats struct {
+	File   string `json:"file"`
+	Module string `json:"module"`
+	sourceStats
+	// Parsed is whether functions were counted in the parse tree rather
+	// than by scanning.
+	Parsed bool `json:"parsed"`
+}
+
+type moduleStats struct {
+	Module string `json:"module"`
+	sourceStats
+}
+
+// projectStats is what vira stats --json prints.
+type projectStats struct {
+	Package string `json:"package"`
+	sourceStats
+	Modules []moduleStats `json:"modules"`
+	Sources []fileStats   `json:"sources"`
+}
+
+func (p *project) stats() (*projectStats, error) {
+	files, err := p.sourceFiles()
+	if err != nil {
+		return nil, err
+	}
+	parsed := p.parsedFunctions()
+	stats := &projectStats{Package: p.manifest.Package.Name, Modules: []moduleStats{}, Sources: []fileStats{}}
+	modules := map[string]*moduleStats{}
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		fs := fileStats{File: p.rel(file), Module: p.module(file), sourceStats: countLines(string(src))}
+		fs.Files = 1
+		for _, sym := range scanSymbols(string(src)) {
+			if sym.kind == symMacro {
+				fs.Macros++
+			} else {
+				fs.Functions++
+			}
+		}
+		if functions, ok := parsed[file]; ok {
+			fs.Functions, fs.Parsed = len(functions), true
+		}
+		stats.Sources = append(stats.Sources, fs)
+		stats.add(fs.sourceStats)
+		if modules[fs.Module] == nil {
+			modules[fs.Module] = &moduleStats{Module: fs.Module}
+		}
+		modules[fs.Module].add(fs.sourceStats)
+	}
+	for _, name := range sortedKeys(modules) {
+		stats.Modules = append(stats.Modules, *modules[name])
+	}
+	return stats, nil
+}
+
+// module names the module of a source file: its directory below src, or
+// "." for files directly in it.
+func (p *project) module(file string) string {
+	rel, err := filepath.Rel(p.srcDir(), filepath.Dir(file))
+	if err != nil {
+		return "."
+	}
+	return filepath.ToSlash(rel)
+}
+
+// parsedFunctions parses every compilation unit and returns the functions
+// defined in each file the units read, by their positions. Files of units
+// that do not parse have no entry. It returns nil when the toolchain
+// cannot parse.
+func (p *project) parsedFunctions() map[string]map[string]bool {
+	if len(checkTools("preprocessor", "plsa")) > 0 {
+		return nil
+	}
+	units, err := p.compilationUnits()
+	if err != nil {
+		return nil
+	}
+	functions := map[string]map[string]bool{}
+	for _, unit := range units {
+		root, err := parseAST(unit)
+		if err != nil {
+			logging.Debug("counting functions by scanning", "file", p.rel(unit), "err", err)
+			continue
+		}
+		var walk func(n *astNode)
+		walk = func(n *astNode) {
+			if n.Kind == "Function" {
+				file, err := filepath.Abs(n.File)
+				if err == nil {
+					if functions[file] == nil {
+						functions[file] = map[string]bool{}
+					}
+					// A file included by several units is counted once.
+					functions[file][strconv.Itoa(n.Line)+":"+strconv.Itoa(n.Column)] = true
+				}
+			}
+			for _, c := range n.Children {
+				walk(c)
+			}
+		}
+		walk(root)
+		// A unit that defines no function has none rather than no entry.
+		if unit, err := filepath.Abs(unit); err == nil && functions[unit] == nil {
+			functions[unit] = map[string]bool{}
+		}
+	}
+	return functions
+}
+
+// countLines counts the lines of src, telling blank ones from code.
+func countLines(src string) sourceStats {
+	var s sourceStats
+	if src == "" {
+		return s
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(src, "\n"), "\n") {
+		s.Lines++
+		if strings.TrimSpace(line) == "" {
+			s.Blank++
+		} else {
+			s.Code++
+		}
+	}
+	return s
+}
+
+func printStats(stats *projectStats, files bool) {
+	header := []string{"Files", "Lines", "Code", "Blank", "Functions", "Macros"}
+	row := func(name string, s sourceStats) []string {
+		return []string{name, strconv.Itoa(s.Files), strconv.Itoa(s.Lines), strconv.Itoa(s.Code), strconv.Itoa(s.Blank), strconv.Itoa(s.Functions), strconv.Itoa(s.Macros)}
+	}
+	data := pterm.TableData{append([]string{"Module"}, header...)}
+	for _, m := range stats.Modules {
+		data = append(data, row(m.Module, m.sourceStats))
+	}
+	data = append(data, row("Total", stats.sourceStats))
+	pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+
+	if files {
+		data := pterm.TableData{append([]string{"File"}, header[1:]...)}
+		for _, f := range stats.Sources {
+			r := row(f.File, f.sourceStats)
+			data = append(data, append(r[:1:1], r[2:]...))
+		}
+		pterm.Println()
+		pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+	}
+}
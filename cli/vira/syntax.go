@@ -0,0 +1,238 @@
+package main
+
+import (
+	"strings"
+)
+
+// The lexer below mirrors the one in plsa closely enough for editor
+// features. Unlike plsa it never fails: unknown characters become
+// tokInvalid tokens so a half-typed buffer can still be indexed.
+
+type tokenKind int
+
+const (
+	tokIdentifier tokenKind = iota
+	tokKeyword
+	tokNumber
+	tokString
+	tokPunct
+	tokDirective
+	tokInvalid
+)
+
+var viraKeywords = []string{"int", "return", "if", "else", "while", "for"}
+
+// viraTypes are the keywords that name a type.
+var viraTypes = []string{"int"}
+
+const viraPunctuators = "+-*/=();{}[]<>,&|!"
+
+type token struct {
+	kind   tokenKind
+	text   string
+	line   int // 1-based
+	column int // 1-based, in bytes
+	offset int
+}
+
+func (t token) end() int {
+	return t.column + len(t.text)
+}
+
+func isKeyword(s string) bool {
+	for _, k := range viraKeywords {
+		if s == k {
+			return true
+		}
+	}
+	return false
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || c >= '0' && c <= '9'
+}
+
+func tokenize(src string) []token {
+	var toks []token
+	line, col := 1, 1
+	atLineStart := true
+	for i := 0; i < len(src); {
+		c := src[i]
+		start := token{line: line, column: col, offset: i}
+		switch {
+		case c == '\n':
+			i++
+			line++
+			col = 1
+			atLineStart = true
+			continue
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+			col++
+			continue
+		case c == '#' && atLineStart:
+			j := i
+			for j < len(src) && src[j] != '\n' {
+				j++
+			}
+			start.kind = tokDirective
+			start.text = strings.TrimRight(src[i:j], "\r")
+		case isIdentStart(c):
+			j := i
+			for j < len(src) && isIdentChar(src[j]) {
+				j++
+			}
+			start.text = src[i:j]
+			start.kind = tokIdentifier
+			if isKeyword(start.text) {
+				start.kind = tokKeyword
+			}
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(src) && src[j] >= '0' && src[j] <= '9' {
+				j++
+			}
+			start.kind = tokNumber
+			start.text = src[i:j]
+		case c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' && src[j] != '\n' {
+				j++
+			}
+			if j < len(src) && src[j] == '"' {
+				j++
+			}
+			start.kind = tokString
+			start.text = src[i:j]
+		case strings.IndexByte(viraPunctuators, c) >= 0:
+			start.kind = tokPunct
+			start.text = src[i : i+1]
+		default:
+			start.kind = tokInvalid
+			start.text = src[i : i+1]
+		}
+		atLineStart = false
+		i += len(start.text)
+		col += len(start.text)
+		toks = append(toks, start)
+	}
+	return toks
+}
+
+type symbolKind int
+
+const (
+	symFunction symbolKind = iota
+	symMacro
+)
+
+// symbol is a top-level declaration found in a source file.
+type symbol struct {
+	name   string
+	kind   symbolKind
+	detail string
+	// Position of the name.
+	line, column int
+	// Extent of the whole declaration; endLine/endColumn are exclusive.
+	startLine, startColumn int
+	endLine, endColumn     int
+}
+
+// scanSymbols finds function definitions ("int name() { ... }") and
+// #define macros in src.
+func scanSymbols(src string) []symbol {
+	toks := tokenize(src)
+	var syms []symbol
+	for i := 0; i < len(toks); i++ {
+		t := toks[i]
+		if t.kind == tokDirective {
+			fields := strings.Fields(strings.TrimSpace(strings.TrimPrefix(t.text, "#")))
+			if len(fields) >= 2 && fields[0] == "define" {
+				sym := symbol{
+					name:        fields[1],
+					kind:        symMacro,
+					detail:      strings.TrimSpace(t.text),
+					line:        t.line,
+					column:      t.column + strings.Index(t.text, fields[1]),
+					startLine:   t.line,
+					startColumn: t.column,
+					endLine:     t.line,
+					endColumn:   t.end(),
+				}
+				syms = append(syms, sym)
+			}
+			continue
+		}
+		if t.kind != tokKeyword || t.text != "int" || i+2 >= len(toks) {
+			continue
+		}
+		name, open := toks[i+1], toks[i+2]
+		if name.kind != tokIdentifier || open.text != "(" {
+			continue
+		}
+		sym := symbol{
+			name:        name.text,
+			kind:        symFunction,
+			detail:      "int " + name.text + "()",
+			line:        name.line,
+			column:      name.column,
+			startLine:   t.line,
+			startColumn: t.column,
+			endLine:     name.line,
+			endColumn:   name.end(),
+		}
+		// Extend the symbol to the brace closing its body.
+		depth := 0
+		for j := i + 3; j < len(toks); j++ {
+			if toks[j].text == "{" {
+				depth++
+			} else if toks[j].text == "}" {
+				depth--
+				if depth == 0 {
+					sym.endLine, sym.endColumn = toks[j].line, toks[j].end()
+					i = j
+					break
+				}
+			}
+		}
+		syms = append(syms, sym)
+	}
+	return syms
+}
+
+// scanMacros returns the #define macros of src, which the preprocessor
+// consumes and the parse tree never has.
+func scanMacros(src string) []symbol {
+	var macros []symbol
+	for _, sym := range scanSymbols(src) {
+		if sym.kind == symMacro {
+			macros = append(macros, sym)
+		}
+	}
+	return macros
+}
+
+// wordAt returns the identifier touching the 1-based line and column.
+func wordAt(src string, line, column int) string {
+	lines := strings.Split(src, "\n")
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	text := lines[line-1]
+	i := column - 1
+	if i > len(text) {
+		i = len(text)
+	}
+	start, end := i, i
+	for start > 0 && isIdentChar(text[start-1]) {
+		start--
+	}
+	for end < len(text) && isIdentChar(text[end]) {
+		end++
+	}
+	return text[start:end]
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"vira/pkg/interrupt"
+)
+
+func newTaskCmd() *cobra.Command {
+	var release bool
+	var jobs int
+
+	cmd := &cobra.Command{
+		Use:   "task [name...]",
+		Short: "Run tasks from the [tasks] section of vira.toml",
+		Long: `Run the named tasks of the [tasks] section of vira.toml, or list them
+without a name. A task is a command, or a table with the commands to run
+one after another (run), the tasks that must succeed first (depends) and
+a description:
+
+    [tasks]
+    lint = "vira lint"
+    docs = { run = ["vira build", "./gen-docs.sh"], depends = ["lint"] }
+    all = { depends = ["lint", "docs"], description = "everything CI runs" }
+
+Commands run in the shell, sh or cmd on Windows, in the project root.
+Tasks whose dependencies have succeeded run in parallel, up to --jobs at
+once, with the output of each line prefixed by its task; the first task
+to fail stops the others from starting. Besides vira on PATH, commands get
+the locations of the build in the environment: VIRA_PROFILE,
+VIRA_TARGET_DIR and VIRA_EXECUTABLE, for the release profile with
+--release, as well as VIRA and VIRA_MANIFEST_PATH.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			proj, err := loadProject(".")
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			if len(args) == 0 {
+				if err := listTasks(proj); err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+				return
+			}
+			if jobs <= 0 {
+				jobs = runtime.NumCPU()
+			}
+			code, err := proj.runTasks(args, buildOptions{release: release}, jobs)
+			if err != nil {
+				pterm.Error.Println(err)
+			}
+			if code != 0 {
+				exit(code)
+			}
+		},
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			proj, err := loadProject(".")
+			if err != nil {
+				return nil, cobra.ShellCompDirectiveNoFileComp
+			}
+			return sortedKeys(proj.manifest.Tasks), cobra.ShellCompDirectiveNoFileComp
+		},
+	}
+	cmd.Flags().BoolVar(&release, "release", false, "point the build locations at the release profile")
+	cmd.Flags().IntVarP(&jobs, "jobs", "j", 0, "run this many tasks at once (one per CPU by default)")
+	return cmd
+}
+
+// taskInfo is an entry of what vira task --json lists.
+type taskInfo struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Run         []string `json:"run"`
+	Depends     []string `json:"depends"`
+}
+
+func listTasks(p *project) error {
+	names := sortedKeys(p.manifest.Tasks)
+	if jsonOutput {
+		tasks := []taskInfo{}
+		for _, name := range names {
+			t := p.manifest.Tasks[name]
+			info := taskInfo{Name: name, Description: t.Description, Run: t.Run, Depends: t.Depends}
+			if info.Run == nil {
+				info.Run = []string{}
+			}
+			if info.Depends == nil {
+				info.Depends = []string{}
+			}
+			tasks = append(tasks, info)
+		}
+		return printJSON(tasks)
+	}
+	if len(names) == 0 {
+		pterm.Info.Printfln("%s has no [tasks]", manifestName)
+		return nil
+	}
+	data := pterm.TableData{{"Task", "Depends on", "Description"}}
+	for _, name := range names {
+		t := p.manifest.Tasks[name]
+		desc := t.Description
+		if desc == "" {
+			desc = strings.Join(t.Run, " && ")
+		}
+		data = append(data, []string{name, strings.Join(t.Depends, ", "), desc})
+	}
+	return pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+}
+
+// taskPlan returns the tasks that running names takes, which are names and
+// everything they depend on, in an order where dependencies come first.
+func (p *project) taskPlan(names []string) ([]string, error) {
+	var plan []string
+	state := map[string]int{} // 1 while visiting, 2 when done
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("the tasks depend on each other in a cycle: %s", strings.Join(append(path, name), " -> "))
+		case 2:
+			return nil
+		}
+		t, ok := p.manifest.Tasks[name]
+		if !ok {
+			if len(path) > 0 {
+				return fmt.Errorf("task %s depends on %s, which is not in [tasks]", path[len(path)-1], name)
+			}
+			return fmt.Errorf("there is no task %s in %s", name, manifestName)
+		}
+		state[name] = 1
+		for _, dep := range t.Depends {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		plan = append(plan, name)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+// runTasks runs names and their dependencies, up to jobs at once, and
+// returns the exit code of the first command that failed.
+func (p *project) runTasks(names []string, opts buildOptions, jobs int) (int, error) {
+	plan, err := p.taskPlan(names)
+	if err != nil {
+		return 1, err
+	}
+	env := p.taskEnv(opts)
+	// Output is only told apart when tasks can run at the same time.
+	var outMu sync.Mutex
+	prefix := jobs > 1 && len(plan) > 1
+	width := 0
+	for _, name := range plan {
+		width = max(width, len(name))
+	}
+
+	type result struct {
+		name string
+		code int
+		err  error
+	}
+	done := map[string]bool{}
+	started := map[string]bool{}
+	results := make(chan result)
+	running := 0
+	failed := result{}
+	for {
+		for _, name := range plan {
+			if running >= jobs || failed.name != "" {
+				break
+			}
+			if started[name] || !tasksDone(p.manifest.Tasks[name].Depends, done) {
+				continue
+			}
+			started[name] = true
+			running++
+			var stdout, stderr io.Writer = os.Stdout, os.Stderr
+			if prefix {
+				label := fmt.Sprintf("%-*s | ", width, name)
+				stdout = &prefixWriter{mu: &outMu, w: os.Stdout, prefix: label}
+				stderr = &prefixWriter{mu: &outMu, w: os.Stderr, prefix: label}
+			}
+			go func(name string) {
+				code, err := runTask(name, p.manifest.Tasks[name], p.root, env, stdout, stderr)
+				results <- result{name, code, err}
+			}(name)
+		}
+		if running == 0 {
+			break
+		}
+		r := <-results
+		running--
+		if r.code != 0 || r.err != nil {
+			if failed.name == "" {
+				failed = r
+			}
+			continue
+		}
+		done[r.name] = true
+	}
+	if failed.name != "" {
+		if failed.err == nil {
+			failed.err = fmt.Errorf("task %s failed with exit status %d", failed.name, failed.code)
+		}
+		return failed.code, failed.err
+	}
+	return 0, nil
+}
+
+func tasksDone(names []string, done map[string]bool) bool {
+	for _, name := range names {
+		if !done[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// runTask runs the commands of t one after another, stopping at the first
+// that fails, and returns its exit code.
+func runTask(name string, t Task, dir string, env []string, stdout, stderr io.Writer) (int, error) {
+	for _, line := range t.Run {
+		pterm.Info.Printfln("%s: %s", name, line)
+		cmd := shellCommand(line)
+		cmd.Dir = dir
+		cmd.Env = append(env, "VIRA_TASK="+name)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, stdout, stderr
+		err := interrupt.Start(cmd)
+		if err == nil {
+			err = interrupt.Wait(cmd)
+		}
+		for _, w := range []io.Writer{stdout, stderr} {
+			if pw, ok := w.(*prefixWriter); ok {
+				pw.flush()
+			}
+		}
+		if code, err := commandExitCode(err); code != 0 || err != nil {
+			if err != nil {
+				err = fmt.Errorf("task %s: %v", name, err)
+			}
+			return code, err
+		}
+	}
+	return 0, nil
+}
+
+// shellCommand returns the command that runs line in the shell.
+func shellCommand(line string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", line)
+	}
+	return exec.Command("sh", "-c", line)
+}
+
+// taskEnv is the environment of task commands: that of vira, with vira
+// itself first on PATH and the locations of the build the options describe.
+func (p *project) taskEnv(opts buildOptions) []string {
+	env := os.Environ()
+	if self, err := os.Executable(); err == nil {
+		env = append(env, "VIRA="+self, "PATH="+filepath.Dir(self)+string(os.PathListSeparator)+os.Getenv("PATH"))
+	}
+	return append(env,
+		"VIRA_MANIFEST_PATH="+filepath.Join(p.root, manifestName),
+		"VIRA_PROFILE="+opts.profile(),
+		"VIRA_TARGET_DIR="+p.targetDir(opts.outputDir()),
+		"VIRA_EXECUTABLE="+p.executable(opts.outputDir(), nil),
+	)
+}
+
+// prefixWriter writes every line to w with prefix in front of it, keeping
+// the lines of several writers sharing mu whole.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (pw *prefixWriter) Write(b []byte) (int, error) {
+	pw.buf = append(pw.buf, b...)
+	for {
+		i := bytes.IndexByte(pw.buf, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		pw.mu.Lock()
+		_, err := fmt.Fprintf(pw.w, "%s%s", pw.prefix, pw.buf[:i+1])
+		pw.mu.Unlock()
+		pw.buf = pw.buf[i+1:]
+		if err != nil {
+			return len(b), err
+		}
+	}
+}
+
+// flush writes what is left of a last line without a newline.
+func (pw *prefixWriter) flush() {
+	if len(pw.buf) > 0 {
+		pw.Write([]byte("\n"))
+	}
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"vira/pkg/interrupt"
+	"vira/pkg/logging"
+)
+
+// Telemetry is off unless the user turns it on with vira telemetry on.
+// While it is on, every command appends one event to telemetry.jsonl in the
+// data directory: the name of the command without its arguments, how long
+// it ran, its exit status and the class of its error. Nothing is sent
+// anywhere until the user runs vira telemetry upload.
+
+// maxTelemetrySize bounds the local log; once it grows past this, the older
+// half of the events is dropped.
+const maxTelemetrySize = 1 << 20
+
+// telemetryEvent is one line of telemetry.jsonl.
+type telemetryEvent struct {
+	Time     time.Time `json:"time"`
+	Command  string    `json:"command"`
+	Duration int64     `json:"duration_ms"`
+	ExitCode int       `json:"exit_code,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	OS       string    `json:"os"`
+	Arch     string    `json:"arch"`
+}
+
+// telemetryRecording is a command being recorded.
+type telemetryRecording struct {
+	command    string
+	start      time.Time
+	errorClass string
+}
+
+// telemetryRun is the command being recorded, or nil when telemetry is off.
+var telemetryRun *telemetryRecording
+
+// startTelemetry starts recording cmd if telemetry is on.
+func startTelemetry(cmd *cobra.Command) {
+	for c := cmd; c != nil; c = c.Parent() {
+		if c.Name() == "telemetry" {
+			return
+		}
+	}
+	cfg, err := loadGlobalConfig()
+	if err != nil || !cfg.Telemetry.Enabled {
+		return
+	}
+	name := strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name())
+	telemetryRun = &telemetryRecording{command: strings.TrimSpace(name), start: time.Now()}
+}
+
+// noteTelemetryError records the class of the error a command fails with.
+func noteTelemetryError(err error) {
+	if telemetryRun != nil && telemetryRun.errorClass == "" {
+		telemetryRun.errorClass = errorClass(err)
+	}
+}
+
+// finishTelemetry appends the event of the command being recorded.
+// Telemetry never makes a command fail; problems writing it are only
+// logged.
+func finishTelemetry(code int) {
+	run := telemetryRun
+	if run == nil {
+		return
+	}
+	telemetryRun = nil
+	event := telemetryEvent{
+		Time:     run.start.UTC().Truncate(time.Second),
+		Command:  run.command,
+		Duration: time.Since(run.start).Milliseconds(),
+		ExitCode: code,
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+	}
+	if code != 0 {
+		event.Error = run.errorClass
+		if event.Error == "" {
+			event.Error = "failed"
+		}
+	}
+	if err := appendTelemetry(event); err != nil {
+		logging.Debug("could not record telemetry", "err", err)
+	}
+}
+
+// exit records the command for telemetry and exits with code.
+func exit(code int) {
+	finishTelemetry(code)
+	os.Exit(code)
+}
+
+// errorClass sorts an error into a few classes that say which path failed
+// without anything of the user's sources or machine.
+func errorClass(err error) string {
+	var diagErr *diagnosticsError
+	var stageErr *stageError
+	var netErr net.Error
+	var offlineErr *offlineModeError
+	switch {
+	case errors.Is(err, interrupt.ErrInterrupted):
+		return "interrupted"
+	case errors.As(err, &diagErr):
+		return "diagnostics"
+	case errors.As(err, &stageErr):
+		if _, ok := internalError(err); ok {
+			return "internal " + stageErr.stage
+		}
+		return "stage " + stageErr.stage
+	case errors.As(err, &netErr):
+		return "network"
+	case errors.As(err, &offlineErr):
+		return "offline"
+	case errors.Is(err, os.ErrNotExist):
+		return "not found"
+	case errors.Is(err, os.ErrPermission):
+		return "permission"
+	default:
+		return "other"
+	}
+}
+
+func telemetryPath() (string, error) {
+	dir, err := dataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "telemetry.jsonl"), nil
+}
+
+func appendTelemetry(event telemetryEvent) error {
+	file, err := telemetryPath()
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(file); err == nil && info.Size() > maxTelemetrySize {
+		if err := dropOlderTelemetry(file); err != nil {
+			return err
+		}
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// dropOlderTelemetry keeps the newer half of the events in file.
+func dropOlderTelemetry(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	lines := strings.SplitAfter(strings.TrimSpace(string(data)), "\n")
+	kept := strings.Join(lines[len(lines)/2:], "")
+	return os.WriteFile(file, []byte(strings.TrimSpace(kept)+"\n"), 0644)
+}
+
+// readTelemetry reads the recorded events, skipping lines it cannot read.
+func readTelemetry() ([]telemetryEvent, error) {
+	file, err := telemetryPath()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var events []telemetryEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event telemetryEvent
+		if json.Unmarshal(scanner.Bytes(), &event) == nil && event.Command != "" {
+			events = append(events, event)
+		}
+	}
+	return events, scanner.Err()
+}
+
+// telemetryUploadURL is where vira telemetry upload sends the events:
+// VIRA_TELEMETRY_URL, or telemetry.upload-url in config.toml.
+func telemetryUploadURL() (string, error) {
+	if url := os.Getenv("VIRA_TELEMETRY_URL"); url != "" {
+		return url, nil
+	}
+	cfg, err := loadGlobalConfig()
+	if err != nil {
+		return "", err
+	}
+	return cfg.Telemetry.UploadURL, nil
+}
+
+func newTelemetryCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:         "telemetry",
+		Annotations: map[string]string{skipToolchain: "true"},
+		Short:       "Turn anonymous usage telemetry on or off and look at it",
+		Long: `Turn anonymous usage telemetry on or off and look at what it recorded.
+
+Telemetry is off unless you turn it on. While it is on, each vira command
+records its name, without arguments, how long it ran and, when it failed,
+the class of its error (such as diagnostics, network or stage compiler),
+together with the operating system and architecture. No file names, sources,
+paths or identifiers are recorded.
+
+The events are kept in telemetry.jsonl in the data directory and never leave
+the machine unless you run vira telemetry upload, which sends them to
+telemetry.upload-url in config.toml, or VIRA_TELEMETRY_URL, and then
+deletes them.`,
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "on",
+		Short: "Start recording usage telemetry",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setConfig("telemetry.enabled", "true", false); err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			file, _ := telemetryPath()
+			pterm.Success.Println("Telemetry is on")
+			pterm.Info.Printfln("Command names, durations and error classes are recorded in %s; nothing is sent until you run vira telemetry upload", displayPath(file))
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "off",
+		Short: "Stop recording usage telemetry",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setConfig("telemetry.enabled", "", true); err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			pterm.Success.Println("Telemetry is off")
+			if events, _ := readTelemetry(); len(events) > 0 {
+				pterm.Info.Printfln("%d recorded event(s) are kept; delete them with vira telemetry clear", len(events))
+			}
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "status",
+		Short: "Show whether telemetry is on and what it recorded",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := telemetryStatus(); err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "show",
+		Short: "Summarize the recorded events by command",
+		Long: `Summarize the recorded events by command. With --json, the events are
+printed as they would be uploaded.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := showTelemetry(); err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "upload",
+		Short: "Send the recorded events to the maintainers and delete them",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := uploadTelemetry(); err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "clear",
+		Short: "Delete the recorded events",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			file, err := telemetryPath()
+			if err == nil {
+				if err = os.Remove(file); errors.Is(err, os.ErrNotExist) {
+					err = nil
+				}
+			}
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			pterm.Success.Println("Deleted the recorded telemetry")
+		},
+	})
+	return cmd
+}
+
+func telemetryStatus() error {
+	cfg, err := loadGlobalConfig()
+	if err != nil {
+		return err
+	}
+	events, err := readTelemetry()
+	if err != nil {
+		return err
+	}
+	file, err := telemetryPath()
+	if err != nil {
+		return err
+	}
+	state := "off"
+	if cfg.Telemetry.Enabled {
+		state = "on"
+	}
+	fmt.Printf("telemetry: %s\n", state)
+	fmt.Printf("events:    %d in %s\n", len(events), displayPath(file))
+	url, err := telemetryUploadURL()
+	if err != nil {
+		return err
+	}
+	if url == "" {
+		url = "not configured"
+	}
+	fmt.Printf("upload:    %s\n", url)
+	return nil
+}
+
+func showTelemetry() error {
+	if jsonOutput {
+		file, err := telemetryPath()
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(file)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		os.Stdout.Write(data)
+		return nil
+	}
+	events, err := readTelemetry()
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		pterm.Info.Println("No telemetry has been recorded")
+		return nil
+	}
+	type summary struct {
+		runs, failures int
+		durations      []int64
+		errors         map[string]int
+	}
+	byCommand := map[string]*summary{}
+	for _, event := range events {
+		s := byCommand[event.Command]
+		if s == nil {
+			s = &summary{errors: map[string]int{}}
+			byCommand[event.Command] = s
+		}
+		s.runs++
+		s.durations = append(s.durations, event.Duration)
+		if event.ExitCode != 0 {
+			s.failures++
+			s.errors[event.Error]++
+		}
+	}
+	data := [][]string{{"Command", "Runs", "Failed", "Median", "Slowest", "Errors"}}
+	for _, name := range sortedKeys(byCommand) {
+		s := byCommand[name]
+		sort.Slice(s.durations, func(i, j int) bool { return s.durations[i] < s.durations[j] })
+		var errs []string
+		for _, class := range sortedKeys(s.errors) {
+			errs = append(errs, fmt.Sprintf("%s (%d)", class, s.errors[class]))
+		}
+		data = append(data, []string{
+			name,
+			strconv.Itoa(s.runs),
+			strconv.Itoa(s.failures),
+			formatMillis(s.durations[len(s.durations)/2]),
+			formatMillis(s.durations[len(s.durations)-1]),
+			strings.Join(errs, ", "),
+		})
+	}
+	return pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+}
+
+func formatMillis(ms int64) string {
+	return (time.Duration(ms) * time.Millisecond).String()
+}
+
+// uploadTelemetry POSTs the recorded events as JSON lines and deletes them
+// once the server took them.
+func uploadTelemetry() error {
+	url, err := telemetryUploadURL()
+	if err != nil {
+		return err
+	}
+	if url == "" {
+		return errors.New("no upload URL is configured: set telemetry.upload-url with vira config set, or VIRA_TELEMETRY_URL")
+	}
+	if offlineMode() {
+		return offlineError("uploading telemetry")
+	}
+	file, err := telemetryPath()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) || len(bytes.TrimSpace(data)) == 0 {
+		pterm.Info.Println("No telemetry has been recorded")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(url, "application/x-ndjson", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to upload telemetry: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s rejected the telemetry: %s\n%s", url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if err := os.Remove(file); err != nil {
+		return err
+	}
+	pterm.Success.Printfln("Uploaded %d event(s) to %s", bytes.Count(data, []byte("\n")), url)
+	return nil
+}
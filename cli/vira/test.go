@@ -0,0 +1,604 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"vira/pkg/i18n"
+	"vira/pkg/interrupt"
+)
+
+func newTestCmd() *cobra.Command {
+	var opts testOptions
+
+	cmd := &cobra.Command{
+		Use:   "test [filter...]",
+		Short: "Build and run the tests of the project",
+		Long: `Build every test of the project and run it. A test is a program in
+tests/, or a directory below it, that is not included by another file
+there; it passes when main returns 0. Tests include the sources of the
+project as system includes, #include <file.vira> for src/file.vira, and
+those of its dependencies, and are built into target/debug/tests, or
+target/release/tests with --release.
+
+Only the tests whose names, their paths below tests/ without .vira,
+contain one of the filters run, if any are given. --shard i/n runs the
+i-th of n even parts of the tests, for splitting them across CI machines,
+and --rerun-failed runs only the tests that failed in the last run. Tests
+are built one after another and run in parallel, up to --jobs at once.
+
+A test with a snapshot, tests/snapshots/<name>.snap, passes when its exit
+status and output match the snapshot instead, and fails with a diff of
+them otherwise. --update-snapshots writes the snapshots of the tests that
+run, accepting their exit status and output as the new baselines.
+
+--format junit or tap writes the results as JUnit XML or TAP instead of
+a summary, with the time each test took and the output and exit status of
+failed ones, for CI systems such as Jenkins, GitLab or Azure Pipelines.
+The report goes to the file given with --output, with the summary still
+printed, or to stdout. With --json the results are printed as JSON.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			opts.filters = args
+			if opts.jobs <= 0 {
+				opts.jobs = runtime.NumCPU()
+			}
+			if opts.format != "human" && opts.format != "junit" && opts.format != "tap" {
+				pterm.Error.Printfln("unknown test report format %q (use human, junit or tap)", opts.format)
+				exit(1)
+			}
+			report := opts.format != "human" && opts.output == ""
+			if report || jsonOutput {
+				// stdout carries the report.
+				pterm.SetDefaultOutput(os.Stderr)
+			}
+			proj, err := loadProject(".")
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			results, err := proj.runTests(opts)
+			if err != nil {
+				printError(err)
+				exit(1)
+			}
+			switch {
+			case jsonOutput:
+				err = printJSON(results)
+			case report:
+				err = writeTestReport(os.Stdout, opts.format, proj, results)
+			default:
+				printTestSummary(results)
+				if opts.format != "human" {
+					err = writeTestReportFile(opts.output, opts.format, proj, results)
+				}
+			}
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			for _, r := range results {
+				if !r.Passed {
+					exit(1)
+				}
+			}
+		},
+	}
+	cmd.Flags().BoolVar(&opts.release, "release", false, "build the tests with the release profile")
+	cmd.Flags().StringVar(&opts.format, "format", "human", "report the results as human, junit or tap")
+	cmd.Flags().StringVarP(&opts.output, "output", "o", "", "write the junit or tap report to this file")
+	cmd.Flags().IntVarP(&opts.jobs, "jobs", "j", 0, "run this many tests at once (one per CPU by default)")
+	cmd.Flags().StringVar(&opts.shard, "shard", "", "run only the i-th of n parts of the tests, given as i/n")
+	cmd.Flags().BoolVar(&opts.rerunFailed, "rerun-failed", false, "run only the tests that failed in the last run")
+	cmd.Flags().BoolVar(&opts.updateSnapshots, "update-snapshots", false, "write the snapshots of the tests from what they do now")
+	return cmd
+}
+
+type testOptions struct {
+	release bool
+	// format is human, junit or tap, and output the file that junit and
+	// tap reports go to instead of stdout.
+	format string
+	output string
+	// filters select the tests whose names contain any of them.
+	filters []string
+	// shard is i/n to run the i-th of n parts of the tests.
+	shard           string
+	rerunFailed     bool
+	jobs            int
+	updateSnapshots bool
+}
+
+// testResult is the outcome of a test, as vira test --json prints it.
+type testResult struct {
+	Name string `json:"name"`
+	File string `json:"file"`
+	// Passed is whether the test ran and exited with status 0.
+	Passed bool `json:"passed"`
+	// ExitCode is the exit status of the test, or -1 if it did not run.
+	ExitCode int    `json:"exit_code"`
+	Output   string `json:"output"`
+	// Duration is how long the test ran, in milliseconds.
+	Duration int64 `json:"duration_ms"`
+	// Error is why the test could not be built or run.
+	Error string `json:"error,omitempty"`
+	// Snapshot is the snapshot the test is checked against, if it has one,
+	// and SnapshotDiff how the test differs from it.
+	Snapshot     string `json:"snapshot,omitempty"`
+	SnapshotDiff string `json:"snapshot_diff,omitempty"`
+}
+
+func (p *project) testsDir() string {
+	return filepath.Join(p.root, "tests")
+}
+
+// testFiles lists the tests of the project: the files below tests/ that
+// no other file there includes, sorted.
+func (p *project) testFiles() ([]string, error) {
+	return programFiles(p.testsDir())
+}
+
+// programFiles lists the programs below root, the files that no other file
+// there includes, sorted.
+func programFiles(root string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && filepath.Ext(path) == ".vira" {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	included := map[string]bool{}
+	for _, file := range files {
+		for _, inc := range localIncludes(file) {
+			included[inc] = true
+		}
+	}
+	var programs []string
+	for _, file := range files {
+		if !included[file] {
+			programs = append(programs, file)
+		}
+	}
+	sort.Strings(programs)
+	return programs, nil
+}
+
+// testName names the test of file by its path below tests/, without the
+// extension.
+func (p *project) testName(file string) string {
+	return programName(p.testsDir(), file)
+}
+
+// programName names the program file below root by its path there,
+// without the extension.
+func programName(root, file string) string {
+	rel, err := filepath.Rel(root, file)
+	if err != nil {
+		rel = filepath.Base(file)
+	}
+	return filepath.ToSlash(strings.TrimSuffix(rel, ".vira"))
+}
+
+// runTests builds the tests opts select, one after another, and runs
+// them, up to opts.jobs at once. The results are in the order of the
+// tests. A test that fails to build fails, without stopping the others.
+func (p *project) runTests(opts testOptions) ([]testResult, error) {
+	tests, err := p.testFiles()
+	if err != nil {
+		return nil, err
+	}
+	results := []testResult{}
+	if len(tests) == 0 {
+		pterm.Info.Println("The project has no tests; add programs to tests/ whose main returns 0 when they pass")
+		return results, nil
+	}
+	dir := filepath.Join(p.targetDir(buildOptions{release: opts.release}.outputDir()), "tests")
+	if tests, err = p.selectTests(tests, opts, dir); err != nil {
+		return nil, err
+	}
+	if len(tests) == 0 {
+		pterm.Info.Println("No test is selected")
+		return results, nil
+	}
+	includeDirs, sources, err := p.programInputs()
+	if err != nil {
+		return nil, err
+	}
+
+	results = make([]testResult, len(tests))
+	exes := make([]string, len(tests))
+	for i, test := range tests {
+		results[i] = testResult{Name: p.testName(test), File: p.rel(test), ExitCode: -1}
+		exe, err := p.buildProgram(test, results[i].Name, dir, includeDirs, sources)
+		if err != nil {
+			err = compileError(test, err)
+			printError(err)
+			results[i].Error = err.Error()
+			continue
+		}
+		exes[i] = exe
+	}
+
+	sem := make(chan struct{}, max(opts.jobs, 1))
+	var wg sync.WaitGroup
+	for i, exe := range exes {
+		if exe == "" {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(r *testResult, exe string) {
+			defer func() { <-sem; wg.Done() }()
+			p.runTest(r, exe)
+		}(&results[i], exe)
+	}
+	wg.Wait()
+
+	for i := range results {
+		if exes[i] != "" {
+			if err := p.checkSnapshot(&results[i], opts.updateSnapshots); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var failed []string
+	for _, r := range results {
+		if !r.Passed {
+			failed = append(failed, r.Name)
+		}
+	}
+	if err := writeFailedTests(dir, failed); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// runTest runs the test executable exe, filling in r.
+func (p *project) runTest(r *testResult, exe string) {
+	logf("test %s: running %s", r.Name, exe)
+	start := time.Now()
+	cmd := exec.Command(exe)
+	cmd.Dir = p.root
+	out, err := interrupt.CombinedOutput(cmd)
+	r.Duration = time.Since(start).Milliseconds()
+	r.Output = string(out)
+	if r.ExitCode, err = commandExitCode(err); err != nil {
+		r.Error = err.Error()
+	}
+	r.Passed = r.ExitCode == 0 && err == nil
+	logf("test %s: exit status %d after %dms", r.Name, r.ExitCode, r.Duration)
+}
+
+// snapshotPath returns where the snapshot of the test name is.
+func (p *project) snapshotPath(name string) string {
+	return filepath.Join(p.testsDir(), "snapshots", filepath.FromSlash(name)+".snap")
+}
+
+// snapshotText is what the snapshot of r holds: its exit status, then its
+// output, with Windows line endings turned into Unix ones so that snapshots
+// match on every platform.
+func snapshotText(r *testResult) string {
+	return fmt.Sprintf("exit status: %d\n", r.ExitCode) + strings.ReplaceAll(r.Output, "\r\n", "\n")
+}
+
+// checkSnapshot checks r, a test that ran, against its snapshot if it has
+// one, or writes the snapshot if update is set.
+func (p *project) checkSnapshot(r *testResult, update bool) error {
+	path := p.snapshotPath(r.Name)
+	got := snapshotText(r)
+	want, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err != nil && !update {
+		return nil
+	}
+	r.Snapshot = p.rel(path)
+	if update {
+		// A test that ran passes whatever it did, as that is the baseline.
+		r.Passed = r.Error == ""
+		if err == nil && string(want) == got {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			return err
+		}
+		pterm.Info.Printfln("Updated the snapshot %s", r.Snapshot)
+		return nil
+	}
+	r.SnapshotDiff = unifiedDiff(r.Snapshot, string(want), got)
+	r.Passed = r.SnapshotDiff == "" && r.Error == ""
+	return nil
+}
+
+// failedTestsFile records the names of the tests that failed in the last
+// run, one per line, in the directory of the tests.
+const failedTestsFile = "last-failed"
+
+func writeFailedTests(dir string, names []string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	text := strings.Join(names, "\n")
+	if text != "" {
+		text += "\n"
+	}
+	return os.WriteFile(filepath.Join(dir, failedTestsFile), []byte(text), 0644)
+}
+
+// selectTests returns the tests of tests that the filters, --rerun-failed
+// and --shard of opts select, in order.
+func (p *project) selectTests(tests []string, opts testOptions, dir string) ([]string, error) {
+	var failed map[string]bool
+	if opts.rerunFailed {
+		data, err := os.ReadFile(filepath.Join(dir, failedTestsFile))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, errors.New("no tests have run yet, so none failed in the last run")
+		}
+		if err != nil {
+			return nil, err
+		}
+		failed = map[string]bool{}
+		for _, name := range strings.Fields(string(data)) {
+			failed[name] = true
+		}
+	}
+	shard, shards := 1, 1
+	if opts.shard != "" {
+		if _, err := fmt.Sscanf(opts.shard, "%d/%d", &shard, &shards); err != nil || shards < 1 || shard < 1 || shard > shards {
+			return nil, fmt.Errorf("invalid shard %q: expected i/n with 1 <= i <= n, such as 2/4", opts.shard)
+		}
+	}
+
+	var selected []string
+	for _, test := range tests {
+		name := p.testName(test)
+		if failed != nil && !failed[name] {
+			continue
+		}
+		if matchesFilters(name, opts.filters) {
+			selected = append(selected, test)
+		}
+	}
+	var sharded []string
+	for i, test := range selected {
+		// Tests are dealt out in turn, so that shards stay even as tests
+		// are added.
+		if i%shards == shard-1 {
+			sharded = append(sharded, test)
+		}
+	}
+	return sharded, nil
+}
+
+// matchesFilters reports whether name contains one of filters, or there
+// are none.
+func matchesFilters(name string, filters []string) bool {
+	for _, f := range filters {
+		if strings.Contains(name, f) {
+			return true
+		}
+	}
+	return len(filters) == 0
+}
+
+// programInputs returns the include path of tests and benchmarks, the
+// sources of the project and of its dependencies, and every source they
+// can include, for telling whether they are up to date.
+func (p *project) programInputs() (includeDirs, sources []string, err error) {
+	if includeDirs, err = p.dependencyDirs(resolveOptions{}); err != nil {
+		return nil, nil, err
+	}
+	includeDirs = append([]string{p.srcDir()}, includeDirs...)
+	if sources, err = p.sourceFiles(); err != nil {
+		return nil, nil, err
+	}
+	localSources, err := p.pathDependencySources()
+	if err != nil {
+		return nil, nil, err
+	}
+	return includeDirs, append(sources, localSources...), nil
+}
+
+// buildProgram builds the test or benchmark file, named name, into dir
+// unless its executable is newer than it and the sources of the project.
+func (p *project) buildProgram(file, name, dir string, includeDirs, sources []string) (string, error) {
+	name = filepath.FromSlash(name)
+	exe := filepath.Join(dir, executableName(name))
+	if upToDate(exe, append(includeClosure(file), sources...)) {
+		return exe, nil
+	}
+	pterm.Info.Println(i18n.T("Compiling %s", p.rel(file)))
+	obj, err := compileObject(file, filepath.Join(dir, "obj", name+".o"), includeDirs...)
+	if err != nil {
+		return "", err
+	}
+	if err := linkExecutable([]string{obj}, exe); err != nil {
+		return "", err
+	}
+	return exe, nil
+}
+
+func printTestSummary(results []testResult) {
+	passed := 0
+	for _, r := range results {
+		switch {
+		case r.Passed:
+			passed++
+			pterm.Success.Printfln("%s (%dms)", r.Name, r.Duration)
+		case r.ExitCode < 0:
+			pterm.Error.Printfln("%s did not build", r.Name)
+		case r.SnapshotDiff != "":
+			pterm.Error.Printfln("%s does not match its snapshot %s (%dms)", r.Name, r.Snapshot, r.Duration)
+			pterm.Print(r.SnapshotDiff)
+		default:
+			pterm.Error.Printfln("%s failed with exit status %d (%dms)", r.Name, r.ExitCode, r.Duration)
+			if out := strings.TrimRight(r.Output, "\n"); out != "" {
+				pterm.Println(out)
+			}
+		}
+	}
+	if len(results) > 0 {
+		pterm.Println()
+		pterm.Info.Printfln("%d passed, %d failed", passed, len(results)-passed)
+	}
+}
+
+// writeTestReportFile writes the report in format to file.
+func writeTestReportFile(file, format string, p *project, results []testResult) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := writeTestReport(f, format, p, results); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	pterm.Info.Printfln("Wrote the test results to %s", file)
+	return nil
+}
+
+func writeTestReport(w io.Writer, format string, p *project, results []testResult) error {
+	if format == "tap" {
+		return writeTAP(w, results)
+	}
+	return writeJUnit(w, p.manifest.Package.Name, results)
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Errors   int             `xml:"errors,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junitSeconds renders milliseconds as the seconds JUnit reports have.
+func junitSeconds(ms int64) string {
+	return fmt.Sprintf("%.3f", float64(ms)/1000)
+}
+
+// writeJUnit writes the results as one JUnit test suite named after the
+// package. A test that did not build is an error, one that failed a
+// failure.
+func writeJUnit(w io.Writer, pkg string, results []testResult) error {
+	suite := junitTestSuite{Name: pkg, Tests: len(results)}
+	var total int64
+	for _, r := range results {
+		c := junitTestCase{Name: r.Name, Classname: pkg, Time: junitSeconds(r.Duration), SystemOut: r.Output}
+		switch {
+		case r.ExitCode < 0:
+			suite.Errors++
+			c.Error = &junitMessage{Message: "the test did not build or run", Text: r.Error}
+		case r.SnapshotDiff != "":
+			suite.Failures++
+			c.Failure = &junitMessage{Message: "does not match the snapshot " + r.Snapshot, Text: r.SnapshotDiff}
+		case !r.Passed:
+			suite.Failures++
+			c.Failure = &junitMessage{Message: fmt.Sprintf("exit status %d", r.ExitCode), Text: r.Output}
+		}
+		total += r.Duration
+		suite.Cases = append(suite.Cases, c)
+	}
+	suite.Time = junitSeconds(total)
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(junitTestSuites{Suites: []junitTestSuite{suite}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// writeTAP writes the results as TAP version 13, with the details of
+// failed tests in YAML blocks.
+func writeTAP(w io.Writer, results []testResult) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "TAP version 13\n1..%d\n", len(results))
+	for i, r := range results {
+		status := "ok"
+		if !r.Passed {
+			status = "not ok"
+		}
+		fmt.Fprintf(&b, "%s %d - %s\n", status, i+1, r.Name)
+		b.WriteString("  ---\n")
+		fmt.Fprintf(&b, "  duration_ms: %d\n", r.Duration)
+		if !r.Passed {
+			message := fmt.Sprintf("exit status %d", r.ExitCode)
+			details := r.Output
+			switch {
+			case r.ExitCode < 0:
+				message = "the test did not build or run"
+			case r.SnapshotDiff != "":
+				message = "does not match the snapshot " + r.Snapshot
+				details = r.SnapshotDiff
+			}
+			fmt.Fprintf(&b, "  message: %q\n", message)
+			if r.Error != "" {
+				details = r.Error
+			}
+			if details = strings.TrimRight(details, "\n"); details != "" {
+				b.WriteString("  output: |\n")
+				for _, line := range strings.Split(details, "\n") {
+					b.WriteString("    " + line + "\n")
+				}
+			}
+		}
+		b.WriteString("  ...\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,853 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"vira/pkg/interrupt"
+	"vira/pkg/logging"
+	"vira/pkg/terminal"
+	"vira/pkg/toolchain"
+)
+
+// Toolchains managed by vira toolchain live side by side in toolchain.Dir,
+// laid out as package toolchain describes. Without a default, the system
+// installation in systemBinPath is used.
+
+const (
+	toolchainVersionsURL  = "https://raw.githubusercontent.com/vira-language/vira/main/repository/vira-version.json"
+	toolchainNightliesURL = "https://raw.githubusercontent.com/vira-language/vira/main/repository/vira-nightly.json"
+	toolchainReleasesURL  = "https://github.com/vira-language/vira/releases/download"
+)
+
+// Channels name the newest toolchain of a kind: the stable releases, or the
+// nightly builds, whose versions are nightly-YYYY-MM-DD.
+const (
+	channelStable  = toolchain.Stable
+	channelNightly = toolchain.Nightly
+)
+
+var (
+	toolchainVersionPattern = toolchain.VersionPattern
+	nightlyVersionPattern   = regexp.MustCompile(`^nightly-\d{4}-\d{2}-\d{2}$`)
+)
+
+var isChannel = toolchain.IsChannel
+
+// toolchainChannel returns the channel that version is released on.
+func toolchainChannel(version string) string {
+	if strings.HasPrefix(version, channelNightly) {
+		return channelNightly
+	}
+	return channelStable
+}
+
+func toolchainDir(version string) (string, error) {
+	if !toolchainVersionPattern.MatchString(version) || isChannel(version) {
+		return "", fmt.Errorf("invalid toolchain version %q", version)
+	}
+	if toolchainChannel(version) == channelNightly && !nightlyVersionPattern.MatchString(version) {
+		return "", fmt.Errorf("invalid nightly version %q (expected nightly-YYYY-MM-DD)", version)
+	}
+	dir, err := toolchain.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, version), nil
+}
+
+func toolchainInstalled(version string) bool {
+	dir, err := toolchainDir(version)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(filepath.Join(dir, "version.json"))
+	return err == nil
+}
+
+// defaultToolchain returns the version selected with vira toolchain use, or
+// "" for the system installation.
+func defaultToolchain() string {
+	return toolchain.Default()
+}
+
+// trackedChannel returns the channel the default toolchain follows, or "".
+func trackedChannel() string {
+	return readToolchainsFile("channel")
+}
+
+func readToolchainsFile(name string) string {
+	dir, err := toolchain.Dir()
+	if err != nil {
+		return ""
+	}
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// activeToolchain returns the toolchain version in use: VIRA_TOOLCHAIN, or
+// else the default. "" means the system installation.
+var activeToolchain = toolchain.Active
+
+// toolchainBinDir is the directory holding the binaries of the active
+// toolchain.
+var toolchainBinDir = toolchain.BinDir
+
+func newToolchainCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:         "toolchain",
+		Annotations: map[string]string{skipToolchain: "true"},
+		Short:       "Manage installed Vira toolchains",
+		Long: `Manage Vira toolchains installed side by side in
+~/.local/share/vira/toolchains on Linux and ~/.vira/toolchains elsewhere.
+
+The default toolchain is used by vira and, through the shims that vira
+toolchain use writes to the user bin directory, by the vira and virac
+commands. Setting VIRA_TOOLCHAIN to a version, or to system, overrides it.
+
+A project can pin its toolchain in vira-toolchain.toml next to vira.toml:
+
+    [toolchain]
+    version = "0.2"    # or channel = "stable"
+
+or with toolchain = "0.2" in the [package] section of vira.toml. Commands
+run inside the project then use that toolchain.`,
+	}
+	var components []string
+	install := &cobra.Command{
+		Use:   "install [version|channel]",
+		Short: "Install a toolchain version, by default the latest stable release",
+		Long: `Install a toolchain: a release such as 0.2, a nightly build such as
+nightly-2025-06-01, or the latest toolchain on the stable or nightly
+channel. The first toolchain installed becomes the default.
+
+Releases that are split into components install their default components,
+or those given with --component; vira component adds or removes them later.`,
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			name := channelStable
+			if len(args) == 1 {
+				name = args[0]
+			}
+			version, err := installToolchain(name, components)
+			if err == nil && defaultToolchain() == "" {
+				err = setDefaultToolchain(version, "")
+			}
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+		},
+	}
+	install.Flags().StringSliceVarP(&components, "component", "c", nil, "install only these components")
+	cmd.AddCommand(install)
+	cmd.AddCommand(&cobra.Command{
+		Use:     "list",
+		Aliases: []string{"ls"},
+		Short:   "List installed toolchains",
+		Args:    cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := listToolchains(); err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+		},
+	})
+	var force bool
+	uninstall := &cobra.Command{
+		Use:     "uninstall <version>...",
+		Aliases: []string{"rm"},
+		Short:   "Remove installed toolchains",
+		Long: `Remove installed toolchains.
+
+The default toolchain and one pinned by the current project are kept unless
+--force is given; removing the default makes the system installation the
+default again.`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			for _, version := range args {
+				if err := uninstallToolchain(version, force); err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+			}
+		},
+	}
+	uninstall.Flags().BoolVarP(&force, "force", "f", false, "also remove the default or pinned toolchain")
+	cmd.AddCommand(uninstall)
+	cmd.AddCommand(&cobra.Command{
+		Use:     "disk-usage",
+		Aliases: []string{"du"},
+		Short:   "Show the disk space used by each toolchain and the caches",
+		Args:    cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := printDiskUsage(); err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:    "resolve <version|channel>",
+		Short:  "Print the toolchain version a version or channel stands for",
+		Hidden: true,
+		Args:   cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			version, err := resolveToolchain(args[0])
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			fmt.Println(version)
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "use <version|channel|system>",
+		Short: "Make a toolchain the default",
+		Long: `Make an installed toolchain the default, or the latest toolchain on the
+stable or nightly channel, which the default then follows whenever a newer
+one is installed, as by vira update.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := useToolchain(args[0]); err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+		},
+	})
+	return cmd
+}
+
+// latestToolchain returns the newest toolchain version on channel.
+func latestToolchain(channel string) (string, error) {
+	data, err := readCachedLocation(toolchainListURL(channel))
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch the %s toolchain versions: %v", channel, err)
+	}
+	var versions []string
+	if err := json.Unmarshal(data, &versions); err != nil {
+		return "", fmt.Errorf("invalid %s toolchain version list", channel)
+	}
+	if len(versions) == 0 {
+		return "", fmt.Errorf("no %s toolchains have been released", channel)
+	}
+	return versions[0], nil
+}
+
+// toolchainListURL is the location of the list of toolchain versions on
+// channel, newest first.
+func toolchainListURL(channel string) string {
+	url := toolchainVersionsURL
+	if channel == channelNightly {
+		url = toolchainNightliesURL
+	}
+	if mirror := os.Getenv("VIRA_TOOLCHAIN_MIRROR"); mirror != "" {
+		url = strings.TrimSuffix(mirror, "/") + "/" + url[strings.LastIndex(url, "/")+1:]
+	}
+	return url
+}
+
+// resolveToolchain returns the version that name, a version or a channel,
+// stands for.
+func resolveToolchain(name string) (string, error) {
+	if isChannel(name) {
+		return latestToolchain(name)
+	}
+	return name, nil
+}
+
+// toolchainReleaseURL is the location of a file published with the release
+// of version. Releases are tagged v<version> and nightlies by their version.
+// VIRA_TOOLCHAIN_MIRROR replaces the release download location, and also
+// serves the version lists.
+func toolchainReleaseURL(version, file string) string {
+	base := toolchainReleasesURL
+	if mirror := os.Getenv("VIRA_TOOLCHAIN_MIRROR"); mirror != "" {
+		base = strings.TrimSuffix(mirror, "/")
+	}
+	tag := "v" + version
+	if toolchainChannel(version) == channelNightly {
+		tag = version
+	}
+	return base + "/" + tag + "/" + file
+}
+
+// installToolchain downloads and unpacks a toolchain, given by version or
+// channel, and returns its version. If components is not nil, only those
+// components are installed; otherwise the default ones. A default that
+// follows the toolchain's channel moves to it.
+func installToolchain(name string, components []string) (string, error) {
+	if offlineMode() {
+		return "", offlineError("installing a toolchain")
+	}
+	version, err := resolveToolchain(name)
+	if err != nil {
+		return "", err
+	}
+	dir, err := toolchainDir(version)
+	if err != nil {
+		return "", err
+	}
+	if toolchainInstalled(version) {
+		pterm.Info.Printfln("Toolchain %s is already installed", version)
+		return version, nil
+	}
+	unlock, err := lockPath(dir)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	tmp := dir + ".tmp"
+	os.RemoveAll(tmp)
+	defer interrupt.Cleanup(func() { os.RemoveAll(tmp) })()
+	if manifest, err := fetchComponentManifest(version); err == nil {
+		err = manifest.install(version, tmp, components)
+		if err != nil {
+			os.RemoveAll(tmp)
+			return "", err
+		}
+	} else if components != nil {
+		return "", fmt.Errorf("toolchain %s is not split into components: %v", version, err)
+	} else {
+		file := "bin-" + runtime.GOOS + ".zip"
+		pterm.Info.Printfln("Downloading toolchain %s from %s", version, toolchainReleaseURL(version, file))
+		data, err := downloadRelease(version, file)
+		if err != nil {
+			return "", fmt.Errorf("failed to download toolchain %s: %v", version, err)
+		}
+		sums, err := unzipToolchain(data, filepath.Join(tmp, "bin"))
+		if err == nil {
+			err = recordFiles(tmp, sums)
+		}
+		if err != nil {
+			os.RemoveAll(tmp)
+			return "", fmt.Errorf("toolchain %s: %v", version, err)
+		}
+	}
+	versionJSON, _ := json.Marshal([]string{version})
+	if err := os.WriteFile(filepath.Join(tmp, "version.json"), versionJSON, 0644); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return "", err
+	}
+	pterm.Success.Printfln("Installed toolchain %s", version)
+	if channel := trackedChannel(); channel == toolchainChannel(version) && defaultToolchain() != version {
+		return version, setDefaultToolchain(version, channel)
+	}
+	return version, nil
+}
+
+// downloadRelease downloads a file of the release of version and checks it
+// against the SHA-256 sum published next to it as <file>.sha256, in the
+// format of sha256sum. A file the release has no checksum for is accepted
+// with a warning, but a checksum that fails to download is an error.
+func downloadRelease(version, file string) ([]byte, error) {
+	data, err := downloadReleases(version, []string{file})
+	if err != nil {
+		return nil, err
+	}
+	return data[0], nil
+}
+
+// maxParallelDownloads bounds how many files downloadReleases fetches at
+// once.
+const maxParallelDownloads = 4
+
+// downloadReleases downloads files of the release of version, together with
+// their checksums, in parallel, checks them as downloadRelease does and
+// returns their contents in the same order. The errors of files that fail
+// to download name the file.
+func downloadReleases(version string, files []string) ([][]byte, error) {
+	// Even indices are the files, odd ones their checksums.
+	var locations []string
+	for _, file := range files {
+		locations = append(locations, toolchainReleaseURL(version, file), toolchainReleaseURL(version, file+".sha256"))
+	}
+	data := make([][]byte, len(locations))
+	errs := make([]error, len(locations))
+	slots := make(chan struct{}, maxParallelDownloads)
+	var mu sync.Mutex
+	var done int
+	var total int64
+	var wg sync.WaitGroup
+	for i, location := range locations {
+		wg.Add(1)
+		go func(i int, location string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			data[i], errs[i] = readLocation(location)
+			if i%2 == 0 && errs[i] == nil && len(files) > 1 {
+				mu.Lock()
+				done++
+				total += int64(len(data[i]))
+				pterm.Info.Printfln("Downloaded %s (%d of %d, %s in total)", files[i/2], done, len(files), formatSize(total))
+				mu.Unlock()
+			}
+		}(i, location)
+	}
+	wg.Wait()
+
+	results := make([][]byte, len(files))
+	for i, file := range files {
+		if errs[2*i] != nil {
+			return nil, fmt.Errorf("%s: %v", file, errs[2*i])
+		}
+		results[i] = data[2*i]
+		// Only a release published without a checksum is installed
+		// unverified; one that could not be fetched fails the download.
+		if err := errs[2*i+1]; errors.Is(err, os.ErrNotExist) {
+			logging.Warn("no published checksum; not verified", "file", file, "toolchain", version)
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("%s.sha256: %v", file, err)
+		}
+		fields := strings.Fields(string(data[2*i+1]))
+		sum := sha256.Sum256(results[i])
+		if len(fields) == 0 || !strings.EqualFold(fields[0], hex.EncodeToString(sum[:])) {
+			return nil, fmt.Errorf("checksum mismatch for %s", file)
+		}
+	}
+	return results, nil
+}
+
+// unzipToolchain writes the files of a release archive into dir. The
+// archive's directory structure is flattened, as the updater does. It
+// returns the SHA-256 sums of the files it wrote by name, which
+// recordFiles keeps for vira self verify.
+func unzipToolchain(data []byte, dir string) (map[string]string, error) {
+	return unzipFiles(data, dir, nil)
+}
+
+// unzipFiles is unzipToolchain for only the files whose names are in keep,
+// or all of them if keep is nil.
+func unzipFiles(data []byte, dir string, keep map[string]bool) (map[string]string, error) {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	sums := map[string]string{}
+	for _, f := range r.File {
+		name := filepath.Base(f.Name)
+		if f.FileInfo().IsDir() || keep != nil && !keep[name] {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		// Files are replaced rather than overwritten, which also works for
+		// a binary that is running, such as vira repairing its toolchain.
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file+".new", content, 0755); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(file+".new", file); err != nil {
+			os.Remove(file + ".new")
+			return nil, err
+		}
+		sum := sha256.Sum256(content)
+		sums[name] = hex.EncodeToString(sum[:])
+	}
+	return sums, nil
+}
+
+// installedToolchains returns the installed toolchain versions, newest
+// first.
+func installedToolchains() ([]string, error) {
+	dir, err := toolchain.Dir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	var versions []string
+	for _, e := range entries {
+		if e.IsDir() && toolchainInstalled(e.Name()) {
+			versions = append(versions, e.Name())
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		vi, erri := parseVersion(versions[i])
+		vj, errj := parseVersion(versions[j])
+		if erri != nil || errj != nil {
+			return versions[i] > versions[j]
+		}
+		return vi.compare(vj) > 0
+	})
+	return versions, nil
+}
+
+// listedToolchain is a toolchain as vira toolchain list prints it with
+// --json.
+type listedToolchain struct {
+	Version string `json:"version,omitempty"`
+	System  bool   `json:"system,omitempty"`
+	Active  bool   `json:"active"`
+}
+
+func listToolchains() error {
+	versions, err := installedToolchains()
+	if err != nil {
+		return err
+	}
+	active := activeToolchain()
+	listed := []listedToolchain{}
+	for _, v := range versions {
+		listed = append(listed, listedToolchain{Version: v, Active: v == active})
+	}
+	if bin, err := systemBinPath(); err == nil && dirExists(bin) {
+		system := listedToolchain{System: true, Active: active == ""}
+		if data, err := os.ReadFile(filepath.Join(filepath.Dir(bin), "version.json")); err == nil {
+			var vs []string
+			if json.Unmarshal(data, &vs) == nil && len(vs) > 0 {
+				system.Version = vs[0]
+			}
+		}
+		listed = append(listed, system)
+	}
+	if jsonOutput {
+		return printJSON(listed)
+	}
+	if len(listed) == 0 {
+		pterm.Info.Println("No toolchains installed; run vira toolchain install")
+	}
+	for _, t := range listed {
+		line := "  "
+		if t.Active {
+			line = "* "
+		}
+		switch {
+		case !t.System:
+			line += t.Version
+		case t.Version != "":
+			line += "system (" + t.Version + ")"
+		default:
+			line += "system"
+		}
+		pterm.Println(line)
+	}
+	return nil
+}
+
+// uninstallToolchain removes an installed toolchain. Unless force is set,
+// the default toolchain and the one pinned for the current directory are
+// refused.
+func uninstallToolchain(version string, force bool) error {
+	dir, err := toolchainDir(version)
+	if err != nil {
+		return err
+	}
+	if !toolchainInstalled(version) {
+		return fmt.Errorf("toolchain %s is not installed", version)
+	}
+	isDefault := defaultToolchain() == version
+	if pin, file, err := toolchain.Pinned("."); err == nil && pin == version && !force {
+		return fmt.Errorf("toolchain %s is pinned by %s (use --force to remove it anyway)", version, file)
+	}
+	if isDefault && !force {
+		return fmt.Errorf("toolchain %s is the default (run vira toolchain use with another version first, or use --force)", version)
+	}
+	unlock, err := lockPath(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	size, _ := dirSize(dir)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	pterm.Success.Printfln("Removed toolchain %s, freeing %s", version, formatSize(size))
+	if isDefault {
+		return setDefaultToolchain("", "")
+	}
+	return nil
+}
+
+// dirSize returns the total size of the files below dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// printDiskUsage lists the size of every installed toolchain and of each
+// part of the cache.
+func printDiskUsage() error {
+	versions, err := installedToolchains()
+	if err != nil {
+		return err
+	}
+	cache, err := cacheDir()
+	if err != nil {
+		return err
+	}
+	data := pterm.TableData{{"Item", "Size"}}
+	var total int64
+	add := func(label, dir string) error {
+		size, err := dirSize(dir)
+		if err != nil {
+			return err
+		}
+		total += size
+		data = append(data, []string{label, formatSize(size)})
+		return nil
+	}
+	for _, v := range versions {
+		dir, _ := toolchainDir(v)
+		label := "toolchain " + v
+		if v == defaultToolchain() {
+			label += " (default)"
+		}
+		if err := add(label, dir); err != nil {
+			return err
+		}
+	}
+	entries, err := os.ReadDir(cache)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			if err := add("cache/"+e.Name(), filepath.Join(cache, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	data = append(data, []string{"total", formatSize(total)})
+	return pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+}
+
+// useToolchain makes a version, the latest toolchain on a channel or the
+// system installation the default, and writes the shims that run it. With a
+// channel, the default moves along as newer toolchains are installed from it.
+func useToolchain(name string) error {
+	if name == "system" {
+		return setDefaultToolchain("", "")
+	}
+	if isChannel(name) {
+		version, err := installToolchain(name, nil)
+		if err != nil {
+			return err
+		}
+		return setDefaultToolchain(version, name)
+	}
+	if !toolchainInstalled(name) {
+		return fmt.Errorf("toolchain %s is not installed (run vira toolchain install %s)", name, name)
+	}
+	return setDefaultToolchain(name, "")
+}
+
+// setDefaultToolchain records version, following channel if it is not "",
+// as the default. An empty version selects the system installation.
+func setDefaultToolchain(version, channel string) error {
+	dir, err := toolchain.Dir()
+	if err != nil {
+		return err
+	}
+	for name, value := range map[string]string{"default": version, "channel": channel} {
+		file := filepath.Join(dir, name)
+		if value == "" {
+			err = os.Remove(file)
+			if errors.Is(err, os.ErrNotExist) {
+				err = nil
+			}
+		} else if err = os.MkdirAll(dir, 0755); err == nil {
+			err = os.WriteFile(file, []byte(value+"\n"), 0644)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	switch {
+	case version == "":
+		pterm.Success.Println("Using the system toolchain")
+		return nil
+	case channel != "":
+		pterm.Success.Printfln("Using toolchain %s by default, following the %s channel", version, channel)
+	default:
+		pterm.Success.Printfln("Using toolchain %s by default", version)
+	}
+	return writeToolchainShims()
+}
+
+// writeToolchainShims writes vira and virac to the user bin directory. The
+// shims look up the active toolchain each time they run, so they only need
+// to be written once, and fall back to the system installation.
+func writeToolchainShims() error {
+	bin, err := userBinDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		return err
+	}
+	for _, name := range []string{"vira", "virac"} {
+		file, content := filepath.Join(bin, name), unixShim(name)
+		if runtime.GOOS == "windows" {
+			file, content = file+".cmd", windowsShim(name)
+		}
+		if err := os.WriteFile(file, []byte(content), 0755); err != nil {
+			return err
+		}
+	}
+	if !onPath(bin) {
+		pterm.Warning.Printfln("%s is not on PATH; add it before the system installation to run the selected toolchain", bin)
+	}
+	return nil
+}
+
+func unixShim(name string) string {
+	toolchains := `$HOME/.vira/toolchains`
+	if runtime.GOOS == "linux" {
+		toolchains = `${XDG_DATA_HOME:-$HOME/.local/share}/vira/toolchains`
+	}
+	return `#!/bin/sh
+# Written by vira toolchain use: runs ` + name + ` from the selected toolchain.
+if [ -n "$VIRA_HOME" ]; then
+	toolchains="$VIRA_HOME/toolchains"
+else
+	toolchains="` + toolchains + `"
+fi
+version="${VIRA_TOOLCHAIN:-$(cat "$toolchains/default" 2>/dev/null)}"
+if [ -n "$version" ] && [ "$version" != system ] && [ -x "$toolchains/$version/bin/` + name + `" ]; then
+	exec "$toolchains/$version/bin/` + name + `" "$@"
+fi
+exec /usr/bin/` + name + ` "$@"
+`
+}
+
+func windowsShim(name string) string {
+	return `@echo off
+rem Written by vira toolchain use: runs ` + name + ` from the selected toolchain.
+setlocal
+set "home=%VIRA_HOME%"
+if "%home%"=="" set "home=%USERPROFILE%\.vira"
+set "version=%VIRA_TOOLCHAIN%"
+if "%version%"=="" if exist "%home%\toolchains\default" set /p version=<"%home%\toolchains\default"
+if "%version%"=="" goto system
+if "%version%"=="system" goto system
+if not exist "%home%\toolchains\%version%\bin\` + name + `.exe" goto system
+"%home%\toolchains\%version%\bin\` + name + `.exe" %*
+exit /b %errorlevel%
+:system
+"%SystemRoot%\System32\` + name + `.exe" %*
+exit /b %errorlevel%
+`
+}
+
+// selectProjectToolchain makes the toolchain pinned for the current
+// directory the active one for this process and the tools it runs, offering
+// to install it if it is missing. VIRA_TOOLCHAIN takes precedence.
+func selectProjectToolchain() error {
+	if os.Getenv("VIRA_TOOLCHAIN") != "" {
+		return nil
+	}
+	pin, file, err := toolchain.Pinned(".")
+	if err != nil || pin == "" {
+		return err
+	}
+	version := pin
+	switch {
+	case pin == "system":
+	case isChannel(pin):
+		if version, err = latestToolchain(pin); err != nil {
+			return err
+		}
+	case !toolchainVersionPattern.MatchString(pin):
+		return fmt.Errorf("%s: unknown toolchain %q (use a version or a channel)", file, pin)
+	}
+	if version != "system" && !toolchainInstalled(version) {
+		if !confirm(fmt.Sprintf("Toolchain %s, required by %s, is not installed. Install it now?", version, file), false) {
+			return fmt.Errorf("toolchain %s, required by %s, is not installed (run vira toolchain install %s, or use --yes to install it)", version, file, version)
+		}
+		if _, err := installToolchain(version, nil); err != nil {
+			return err
+		}
+	}
+	return os.Setenv("VIRA_TOOLCHAIN", version)
+}
+
+// confirm asks a yes/no question on the terminal. With --yes or assume-yes
+// in config.toml, the answer is yes. When nobody can answer, without a
+// terminal or in CI, the answer is unattended, which callers set only for
+// steps that are safe to take unasked.
+func confirm(question string, unattended bool) bool {
+	if assumeYes {
+		return true
+	}
+	if cfg, err := loadGlobalConfig(); err == nil && cfg.AssumeYes {
+		return true
+	}
+	if !terminal.Interactive() {
+		return unattended
+	}
+	pterm.Print(question + " [Y/n] ")
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "" || answer == "y" || answer == "yes"
+}
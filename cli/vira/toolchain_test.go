@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDownloadReleaseChecksums(t *testing.T) {
+	sum := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(h[:]) + "  file\n"
+	}
+	responses := map[string]struct {
+		status int
+		body   string
+	}{
+		"/v1.0.0/verified.zip":           {http.StatusOK, "verified"},
+		"/v1.0.0/verified.zip.sha256":    {http.StatusOK, sum("verified")},
+		"/v1.0.0/unpublished.zip":        {http.StatusOK, "unpublished"},
+		"/v1.0.0/unpublished.zip.sha256": {http.StatusNotFound, ""},
+		"/v1.0.0/unavailable.zip":        {http.StatusOK, "unavailable"},
+		"/v1.0.0/unavailable.zip.sha256": {http.StatusServiceUnavailable, ""},
+		"/v1.0.0/mismatched.zip":         {http.StatusOK, "mismatched"},
+		"/v1.0.0/mismatched.zip.sha256":  {http.StatusOK, sum("something else")},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, ok := responses[r.URL.Path]
+		if !ok {
+			resp.status = http.StatusNotFound
+		}
+		w.WriteHeader(resp.status)
+		w.Write([]byte(resp.body))
+	}))
+	defer srv.Close()
+	t.Setenv("VIRA_TOOLCHAIN_MIRROR", srv.URL)
+
+	tests := []struct {
+		file    string
+		wantErr string
+	}{
+		{"verified.zip", ""},
+		// A release may be published without checksums.
+		{"unpublished.zip", ""},
+		{"unavailable.zip", "unavailable.zip.sha256: bad status: 503"},
+		{"mismatched.zip", "checksum mismatch for mismatched.zip"},
+	}
+	for _, tt := range tests {
+		data, err := downloadRelease("1.0.0", tt.file)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("downloadRelease(%s): %v", tt.file, err)
+		case tt.wantErr == "" && string(data) != strings.TrimSuffix(tt.file, ".zip"):
+			t.Errorf("downloadRelease(%s) = %q", tt.file, data)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("downloadRelease(%s) error = %v, want %q", tt.file, err, tt.wantErr)
+		}
+	}
+}
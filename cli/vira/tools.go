@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/pterm/pterm"
+)
+
+// brokenTool is a binary of the active toolchain that cannot be run.
+type brokenTool struct {
+	name      string
+	path      string
+	reason    string
+	component string
+}
+
+// checkTools reports the tools, such as plsa or compiler, that are missing
+// from the active toolchain or are not executable.
+func checkTools(names ...string) []brokenTool {
+	var broken []brokenTool
+	for _, name := range names {
+		path := toolPath(name)
+		info, err := os.Stat(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			t := brokenTool{name: name, path: path, reason: "does not exist"}
+			t.component, _ = missingComponent(name)
+			broken = append(broken, t)
+		case err != nil:
+			broken = append(broken, brokenTool{name: name, path: path, reason: err.Error()})
+		case info.IsDir():
+			broken = append(broken, brokenTool{name: name, path: path, reason: "is a directory"})
+		case runtime.GOOS != "windows" && info.Mode()&0111 == 0:
+			broken = append(broken, brokenTool{name: name, path: path, reason: fmt.Sprintf("is not executable (mode %v)", info.Mode().Perm())})
+		}
+	}
+	return broken
+}
+
+// ensureTools checks the tools a pipeline needs before it runs. If any are
+// broken, the error says which and how to fix it; on a terminal, a damaged
+// toolchain is offered to be repaired right away.
+func ensureTools(names ...string) error {
+	bin, err := toolchainBinDir()
+	if err != nil {
+		return err
+	}
+	broken := checkTools(names...)
+	if len(broken) == 0 {
+		return nil
+	}
+	var components []string
+	repairable := false
+	for _, t := range broken {
+		if t.component != "" {
+			if !containsString(components, t.component) {
+				components = append(components, t.component)
+			}
+		} else {
+			repairable = true
+		}
+	}
+	if repairable && confirm(toolsProblem(broken)+"\nRepair the toolchain now?", true) {
+		if err := repairToolchain(); err != nil {
+			return err
+		}
+		if broken = checkTools(names...); len(broken) == 0 {
+			return nil
+		}
+	}
+
+	msg := toolsProblem(broken)
+	switch {
+	case repairable && activeToolchain() == "" && !dirExists(bin):
+		msg += "\nno Vira toolchain is installed in " + bin + "; run vira setup to install one"
+	case repairable:
+		msg += "\nthe toolchain is damaged; run vira update --repair to download it again"
+	}
+	if len(components) > 0 {
+		msg += "\nnot every component of the toolchain is installed; run vira component add " + strings.Join(components, " ")
+	}
+	return errors.New(msg)
+}
+
+func toolsProblem(broken []brokenTool) string {
+	toolchain := "the system toolchain"
+	if version := activeToolchain(); version != "" {
+		toolchain = "toolchain " + version
+	}
+	lines := []string{"tools of " + toolchain + " cannot be run:"}
+	for _, t := range broken {
+		reason := t.path + " " + t.reason
+		if t.component != "" {
+			reason = "the " + t.component + " component is not installed"
+		}
+		lines = append(lines, "  "+t.name+": "+reason)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func dirExists(dir string) bool {
+	info, err := os.Stat(dir)
+	return err == nil && info.IsDir()
+}
+
+// repairToolchain downloads the active toolchain again and unpacks it over
+// the installed one. Of a toolchain installed by component, the installed
+// components are downloaded again.
+func repairToolchain() error {
+	if offlineMode() {
+		return offlineError("repairing the toolchain")
+	}
+	version := activeToolchain()
+	if version == "" {
+		return repairSystemToolchain()
+	}
+	dir, err := toolchainDir(version)
+	if err != nil {
+		return err
+	}
+	if !toolchainInstalled(version) {
+		_, err := installToolchain(version, nil)
+		return err
+	}
+	unlock, err := lockPath(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	pterm.Info.Printfln("Repairing toolchain %s", version)
+	if m, _, err := installedComponents(version); err == nil {
+		var names []string
+		for _, c := range m.Components {
+			if c.Installed {
+				names = append(names, c.Name)
+			}
+		}
+		if err := m.install(version, dir, names); err != nil {
+			return err
+		}
+	} else {
+		file := "bin-" + runtime.GOOS + ".zip"
+		data, err := downloadRelease(version, file)
+		if err != nil {
+			return fmt.Errorf("failed to download toolchain %s: %v", version, err)
+		}
+		sums, err := unzipToolchain(data, filepath.Join(dir, "bin"))
+		if err == nil {
+			err = recordFiles(dir, sums)
+		}
+		if err != nil {
+			return fmt.Errorf("toolchain %s: %v", version, err)
+		}
+	}
+	pterm.Success.Printfln("Repaired toolchain %s", version)
+	return nil
+}
+
+// repairSystemToolchain unpacks the release recorded in the version.json
+// of the system installation over its directory again.
+func repairSystemToolchain() error {
+	binPath, err := systemBinPath()
+	if err != nil {
+		return err
+	}
+	version := toolchainVersion()
+	if version == "" {
+		return fmt.Errorf("the version of the system toolchain in %s is unknown; run vira setup to install a toolchain instead", binPath)
+	}
+	pterm.Info.Printfln("Repairing the system toolchain %s in %s", version, binPath)
+	file := "bin-" + runtime.GOOS + ".zip"
+	data, err := downloadRelease(version, file)
+	if err != nil {
+		return fmt.Errorf("failed to download toolchain %s: %v", version, err)
+	}
+	if _, err := unzipToolchain(data, binPath); err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("%v (the system toolchain may need to be repaired as an administrator)", err)
+		}
+		return err
+	}
+	pterm.Success.Printfln("Repaired the system toolchain %s", version)
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"vira/pkg/interrupt"
+)
+
+// Pipeline tools that support it can be kept running between files, which
+// saves their startup on builds of many files. Such a tool, started with
+// --serve, writes the banner line
+//
+//	vira-serve 1
+//
+// and then reads requests from stdin, one per line: the working directory
+// and the arguments of a run, separated by tabs. For each it writes the
+// output the run would have printed, then a NUL byte, the exit status and a
+// newline. It exits at the end of stdin. Tools that do not write the banner
+// are run once per file as before.
+const toolServerBanner = "vira-serve 1"
+
+// toolServerStartTimeout bounds the wait for the banner, for tools that
+// take --serve for something else.
+const toolServerStartTimeout = 2 * time.Second
+
+// toolPool holds the idle servers of each tool while a build runs.
+type toolPool struct {
+	mu          sync.Mutex
+	idle        map[string][]*toolServer
+	unsupported map[string]bool
+}
+
+type toolServer struct {
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	out *bufio.Reader
+}
+
+// activeToolPool is the pool runStageOutput uses, if any.
+var activeToolPool *toolPool
+
+// startToolPool makes pipeline tools run as servers until the returned
+// function is called.
+func startToolPool() (stop func()) {
+	pool := &toolPool{idle: map[string][]*toolServer{}, unsupported: map[string]bool{}}
+	activeToolPool = pool
+	return func() {
+		activeToolPool = nil
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		for _, servers := range pool.idle {
+			for _, s := range servers {
+				s.close()
+			}
+		}
+		pool.idle = nil
+	}
+}
+
+// toolExitError is the failure of a run on a tool server, which is not an
+// *exec.ExitError since the process keeps running.
+type toolExitError struct {
+	code int
+}
+
+func (e *toolExitError) Error() string {
+	return "exit status " + strconv.Itoa(e.code)
+}
+
+// toolFailed reports whether err is a tool exiting with a failure, rather
+// than the tool not running at all.
+func toolFailed(err error) bool {
+	var exitErr *exec.ExitError
+	var serverErr *toolExitError
+	return errors.As(err, &exitErr) || errors.As(err, &serverErr)
+}
+
+// run runs tool with args in dir on one of its servers, returning its
+// output and failure. ran is false when the tool has no server mode or the
+// server failed, in which case the caller runs the tool itself.
+func (p *toolPool) run(tool, dir string, args []string) (out string, ran bool, err error) {
+	for _, arg := range append([]string{dir}, args...) {
+		if strings.ContainsAny(arg, "\t\n") {
+			return "", false, nil
+		}
+	}
+	s := p.get(tool)
+	if s == nil {
+		return "", false, nil
+	}
+	out, code, err := s.request(dir, args)
+	if err != nil {
+		// The server crashed or broke the protocol; running the tool
+		// directly reports what went wrong.
+		logf("the %s server failed: %v", tool, err)
+		s.close()
+		return "", false, nil
+	}
+	p.put(tool, s)
+	if code != 0 {
+		return out, true, &toolExitError{code: code}
+	}
+	return out, true, nil
+}
+
+// get returns an idle server of tool, starting one if there is none.
+func (p *toolPool) get(tool string) *toolServer {
+	p.mu.Lock()
+	if p.idle == nil || p.unsupported[tool] {
+		p.mu.Unlock()
+		return nil
+	}
+	if servers := p.idle[tool]; len(servers) > 0 {
+		s := servers[len(servers)-1]
+		p.idle[tool] = servers[:len(servers)-1]
+		p.mu.Unlock()
+		return s
+	}
+	p.mu.Unlock()
+
+	s, err := startToolServer(tool)
+	if err != nil {
+		logf("running %s once per file: %v", tool, err)
+		p.mu.Lock()
+		p.unsupported[tool] = true
+		p.mu.Unlock()
+		return nil
+	}
+	return s
+}
+
+func (p *toolPool) put(tool string, s *toolServer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.idle == nil {
+		s.close()
+		return
+	}
+	p.idle[tool] = append(p.idle[tool], s)
+}
+
+func startToolServer(tool string) (*toolServer, error) {
+	cmd := exec.Command(tool, "--serve")
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := interrupt.Start(cmd); err != nil {
+		return nil, err
+	}
+	s := &toolServer{cmd: cmd, in: in, out: bufio.NewReader(stdout)}
+	banner := make(chan string, 1)
+	go func() {
+		line, _ := s.out.ReadString('\n')
+		banner <- strings.TrimSpace(line)
+	}()
+	select {
+	case line := <-banner:
+		if line == toolServerBanner {
+			return s, nil
+		}
+		s.close()
+		return nil, fmt.Errorf("%s has no server mode", tool)
+	case <-time.After(toolServerStartTimeout):
+		s.close()
+		return nil, fmt.Errorf("%s did not start a server", tool)
+	}
+}
+
+// request runs one request and returns the output and exit status of the
+// run.
+func (s *toolServer) request(dir string, args []string) (string, int, error) {
+	if _, err := io.WriteString(s.in, strings.Join(append([]string{dir}, args...), "\t")+"\n"); err != nil {
+		return "", 0, err
+	}
+	out, err := s.out.ReadString(0)
+	if err != nil {
+		return "", 0, err
+	}
+	status, err := s.out.ReadString('\n')
+	if err != nil {
+		return "", 0, err
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(status))
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid exit status %q", strings.TrimSpace(status))
+	}
+	return strings.TrimSuffix(out, "\x00"), code, nil
+}
+
+func (s *toolServer) close() {
+	s.in.Close()
+	done := make(chan struct{})
+	go func() {
+		interrupt.Wait(s.cmd)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(toolServerStartTimeout):
+		s.cmd.Process.Kill()
+		<-done
+	}
+}
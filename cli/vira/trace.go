@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// buildTrace records, when vira build runs with --trace, a span for every
+// pipeline stage, cache lookup, download and link, and writes them in the
+// Chrome trace event format, which Perfetto and chrome://tracing display
+// on a timeline.
+var buildTrace *traceRecorder
+
+type traceRecorder struct {
+	mu    sync.Mutex
+	start time.Time
+	spans []*traceSpanRecord
+	// parallel counts the parallel sections running, whose spans cannot be
+	// told apart by nesting.
+	parallel int
+}
+
+type traceSpanRecord struct {
+	cat, name  string
+	args       map[string]any
+	start, end time.Duration
+	// detached spans were started in a parallel section.
+	detached bool
+}
+
+// traceEvent is a complete ("X") or metadata ("M") event of the Chrome
+// trace event format. Times are in microseconds.
+type traceEvent struct {
+	Name string         `json:"name"`
+	Cat  string         `json:"cat,omitempty"`
+	Ph   string         `json:"ph"`
+	TS   int64          `json:"ts"`
+	Dur  int64          `json:"dur,omitempty"`
+	PID  int            `json:"pid"`
+	TID  int            `json:"tid"`
+	Args map[string]any `json:"args,omitempty"`
+}
+
+// openTrace starts recording spans and returns the function that writes
+// them to path.
+func openTrace(path string) (func() error, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	// Fail now rather than after the build if path cannot be written.
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	buildTrace = &traceRecorder{start: time.Now()}
+	return func() error {
+		events := buildTrace.events()
+		buildTrace = nil
+		enc := json.NewEncoder(f)
+		if err := enc.Encode(struct {
+			TraceEvents     []traceEvent `json:"traceEvents"`
+			DisplayTimeUnit string       `json:"displayTimeUnit"`
+		}{events, "ms"}); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}, nil
+}
+
+// traceSpan starts a span of category cat, if a trace is being recorded,
+// and returns the function that ends it. args are shown with the span.
+func traceSpan(cat, name string, args map[string]any) func() {
+	t := buildTrace
+	if t == nil {
+		return func() {}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	span := &traceSpanRecord{cat: cat, name: name, args: args, start: time.Since(t.start), detached: t.parallel > 0}
+	t.spans = append(t.spans, span)
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		span.end = time.Since(t.start)
+	}
+}
+
+// traceParallel marks the start of a section whose spans run concurrently,
+// and returns the function that marks its end.
+func traceParallel() func() {
+	t := buildTrace
+	if t == nil {
+		return func() {}
+	}
+	t.mu.Lock()
+	t.parallel++
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		t.parallel--
+		t.mu.Unlock()
+	}
+}
+
+// events lays the spans out on tracks: spans of the sequential part of the
+// build nest on the first track, and those of parallel sections, which
+// would not nest properly, are packed onto further tracks without nesting.
+func (t *traceRecorder) events() []traceEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	spans := append([]*traceSpanRecord{}, t.spans...)
+	sort.SliceStable(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	end := time.Since(t.start)
+	var events []traceEvent
+	var trackEnds []time.Duration
+	for _, s := range spans {
+		if s.end == 0 {
+			// A span a failure left open ends with the trace.
+			s.end = end
+		}
+		tid := 1
+		if s.detached {
+			track := 0
+			for track < len(trackEnds) && trackEnds[track] > s.start {
+				track++
+			}
+			if track == len(trackEnds) {
+				trackEnds = append(trackEnds, 0)
+			}
+			trackEnds[track] = s.end
+			tid = track + 2
+		}
+		events = append(events, traceEvent{
+			Name: s.name,
+			Cat:  s.cat,
+			Ph:   "X",
+			TS:   s.start.Microseconds(),
+			Dur:  max((s.end - s.start).Microseconds(), 1),
+			PID:  1,
+			TID:  tid,
+			Args: s.args,
+		})
+	}
+	events = append(events, traceEvent{Name: "process_name", Ph: "M", PID: 1, Args: map[string]any{"name": "vira build"}})
+	events = append(events, traceEvent{Name: "thread_name", Ph: "M", PID: 1, TID: 1, Args: map[string]any{"name": "vira"}})
+	for i := range trackEnds {
+		events = append(events, traceEvent{Name: "thread_name", Ph: "M", PID: 1, TID: i + 2, Args: map[string]any{"name": fmt.Sprintf("parallel %d", i+1)}})
+	}
+	return events
+}
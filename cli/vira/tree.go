@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+func newTreeCmd() *cobra.Command {
+	var invert string
+
+	cmd := &cobra.Command{
+		Use:   "tree",
+		Short: "Print the resolved dependency tree",
+		Long: `Print the resolved dependency tree.
+
+Packages resolved at more than one version are marked with the other
+versions, and subtrees that were already printed are marked with (*).
+With --invert, the tree is turned upside down to show every path through
+which a package ends up in the build.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			proj, err := loadProject(".")
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			res, _, err := proj.resolve(resolveOptions{})
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			if invert != "" {
+				err = printInvertedTree(os.Stdout, res, invert)
+			} else {
+				printTree(os.Stdout, res, res.root, func(p *resolvedPackage) []string { return p.Deps })
+			}
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+		},
+	}
+	cmd.Flags().StringVarP(&invert, "invert", "i", "", "show the packages that depend on the given package")
+	return cmd
+}
+
+func treeLabel(res *resolution, key string) string {
+	pkg := res.packages[key]
+	label := pkg.Name + " v" + pkg.Version
+	if len(pkg.Features) > 0 {
+		label += " [features: " + strings.Join(pkg.Features, ", ") + "]"
+	}
+	if key == res.root {
+		return label
+	}
+	var others []string
+	for _, v := range res.versionsOf(pkg.Name) {
+		if v != pkg.Version {
+			others = append(others, "v"+v)
+		}
+	}
+	if len(others) > 0 {
+		label += " (duplicate: also " + strings.Join(others, ", ") + ")"
+	}
+	return label
+}
+
+// printTree prints the tree below root, following the edges returned by
+// next. Subtrees are only expanded the first time they appear.
+func printTree(w io.Writer, res *resolution, root string, next func(*resolvedPackage) []string) {
+	fmt.Fprintln(w, treeLabel(res, root))
+	expanded := map[string]bool{root: true}
+	var walk func(key, prefix string)
+	walk = func(key, prefix string) {
+		children := next(res.packages[key])
+		for i, child := range children {
+			branch, indent := "├── ", "│   "
+			if i == len(children)-1 {
+				branch, indent = "└── ", "    "
+			}
+			label := treeLabel(res, child)
+			if expanded[child] && len(next(res.packages[child])) > 0 {
+				fmt.Fprintln(w, prefix+branch+label+" (*)")
+				continue
+			}
+			fmt.Fprintln(w, prefix+branch+label)
+			expanded[child] = true
+			walk(child, prefix+indent)
+		}
+	}
+	walk(root, "")
+}
+
+func printInvertedTree(w io.Writer, res *resolution, name string) error {
+	versions := res.versionsOf(name)
+	if len(versions) == 0 {
+		return fmt.Errorf("package %s is not a dependency of %s", name, res.packages[res.root].Name)
+	}
+	rev := res.dependents()
+	for i, v := range versions {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		printTree(w, res, pkgKey(name, v), func(p *resolvedPackage) []string {
+			return rev[pkgKey(p.Name, p.Version)]
+		})
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// treeManifest depends on two versions of math, and on std both directly
+// and through the dependencies of net and math, in testdata/registry.json.
+const treeManifest = `[package]
+name = "app"
+version = "0.1.0"
+
+[dependencies]
+net = "0.5"
+math = { version = "0.1" }
+std = { version = "1.1", features = ["alloc"] }
+`
+
+func TestTree(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, manifestName), []byte(treeManifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "src", "main.vira"), []byte("int main() { return 0; }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	registry, err := filepath.Abs(filepath.Join("testdata", "registry.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("VIRA_REGISTRY", registry)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{
+			[]string{"tree"},
+			`app v0.1.0
+├── math v0.1.0 (duplicate: also v0.2.1)
+├── net v0.5.1
+│   ├── math v0.2.1 [features: default, float] (duplicate: also v0.1.0)
+│   │   └── std v1.1.0 [features: alloc]
+│   └── std v1.1.0 [features: alloc]
+└── std v1.1.0 [features: alloc]
+`,
+		},
+		{
+			[]string{"tree", "--invert", "std"},
+			`std v1.1.0 [features: alloc]
+├── app v0.1.0
+├── math v0.2.1 [features: default, float] (duplicate: also v0.1.0)
+│   └── net v0.5.1
+│       └── app v0.1.0
+└── net v0.5.1 (*)
+`,
+		},
+	}
+	for _, tt := range tests {
+		stdout, stderr, err := runVira(t, dir, tt.args...)
+		if err != nil {
+			t.Fatalf("vira %v: %v\n%s", tt.args, err, stderr)
+		}
+		if stdout != tt.want {
+			t.Errorf("vira %v printed\n%s\nwant\n%s", tt.args, stdout, tt.want)
+		}
+	}
+}
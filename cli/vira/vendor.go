@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+const (
+	vendorDirName = "vendor"
+	// vendorIndexName records what was vendored, inside the vendor directory.
+	vendorIndexName = "vendor.json"
+)
+
+// vendorIndex lists the packages in a project's vendor directory together
+// with the SHA-256 of every file, so a vendored tree can be verified.
+type vendorIndex struct {
+	Packages []vendoredPackage `json:"packages"`
+}
+
+type vendoredPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Source  string `json:"source"`
+	// Files maps file names inside the package directory to their hashes.
+	Files map[string]string `json:"files"`
+}
+
+func (v vendoredPackage) dirName() string {
+	return v.Name + "-" + v.Version
+}
+
+func (p *project) vendorDir() string {
+	return filepath.Join(p.root, vendorDirName)
+}
+
+// loadVendorIndex returns the project's vendor index, or nil if the project
+// has not been vendored.
+func (p *project) loadVendorIndex() (*vendorIndex, error) {
+	data, err := os.ReadFile(filepath.Join(p.vendorDir(), vendorIndexName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var idx vendorIndex
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", filepath.Join(vendorDirName, vendorIndexName), err)
+	}
+	return &idx, nil
+}
+
+// verify checks every vendored file against its recorded hash.
+func (idx *vendorIndex) verify(dir string) error {
+	for _, pkg := range idx.Packages {
+		for _, name := range sortedKeys(pkg.Files) {
+			file := filepath.Join(dir, pkg.dirName(), name)
+			sum, err := fileHash(file)
+			if err != nil {
+				return fmt.Errorf("vendored %s v%s: %v", pkg.Name, pkg.Version, err)
+			}
+			if sum != pkg.Files[name] {
+				return fmt.Errorf("vendored %s v%s: checksum mismatch for %s", pkg.Name, pkg.Version, name)
+			}
+		}
+	}
+	return nil
+}
+
+func fileHash(file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// dependencyDirs returns the directories holding the sources of the
+// project's dependencies, which are passed to the preprocessor as include
+// directories. A vendored project is built from vendor/ without touching the
+// network; otherwise the versions pinned in vira.lock are taken from the
+// download cache, checked against their recorded checksums.
+func (p *project) dependencyDirs(opts resolveOptions) ([]string, error) {
+	if len(p.manifest.Dependencies) == 0 {
+		return nil, nil
+	}
+	vendored, err := p.loadVendorIndex()
+	if err != nil {
+		return nil, err
+	}
+	if vendored != nil {
+		if err := vendored.verify(p.vendorDir()); err != nil {
+			return nil, err
+		}
+		var dirs []string
+		for _, pkg := range vendored.Packages {
+			dirs = append(dirs, filepath.Join(p.vendorDir(), pkg.dirName()))
+		}
+		// Path dependencies are not vendored but used in place.
+		local, err := p.pathDependencies()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range sortedKeys(local) {
+			dirs = append(dirs, packageIncludeDir(local[name].dir))
+		}
+		return dirs, nil
+	}
+
+	_, lf, err := p.resolve(opts)
+	if err != nil {
+		return nil, err
+	}
+	sources, err := p.sourceDirs(lf)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, key := range sortedKeys(sources) {
+		dirs = append(dirs, sources[key])
+	}
+	return dirs, nil
+}
+
+func newVendorCmd() *cobra.Command {
+	var verify, locked bool
+
+	cmd := &cobra.Command{
+		Use:   "vendor",
+		Short: "Copy all dependencies into the vendor directory",
+		Long: `Download every resolved dependency into vendor/ and record the hash of
+each file in vendor/vendor.json.
+
+Once a project is vendored, vira build uses the vendored sources, verifies
+them against the recorded hashes and needs no network access, so
+vira build --offline works. Run vira vendor again after changing the
+dependencies, or vira vendor --verify to check the vendored tree.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			proj, err := loadProject(".")
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			if verify {
+				err = proj.verifyVendor()
+			} else {
+				err = proj.vendor(locked)
+			}
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+		},
+	}
+	cmd.Flags().BoolVar(&verify, "verify", false, "check the vendored files against the recorded hashes")
+	cmd.Flags().BoolVar(&locked, "locked", false, "fail if vira.lock is missing or out of date")
+	return cmd
+}
+
+func (p *project) verifyVendor() error {
+	idx, err := p.loadVendorIndex()
+	if err != nil {
+		return err
+	}
+	if idx == nil {
+		return errors.New("the project is not vendored")
+	}
+	if err := idx.verify(p.vendorDir()); err != nil {
+		return err
+	}
+	pterm.Success.Printfln("Verified %d vendored packages", len(idx.Packages))
+	return nil
+}
+
+// vendor replaces the vendor directory with copies of all dependencies
+// pinned in vira.lock, taken from the download cache.
+func (p *project) vendor(locked bool) error {
+	dir := p.vendorDir()
+	if _, err := os.Stat(dir); err == nil {
+		// Only replace a directory this command created.
+		if _, err := os.Stat(filepath.Join(dir, vendorIndexName)); err != nil {
+			return fmt.Errorf("%s exists but was not created by vira vendor", dir)
+		}
+	}
+
+	_, lf, err := p.resolve(resolveOptions{locked: locked})
+	if err != nil {
+		return err
+	}
+
+	// Download into a fresh directory first so a failure leaves the old
+	// vendor directory intact.
+	tmp := dir + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	vendored := vendorIndex{Packages: []vendoredPackage{}}
+	for _, pkg := range lf.Packages[1:] {
+		if strings.HasPrefix(pkg.Source, "path+") {
+			continue
+		}
+		v := vendoredPackage{Name: pkg.Name, Version: pkg.Version, Source: pkg.Source, Files: map[string]string{}}
+		pterm.Info.Printfln("Vendoring %s v%s", pkg.Name, pkg.Version)
+		if repo, commit, ok := parseGitSource(pkg.Source); ok {
+			if v.Files, err = vendorCheckout(repo, commit, filepath.Join(tmp, v.dirName())); err != nil {
+				return err
+			}
+			vendored.Packages = append(vendored.Packages, v)
+			continue
+		}
+		cached, err := cachedPackage(pkg)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(cached)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		file := filepath.Base(cached)
+		if v.Files[file] = hex.EncodeToString(sum[:]); pkg.Checksum != "" && v.Files[file] != pkg.Checksum {
+			return fmt.Errorf("checksum mismatch for %s v%s: %s does not match %s", pkg.Name, pkg.Version, cached, lockfileName)
+		}
+		if err := os.MkdirAll(filepath.Join(tmp, v.dirName()), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(tmp, v.dirName(), file), data, 0644); err != nil {
+			return err
+		}
+		vendored.Packages = append(vendored.Packages, v)
+	}
+	data, err := json.MarshalIndent(vendored, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(tmp, vendorIndexName), append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return err
+	}
+	pterm.Success.Printfln("Vendored %d packages into %s", len(vendored.Packages), p.rel(dir))
+	return nil
+}
+
+// vendorCheckout copies the sources of a git dependency at commit into dir
+// and returns their hashes.
+func vendorCheckout(repo, commit, dir string) (map[string]string, error) {
+	checkout, err := gitCheckout(repo, commit)
+	if err != nil {
+		return nil, err
+	}
+	src := packageIncludeDir(checkout)
+	files := map[string]string{}
+	err = filepath.WalkDir(src, func(file string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(file) != ".vira" {
+			return nil
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(target, data, 0644); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		files[filepath.ToSlash(rel)] = hex.EncodeToString(sum[:])
+		return nil
+	})
+	return files, err
+}
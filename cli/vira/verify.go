@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"vira/pkg/i18n"
+)
+
+func newVerifyBuildCmd() *cobra.Command {
+	var opts buildOptions
+	var against string
+
+	cmd := &cobra.Command{
+		Use:   "verify-build",
+		Short: "Check that the project builds reproducibly",
+		Long: `Build the project twice from scratch with --reproducible, a second apart
+and in different directories below target/verify-build, and compare the
+executables byte for byte. With --against, the project is built once and
+compared with the given executable instead, such as a released one.
+
+When the executables differ, the sections of the executable the
+differences are in are listed along with the likely sources of them:
+timestamps, found where the two hold nearby times, and the paths of the
+build, found where an executable contains the directory it was built in.
+The command fails unless the executables are identical.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			proj, err := loadProject(".")
+			if err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			cmp, err := proj.verifyBuild(opts, against)
+			if err != nil {
+				printError(err)
+				exit(1)
+			}
+			if jsonOutput {
+				if err := printJSON(cmp); err != nil {
+					pterm.Error.Println(err)
+					exit(1)
+				}
+			} else {
+				printComparison(cmp)
+			}
+			if !cmp.Identical {
+				exit(1)
+			}
+		},
+	}
+	cmd.Flags().BoolVar(&opts.release, "release", false, "build with the release profile")
+	cmd.Flags().StringVar(&opts.target, "target", "", "build for another platform, as vira build --target does")
+	cmd.Flags().BoolVar(&opts.locked, "locked", false, "fail if vira.lock is missing or out of date")
+	cmd.Flags().StringVar(&against, "against", "", "compare a single build with this executable")
+	return cmd
+}
+
+// buildComparison is the outcome of vira verify-build, which --json prints.
+type buildComparison struct {
+	First        string `json:"first"`
+	Second       string `json:"second"`
+	FirstSHA256  string `json:"first_sha256"`
+	SecondSHA256 string `json:"second_sha256"`
+	Identical    bool   `json:"identical"`
+	// DifferingBytes counts the bytes that differ, with the difference in
+	// size counted as well.
+	DifferingBytes int `json:"differing_bytes"`
+	// Sections are the sections of the executable with differences.
+	Sections []string `json:"sections"`
+	// Sources are the likely sources of nondeterminism.
+	Sources []string `json:"sources"`
+}
+
+// setReproducibleEnv makes the tools of the build, and the programs they
+// run, leave out when the build happened: SOURCE_DATE_EPOCH, the time
+// tools use instead of the current one, is set to the time of the last
+// commit, or the start of 1970 outside git, unless it is set already.
+func (p *project) setReproducibleEnv() error {
+	if os.Getenv("SOURCE_DATE_EPOCH") == "" {
+		epoch, err := runGit(p.root, "log", "-1", "--format=%ct")
+		if _, perr := strconv.ParseInt(epoch, 10, 64); err != nil || perr != nil {
+			epoch = "0"
+		}
+		if err := os.Setenv("SOURCE_DATE_EPOCH", epoch); err != nil {
+			return err
+		}
+	}
+	// Apple's tools leave the modification times out of archives.
+	return os.Setenv("ZERO_AR_DATE", "1")
+}
+
+// verifyBuild builds the project twice, or once if against is set, and
+// compares the executables.
+func (p *project) verifyBuild(opts buildOptions, against string) (*buildComparison, error) {
+	opts.reproducible = true
+	base := filepath.Join("verify-build", opts.outputDir())
+	if err := os.RemoveAll(p.targetDir(base)); err != nil {
+		return nil, err
+	}
+	var dirs, exes []string
+	for i := 1; i <= 2; i++ {
+		if i == 2 && against != "" {
+			break
+		}
+		if i == 2 {
+			// Timestamps of the second build differ from those of the
+			// first.
+			time.Sleep(time.Second)
+		}
+		opts.dir = filepath.Join(base, strconv.Itoa(i))
+		pterm.DefaultSection.Println(i18n.T("Building %s v%s", p.manifest.Package.Name, p.manifest.Package.Version))
+		exe, err := p.build(opts)
+		if err != nil {
+			return nil, err
+		}
+		dirs, exes = append(dirs, p.targetDir(opts.dir)), append(exes, exe)
+	}
+	if against != "" {
+		abs, err := filepath.Abs(against)
+		if err != nil {
+			return nil, err
+		}
+		exes = append(exes, abs)
+	}
+	return compareExecutables(exes[0], exes[1], append(dirs, p.root))
+}
+
+// compareExecutables compares first and second, looking for the first of
+// dirs either contains.
+func compareExecutables(first, second string, dirs []string) (*buildComparison, error) {
+	a, err := os.ReadFile(first)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(second)
+	if err != nil {
+		return nil, err
+	}
+	c := &buildComparison{First: first, Second: second, Sections: []string{}, Sources: []string{}}
+	if c.FirstSHA256, err = fileHash(first); err != nil {
+		return nil, err
+	}
+	if c.SecondSHA256, err = fileHash(second); err != nil {
+		return nil, err
+	}
+	if c.Identical = bytes.Equal(a, b); c.Identical {
+		return c, nil
+	}
+
+	var diffs []int64
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			diffs = append(diffs, int64(i))
+		}
+	}
+	c.DifferingBytes = len(diffs) + max(len(a), len(b)) - n
+	if len(a) != len(b) {
+		c.Sources = append(c.Sources, fmt.Sprintf("the executables differ in size: %d and %d bytes", len(a), len(b)))
+	}
+
+	sections := map[string]bool{}
+	ranges := sectionRanges(first)
+	timestamps := 0
+	for _, off := range diffs {
+		name := "outside any section"
+		for _, r := range ranges {
+			if off >= r.offset && off < r.offset+r.size {
+				name = r.name
+				break
+			}
+		}
+		sections[name] = true
+		if nearbyTimes(a, b, off) {
+			timestamps++
+		}
+	}
+	c.Sections = sortedKeys(sections)
+	if timestamps > 0 {
+		c.Sources = append(c.Sources, fmt.Sprintf("timestamps: %d of the differing bytes are part of times of the builds", timestamps))
+	}
+	// dirs are the most specific first: the project directory contains the
+	// build directories.
+	for _, dir := range dirs {
+		if bytes.Contains(a, []byte(dir)) || bytes.Contains(b, []byte(dir)) {
+			c.Sources = append(c.Sources, "paths: the executables contain the directory "+dir)
+			break
+		}
+	}
+	if len(c.Sources) == 0 {
+		c.Sources = append(c.Sources, "unknown: compare the sections listed with a disassembler or diffoscope")
+	}
+	return c, nil
+}
+
+// sectionRange is where a section of an executable is in its file.
+type sectionRange struct {
+	name         string
+	offset, size int64
+}
+
+// sectionRanges returns the sections of the ELF, PE or Mach-O executable
+// exe, or none if it is in neither format.
+func sectionRanges(exe string) []sectionRange {
+	var ranges []sectionRange
+	if f, err := elf.Open(exe); err == nil {
+		defer f.Close()
+		for _, s := range f.Sections {
+			if s.Type != elf.SHT_NOBITS {
+				ranges = append(ranges, sectionRange{s.Name, int64(s.Offset), int64(s.FileSize)})
+			}
+		}
+		ranges = append(ranges, sectionRange{"ELF header", 0, 64})
+	} else if f, err := pe.Open(exe); err == nil {
+		defer f.Close()
+		for _, s := range f.Sections {
+			ranges = append(ranges, sectionRange{s.Name, int64(s.Offset), int64(s.Size)})
+		}
+		ranges = append(ranges, sectionRange{"PE headers", 0, 1024})
+	} else if f, err := macho.Open(exe); err == nil {
+		defer f.Close()
+		for _, s := range f.Sections {
+			ranges = append(ranges, sectionRange{s.Seg + "," + s.Name, int64(s.Offset), int64(s.Size)})
+		}
+		ranges = append(ranges, sectionRange{"Mach-O load commands", 0, int64(f.Cmdsz) + 32})
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].size < ranges[j].size })
+	return ranges
+}
+
+// nearbyTimes reports whether the differing byte at off is part of 32-bit
+// Unix times in a and b that are an hour apart at most, as timestamps of
+// two builds are.
+func nearbyTimes(a, b []byte, off int64) bool {
+	now := time.Now().Add(24 * time.Hour).Unix()
+	past := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+	for start := off - 3; start <= off; start++ {
+		if start < 0 || start+4 > int64(len(a)) || start+4 > int64(len(b)) {
+			continue
+		}
+		ta := int64(binary.LittleEndian.Uint32(a[start:]))
+		tb := int64(binary.LittleEndian.Uint32(b[start:]))
+		if ta != tb && ta > past && tb > past && ta < now && tb < now && max(ta, tb)-min(ta, tb) <= 3600 {
+			return true
+		}
+	}
+	return false
+}
+
+func printComparison(c *buildComparison) {
+	if c.Identical {
+		pterm.Success.Printfln("The builds are identical: sha256 %s", c.FirstSHA256)
+		return
+	}
+	pterm.Error.Printfln("The builds differ in %s", i18n.Plural(c.DifferingBytes, "%d byte", "%d bytes"))
+	pterm.Println("  " + c.First + "  sha256 " + c.FirstSHA256)
+	pterm.Println("  " + c.Second + "  sha256 " + c.SecondSHA256)
+	pterm.Println("Sections with differences:")
+	for _, s := range c.Sections {
+		pterm.Println("  " + s)
+	}
+	pterm.Println("Likely sources:")
+	for _, s := range c.Sources {
+		pterm.Println("  " + s)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+func newYankCmd() *cobra.Command {
+	var undo bool
+	var registry, token string
+
+	cmd := &cobra.Command{
+		Use:   "yank <package@version>",
+		Short: "Mark a published version as yanked in a registry",
+		Long: `Mark a published version as yanked in a registry.
+
+A yanked version stays downloadable, so projects whose vira.lock pins it keep
+building, but it is no longer picked when dependencies are resolved anew.
+With --undo, the version is made available again.
+
+The registry API and token are found as for vira publish.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			name, version, _ := strings.Cut(args[0], "@")
+			if _, err := parseVersion(version); err != nil || name == "" {
+				pterm.Error.Printfln("%s is not a package version; use <package>@<version>, as in math@0.2.1", args[0])
+				exit(1)
+			}
+			registry, token = publishCredentials(registry, token)
+			if err := yankPackage(registry, token, name, version, !undo); err != nil {
+				pterm.Error.Println(err)
+				exit(1)
+			}
+			if undo {
+				pterm.Success.Printfln("Unyanked %s v%s", name, version)
+			} else {
+				pterm.Success.Printfln("Yanked %s v%s", name, version)
+			}
+		},
+	}
+	cmd.Flags().BoolVar(&undo, "undo", false, "make a yanked version available again")
+	cmd.Flags().StringVar(&registry, "registry", "", "registry API, or configured registry name")
+	cmd.Flags().StringVar(&token, "token", "", "API token for the registry")
+	return cmd
+}
+
+// yankPackage sends PUT <registry>/packages/<name>/<version>/yank to yank a
+// version, or DELETE to the same URL to unyank it.
+func yankPackage(registry, token, name, version string, yank bool) error {
+	if registry == "" {
+		return errors.New("no registry (use --registry or VIRA_PUBLISH_REGISTRY)")
+	}
+	if token == "" {
+		return errors.New("no registry token (run vira login or use --token)")
+	}
+	if offlineMode() {
+		return offlineError("changing " + registry)
+	}
+	method := http.MethodPut
+	if !yank {
+		method = http.MethodDelete
+	}
+	url := strings.TrimSuffix(registry, "/") + "/packages/" + name + "/" + version + "/yank"
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach %s: %v", registry, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("registry rejected the request for %s v%s: %s\n%s", name, version, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
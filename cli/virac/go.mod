@@ -6,9 +6,11 @@ require (
 	github.com/pterm/pterm v0.12.31
 	github.com/spf13/cobra v1.8.0
 	github.com/spf13/pflag v1.0.5
+	vira v0.0.0
 )
 
 require (
+	github.com/BurntSushi/toml v1.4.0 // indirect
 	github.com/atomicgo/cursor v0.0.1 // indirect
 	github.com/gookit/color v1.4.2 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
@@ -18,3 +20,5 @@ require (
 	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
 	golang.org/x/term v0.0.0-20210615171337-6886f2dfbf5b // indirect
 )
+
+replace vira => ../vira
@@ -1,134 +1,251 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strings"
 
 	"github.com/pterm/pterm"
 	"github.com/spf13/cobra"
+	"vira/pkg/diagnostics"
+	"vira/pkg/i18n"
+	"vira/pkg/interrupt"
+	"vira/pkg/logging"
+	"vira/pkg/terminal"
+	"vira/pkg/toolchain"
 )
 
+// binPath is the directory of the toolchain that compiles, set by
+// selectToolchain or to the system toolchain.
 var binPath string
 
-func init() {
-	osName := runtime.GOOS
-	if osName == "linux" {
-		binPath = "/usr/lib/vira-lang/bin"
-	} else if osName == "windows" {
-		programFiles := os.Getenv("ProgramFiles")
-		if programFiles == "" {
-			programFiles = "C:\\Program Files"
-		}
-		binPath = filepath.Join(programFiles, "ViraLang", "bin")
-	} else {
-		pterm.Fatal.Println("Unsupported OS")
-		os.Exit(1)
-	}
-}
+// errorFormat is set by --error-format: human shows each diagnostic with the
+// source it points at, short on a single line as
+// file:line:column: severity[code]: message, in the format diagnostics.Short
+// keeps stable for editors.
+var errorFormat = "human"
+
+// maxErrors is set by --max-errors: how many errors are shown before the
+// rest are suppressed, or zero for all of them.
+var maxErrors = 20
+
+// assumeYes is set by --yes: questions are answered with yes without being
+// asked.
+var assumeYes bool
+
+// logLevel and logFormat are set by --log-level and --log-format.
+var logLevel, logFormat string
 
 func main() {
+	interrupt.Handle(func(code int) {
+		pterm.Warning.Println(i18n.T("Interrupted"))
+		os.Exit(code)
+	})
+
 	var rootCmd = &cobra.Command{
 		Use:   "virac [input.vira]",
 		Short: "Vira compilation tool",
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
+			terminal.Setup(os.Stdout)
+			if err := logging.Setup("virac", logLevel, logFormat, slog.LevelWarn); err != nil {
+				pterm.Error.Println(err)
+				os.Exit(1)
+			}
+			if errorFormat != "human" && errorFormat != "short" {
+				pterm.Error.Printfln("unknown error format %q (use human or short)", errorFormat)
+				os.Exit(1)
+			}
+			if err := selectToolchain(args[0]); err != nil {
+				pterm.Error.Println(err)
+				os.Exit(1)
+			}
+			if binPath == "" {
+				dir, err := toolchain.SystemBinDir()
+				if err != nil {
+					pterm.Error.Println(err)
+					os.Exit(1)
+				}
+				binPath = dir
+			}
+			if err := checkTools(); err != nil {
+				pterm.Error.Println(err)
+				os.Exit(1)
+			}
 			compile(args[0])
 		},
 	}
 
+	rootCmd.Flags().IntVar(&maxErrors, "max-errors", maxErrors, "stop showing diagnostics after this many errors, or 0 for no limit")
+	rootCmd.Flags().StringVar(&errorFormat, "error-format", "human", "how to show diagnostics: human, or short for one line each")
+	rootCmd.Flags().BoolVarP(&assumeYes, "yes", "y", false, "answer yes to questions, such as whether to repair the toolchain")
+	rootCmd.Flags().StringVar(&logLevel, "log-level", "", "log what virac does behind its output from this level on: "+strings.Join(logging.Levels(), ", ")+" (VIRA_LOG; warn by default)")
+	rootCmd.Flags().StringVar(&logFormat, "log-format", "", "write the log as text or json (VIRA_LOG_FORMAT; text by default)")
+
 	if err := rootCmd.Execute(); err != nil {
 		pterm.Error.Println(err)
 		os.Exit(1)
 	}
 }
 
+// brokenTools describes the tools in binPath that are missing or cannot be
+// run.
+func brokenTools() []string {
+	var broken []string
+	for _, name := range []string{"preprocessor", "plsa", "compiler"} {
+		path := filepath.Join(binPath, name)
+		if runtime.GOOS == "windows" {
+			path += ".exe"
+		}
+		info, err := os.Stat(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			broken = append(broken, name+": "+path+" does not exist")
+		case err != nil:
+			broken = append(broken, name+": "+err.Error())
+		case runtime.GOOS != "windows" && info.Mode()&0111 == 0:
+			broken = append(broken, name+": "+path+" is not executable")
+		}
+	}
+	return broken
+}
+
+// checkTools makes sure the toolchain can run before compiling. A damaged
+// toolchain is offered to be repaired with vira update --repair.
+func checkTools() error {
+	broken := brokenTools()
+	if len(broken) == 0 {
+		return nil
+	}
+	msg := "tools of the toolchain in " + binPath + " cannot be run:\n  " + strings.Join(broken, "\n  ")
+	if confirm(msg+"\nRepair the toolchain now?", true) {
+		cmd := exec.Command("vira", "update", "--repair")
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("repairing the toolchain: %v", err)
+		}
+		if broken = brokenTools(); len(broken) == 0 {
+			return nil
+		}
+		msg = "tools of the toolchain in " + binPath + " cannot be run:\n  " + strings.Join(broken, "\n  ")
+	}
+	return errors.New(msg + "\nrun vira update --repair to download the toolchain again, or vira setup to install one")
+}
+
 func compile(inputFile string) {
 	outputPre := inputFile + ".pre"
 	outputObj := inputFile + ".o"
 
-	pterm.DefaultSection.Println("Preprocessing")
+	pterm.DefaultSection.Println(i18n.T("Preprocessing"))
 	preprocessor := filepath.Join(binPath, "preprocessor")
 	if runtime.GOOS == "windows" {
 		preprocessor += ".exe"
 	}
-	cmdPre := exec.Command(preprocessor, inputFile, outputPre)
-	if out, err := cmdPre.CombinedOutput(); err != nil {
-		handleError(outputPre, string(out))
+	// The line map traces the preprocessed lines back to the sources, which
+	// is where the diagnostics of the later stages should point.
+	mapFile := outputPre + ".map"
+	cmdPre := exec.Command(preprocessor, inputFile, outputPre, "--map", mapFile)
+	logging.Debug("running", "command", strings.Join(cmdPre.Args, " "))
+	if out, err := runTool(cmdPre, outputPre, mapFile); err != nil {
+		handleError(inputFile, string(out), nil, "")
 		os.Exit(1)
 	}
-	pterm.Success.Println("Preprocessing done")
+	origins, _ := diagnostics.ReadLineMap(mapFile, ".")
+	pterm.Success.Println(i18n.T("Preprocessing done"))
 
-	pterm.DefaultSection.Println("Parsing and Checking")
+	pterm.DefaultSection.Println(i18n.T("Parsing and Checking"))
 	plsa := filepath.Join(binPath, "plsa")
 	if runtime.GOOS == "windows" {
 		plsa += ".exe"
 	}
 	cmdPlsa := exec.Command(plsa, outputPre)
-	if out, err := cmdPlsa.CombinedOutput(); err != nil {
-		handleError(outputPre, string(out))
+	logging.Debug("running", "command", strings.Join(cmdPlsa.Args, " "))
+	if out, err := runTool(cmdPlsa); err != nil {
+		handleError(inputFile, string(out), origins, outputPre)
 		os.Exit(1)
 	}
-	pterm.Success.Println("PLSA done")
+	pterm.Success.Println(i18n.T("PLSA done"))
 
-	pterm.DefaultSection.Println("Compiling")
+	pterm.DefaultSection.Println(i18n.T("Compiling"))
 	compiler := filepath.Join(binPath, "compiler")
 	if runtime.GOOS == "windows" {
 		compiler += ".exe"
 	}
 	cmdComp := exec.Command(compiler, outputPre, outputObj)
-	if out, err := cmdComp.CombinedOutput(); err != nil {
-		handleError(outputPre, string(out))
+	logging.Debug("running", "command", strings.Join(cmdComp.Args, " "))
+	if out, err := runTool(cmdComp, outputObj); err != nil {
+		handleError(inputFile, string(out), origins, outputPre)
 		os.Exit(1)
 	}
-	pterm.Success.Println("Compilation done")
+	pterm.Success.Println(i18n.T("Compilation done"))
 
 	// Optional: Link to executable
-	pterm.DefaultSection.Println("Linking")
+	pterm.DefaultSection.Println(i18n.T("Linking"))
 	linker := "gcc"
 	if runtime.GOOS == "windows" {
 		linker = "link.exe" // Adjust as needed
 		outputExe := inputFile + ".exe"
 		cmdLink := exec.Command(linker, "/OUT:"+outputExe, outputObj) // Simplified
-		if out, err := cmdLink.CombinedOutput(); err != nil {
+		logging.Debug("running", "command", strings.Join(cmdLink.Args, " "))
+		if out, err := runTool(cmdLink, outputExe); err != nil {
 			pterm.Error.Println(string(out))
 			os.Exit(1)
 		}
 	} else {
 		outputExe := "a.out" // Or input without ext
 		cmdLink := exec.Command(linker, outputObj, "-o", outputExe)
-		if out, err := cmdLink.CombinedOutput(); err != nil {
+		logging.Debug("running", "command", strings.Join(cmdLink.Args, " "))
+		if out, err := runTool(cmdLink, outputExe); err != nil {
 			pterm.Error.Println(string(out))
 			os.Exit(1)
 		}
 	}
-	pterm.Success.Println("Linking done")
+	pterm.Success.Println(i18n.T("Linking done"))
 }
 
-func handleError(sourceFile, errorMsg string) {
-	pterm.Error.Println("Error occurred. Running diagnostic...")
-
-	// Parse errorMsg for line, column, message
-	// For simplicity, assume errorMsg has "line X, column Y: message"
-	// Mock parsing
-	line := 1
-	column := 1
-	message := errorMsg // Full message
+// runTool runs a tool of the toolchain and returns its output. The outputs
+// it writes are removed if virac is interrupted before the tool finishes.
+func runTool(cmd *exec.Cmd, outputs ...string) ([]byte, error) {
+	defer interrupt.Cleanup(func() {
+		for _, file := range outputs {
+			os.Remove(file)
+		}
+	})()
+	return interrupt.CombinedOutput(cmd)
+}
 
-	diagnostic := filepath.Join(binPath, "diagnostic")
-	if runtime.GOOS == "windows" {
-		diagnostic += ".exe"
-	}
-	cmdDiag := exec.Command(diagnostic,
-		"--source", sourceFile,
-		"--message", message,
-		"--line", string(line + '0'), // Convert to string
-		"--column", string(column + '0'),
-	)
-	if out, err := cmdDiag.CombinedOutput(); err != nil {
-		pterm.Error.Println(string(out))
-	} else {
-		pterm.Info.Println(string(out))
+// handleError shows each distinct diagnostic in a failed stage's output with
+// the lines of sourceFile it points at, followed by how many errors and
+// warnings there were, or the output itself if it has none. A stage run on
+// the preprocessed file pre reports lines of it, which origins maps back to
+// the sources.
+func handleError(sourceFile, errorMsg string, origins []diagnostics.Origin, pre string) {
+	diags := diagnostics.Parse(sourceFile, errorMsg)
+	diagnostics.Remap(diags, origins, pre, sourceFile)
+	diags = diagnostics.Dedup(diags)
+	if len(diags) == 0 {
+		pterm.Error.Println(strings.TrimSpace(errorMsg))
+		return
+	}
+	shown, suppressed := diagnostics.Limit(diags, maxErrors)
+	if errorFormat == "short" {
+		for _, d := range shown {
+			fmt.Fprintln(os.Stderr, d)
+		}
+		return
+	}
+	r := &diagnostics.Renderer{Color: pterm.PrintColor, Width: terminal.Width(os.Stderr)}
+	r.RenderAll(os.Stderr, shown)
+	if len(suppressed) > 0 {
+		pterm.Info.Println(i18n.T("%d more not shown (%s); use --max-errors=0 to see all", len(suppressed), diagnostics.Summary(suppressed)))
+	}
+	if summary := diagnostics.Summary(diags); summary != "" {
+		fmt.Fprintln(os.Stderr)
+		pterm.Error.Println(i18n.T("could not compile %s (%s)", sourceFile, summary))
 	}
 }
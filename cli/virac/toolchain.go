@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pterm/pterm"
+
+	"vira/pkg/terminal"
+	"vira/pkg/toolchain"
+)
+
+// Toolchains are installed by vira toolchain into toolchain.Dir, and pinned
+// by projects with vira-toolchain.toml or the toolchain key of vira.toml.
+// virac follows the same rules as vira to pick one, from package toolchain.
+
+// selectToolchain points binPath at the toolchain for source: the one in
+// VIRA_TOOLCHAIN, pinned by its project or made the default with vira
+// toolchain use. Missing pinned toolchains are installed with vira if the
+// user agrees.
+func selectToolchain(source string) error {
+	dir, err := toolchain.Dir()
+	if err != nil {
+		return err
+	}
+	version, file := os.Getenv("VIRA_TOOLCHAIN"), ""
+	if version == "" {
+		if version, file, err = toolchain.Pinned(filepath.Dir(source)); err != nil {
+			return err
+		}
+	}
+	if version == "" {
+		version = toolchain.Default()
+	}
+	if version == "" || version == "system" {
+		return nil
+	}
+	if toolchain.IsChannel(version) {
+		if version, err = latestToolchain(version); err != nil {
+			return err
+		}
+	}
+	if !toolchain.VersionPattern.MatchString(version) {
+		return fmt.Errorf("invalid toolchain version %q", version)
+	}
+	bin := filepath.Join(dir, version, "bin")
+	if _, err := os.Stat(filepath.Join(dir, version, "version.json")); err != nil {
+		if file == "" || !confirm(fmt.Sprintf("Toolchain %s, required by %s, is not installed. Install it now?", version, file), false) {
+			return fmt.Errorf("toolchain %s is not installed (run vira toolchain install %s, or virac --yes to install it)", version, version)
+		}
+		cmd := exec.Command("vira", "toolchain", "install", version)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("installing toolchain %s: %v", version, err)
+		}
+	}
+	binPath = bin
+	return os.Setenv("VIRA_TOOLCHAIN", version)
+}
+
+// latestToolchain returns the newest toolchain version on channel, stable
+// or nightly, as vira resolves it: from the mirror in
+// VIRA_TOOLCHAIN_MIRROR, and from its cache in offline mode.
+func latestToolchain(channel string) (string, error) {
+	cmd := exec.Command("vira", "toolchain", "resolve", channel)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("resolving the %s toolchain with vira: %v", channel, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// confirm asks a yes/no question on the terminal. With --yes, the answer is
+// yes. When nobody can answer, without a terminal or in CI, the answer is
+// unattended, which callers set only for steps that are safe to take
+// unasked.
+func confirm(question string, unattended bool) bool {
+	if assumeYes {
+		return true
+	}
+	if !terminal.Interactive() {
+		return unattended
+	}
+	pterm.Print(question + " [Y/n] ")
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "" || answer == "y" || answer == "yes"
+}
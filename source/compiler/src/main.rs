@@ -3,6 +3,7 @@ use std::env;
 use std::fs::{self, File};
 use std::io::{self, Write};
 use std::process::Command;
+use std::str::FromStr;
 use cranelift::prelude::*;
 use cranelift_codegen::ir::{AbiParam, InstBuilder, UserFuncName};
 use cranelift_codegen::isa::{self};
@@ -11,7 +12,7 @@ use cranelift_codegen::Context;
 use cranelift_frontend::{FunctionBuilder, FunctionBuilderContext};
 use cranelift_module::{Linkage, Module};
 use cranelift_object::{ObjectBuilder, ObjectModule};
-use target_lexicon::Triple;
+use target_lexicon::{OperatingSystem, Triple};
 
 #[derive(Debug, PartialEq, Clone)]
 enum Token {
@@ -205,11 +206,11 @@ struct CodeGenerator {
 }
 
 impl CodeGenerator {
-    fn new() -> Self {
+    fn new(triple: Triple) -> Self {
         let mut flag_builder = settings::builder();
         flag_builder.set("use_colocated_libcalls", "false").unwrap();
         flag_builder.set("is_pic", "false").unwrap();
-        let isa_builder = isa::lookup(Triple::host()).unwrap();
+        let isa_builder = isa::lookup(triple).unwrap();
         let isa = isa_builder.finish(settings::Flags::new(flag_builder)).unwrap();
         let builder = ObjectBuilder::new(isa, "vira_module".to_owned(), cranelift_module::default_libcall_names()).unwrap();
         let module = ObjectModule::new(builder);
@@ -299,24 +300,53 @@ impl CodeGenerator {
 }
 
 fn main() -> io::Result<()> {
-    let args: Vec<String> = env::args().collect();
-    if args.len() != 3 {
-        println!("Usage: compiler <input.vira> <output.o>");
+    let mut no_link = false;
+    let mut target = None;
+    let mut paths = Vec::new();
+    let mut args = env::args().skip(1);
+    while let Some(arg) = args.next() {
+        match arg.as_str() {
+            "--no-link" => no_link = true,
+            "--target" => target = args.next(),
+            _ => paths.push(arg),
+        }
+    }
+    if paths.len() != 2 {
+        println!("Usage: compiler <input.vira> <output.o> [--no-link] [--target <triple>]");
         return Ok(());
     }
-    let input_path = &args[1];
-    let mut output_path = args[2].clone();
+    let input_path = &paths[0];
+    let mut output_path = paths[1].clone();
+    let triple = match &target {
+        Some(name) => match Triple::from_str(name) {
+            Ok(triple) => triple,
+            Err(err) => {
+                eprintln!("error: unknown target {}: {}", name, err);
+                std::process::exit(1);
+            }
+        },
+        None => Triple::host(),
+    };
+    if let Err(err) = isa::lookup(triple.clone()) {
+        eprintln!("error: cannot generate code for {}: {}", triple, err);
+        std::process::exit(1);
+    }
     let input = fs::read_to_string(input_path)?;
     let mut parser = Parser::new(input);
     let ast = parser.parse();
-    let generator = CodeGenerator::new();
+    let generator = CodeGenerator::new(triple.clone());
     let obj_bytes = generator.generate(&ast);
     let os = env::consts::OS;
-    if os == "windows" {
+    if triple.operating_system == OperatingSystem::Windows {
         output_path = output_path.replace(".o", ".obj");
     }
     let mut file = File::create(&output_path)?;
     file.write_all(&obj_bytes)?;
+    // Drivers that link several objects themselves skip the a.out step, and
+    // objects for another target are linked by the driver too.
+    if no_link || target.is_some() {
+        return Ok(());
+    }
     let output_exe = if os == "windows" { "a.exe" } else { "a.out" };
     let mut cmd = if os == "linux" {
         Command::new("gcc")
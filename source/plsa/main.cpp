@@ -5,6 +5,9 @@
 #include <map>
 #include <cctype>
 #include <stdexcept>
+#include <cstdio>
+#include <sstream>
+#include <filesystem>
 
 enum class TokenType {
     Identifier,
@@ -122,6 +125,8 @@ struct ASTNode {
     ASTType type;
     std::string value; // for identifiers, operators, etc.
     std::vector<ASTNode*> children;
+    size_t line = 0;
+    size_t column = 0;
     ~ASTNode() {
         for (auto child : children) {
             delete child;
@@ -144,13 +149,21 @@ private:
         }
     }
 
+    // at creates a node at the position of the current token.
+    ASTNode* at(ASTType type, const std::string& value) {
+        ASTNode* node = new ASTNode{type, value};
+        node->line = currentToken.line;
+        node->column = currentToken.column;
+        return node;
+    }
+
     ASTNode* parsePrimary() {
         if (currentToken.type == TokenType::Number) {
-            ASTNode* node = new ASTNode{ASTType::NumberLiteral, currentToken.value};
+            ASTNode* node = at(ASTType::NumberLiteral, currentToken.value);
             eat(TokenType::Number);
             return node;
         } else if (currentToken.type == TokenType::Identifier) {
-            ASTNode* node = new ASTNode{ASTType::Identifier, currentToken.value};
+            ASTNode* node = at(ASTType::Identifier, currentToken.value);
             eat(TokenType::Identifier);
             return node;
         } else {
@@ -164,9 +177,9 @@ private:
                (currentToken.value == "+" || currentToken.value == "-" ||
                 currentToken.value == "*" || currentToken.value == "/")) {
             std::string op = currentToken.value;
+            ASTNode* newNode = at(ASTType::BinaryOp, op);
             eat(TokenType::Punctuator, op);
             ASTNode* right = parsePrimary();
-            ASTNode* newNode = new ASTNode{ASTType::BinaryOp, op};
             newNode->children.push_back(node);
             newNode->children.push_back(right);
             node = newNode;
@@ -176,10 +189,10 @@ private:
 
     ASTNode* parseStatement() {
         if (currentToken.type == TokenType::Keyword && currentToken.value == "return") {
+            ASTNode* node = at(ASTType::ReturnStmt, "");
             eat(TokenType::Keyword, "return");
             ASTNode* expr = parseExpr();
             eat(TokenType::Punctuator, ";");
-            ASTNode* node = new ASTNode{ASTType::ReturnStmt, ""};
             node->children.push_back(expr);
             return node;
         } else {
@@ -190,11 +203,11 @@ private:
     ASTNode* parseFunction() {
         eat(TokenType::Keyword, "int");
         std::string name = currentToken.value;
+        ASTNode* node = at(ASTType::Function, name);
         eat(TokenType::Identifier);
         eat(TokenType::Punctuator, "(");
         eat(TokenType::Punctuator, ")");
         eat(TokenType::Punctuator, "{");
-        ASTNode* node = new ASTNode{ASTType::Function, name};
         while (currentToken.type != TokenType::Punctuator || currentToken.value != "}") {
             node->children.push_back(parseStatement());
         }
@@ -207,6 +220,8 @@ public:
 
     ASTNode* parse() {
         ASTNode* program = new ASTNode{ASTType::Program, ""};
+        program->line = 1;
+        program->column = 1;
         while (currentToken.type != TokenType::EOFToken) {
             program->children.push_back(parseFunction());
         }
@@ -269,15 +284,71 @@ public:
     }
 };
 
-int main(int argc, char* argv[]) {
-    if (argc != 2) {
-        std::cerr << "Usage: plsa <input.vira>" << std::endl;
+const char* astTypeName(ASTType type) {
+    switch (type) {
+        case ASTType::Program: return "Program";
+        case ASTType::Function: return "Function";
+        case ASTType::ReturnStmt: return "ReturnStmt";
+        case ASTType::BinaryOp: return "BinaryOp";
+        case ASTType::NumberLiteral: return "NumberLiteral";
+        case ASTType::Identifier: return "Identifier";
+    }
+    return "Unknown";
+}
+
+std::string jsonString(const std::string& s) {
+    std::string out = "\"";
+    for (unsigned char c : s) {
+        switch (c) {
+            case '"': out += "\\\""; break;
+            case '\\': out += "\\\\"; break;
+            case '\n': out += "\\n"; break;
+            case '\t': out += "\\t"; break;
+            default:
+                if (c < 0x20) {
+                    char buf[8];
+                    snprintf(buf, sizeof buf, "\\u%04x", c);
+                    out += buf;
+                } else {
+                    out += c;
+                }
+        }
+    }
+    return out + "\"";
+}
+
+// writeAST prints node as JSON: its kind, value, position and children.
+void writeAST(std::ostream& out, const ASTNode* node) {
+    out << "{\"kind\":" << jsonString(astTypeName(node->type));
+    if (!node->value.empty()) {
+        out << ",\"value\":" << jsonString(node->value);
+    }
+    out << ",\"line\":" << node->line << ",\"column\":" << node->column;
+    if (!node->children.empty()) {
+        out << ",\"children\":[";
+        for (size_t i = 0; i < node->children.size(); i++) {
+            if (i > 0) out << ",";
+            writeAST(out, node->children[i]);
+        }
+        out << "]";
+    }
+    out << "}";
+}
+
+// run checks the file named in args, or prints its parse tree with
+// --ast-json, and returns the exit status.
+int run(const std::vector<std::string>& args) {
+    // With --ast-json, the parse tree is printed as JSON instead of being
+    // checked.
+    bool astJSON = args.size() == 2 && args[1] == "--ast-json";
+    if (args.size() != 1 && !astJSON) {
+        std::cerr << "Usage: plsa <input.vira> [--ast-json]" << std::endl;
         return 1;
     }
 
-    std::ifstream file(argv[1]);
+    std::ifstream file(args[0]);
     if (!file) {
-        std::cerr << "Could not open file: " << argv[1] << std::endl;
+        std::cerr << "Could not open file: " << args[0] << std::endl;
         return 1;
     }
 
@@ -287,6 +358,13 @@ int main(int argc, char* argv[]) {
         Parser parser(input);
         ASTNode* ast = parser.parse();
 
+        if (astJSON) {
+            writeAST(std::cout, ast);
+            std::cout << std::endl;
+            delete ast;
+            return 0;
+        }
+
         // Syntax check is implicit in parsing
 
         SemanticChecker checker;
@@ -302,3 +380,45 @@ int main(int argc, char* argv[]) {
 
     return 0;
 }
+
+// serve runs requests from stdin until it ends, for vira to keep plsa
+// running between files: each line holds the working directory and the
+// arguments of a run, separated by tabs, and is answered with the output
+// of the run, a NUL byte, the exit status and a newline.
+int serve() {
+    std::cout << "vira-serve 1" << std::endl;
+    std::string line;
+    while (std::getline(std::cin, line)) {
+        std::vector<std::string> fields;
+        size_t start = 0;
+        for (size_t tab; (tab = line.find('\t', start)) != std::string::npos; start = tab + 1) {
+            fields.push_back(line.substr(start, tab - start));
+        }
+        fields.push_back(line.substr(start));
+
+        std::ostringstream output;
+        std::streambuf* out = std::cout.rdbuf(output.rdbuf());
+        std::streambuf* err = std::cerr.rdbuf(output.rdbuf());
+        int status;
+        std::error_code ec;
+        std::filesystem::current_path(fields[0], ec);
+        if (ec) {
+            std::cerr << "Cannot change to " << fields[0] << ": " << ec.message() << std::endl;
+            status = 1;
+        } else {
+            status = run(std::vector<std::string>(fields.begin() + 1, fields.end()));
+        }
+        std::cout.rdbuf(out);
+        std::cerr.rdbuf(err);
+
+        std::cout << output.str() << '\0' << status << '\n' << std::flush;
+    }
+    return 0;
+}
+
+int main(int argc, char* argv[]) {
+    if (argc == 2 && std::string(argv[1]) == "--serve") {
+        return serve();
+    }
+    return run(std::vector<std::string>(argv + 1, argv + argc));
+}
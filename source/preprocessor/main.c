@@ -6,6 +6,7 @@
 #define MAX_DEFINES 1024
 #define MAX_INCLUDE_DEPTH 16
 #define BUFFER_SIZE 4096
+#define MAX_INCLUDE_PATHS 64
 
 typedef struct {
     char *name;
@@ -17,9 +18,28 @@ int num_defines = 0;
 
 FILE *include_stack[MAX_INCLUDE_DEPTH];
 char *include_filenames[MAX_INCLUDE_DEPTH];
+int include_lines[MAX_INCLUDE_DEPTH];
 int include_depth = 0;
 
-char *include_paths[] = {"/usr/include", ".", NULL}; // Example paths
+// Optional line map: one "file<TAB>line" entry per output line, naming the
+// source line that produced it.
+FILE *map_file = NULL;
+
+// Directories searched for <system> includes: those given with -I, in
+// order, followed by the defaults.
+char *include_paths[MAX_INCLUDE_PATHS + 3] = {"/usr/include", ".", NULL};
+int num_include_paths = 2;
+
+int add_include_path(char *path) {
+    if (num_include_paths >= MAX_INCLUDE_PATHS + 2) {
+        return 0;
+    }
+    int user = num_include_paths - 2;
+    memmove(&include_paths[user + 1], &include_paths[user], 3 * sizeof(char *));
+    include_paths[user] = path;
+    num_include_paths++;
+    return 1;
+}
 
 int is_whitespace(char c) {
     return c == ' ' || c == '\t' || c == '\n' || c == '\r';
@@ -64,6 +84,15 @@ void remove_define(const char *name) {
     }
 }
 
+void emit_line(const char *text, FILE *output) {
+    size_t len = strlen(text);
+    while (len > 0 && (text[len - 1] == '\n' || text[len - 1] == '\r')) len--;
+    fprintf(output, "%.*s\n", (int)len, text);
+    if (map_file) {
+        fprintf(map_file, "%s\t%d\n", include_filenames[include_depth - 1], include_lines[include_depth - 1]);
+    }
+}
+
 FILE *open_include(const char *filename, int system) {
     FILE *fp = NULL;
     if (system) {
@@ -105,6 +134,7 @@ void process_directive(char *line, FILE *output) {
         }
         include_stack[include_depth] = fp;
         include_filenames[include_depth] = strdup(filename);
+        include_lines[include_depth] = 0;
         include_depth++;
     } else if (strncmp(directive, "define", 6) == 0) {
         directive += 6;
@@ -124,10 +154,10 @@ void process_directive(char *line, FILE *output) {
         remove_define(name);
     } else if (strncmp(directive, "ifdef", 5) == 0 || strncmp(directive, "ifndef", 6) == 0) {
         // Simplified: skip for now
-        fprintf(output, "%s\n", line);
+        emit_line(line, output);
     } else {
         // Other directives: pass through or error
-        fprintf(output, "%s\n", line);
+        emit_line(line, output);
     }
 }
 
@@ -147,29 +177,30 @@ void expand_macros(char *line, FILE *output) {
                 strcpy(out, value);
                 out += strlen(value);
             } else {
-                strcpy(out, start);
-                out += strlen(start);
+                memcpy(out, start, in - start);
+                out += in - start;
             }
         } else {
             *out++ = *in++;
         }
     }
     *out = '\0';
-    fprintf(output, "%s\n", buffer);
+    emit_line(buffer, output);
 }
 
-void preprocess(FILE *input, FILE *output, const char *filename) {
+void preprocess(FILE *output) {
     char line[BUFFER_SIZE];
-    while (1) {
+    // Always read from the innermost open file, so an #include is expanded
+    // in place and reading resumes after it once the included file ends.
+    while (include_depth > 0) {
+        FILE *input = include_stack[include_depth - 1];
         if (fgets(line, sizeof(line), input) == NULL) {
-            if (include_depth > 0) {
-                fclose(include_stack[--include_depth]);
-                free(include_filenames[include_depth]);
-                input = include_depth > 0 ? include_stack[include_depth - 1] : stdin; // Assuming main input is stdin for simplicity
-                continue;
-            }
-            break;
+            fclose(input);
+            include_depth--;
+            free(include_filenames[include_depth]);
+            continue;
         }
+        include_lines[include_depth - 1]++;
         char *trimmed = line;
         while (is_whitespace(*trimmed)) trimmed++;
         if (*trimmed == '#') {
@@ -182,7 +213,7 @@ void preprocess(FILE *input, FILE *output, const char *filename) {
 
 int main(int argc, char *argv[]) {
     if (argc < 3) {
-        fprintf(stderr, "Usage: preprocessor input.vira output.c\n");
+        fprintf(stderr, "Usage: preprocessor input.vira output.c [--map output.map] [-I dir]...\n");
         return 1;
     }
 
@@ -199,13 +230,34 @@ int main(int argc, char *argv[]) {
         return 1;
     }
 
+    for (int i = 3; i + 1 < argc; i += 2) {
+        if (strcmp(argv[i], "-I") == 0) {
+            if (!add_include_path(argv[i + 1])) {
+                fprintf(stderr, "Too many include paths\n");
+                fclose(input);
+                fclose(output);
+                return 1;
+            }
+        } else if (strcmp(argv[i], "--map") == 0) {
+            map_file = fopen(argv[i + 1], "w");
+            if (!map_file) {
+                fprintf(stderr, "Cannot open map output: %s\n", argv[i + 1]);
+                fclose(input);
+                fclose(output);
+                return 1;
+            }
+        }
+    }
+
     include_stack[0] = input;
     include_filenames[0] = strdup(argv[1]);
+    include_lines[0] = 0;
     include_depth = 1;
 
-    preprocess(input, output, argv[1]);
+    preprocess(output);
 
     fclose(output);
+    if (map_file) fclose(map_file);
     // Note: input closed in preprocess
 
     for (int i = 0; i < num_defines; i++) {
@@ -1,3 +1,7 @@
 module updater
 
 go 1.22
+
+require vira v0.0.0
+
+replace vira => ../../cli/vira
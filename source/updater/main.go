@@ -2,24 +2,32 @@ package main
 
 import (
 	"archive/zip"
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
+
+	"vira/pkg/logging"
 )
 
 func main() {
-	if err := runUpdater(); err != nil {
+	// The updater has no flags; VIRA_LOG and VIRA_LOG_FORMAT choose what it
+	// logs, from info on by default.
+	if err := logging.Setup("updater", "", "", slog.LevelInfo); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
-	fmt.Println("Update check complete.")
+	if err := runUpdater(); err != nil {
+		logging.Error("update failed", "err", err)
+		os.Exit(1)
+	}
+	logging.Info("update check complete")
 }
 
 func runUpdater() error {
@@ -67,21 +75,23 @@ func runUpdater() error {
 
 	// Compare versions
 	if !isNewerVersion(remoteVersion, localVersion) {
-		fmt.Printf("Current version %s is up to date.\n", localVersion)
+		logging.Info("up to date", "version", localVersion)
 		return nil
 	}
 
-	fmt.Printf("New version %s available (current: %s). Updating...\n", remoteVersion, localVersion)
+	logging.Info("updating", "version", remoteVersion, "current", localVersion)
 
-	// Download zip
+	// Download zip to a temporary file rather than into memory
 	zipURL := fmt.Sprintf("https://github.com/vira-language/vira/releases/download/v%s/%s", remoteVersion, zipName)
-	zipData, err := downloadFileToBytes(zipURL)
+	logging.Debug("downloading", "url", zipURL)
+	zipPath, err := downloadFileToTemp(zipURL)
 	if err != nil {
 		return fmt.Errorf("failed to download zip: %v", err)
 	}
+	defer os.Remove(zipPath)
 
 	// Unzip
-	if err := unzipBytes(zipData, binDir, sysBinDir, osName); err != nil {
+	if err := unzipFile(zipPath, binDir, sysBinDir, osName); err != nil {
 		return fmt.Errorf("failed to unzip: %v", err)
 	}
 
@@ -90,7 +100,7 @@ func runUpdater() error {
 		return fmt.Errorf("failed to update local version: %v", err)
 	}
 
-	fmt.Println("Update successful.")
+	logging.Info("update successful", "version", remoteVersion)
 	return nil
 }
 
@@ -114,6 +124,13 @@ func writeVersion(filePath string, version string) error {
 	return os.WriteFile(filePath, data, 0644)
 }
 
+// maxVersionFileSize bounds the version file, which is read into memory.
+const maxVersionFileSize = 1 << 20
+
+// copyBufferSize is the size of the buffer archives are downloaded and
+// extracted through, so that memory use does not grow with their size.
+const copyBufferSize = 64 << 10
+
 func downloadFileToBytes(url string) ([]byte, error) {
 	resp, err := http.Get(url)
 	if err != nil {
@@ -123,14 +140,52 @@ func downloadFileToBytes(url string) ([]byte, error) {
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("bad status: %s", resp.Status)
 	}
-	return io.ReadAll(resp.Body)
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxVersionFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxVersionFileSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", url, maxVersionFileSize)
+	}
+	return data, nil
+}
+
+// downloadFileToTemp streams url into a temporary file and returns its
+// path. The caller removes the file.
+func downloadFileToTemp(url string) (string, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("bad status: %s", resp.Status)
+	}
+	f, err := os.CreateTemp("", "vira-update-*.zip")
+	if err != nil {
+		return "", err
+	}
+	n, err := io.CopyBuffer(f, resp.Body, make([]byte, copyBufferSize))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && resp.ContentLength >= 0 && n != resp.ContentLength {
+		err = fmt.Errorf("download truncated: got %d of %d bytes", n, resp.ContentLength)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
 }
 
-func unzipBytes(data []byte, binDir, sysBinDir, osName string) error {
-	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+// unzipFile extracts the archive at path from disk, one file at a time.
+func unzipFile(path, binDir, sysBinDir, osName string) error {
+	r, err := zip.OpenReader(path)
 	if err != nil {
 		return err
 	}
+	defer r.Close()
 
 	if err := os.MkdirAll(binDir, 0755); err != nil {
 		return err
@@ -139,45 +194,48 @@ func unzipBytes(data []byte, binDir, sysBinDir, osName string) error {
 		return err
 	}
 
+	exeSuffix := ""
+	if osName == "windows" {
+		exeSuffix = ".exe"
+	}
+	buf := make([]byte, copyBufferSize)
 	for _, f := range r.File {
 		if f.FileInfo().IsDir() {
 			continue
 		}
 
-		fileName := f.Name
-		baseName := filepath.Base(fileName)
+		baseName := filepath.Base(f.Name)
 		targetDir := binDir
-
-		exeSuffix := ""
-		if osName == "windows" {
-			exeSuffix = ".exe"
-		}
-
 		if strings.EqualFold(baseName, "vira"+exeSuffix) || strings.EqualFold(baseName, "virac"+exeSuffix) {
 			targetDir = sysBinDir
 		}
 
-		targetPath := filepath.Join(targetDir, baseName)
-
-		outFile, err := os.OpenFile(targetPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-		if err != nil {
+		logging.Debug("extracting", "file", f.Name, "to", targetDir)
+		if err := extractFile(f, filepath.Join(targetDir, baseName), buf); err != nil {
 			return err
 		}
-		defer outFile.Close()
+	}
 
-		rc, err := f.Open()
-		if err != nil {
-			return err
-		}
-		defer rc.Close()
+	return nil
+}
 
-		_, err = io.Copy(outFile, rc)
-		if err != nil {
-			return err
-		}
+// extractFile writes the archived file f to targetPath through buf.
+func extractFile(f *zip.File, targetPath string, buf []byte) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
 	}
+	defer rc.Close()
 
-	return nil
+	outFile, err := os.OpenFile(targetPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyBuffer(outFile, rc, buf); err != nil {
+		outFile.Close()
+		return err
+	}
+	return outFile.Close()
 }
 
 func isNewerVersion(remote, local string) bool {